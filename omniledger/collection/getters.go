@@ -21,6 +21,29 @@ func (c *Collection) Get(key []byte) Getter {
 	return Getter{c, key}
 }
 
+// ForEach calls f with the key and the values of every record of the
+// collection. The records of the subtrees that are not known are skipped.
+// f must not change the collection.
+func (c *Collection) ForEach(f func(key []byte, values [][]byte)) {
+	c.Lock()
+	defer c.Unlock()
+	var explore func(*node)
+	explore = func(cursor *node) {
+		if !cursor.known {
+			return
+		}
+		if cursor.leaf() {
+			if !cursor.placeholder() {
+				f(cursor.key, cursor.values)
+			}
+			return
+		}
+		explore(cursor.children.left)
+		explore(cursor.children.right)
+	}
+	explore(c.root)
+}
+
 // Methods
 
 // Record returns a Record object that correspond to the result of the key search.
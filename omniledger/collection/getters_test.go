@@ -19,6 +19,29 @@ func TestGettersConstructors(test *testing.T) {
 	}
 }
 
+func TestGettersForEach(test *testing.T) {
+	collection := New(Data{})
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, key)
+	}
+
+	seen := make(map[uint64]bool)
+	collection.ForEach(func(key []byte, values [][]byte) {
+		if !equal(key, values[0]) {
+			test.Error("[getters.go]", "[foreach]", "ForEach() yields wrong values.")
+		}
+		seen[binary.BigEndian.Uint64(key)] = true
+	})
+
+	if len(seen) != 64 {
+		test.Error("[getters.go]", "[foreach]", "ForEach() doesn't yield every record.")
+	}
+}
+
 func TestGettersRecord(test *testing.T) {
 	collection := New()
 
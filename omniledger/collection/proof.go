@@ -2,7 +2,9 @@ package collection
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"io"
 
 	"github.com/dedis/protobuf"
 )
@@ -155,11 +157,21 @@ func (p Proof) Values() ([]interface{}, error) {
 // Consistent returns true if the given proof is correct, that is, if it is
 // a valid representation and all steps are valid.
 func (p Proof) Consistent() bool {
+	return p.consistent(nil)
+}
+
+// consistent checks the proof like Consistent, but doesn't check the label
+// of the node trusted, if it is not nil.
+func (p Proof) consistent(trusted *dump) bool {
+	valid := func(d *dump) bool {
+		return d == trusted || d.consistent()
+	}
+
 	if len(p.Steps) == 0 {
 		return false
 	}
 
-	if !(p.Root.consistent()) {
+	if !valid(&p.Root) {
 		return false
 	}
 
@@ -171,7 +183,7 @@ func (p Proof) Consistent() bool {
 			return false
 		}
 
-		if !(p.Steps[depth].Left.consistent()) || !(p.Steps[depth].Right.consistent()) {
+		if !valid(&p.Steps[depth].Left) || !valid(&p.Steps[depth].Right) {
 			return false
 		}
 
@@ -185,6 +197,115 @@ func (p Proof) Consistent() bool {
 	return cursor.leaf()
 }
 
+// Detach returns a copy of the proof where the first value of the key is
+// removed. The removed value can then be sent separately and checked with
+// VerifyStream, without having to hold it in memory.
+func (p Proof) Detach() (Proof, error) {
+	if !p.Match() {
+		return Proof{}, errors.New("proof doesn't match the key")
+	}
+	leaf := p.leaf()
+	if len(leaf.Values) == 0 {
+		return Proof{}, errors.New("no value to detach")
+	}
+
+	detached := p
+	detached.Steps = append([]step{}, p.Steps...)
+	leaf = detached.leaf()
+	detached.DetachedLength = len(leaf.Values[0])
+	leaf.Values = append([][]byte{{}}, leaf.Values[1:]...)
+	return detached, nil
+}
+
+// VerifyStream checks that the proof is consistent and that value is the
+// first value of the key, reading value only once. The proof must have been
+// detached from its value using Detach.
+func (p Proof) VerifyStream(value io.Reader) error {
+	if !p.Match() {
+		return errors.New("proof doesn't match the key")
+	}
+	leaf := p.leaf()
+	if len(leaf.Values) == 0 || len(leaf.Values[0]) != 0 {
+		return errors.New("value is not detached from the proof")
+	}
+	if p.DetachedLength < 0 {
+		return errors.New("negative length of value")
+	}
+
+	label, err := leaf.streamLabel(p.DetachedLength, value)
+	if err != nil {
+		return err
+	}
+	if label != leaf.Label {
+		return errors.New("value doesn't match the proof")
+	}
+	if !p.consistent(leaf) {
+		return errors.New("proof is not consistent")
+	}
+	return nil
+}
+
+// leaf returns the last node of the path to the key, or nil if the proof
+// has no steps.
+func (p Proof) leaf() *dump {
+	if len(p.Steps) == 0 {
+		return nil
+	}
+
+	path := sha256.Sum256(p.Key)
+	depth := len(p.Steps) - 1
+
+	if bit(path[:], depth) {
+		return &p.Steps[depth].Right
+	}
+	return &p.Steps[depth].Left
+}
+
+// streamLabel computes the label of a leaf whose first value is read from
+// value and has the given length.
+func (d *dump) streamLabel(length int, value io.Reader) (label [sha256.Size]byte, err error) {
+	// The label is the hash of the encoded node. To find out what comes
+	// before and after the first value in the encoding, the node is encoded
+	// with a value of one and two bytes: the first difference is the varint
+	// holding the length of the value.
+	encode := func(first []byte) ([]byte, error) {
+		values := append([][]byte{first}, d.Values[1:]...)
+		return protobuf.Encode(&toHash{true, d.Key, values, [sha256.Size]byte{}, [sha256.Size]byte{}})
+	}
+	one, err := encode([]byte{0})
+	if err != nil {
+		return
+	}
+	two, err := encode([]byte{0, 0})
+	if err != nil {
+		return
+	}
+	pos := 0
+	for pos < len(one) && one[pos] == two[pos] {
+		pos++
+	}
+	if pos+2 > len(one) {
+		err = errors.New("couldn't find value in encoding")
+		return
+	}
+
+	h := sha256.New()
+	h.Write(one[:pos])
+	lengthBuf := make([]byte, binary.MaxVarintLen64)
+	h.Write(lengthBuf[:binary.PutUvarint(lengthBuf, uint64(length))])
+	if _, err = io.CopyN(h, value, int64(length)); err != nil {
+		err = errors.New("value is shorter than expected: " + err.Error())
+		return
+	}
+	if n, _ := value.Read(make([]byte, 1)); n > 0 {
+		err = errors.New("value is longer than expected")
+		return
+	}
+	h.Write(one[pos+2:])
+	copy(label[:], h.Sum(nil))
+	return
+}
+
 // collection
 
 // Methods (collection) (serialization)
@@ -193,10 +314,11 @@ func (p Proof) Consistent() bool {
 // It transforms a given Proof into an array of byte, to allow easy exchange of proof, for example on a network.
 func (c *Collection) Serialize(proof Proof) []byte {
 	serializable := struct {
-		Key   []byte
-		Root  dump
-		Steps []step
-	}{proof.Key, proof.Root, proof.Steps}
+		Key            []byte
+		Root           dump
+		Steps          []step
+		DetachedLength int `protobuf:"opt"`
+	}{proof.Key, proof.Root, proof.Steps, proof.DetachedLength}
 
 	buffer, _ := protobuf.Encode(&serializable)
 	return buffer
@@ -207,9 +329,10 @@ func (c *Collection) Serialize(proof Proof) []byte {
 // It will generate an error if the given byte array doesn't represent a Proof.
 func (c *Collection) Deserialize(buffer []byte) (Proof, error) {
 	deserializable := struct {
-		Key   []byte
-		Root  dump
-		Steps []step
+		Key            []byte
+		Root           dump
+		Steps          []step
+		DetachedLength int `protobuf:"opt"`
 	}{}
 
 	err := protobuf.Decode(buffer, &deserializable)
@@ -218,5 +341,73 @@ func (c *Collection) Deserialize(buffer []byte) (Proof, error) {
 		return Proof{}, err
 	}
 
-	return Proof{deserializable.Key, deserializable.Root, deserializable.Steps, c}, nil
+	return Proof{deserializable.Key, deserializable.Root, deserializable.Steps,
+		deserializable.DetachedLength, c}, nil
+}
+
+// Methods (compression)
+
+// CompressProofs returns the given proofs in a compressed form, where every
+// node present in more than one proof is stored only once. As all proofs
+// of a collection start at the same root, this saves a lot of space when
+// sending many proofs at once.
+func CompressProofs(proofs []Proof) CompressedProofs {
+	var cp CompressedProofs
+	indexes := make(map[[sha256.Size]byte]int)
+	add := func(d dump) int {
+		if i, ok := indexes[d.Label]; ok {
+			return i
+		}
+		indexes[d.Label] = len(cp.Nodes)
+		cp.Nodes = append(cp.Nodes, d)
+		return len(cp.Nodes) - 1
+	}
+
+	for _, p := range proofs {
+		c := CompressedProof{
+			Key:  p.Key,
+			Root: add(p.Root),
+		}
+		for _, s := range p.Steps {
+			c.Steps = append(c.Steps, add(s.Left), add(s.Right))
+		}
+		cp.Proofs = append(cp.Proofs, c)
+	}
+	return cp
+}
+
+// Expand is the inverse of CompressProofs and returns the individual proofs.
+// It returns an error if an index points outside of the nodes. The returned
+// proofs still need to be verified.
+func (cp CompressedProofs) Expand() ([]Proof, error) {
+	get := func(i int) (dump, error) {
+		if i < 0 || i >= len(cp.Nodes) {
+			return dump{}, errors.New("node index out of range")
+		}
+		return cp.Nodes[i], nil
+	}
+
+	proofs := make([]Proof, len(cp.Proofs))
+	for i, c := range cp.Proofs {
+		if len(c.Steps)%2 != 0 {
+			return nil, errors.New("odd number of step indexes")
+		}
+		root, err := get(c.Root)
+		if err != nil {
+			return nil, err
+		}
+		proofs[i] = Proof{Key: c.Key, Root: root}
+		for j := 0; j < len(c.Steps); j += 2 {
+			left, err := get(c.Steps[j])
+			if err != nil {
+				return nil, err
+			}
+			right, err := get(c.Steps[j+1])
+			if err != nil {
+				return nil, err
+			}
+			proofs[i].Steps = append(proofs[i].Steps, step{left, right})
+		}
+	}
+	return proofs, nil
 }
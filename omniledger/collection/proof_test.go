@@ -1,10 +1,12 @@
 package collection
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"testing"
 
+	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/require"
 )
 
@@ -526,3 +528,98 @@ func TestProofSerialization(test *testing.T) {
 		test.Error("[proof.go]", "[serialization]", "Deserialize() does not yield an error when provided with an invalid byte slice.")
 	}
 }
+
+func TestProofCompression(test *testing.T) {
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection := New(stake64, data)
+
+	var proofs []Proof
+	size := 0
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+	}
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		proof, err := collection.Get(key).Proof()
+		require.Nil(test, err)
+		proofs = append(proofs, proof)
+		size += len(collection.Serialize(proof))
+	}
+
+	compressed := CompressProofs(proofs)
+	buf, err := protobuf.Encode(&compressed)
+	require.Nil(test, err)
+	require.True(test, len(buf) < size)
+
+	var decoded CompressedProofs
+	require.Nil(test, protobuf.Decode(buf, &decoded))
+	expanded, err := decoded.Expand()
+	require.Nil(test, err)
+	require.Equal(test, len(proofs), len(expanded))
+	for i, p := range expanded {
+		require.Equal(test, proofs[i].Key, p.Key)
+		require.True(test, collection.Verify(p))
+		require.True(test, p.Match())
+	}
+
+	decoded.Proofs[0].Root = len(decoded.Nodes)
+	_, err = decoded.Expand()
+	require.NotNil(test, err)
+}
+
+func TestProofVerifyStream(test *testing.T) {
+	collection := New(Data{}, Data{})
+
+	large := make([]byte, 4*1024*1024)
+	for index := range large {
+		large[index] = byte(index)
+	}
+	key := []byte("large")
+	require.Nil(test, collection.Add(key, large, []byte("contract")))
+	for index := 0; index < 16; index++ {
+		other := make([]byte, 8)
+		binary.BigEndian.PutUint64(other, uint64(index))
+		require.Nil(test, collection.Add(other, other, other))
+	}
+
+	proof, err := collection.Get(key).Proof()
+	require.Nil(test, err)
+	require.True(test, proof.Consistent())
+
+	detached, err := proof.Detach()
+	require.Nil(test, err)
+	require.Equal(test, len(large), detached.DetachedLength)
+	// The original proof is unchanged.
+	require.True(test, proof.Consistent())
+	values, err := proof.RawValues()
+	require.Nil(test, err)
+	require.Equal(test, large, values[0])
+
+	// The detached proof survives serialization.
+	detached, err = collection.Deserialize(collection.Serialize(detached))
+	require.Nil(test, err)
+	require.True(test, len(collection.Serialize(detached)) < len(large))
+
+	require.Nil(test, detached.VerifyStream(bytes.NewReader(large)))
+	require.NotNil(test, proof.VerifyStream(bytes.NewReader(large)))
+
+	// Changed, shorter and longer values are refused.
+	wrong := append([]byte{}, large...)
+	wrong[len(wrong)/2]++
+	require.NotNil(test, detached.VerifyStream(bytes.NewReader(wrong)))
+	require.NotNil(test, detached.VerifyStream(bytes.NewReader(large[1:])))
+	require.NotNil(test, detached.VerifyStream(bytes.NewReader(append(large, 0))))
+
+	// A proof of absence cannot be detached.
+	absent, err := collection.Get([]byte("absent")).Proof()
+	require.Nil(test, err)
+	_, err = absent.Detach()
+	require.NotNil(test, err)
+}
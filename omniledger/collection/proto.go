@@ -41,6 +41,31 @@ type Proof struct {
 	// Root is the root node
 	Root dump
 	// Steps are the steps to go from root to key
-	Steps      []step
-	collection *Collection
+	Steps []step
+	// DetachedLength is the length of the first value of the key, if the
+	// value has been removed from the proof with Detach.
+	DetachedLength int `protobuf:"opt"`
+	collection     *Collection
+}
+
+// CompressedProofs
+
+// CompressedProofs holds several proofs of the same collection, where every
+// node shared by more than one proof is stored only once.
+type CompressedProofs struct {
+	// Nodes are all the distinct nodes of the proofs
+	Nodes []dump
+	// Proofs point to the nodes of every proof
+	Proofs []CompressedProof
+}
+
+// CompressedProof is one proof of CompressedProofs, where the nodes are
+// replaced by their index in CompressedProofs.Nodes.
+type CompressedProof struct {
+	// Key is the key that this proof is representing
+	Key []byte
+	// Root is the index of the root node
+	Root int
+	// Steps are the indexes of the left and right node of every step
+	Steps []int
 }
@@ -5,9 +5,13 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
+	"github.com/dedis/cothority/omniledger/darc"
 	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
 )
 
 // ContractCoinID denotes a contract that can store and transfer coins.
@@ -17,6 +21,11 @@ var ContractCoinID = "coin"
 // to this contract.
 var CoinName = iid("olCoin")
 
+// ContractCoinGenesisID denotes a contract whose instances define new types of
+// coins: the ID of an instance is the Name of the coins of its type. The
+// type CoinName is built in and has no instance.
+var ContractCoinGenesisID = "coingenesis"
+
 // safeUint64 is a uin64 that guards against overflow/underflow.
 type safeUint64 uint64
 
@@ -42,9 +51,125 @@ func (s safeUint64) sub(a uint64) (safeUint64, error) {
 	return s, errUnderflow
 }
 
+// coinAllowances holds how many coins other identities are allowed to spend
+// from a coin instance, and the type of its coins. It is stored in the
+// instance after the 8 bytes of the balance, and left out if there are no
+// allowances and the coins are of type CoinName.
+type coinAllowances struct {
+	Allowances []coinAllowance
+	// Name is the type of the coins of the instance, as the slice of the
+	// ID of its coin genesis, or empty for CoinName.
+	Name []byte `protobuf:"opt"`
+}
+
+// name returns the type of the coins of the instance.
+func (ca coinAllowances) name() omniledger.InstanceID {
+	if len(ca.Name) == 0 {
+		return CoinName
+	}
+	return omniledger.NewInstanceID(ca.Name)
+}
+
+// coinAllowance is the number of coins one spender is allowed to spend.
+type coinAllowance struct {
+	Spender string
+	Coins   uint64
+}
+
+// decodeAllowances returns the allowances stored in the value of a coin
+// instance.
+func decodeAllowances(value []byte) (ca coinAllowances, err error) {
+	if len(value) <= 8 {
+		return
+	}
+	err = protobuf.Decode(value[8:], &ca)
+	return
+}
+
+// encodeCoin returns the value of a coin instance holding the balance and the
+// allowances.
+func encodeCoin(balance safeUint64, ca coinAllowances) ([]byte, error) {
+	var w bytes.Buffer
+	binary.Write(&w, binary.LittleEndian, balance)
+	if len(ca.Allowances) == 0 && len(ca.Name) == 0 {
+		return w.Bytes(), nil
+	}
+	caBuf, err := protobuf.Encode(&ca)
+	if err != nil {
+		return nil, err
+	}
+	return append(w.Bytes(), caBuf...), nil
+}
+
+// set sets the allowance of spender to coins. An allowance of 0 coins is
+// removed.
+func (ca *coinAllowances) set(spender string, coins uint64) {
+	for i, a := range ca.Allowances {
+		if a.Spender == spender {
+			if coins == 0 {
+				ca.Allowances = append(ca.Allowances[:i], ca.Allowances[i+1:]...)
+			} else {
+				ca.Allowances[i].Coins = coins
+			}
+			return
+		}
+	}
+	if coins > 0 {
+		ca.Allowances = append(ca.Allowances, coinAllowance{spender, coins})
+	}
+}
+
+// spend takes coins from the allowance of the first signer that is allowed
+// to spend that many coins.
+func (ca *coinAllowances) spend(sigs []darc.Signature, coins uint64) error {
+	for _, sig := range sigs {
+		spender := sig.Signer.String()
+		for _, a := range ca.Allowances {
+			if a.Spender == spender && a.Coins >= coins {
+				ca.set(spender, a.Coins-coins)
+				return nil
+			}
+		}
+	}
+	return errors.New("no signer has a big enough allowance")
+}
+
+// CoinState is the decoded value of a coin instance.
+type CoinState struct {
+	// Name is the type of the coins.
+	Name    omniledger.InstanceID
+	Balance uint64
+	// Allowances maps the spenders to the number of coins they are
+	// allowed to spend.
+	Allowances map[string]uint64
+}
+
+// DecodeCoin decodes the value of a coin instance. It is registered as the
+// decoder of the state of ContractCoin.
+func DecodeCoin(value []byte) (interface{}, error) {
+	if len(value) < 8 {
+		return nil, errors.New("value of coin is too short")
+	}
+	ca, err := decodeAllowances(value)
+	if err != nil {
+		return nil, err
+	}
+	cs := &CoinState{
+		Name:       ca.name(),
+		Balance:    binary.LittleEndian.Uint64(value),
+		Allowances: make(map[string]uint64),
+	}
+	for _, a := range ca.Allowances {
+		cs.Allowances[a.Spender] = a.Coins
+	}
+	return cs, nil
+}
+
 // ContractCoin is a coin implementation that holds one instance per coin.
 // If you spawn a new ContractCoin, it will create an account with a value
-// of 0 coins.
+// of 0 coins. The optional argument "type" of the spawn is the ID of the
+// coin genesis of the type of the coins, else the coins are of type
+// CoinName. Coins can only be transferred between accounts of the same type.
 // The following methods are available:
 //  - mint will add the number of coins in the argument "coins" to the
 //    current coin instance. The argument must be a 64-bit uint in LittleEndian
@@ -55,6 +180,15 @@ func (s safeUint64) sub(a uint64) (safeUint64, error) {
 //  - fetch takes "coins" out of the account and returns it as an output
 //    parameter for the next instruction to interpret.
 //  - store puts the coins given to the instance back into the account.
+//  - approve allows the identity given in the argument "spender" to spend
+//    up to "coins" from this account. The "spender" must be the string
+//    representation of a darc.Identity. An approval of 0 coins removes the
+//    allowance.
+//  - transfer_from is like transfer, but is sent by a spender that has been
+//    approved before. The allowance of the spender is reduced by "coins".
+//    It is only authorized by the allowance: the darc of the instance is
+//    not checked, so no "invoke:transfer_from" rule is needed, and the
+//    spender must sign the instruction itself.
 // You can only delete a contractCoin instance if the account is empty.
 func ContractCoin(cdb omniledger.CollectionView, inst omniledger.Instruction, c []omniledger.Coin) (sc []omniledger.StateChange, cOut []omniledger.Coin, err error) {
 	cOut = c
@@ -67,18 +201,41 @@ func ContractCoin(cdb omniledger.CollectionView, inst omniledger.Instruction, c
 			SubID:  omniledger.NewSubID(inst.Hash()),
 		}
 		log.Lvlf3("Spawing coin to %x", ca.Slice())
+		var allowances coinAllowances
+		if typeBuf := inst.Spawn.Args.Search("type"); typeBuf != nil {
+			name := omniledger.NewInstanceID(typeBuf)
+			if err = checkCoinNames(cdb, []omniledger.Coin{{Name: name}}); err != nil {
+				return
+			}
+			if !name.Equal(CoinName) {
+				allowances.Name = name.Slice()
+			}
+		}
+		var coinBuf []byte
+		coinBuf, err = encodeCoin(0, allowances)
+		if err != nil {
+			return
+		}
 		sc = []omniledger.StateChange{
-			omniledger.NewStateChange(omniledger.Create, ca, ContractCoinID, make([]byte, 8)),
+			omniledger.NewStateChange(omniledger.Create, ca, ContractCoinID, coinBuf),
 		}
 		return
 	case omniledger.InvokeType:
 		// Invoke is one of "mint", "transfer", "fetch", or "store".
+		if err = checkCoinNames(cdb, c); err != nil {
+			return
+		}
 		var value []byte
 		value, _, err = cdb.GetValues(inst.InstanceID.Slice())
 		if err != nil {
 			return
 		}
 		coinsCurrent := newSafeUint64(value)
+		var allowances coinAllowances
+		allowances, err = decodeAllowances(value)
+		if err != nil {
+			return
+		}
 		var coinsArg uint64
 
 		if inst.Invoke.Command != "store" {
@@ -103,31 +260,37 @@ func ContractCoin(cdb omniledger.CollectionView, inst omniledger.Instruction, c
 			if err != nil {
 				return
 			}
-
-			target := inst.Invoke.Args.Search("destination")
-			var (
-				v   []byte
-				cid string
-			)
-			v, cid, err = cdb.GetValues(target)
-			if err == nil && cid != ContractCoinID {
-				err = errors.New("destination is not a coin contract")
+			var scTarget omniledger.StateChange
+			scTarget, err = transferCoins(cdb, inst.Invoke.Args.Search("destination"), allowances.name(), coinsArg)
+			if err != nil {
+				return
 			}
+			sc = append(sc, scTarget)
+		case "approve":
+			// approve sets the number of coins a spender is allowed to
+			// transfer from this account.
+			spender := inst.Invoke.Args.Search("spender")
+			if spender == nil {
+				err = errors.New("argument \"spender\" is missing")
+				return
+			}
+			allowances.set(string(spender), coinsArg)
+		case "transfer_from":
+			// transfer_from sends coins to another account on behalf of
+			// the owner, within the allowance of the spender.
+			if err = allowances.spend(inst.Signatures, coinsArg); err != nil {
+				return
+			}
+			coinsCurrent, err = coinsCurrent.sub(coinsArg)
 			if err != nil {
 				return
 			}
-
-			targetCoin := newSafeUint64(v)
-			targetCoin, err = targetCoin.add(coinsArg)
+			var scTarget omniledger.StateChange
+			scTarget, err = transferCoins(cdb, inst.Invoke.Args.Search("destination"), allowances.name(), coinsArg)
 			if err != nil {
 				return
 			}
-			var w bytes.Buffer
-			binary.Write(&w, binary.LittleEndian, targetCoin)
-
-			log.Lvlf3("transferring %d to %x", coinsArg, target)
-			sc = append(sc, omniledger.NewStateChange(omniledger.Update, omniledger.NewInstanceID(target),
-				ContractCoinID, w.Bytes()))
+			sc = append(sc, scTarget)
 		case "fetch":
 			// fetch removes coins from the account and passes it on to the next
 			// instruction.
@@ -139,29 +302,31 @@ func ContractCoin(cdb omniledger.CollectionView, inst omniledger.Instruction, c
 			if err != nil {
 				return
 			}
-			cOut = append(cOut, omniledger.Coin{Name: CoinName, Value: coinsArg})
+			cOut = append(cOut, omniledger.Coin{Name: allowances.name(), Value: coinsArg})
 		case "store":
 			// store moves all coins from this instruction into the account.
-			cOut = []omniledger.Coin{}
-			for _, co := range c {
-				if co.Name.Equal(CoinName) {
-					coinsCurrent, err = coinsCurrent.add(co.Value)
-					if err != nil {
-						return
-					}
-				} else {
-					cOut = append(cOut, co)
-				}
+			purse := omniledger.NewCoinPurse(c)
+			coinsArg = purse.Available(allowances.name())
+			coinsCurrent, err = coinsCurrent.add(coinsArg)
+			if err != nil {
+				return
+			}
+			if err = purse.Spend(allowances.name(), coinsArg); err != nil {
+				return
 			}
+			cOut = purse.Coins()
 		default:
 			err = errors.New("Coin contract can only mine and transfer")
 			return
 		}
 		// Finally update the coin value.
-		var w bytes.Buffer
-		binary.Write(&w, binary.LittleEndian, coinsCurrent)
+		var coinBuf []byte
+		coinBuf, err = encodeCoin(coinsCurrent, allowances)
+		if err != nil {
+			return
+		}
 		sc = append(sc, omniledger.NewStateChange(omniledger.Update, inst.InstanceID,
-			ContractCoinID, w.Bytes()))
+			ContractCoinID, coinBuf))
 		return
 	case omniledger.DeleteType:
 		// Delete our coin address, but only if the current coin is empty.
@@ -184,6 +349,253 @@ func ContractCoin(cdb omniledger.CollectionView, inst omniledger.Instruction, c
 	return
 }
 
+// ContractCoinGenesis creates the genesis object of a new type of coins. The
+// optional argument "description" is stored in the instance. A genesis
+// object cannot be changed or deleted, so that the coins of its type never
+// point to a missing genesis.
+func ContractCoinGenesis(cdb omniledger.CollectionView, inst omniledger.Instruction, c []omniledger.Coin) ([]omniledger.StateChange, []omniledger.Coin, error) {
+	if inst.GetType() != omniledger.SpawnType {
+		return nil, nil, errors.New("coin genesis can only be spawned")
+	}
+	genesis := omniledger.InstanceID{
+		DarcID: inst.InstanceID.DarcID,
+		SubID:  omniledger.NewSubID(inst.Hash()),
+	}
+	description := inst.Spawn.Args.Search("description")
+	if description == nil {
+		description = []byte{}
+	}
+	return []omniledger.StateChange{
+		omniledger.NewStateChange(omniledger.Create, genesis, ContractCoinGenesisID, description),
+	}, c, nil
+}
+
+// checkCoinNames returns an error if the Name of one of the coins is neither
+// CoinName nor an instance of ContractCoinGenesis, so that no coins of a
+// phantom type are accepted.
+func checkCoinNames(cdb omniledger.CollectionView, coins []omniledger.Coin) error {
+	for _, coin := range coins {
+		if coin.Name.Equal(CoinName) {
+			continue
+		}
+		_, cid, err := cdb.GetValues(coin.Name.Slice())
+		if err != nil || cid != ContractCoinGenesisID {
+			return fmt.Errorf("coin name %x doesn't point to a coin genesis", coin.Name.Slice())
+		}
+	}
+	return nil
+}
+
+// ConditionalPayment returns the instructions of a transaction paying coins
+// from the coin instance payer to the coin instance payee, but only if the
+// value instance condition holds expected. The value of condition is then
+// set to newValue, e.g. to mark an invoice as paid. The condition is checked
+// by the first instruction, and as all the instructions of a transaction are
+// applied together or not at all, neither the payment nor the update happens
+// if it fails. The instructions still have to be signed.
+func ConditionalPayment(condition, payer, payee omniledger.InstanceID, coins uint64,
+	expected, newValue []byte) []omniledger.Instruction {
+	coinsBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coinsBuf, coins)
+	nonce := omniledger.GenNonce()
+	instrs := []omniledger.Instruction{{
+		InstanceID: condition,
+		Invoke: &omniledger.Invoke{
+			Command: "update_if",
+			Args: omniledger.Arguments{
+				{Name: "expected", Value: expected},
+				{Name: "value", Value: newValue},
+			},
+		},
+	}, {
+		InstanceID: payer,
+		Invoke: &omniledger.Invoke{
+			Command: "fetch",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinsBuf}},
+		},
+	}, {
+		InstanceID: payee,
+		Invoke:     &omniledger.Invoke{Command: "store"},
+	}}
+	for i := range instrs {
+		instrs[i].Nonce = nonce
+		instrs[i].Index = i
+		instrs[i].Length = len(instrs)
+	}
+	return instrs
+}
+
+// transferCoins returns the state change that adds coins of type name to the
+// coin instance target.
+func transferCoins(cdb omniledger.CollectionView, target []byte, name omniledger.InstanceID, coins uint64) (sc omniledger.StateChange, err error) {
+	var (
+		v   []byte
+		cid string
+	)
+	v, cid, err = cdb.GetValues(target)
+	if err == nil && cid != ContractCoinID {
+		err = errors.New("destination is not a coin contract")
+	}
+	if err != nil {
+		return
+	}
+	var ca coinAllowances
+	ca, err = decodeAllowances(v)
+	if err != nil {
+		return
+	}
+	if !ca.name().Equal(name) {
+		err = errors.New("destination holds another type of coins")
+		return
+	}
+
+	targetCoin := newSafeUint64(v)
+	targetCoin, err = targetCoin.add(coins)
+	if err != nil {
+		return
+	}
+	var w bytes.Buffer
+	binary.Write(&w, binary.LittleEndian, targetCoin)
+	// Keep the allowances of the target.
+	if len(v) > 8 {
+		w.Write(v[8:])
+	}
+
+	log.Lvlf3("transferring %d to %x", coins, target)
+	sc = omniledger.NewStateChange(omniledger.Update, omniledger.NewInstanceID(target),
+		ContractCoinID, w.Bytes())
+	return
+}
+
+// CoinTransfer is a movement of coins between two coin instances. A zero From
+// means that the coins have been minted, a zero To that they left the coin
+// instances, e.g. because they have been fetched but not stored.
+type CoinTransfer struct {
+	From   omniledger.InstanceID
+	To     omniledger.InstanceID
+	Name   omniledger.InstanceID
+	Amount uint64
+}
+
+// coinDelta is the change of the balance of a coin instance.
+type coinDelta struct {
+	id     omniledger.InstanceID
+	name   omniledger.InstanceID
+	before uint64
+	after  uint64
+}
+
+// CoinFlow returns the transfers of coins done by the state changes scs when
+// they are applied to coll. Only the net change of every coin instance is
+// considered, and for every type of coins, the instances losing coins are
+// matched with the instances receiving coins in the order of the state
+// changes.
+func CoinFlow(coll omniledger.CollectionView, scs omniledger.StateChanges) ([]CoinTransfer, error) {
+	var deltas []*coinDelta
+	byKey := make(map[string]*coinDelta)
+	for _, sc := range scs {
+		if string(sc.ContractID) != ContractCoinID {
+			continue
+		}
+		d, ok := byKey[string(sc.InstanceID)]
+		if !ok {
+			d = &coinDelta{id: omniledger.NewInstanceID(sc.InstanceID), name: CoinName}
+			// A new coin instance starts with 0 coins, and its
+			// type is the one of its first value.
+			value, cid, err := coll.GetValues(sc.InstanceID)
+			if err != nil || cid != ContractCoinID {
+				value = sc.Value
+			} else {
+				if len(value) < 8 {
+					return nil, errors.New("invalid coin instance")
+				}
+				d.before = uint64(newSafeUint64(value))
+			}
+			if len(value) > 0 {
+				ca, err := decodeAllowances(value)
+				if err != nil {
+					return nil, err
+				}
+				d.name = ca.name()
+			}
+			d.after = d.before
+			byKey[string(sc.InstanceID)] = d
+			deltas = append(deltas, d)
+		}
+		if sc.StateAction == omniledger.Remove {
+			d.after = 0
+			continue
+		}
+		if len(sc.Value) < 8 {
+			return nil, errors.New("invalid coin instance")
+		}
+		d.after = uint64(newSafeUint64(sc.Value))
+	}
+
+	var names []omniledger.InstanceID
+	seen := make(map[string]bool)
+	for _, d := range deltas {
+		if !seen[string(d.name.Slice())] {
+			seen[string(d.name.Slice())] = true
+			names = append(names, d.name)
+		}
+	}
+	type coinAmount struct {
+		id     omniledger.InstanceID
+		amount uint64
+	}
+	var flow []CoinTransfer
+	for _, name := range names {
+		var debits, credits []coinAmount
+		for _, d := range deltas {
+			if !d.name.Equal(name) {
+				continue
+			}
+			switch {
+			case d.after < d.before:
+				debits = append(debits, coinAmount{d.id, d.before - d.after})
+			case d.after > d.before:
+				credits = append(credits, coinAmount{d.id, d.after - d.before})
+			}
+		}
+		for len(debits) > 0 && len(credits) > 0 {
+			amount := debits[0].amount
+			if credits[0].amount < amount {
+				amount = credits[0].amount
+			}
+			flow = append(flow, CoinTransfer{From: debits[0].id, To: credits[0].id,
+				Name: name, Amount: amount})
+			debits[0].amount -= amount
+			credits[0].amount -= amount
+			if debits[0].amount == 0 {
+				debits = debits[1:]
+			}
+			if credits[0].amount == 0 {
+				credits = credits[1:]
+			}
+		}
+		for _, d := range debits {
+			flow = append(flow, CoinTransfer{From: d.id, Name: name, Amount: d.amount})
+		}
+		for _, c := range credits {
+			flow = append(flow, CoinTransfer{To: c.id, Name: name, Amount: c.amount})
+		}
+	}
+	return flow, nil
+}
+
+// SimulateCoinFlow returns the transfers of coins the transaction ct would do
+// if it was applied to the latest state of the skipchain scID. Nothing is
+// stored.
+func (s *Service) SimulateCoinFlow(scID skipchain.SkipBlockID, ct omniledger.ClientTransaction) ([]CoinTransfer, error) {
+	ol := s.Service(omniledger.ServiceName).(*omniledger.Service)
+	coll, scs, err := ol.SimulateTx(scID, ct)
+	if err != nil {
+		return nil, err
+	}
+	return CoinFlow(coll, scs)
+}
+
 // iid uses darc=sha256(in) and subid=sha256(in) in order to manufacture an
 // InstanceID from in.
 //
@@ -198,3 +610,36 @@ func iid(in string) omniledger.InstanceID {
 	copy(i.SubID[:], sum)
 	return i
 }
+
+// GetCoinSupply returns the total number of coins of type name held by all
+// the coin instances of the skipchain scID. Coins that are fetched but not
+// yet stored during a transaction are not counted. The name must be CoinName
+// or the ID of a coin genesis.
+func (s *Service) GetCoinSupply(scID skipchain.SkipBlockID, name omniledger.InstanceID) (uint64, error) {
+	ol := s.Service(omniledger.ServiceName).(*omniledger.Service)
+	if err := checkCoinNames(ol.GetCollectionView(scID), []omniledger.Coin{{Name: name}}); err != nil {
+		return 0, err
+	}
+	_, values, err := ol.ContractInstances(scID, ContractCoinID)
+	if err != nil {
+		return 0, err
+	}
+	var supply safeUint64
+	for _, value := range values {
+		if len(value) < 8 {
+			return 0, errors.New("invalid coin instance")
+		}
+		ca, err := decodeAllowances(value)
+		if err != nil {
+			return 0, err
+		}
+		if !ca.name().Equal(name) {
+			continue
+		}
+		supply, err = supply.add(uint64(newSafeUint64(value)))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return uint64(supply), nil
+}
@@ -1,10 +1,15 @@
 package contracts
 
 import (
+	"encoding/binary"
 	"testing"
+	"time"
 
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/omniledger/collection"
+	"github.com/dedis/cothority/omniledger/darc"
 	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/dedis/onet"
 	"github.com/stretchr/testify/require"
 )
 
@@ -93,6 +98,7 @@ func TestCoin_InvokeStoreFetch(t *testing.T) {
 	}
 	c1 := omniledger.Coin{Name: CoinName, Value: 1}
 	notOlCoin := iid("notOlCoin")
+	ct.Store(notOlCoin, []byte{}, ContractCoinGenesisID)
 	c2 := omniledger.Coin{Name: notOlCoin, Value: 1}
 
 	sc, co, err := ContractCoin(ct, inst, []omniledger.Coin{c1, c2})
@@ -128,6 +134,117 @@ func TestCoin_InvokeStoreFetch(t *testing.T) {
 		sc[0])
 }
 
+func TestCoin_Genesis(t *testing.T) {
+	ct := newCT()
+	inst := omniledger.Instruction{
+		InstanceID: omniledger.NewInstanceID(nil),
+		Spawn: &omniledger.Spawn{
+			ContractID: ContractCoinGenesisID,
+			Args:       omniledger.Arguments{{Name: "description", Value: []byte("gold")}},
+		},
+	}
+	sc, _, err := ContractCoinGenesis(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	gold := omniledger.NewInstanceID(sc[0].InstanceID)
+	ct.Store(gold, sc[0].Value, ContractCoinGenesisID)
+	inst.Spawn = nil
+	inst.InstanceID = gold
+	inst.Delete = &omniledger.Delete{}
+	_, _, err = ContractCoinGenesis(ct, inst, nil)
+	require.NotNil(t, err)
+
+	coAddr := omniledger.NewInstanceID(nil)
+	ct.Store(coAddr, coinOne, ContractCoinID)
+	coAddr2 := iid("coin2")
+	ct.Store(coAddr2, coinZero, ContractCoinID)
+	transfer := omniledger.Instruction{
+		InstanceID: coAddr,
+		Invoke: &omniledger.Invoke{
+			Command: "transfer",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "destination", Value: coAddr2.Slice()},
+			},
+		},
+	}
+
+	// Coins of a type without a genesis are refused.
+	phantom := []omniledger.Coin{{Name: iid("phantom"), Value: 1}}
+	_, _, err = ContractCoin(ct, transfer, phantom)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "coin genesis")
+	// So are coins pointing to an instance that is not a coin genesis.
+	_, _, err = ContractCoin(ct, transfer, []omniledger.Coin{{Name: coAddr2, Value: 1}})
+	require.NotNil(t, err)
+
+	golden := []omniledger.Coin{{Name: gold, Value: 1}}
+	sc, co, err := ContractCoin(ct, transfer, golden)
+	require.Nil(t, err)
+	require.Equal(t, golden, co)
+	require.Equal(t, 2, len(sc))
+
+	// An account of gold coins stores and fetches gold coins.
+	spawn := omniledger.Instruction{
+		InstanceID: omniledger.NewInstanceID(nil),
+		Spawn: &omniledger.Spawn{
+			ContractID: ContractCoinID,
+			Args:       omniledger.Arguments{{Name: "type", Value: gold.Slice()}},
+		},
+	}
+	sc, _, err = ContractCoin(ct, spawn, nil)
+	require.Nil(t, err)
+	goldAddr := omniledger.NewInstanceID(sc[0].InstanceID)
+	ct.Store(goldAddr, sc[0].Value, ContractCoinID)
+	decoded, err := DecodeCoin(sc[0].Value)
+	require.Nil(t, err)
+	require.Equal(t, gold, decoded.(*CoinState).Name)
+	store := omniledger.Instruction{
+		InstanceID: goldAddr,
+		Invoke:     &omniledger.Invoke{Command: "store"},
+	}
+	sc, co, err = ContractCoin(ct, store, append(golden, omniledger.Coin{Name: CoinName, Value: 1}))
+	require.Nil(t, err)
+	require.Equal(t, []omniledger.Coin{{Name: CoinName, Value: 1}}, co)
+	ct.Store(goldAddr, sc[0].Value, ContractCoinID)
+	fetch := omniledger.Instruction{
+		InstanceID: goldAddr,
+		Invoke: &omniledger.Invoke{
+			Command: "fetch",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinOne}},
+		},
+	}
+	_, co, err = ContractCoin(ct, fetch, nil)
+	require.Nil(t, err)
+	require.Equal(t, golden, co)
+
+	// Coins are only transferred between accounts of the same type.
+	transfer.Invoke.Args[1].Value = goldAddr.Slice()
+	_, _, err = ContractCoin(ct, transfer, nil)
+	require.NotNil(t, err)
+
+	// The type of an account must have a genesis.
+	spawn.Spawn.Args[0].Value = iid("phantom").Slice()
+	_, _, err = ContractCoin(ct, spawn, nil)
+	require.NotNil(t, err)
+}
+
+func TestCoin_Decode(t *testing.T) {
+	var ca coinAllowances
+	ca.set("ed25519:spender", 3)
+	value, err := encodeCoin(42, ca)
+	require.Nil(t, err)
+	decoded, err := DecodeCoin(value)
+	require.Nil(t, err)
+	require.Equal(t, &CoinState{Name: CoinName, Balance: 42, Allowances: map[string]uint64{"ed25519:spender": 3}}, decoded)
+
+	decoded, err = DecodeCoin(coinOne)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), decoded.(*CoinState).Balance)
+	_, err = DecodeCoin([]byte{1})
+	require.NotNil(t, err)
+}
+
 func TestCoin_InvokeTransfer(t *testing.T) {
 	// Test that a coin can be transferred
 	ct := newCT()
@@ -169,6 +286,399 @@ func TestCoin_InvokeTransfer(t *testing.T) {
 	require.Equal(t, omniledger.NewStateChange(omniledger.Update, coAddr1, ContractCoinID, coinZero), sc[1])
 }
 
+func TestCoin_InvokeApproveTransferFrom(t *testing.T) {
+	ct := newCT()
+	coAddr1 := omniledger.InstanceID{DarcID: make([]byte, 32), SubID: omniledger.SubID{}}
+	coAddr2 := omniledger.InstanceID{DarcID: make([]byte, 32), SubID: omniledger.SubID{}}
+	coAddr2.DarcID[31] = byte(1)
+	ct.Store(coAddr1, coinTwo, ContractCoinID)
+	ct.Store(coAddr2, coinZero, ContractCoinID)
+	spender := darc.NewSignerEd25519(nil, nil)
+	other := darc.NewSignerEd25519(nil, nil)
+
+	// The owner approves the spender to use one coin.
+	inst := omniledger.Instruction{
+		InstanceID: coAddr1,
+		Invoke: &omniledger.Invoke{
+			Command: "approve",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "spender", Value: []byte(spender.Identity().String())},
+			},
+		},
+	}
+	sc, _, err := ContractCoin(ct, inst, []omniledger.Coin{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, coinTwo, sc[0].Value[:8])
+	ct.Store(coAddr1, sc[0].Value, ContractCoinID)
+
+	transferFrom := func(signer darc.Signer, coins []byte) omniledger.Instruction {
+		return omniledger.Instruction{
+			InstanceID: coAddr1,
+			Invoke: &omniledger.Invoke{
+				Command: "transfer_from",
+				Args: omniledger.Arguments{
+					{Name: "coins", Value: coins},
+					{Name: "destination", Value: coAddr2.Slice()},
+				},
+			},
+			Signatures: []darc.Signature{{Signer: signer.Identity()}},
+		}
+	}
+
+	// Spending more than the allowance or by another identity fails.
+	_, _, err = ContractCoin(ct, transferFrom(spender, coinTwo), []omniledger.Coin{})
+	require.Error(t, err)
+	_, _, err = ContractCoin(ct, transferFrom(other, coinOne), []omniledger.Coin{})
+	require.Error(t, err)
+
+	// Spending within the allowance works and uses it up.
+	sc, _, err = ContractCoin(ct, transferFrom(spender, coinOne), []omniledger.Coin{})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	require.Equal(t, omniledger.NewStateChange(omniledger.Update, coAddr2, ContractCoinID, coinOne), sc[0])
+	require.Equal(t, omniledger.NewStateChange(omniledger.Update, coAddr1, ContractCoinID, coinOne), sc[1])
+	ct.Store(coAddr1, sc[1].Value, ContractCoinID)
+	ct.Store(coAddr2, sc[0].Value, ContractCoinID)
+
+	_, _, err = ContractCoin(ct, transferFrom(spender, coinOne), []omniledger.Coin{})
+	require.Error(t, err)
+}
+
+func TestCoin_Supply(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	servers, roster, _ := local.GenTree(2, true)
+	cl := omniledger.NewClient()
+
+	genesisMsg, err := omniledger.DefaultGenesisMsg(omniledger.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:transfer"}, signer.Identity())
+	require.Nil(t, err)
+	gDarc := &genesisMsg.GenesisDarc
+	genesisMsg.BlockInterval = time.Second
+	resp, err := cl.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scID := resp.Skipblock.SkipChainID()
+	s := servers[0].Service("contracts").(*Service)
+
+	// send signs the instruction and waits for it to be included.
+	send := func(instr *omniledger.Instruction) {
+		instr.Nonce = omniledger.GenNonce()
+		instr.Length = 1
+		require.Nil(t, instr.SignBy(signer))
+		_, err := cl.AddTransactionAndWait(omniledger.ClientTransaction{
+			Instructions: []omniledger.Instruction{*instr},
+		}, 10)
+		require.Nil(t, err)
+	}
+	spawn := func() omniledger.InstanceID {
+		instr := omniledger.Instruction{
+			InstanceID: omniledger.InstanceID{DarcID: gDarc.GetBaseID()},
+			Spawn:      &omniledger.Spawn{ContractID: ContractCoinID},
+		}
+		send(&instr)
+		return omniledger.InstanceID{
+			DarcID: gDarc.GetBaseID(),
+			SubID:  omniledger.NewSubID(instr.Hash()),
+		}
+	}
+	supply := func() uint64 {
+		coins, err := s.GetCoinSupply(scID, CoinName)
+		require.Nil(t, err)
+		return coins
+	}
+
+	coin1 := spawn()
+	coin2 := spawn()
+	require.Equal(t, uint64(0), supply())
+
+	// Minting increases the supply.
+	send(&omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "mint",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinTwo}},
+		},
+	})
+	require.Equal(t, uint64(2), supply())
+
+	// A transfer leaves it unchanged.
+	send(&omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "transfer",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "destination", Value: coin2.Slice()},
+			},
+		},
+	})
+	require.Equal(t, uint64(2), supply())
+
+	// Unknown coin types are refused.
+	_, err = s.GetCoinSupply(scID, omniledger.NewInstanceID(nil))
+	require.NotNil(t, err)
+
+	local.WaitDone(genesisMsg.BlockInterval)
+}
+
+func TestCoin_TransferFromWithoutRule(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	spender := darc.NewSignerEd25519(nil, nil)
+	_, roster, _ := local.GenTree(2, true)
+	cl := omniledger.NewClient()
+
+	// The genesis darc has no rule for transfer_from.
+	genesisMsg, err := omniledger.DefaultGenesisMsg(omniledger.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:approve"}, signer.Identity())
+	require.Nil(t, err)
+	gDarc := &genesisMsg.GenesisDarc
+	genesisMsg.BlockInterval = time.Second
+	_, err = cl.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+
+	send := func(instr *omniledger.Instruction, signer darc.Signer) {
+		instr.Nonce = omniledger.GenNonce()
+		instr.Length = 1
+		require.Nil(t, instr.SignBy(signer))
+		_, err := cl.AddTransactionAndWait(omniledger.ClientTransaction{
+			Instructions: []omniledger.Instruction{*instr},
+		}, 10)
+		require.Nil(t, err)
+	}
+	spawn := func() omniledger.InstanceID {
+		instr := omniledger.Instruction{
+			InstanceID: omniledger.InstanceID{DarcID: gDarc.GetBaseID()},
+			Spawn:      &omniledger.Spawn{ContractID: ContractCoinID},
+		}
+		send(&instr, signer)
+		return omniledger.InstanceID{
+			DarcID: gDarc.GetBaseID(),
+			SubID:  omniledger.NewSubID(instr.Hash()),
+		}
+	}
+
+	coin1 := spawn()
+	coin2 := spawn()
+	send(&omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "mint",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinTwo}},
+		},
+	}, signer)
+	send(&omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "approve",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "spender", Value: []byte(spender.Identity().String())},
+			},
+		},
+	}, signer)
+
+	// The allowance alone authorizes the spender.
+	send(&omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "transfer_from",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "destination", Value: coin2.Slice()},
+			},
+		},
+	}, spender)
+	reply, err := cl.GetProof(coin2.Slice())
+	require.Nil(t, err)
+	_, values, err := reply.Proof.KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), binary.LittleEndian.Uint64(values[0]))
+
+	local.WaitDone(genesisMsg.BlockInterval)
+}
+
+func TestCoin_CoinFlow(t *testing.T) {
+	ct := newCT()
+	coAddr1 := omniledger.NewInstanceID(nil)
+	coAddr2 := omniledger.InstanceID{DarcID: make([]byte, 32), SubID: omniledger.NewSubID(coinOne)}
+	ct.Store(coAddr1, coinTwo, ContractCoinID)
+
+	// Coins that are not stored again go nowhere.
+	flow, err := CoinFlow(ct, omniledger.StateChanges{
+		omniledger.NewStateChange(omniledger.Update, coAddr1, ContractCoinID, make([]byte, 8)),
+		omniledger.NewStateChange(omniledger.Create, coAddr2, ContractCoinID, coinOne),
+	})
+	require.Nil(t, err)
+	require.Equal(t, []CoinTransfer{
+		{From: coAddr1, To: coAddr2, Name: CoinName, Amount: 1},
+		{From: coAddr1, Name: CoinName, Amount: 1},
+	}, flow)
+
+	flow, err = CoinFlow(ct, omniledger.StateChanges{
+		omniledger.NewStateChange(omniledger.Create, coAddr2, ContractCoinID, coinOne),
+	})
+	require.Nil(t, err)
+	// Minted coins come from nowhere.
+	require.Equal(t, []CoinTransfer{{To: coAddr2, Name: CoinName, Amount: 1}}, flow)
+
+	// The transfers are reported with the type of the coins, and coins
+	// of different types are never matched.
+	gold := iid("gold")
+	goldOne, err := encodeCoin(1, coinAllowances{Name: gold.Slice()})
+	require.Nil(t, err)
+	goldZero, err := encodeCoin(0, coinAllowances{Name: gold.Slice()})
+	require.Nil(t, err)
+	goldAddr := iid("goldAddr")
+	ct.Store(goldAddr, goldOne, ContractCoinID)
+	flow, err = CoinFlow(ct, omniledger.StateChanges{
+		omniledger.NewStateChange(omniledger.Update, goldAddr, ContractCoinID, goldZero),
+		omniledger.NewStateChange(omniledger.Create, coAddr2, ContractCoinID, coinOne),
+	})
+	require.Nil(t, err)
+	require.Equal(t, []CoinTransfer{
+		{From: goldAddr, Name: gold, Amount: 1},
+		{To: coAddr2, Name: CoinName, Amount: 1},
+	}, flow)
+}
+
+func TestCoin_SimulateCoinFlow(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	servers, roster, _ := local.GenTree(2, true)
+	cl := omniledger.NewClient()
+
+	genesisMsg, err := omniledger.DefaultGenesisMsg(omniledger.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:transfer", "invoke:fetch", "invoke:store"},
+		signer.Identity())
+	require.Nil(t, err)
+	gDarc := &genesisMsg.GenesisDarc
+	genesisMsg.BlockInterval = time.Second
+	resp, err := cl.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scID := resp.Skipblock.SkipChainID()
+	s := servers[0].Service("contracts").(*Service)
+	ol := servers[0].Service(omniledger.ServiceName).(*omniledger.Service)
+
+	// sign sets the nonce, the index and the length of the instructions
+	// and signs them.
+	sign := func(instrs []omniledger.Instruction) omniledger.ClientTransaction {
+		ctx := omniledger.ClientTransaction{
+			Instructions: append([]omniledger.Instruction{}, instrs...),
+		}
+		for i := range ctx.Instructions {
+			ctx.Instructions[i].Nonce = omniledger.GenNonce()
+			ctx.Instructions[i].Index = i
+			ctx.Instructions[i].Length = len(instrs)
+			require.Nil(t, ctx.Instructions[i].SignBy(signer))
+		}
+		return ctx
+	}
+	// send signs the instructions and waits for them to be included.
+	send := func(instrs ...omniledger.Instruction) omniledger.ClientTransaction {
+		ctx := sign(instrs)
+		_, err := cl.AddTransactionAndWait(ctx, 10)
+		require.Nil(t, err)
+		return ctx
+	}
+	spawn := func() omniledger.InstanceID {
+		ctx := send(omniledger.Instruction{
+			InstanceID: omniledger.InstanceID{DarcID: gDarc.GetBaseID()},
+			Spawn:      &omniledger.Spawn{ContractID: ContractCoinID},
+		})
+		return omniledger.InstanceID{
+			DarcID: gDarc.GetBaseID(),
+			SubID:  omniledger.NewSubID(ctx.Instructions[0].Hash()),
+		}
+	}
+	balance := func(id omniledger.InstanceID) uint64 {
+		value, _, err := ol.GetCollectionView(scID).GetValues(id.Slice())
+		require.Nil(t, err)
+		return uint64(newSafeUint64(value))
+	}
+
+	coin1 := spawn()
+	coin2 := spawn()
+	send(omniledger.Instruction{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "mint",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinTwo}},
+		},
+	})
+
+	// Transfer one coin and fetch another one that is stored in coin2.
+	instrs := []omniledger.Instruction{{
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "transfer",
+			Args: omniledger.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "destination", Value: coin2.Slice()},
+			},
+		},
+	}, {
+		InstanceID: coin1,
+		Invoke: &omniledger.Invoke{
+			Command: "fetch",
+			Args:    omniledger.Arguments{{Name: "coins", Value: coinOne}},
+		},
+	}, {
+		InstanceID: coin2,
+		Invoke:     &omniledger.Invoke{Command: "store"},
+	}}
+	flow, err := s.SimulateCoinFlow(scID, sign(instrs))
+	require.Nil(t, err)
+	require.Equal(t, []CoinTransfer{{From: coin1, To: coin2, Name: CoinName, Amount: 2}}, flow)
+
+	// The simulation didn't change anything, the committed transaction
+	// has the same effect.
+	require.Equal(t, uint64(2), balance(coin1))
+	require.Equal(t, uint64(0), balance(coin2))
+	send(instrs...)
+	require.Equal(t, uint64(0), balance(coin1))
+	require.Equal(t, uint64(2), balance(coin2))
+
+	local.WaitDone(genesisMsg.BlockInterval)
+}
+
+func TestCoin_ConditionalPayment(t *testing.T) {
+	ct := newCT()
+	invoice := omniledger.NewInstanceID([]byte("invoice"))
+	payer := omniledger.NewInstanceID([]byte("payer"))
+	payee := omniledger.NewInstanceID([]byte("payee"))
+	ct.Store(invoice, []byte("paid=false"), ContractValueID)
+	ct.Store(payer, coinTwo, ContractCoinID)
+	ct.Store(payee, coinZero, ContractCoinID)
+
+	pay := ConditionalPayment(invoice, payer, payee, 1, []byte("paid=false"), []byte("paid=true"))
+	require.Nil(t, ct.applyTx(pay))
+	require.Equal(t, []byte("paid=true"), ct.values[string(invoice.Slice())])
+	require.Equal(t, coinOne, ct.values[string(payer.Slice())])
+	require.Equal(t, coinOne, ct.values[string(payee.Slice())])
+
+	// The invoice is paid already, so the payment is blocked.
+	require.Equal(t, omniledger.ErrPreconditionFailed, ct.applyTx(pay))
+	require.Equal(t, []byte("paid=true"), ct.values[string(invoice.Slice())])
+	require.Equal(t, coinOne, ct.values[string(payer.Slice())])
+	require.Equal(t, coinOne, ct.values[string(payee.Slice())])
+
+	// If the payment fails, the invoice is not marked as paid.
+	ct.Store(invoice, []byte("paid=false"), ContractValueID)
+	pay = ConditionalPayment(invoice, payer, payee, 2, []byte("paid=false"), []byte("paid=true"))
+	require.NotNil(t, ct.applyTx(pay))
+	require.Equal(t, []byte("paid=false"), ct.values[string(invoice.Slice())])
+	require.Equal(t, coinOne, ct.values[string(payer.Slice())])
+}
+
 type cvTest struct {
 	values      map[string][]byte
 	contractIDs map[string]string
@@ -195,3 +705,29 @@ func (ct cvTest) GetValue(key []byte) ([]byte, error) {
 func (ct cvTest) GetContractID(key []byte) (string, error) {
 	return ct.contractIDs[string(key)], nil
 }
+
+// applyTx executes the instructions of a transaction on the value and coin
+// contracts like the service does: the state changes are only applied if all
+// the instructions succeed.
+func (ct *cvTest) applyTx(instrs []omniledger.Instruction) error {
+	tmp := newCT()
+	for k, v := range ct.values {
+		tmp.values[k] = v
+		tmp.contractIDs[k] = ct.contractIDs[k]
+	}
+	var coins []omniledger.Coin
+	for _, instr := range instrs {
+		contract := ContractCoin
+		if tmp.contractIDs[string(instr.InstanceID.Slice())] == ContractValueID {
+			contract = ContractValue
+		}
+		scs, cout, err := contract(tmp, instr, coins)
+		if err != nil {
+			return err
+		}
+		tmp.apply(scs)
+		coins = cout
+	}
+	*ct = *tmp
+	return nil
+}
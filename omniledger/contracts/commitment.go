@@ -0,0 +1,107 @@
+package contracts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/dedis/protobuf"
+)
+
+// ContractCommitmentID denotes a contract that holds the commitment to some
+// external data.
+var ContractCommitmentID = "commitment"
+
+// Commitment is the value of a commitment instance.
+type Commitment struct {
+	// Hash is the sha256 of the committed data.
+	Hash []byte
+	// Metadata is optional information about the data, given by the client.
+	Metadata []byte
+}
+
+// DecodeCommitment returns the commitment stored in the value of a commitment
+// instance.
+func DecodeCommitment(value []byte) (*Commitment, error) {
+	c := &Commitment{}
+	if err := protobuf.Decode(value, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Matches returns true if data is the committed data.
+func (c Commitment) Matches(data []byte) bool {
+	h := sha256.Sum256(data)
+	return bytes.Equal(c.Hash, h[:])
+}
+
+// ContractCommitment stores the commitment to some external data, for example
+// a document. Commitments cannot be changed or deleted. The following
+// instructions are available:
+//  - spawn creates a new commitment with the "hash" argument, which must be
+//    the sha256 of the data, and the optional "metadata" argument
+func ContractCommitment(cdb omniledger.CollectionView, inst omniledger.Instruction, c []omniledger.Coin) (sc []omniledger.StateChange, cOut []omniledger.Coin, err error) {
+	cOut = c
+	switch inst.GetType() {
+	case omniledger.SpawnType:
+		hash := inst.Spawn.Args.Search("hash")
+		if len(hash) != sha256.Size {
+			err = errors.New("argument \"hash\" must be a sha256 hash")
+			return
+		}
+		var buf []byte
+		buf, err = protobuf.Encode(&Commitment{
+			Hash:     hash,
+			Metadata: inst.Spawn.Args.Search("metadata"),
+		})
+		if err != nil {
+			return
+		}
+		sc = []omniledger.StateChange{
+			omniledger.NewStateChange(omniledger.Create, inst.DeriveID(ContractCommitmentID),
+				ContractCommitmentID, buf),
+		}
+		return
+	case omniledger.InvokeType:
+		err = errors.New("a commitment cannot be changed")
+		return
+	case omniledger.DeleteType:
+		err = errors.New("a commitment cannot be deleted")
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// VerifyCommitment returns true if data is the data committed in the
+// commitment instance iID. The proof of the instance is verified against the
+// skipchain of the client.
+func VerifyCommitment(cl *omniledger.Client, iID omniledger.InstanceID, data []byte) (bool, error) {
+	p, err := cl.GetProof(iID.Slice())
+	if err != nil {
+		return false, err
+	}
+	if err = p.Proof.Verify(cl.ID); err != nil {
+		return false, err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return false, errors.New("cannot find the commitment")
+	}
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return false, err
+	}
+	if len(vs) < 2 {
+		return false, errors.New("not enough records")
+	}
+	if string(vs[1]) != ContractCommitmentID {
+		return false, errors.New("expected contract to be commitment but got: " + string(vs[1]))
+	}
+	c, err := DecodeCommitment(vs[0])
+	if err != nil {
+		return false, err
+	}
+	return c.Matches(data), nil
+}
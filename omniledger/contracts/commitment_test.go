@@ -0,0 +1,55 @@
+package contracts
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitment_Spawn(t *testing.T) {
+	ct := newCT()
+	document := []byte("the original document")
+	hash := sha256.Sum256(document)
+	inst := omniledger.Instruction{
+		InstanceID: omniledger.NewInstanceID(nil),
+		Spawn: &omniledger.Spawn{
+			ContractID: ContractCommitmentID,
+			Args: omniledger.Arguments{
+				{Name: "hash", Value: hash[:]},
+				{Name: "metadata", Value: []byte("contract.pdf")},
+			},
+		},
+	}
+	sc, _, err := ContractCommitment(ct, inst, []omniledger.Coin{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, omniledger.Create, sc[0].StateAction)
+	iID := inst.DeriveID(ContractCommitmentID)
+	require.Equal(t, iID.Slice(), sc[0].InstanceID)
+	ct.Store(iID, sc[0].Value, ContractCommitmentID)
+
+	c, err := DecodeCommitment(sc[0].Value)
+	require.Nil(t, err)
+	require.Equal(t, []byte("contract.pdf"), c.Metadata)
+	require.True(t, c.Matches(document))
+	require.False(t, c.Matches([]byte("another document")))
+
+	// The hash must be a sha256.
+	inst.Spawn.Args[0].Value = []byte("not a hash")
+	_, _, err = ContractCommitment(ct, inst, []omniledger.Coin{})
+	require.NotNil(t, err)
+
+	// Commitments are immutable.
+	_, _, err = ContractCommitment(ct, omniledger.Instruction{
+		InstanceID: iID,
+		Invoke:     &omniledger.Invoke{Command: "update"},
+	}, []omniledger.Coin{})
+	require.NotNil(t, err)
+	_, _, err = ContractCommitment(ct, omniledger.Instruction{
+		InstanceID: iID,
+		Delete:     &omniledger.Delete{},
+	}, []omniledger.Coin{})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,245 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/dedis/protobuf"
+)
+
+// ContractEscrowID denotes a contract that sells instances for coins.
+var ContractEscrowID = "escrow"
+
+// EscrowListing is the value of an escrow instance. An empty Instance means
+// that nothing is for sale.
+type EscrowListing struct {
+	// Instance is the ID of the instance for sale.
+	Instance []byte
+	// Price is the number of coins of CoinName the buyer has to pay.
+	Price uint64
+	// Payment is the coin instance receiving the price.
+	Payment []byte
+	// Value and ContractID are the ones of the instance for sale, which
+	// is held by the escrow until it is bought or the sale is cancelled.
+	Value      []byte `protobuf:"opt"`
+	ContractID string `protobuf:"opt"`
+}
+
+// ContractEscrow sells one instance at a time against coins. The escrow and
+// the instances it sells are governed by the darc of the seller. When an
+// instance is bought, it is moved to the darc of the buyer: it keeps its
+// SubID, value and contract, but its DarcID is replaced. The following
+// instructions are available:
+//  - spawn creates an escrow without any instance for sale
+//  - list_for_sale puts the instance given in the argument "instance" up
+//    for sale, for "coins" coins that will be sent to the coin instance
+//    given in the argument "payment". The instance must be governed by the
+//    darc of the escrow, and must not be a darc or a config. It is removed
+//    from the collection and held by the escrow, so that the seller cannot
+//    change it anymore.
+//  - buy takes the price from the coins passed on by the previous
+//    instructions, e.g. a fetch on a coin instance of the buyer, sends it
+//    to the payment instance and moves the instance to the darc given in
+//    the argument "darc". The arguments "instance" and "coins" must be the
+//    instance and the price the buyer expects, so that a seller relisting
+//    the escrow cannot make the buyer pay more or get another instance.
+//    Remaining coins are passed on. As all the instructions of a
+//    transaction are applied together or not at all, the buyer cannot lose
+//    the coins without getting the instance.
+//  - cancel takes the instance off the sale and gives it back to the seller
+// An escrow can only be deleted if nothing is for sale.
+//
+// The escrow instance is governed by the darc of the seller, so the buyers
+// must be able to satisfy its "invoke:buy" rule, e.g. with a rule allowing
+// everyone to buy. The other rules of the darc are kept for the seller.
+func ContractEscrow(cdb omniledger.CollectionView, inst omniledger.Instruction, c []omniledger.Coin) (sc []omniledger.StateChange, cOut []omniledger.Coin, err error) {
+	cOut = c
+	switch inst.GetType() {
+	case omniledger.SpawnType:
+		sc = []omniledger.StateChange{
+			omniledger.NewStateChange(omniledger.Create, inst.DeriveID(ContractEscrowID),
+				ContractEscrowID, []byte{}),
+		}
+		return
+	case omniledger.InvokeType:
+		var listing *EscrowListing
+		listing, err = loadListing(cdb, inst.InstanceID)
+		if err != nil {
+			return
+		}
+		switch inst.Invoke.Command {
+		case "list_for_sale":
+			if listing.Instance != nil {
+				err = errors.New("an instance is already for sale")
+				return
+			}
+			listing, err = newListing(cdb, inst)
+			if err != nil {
+				return
+			}
+			sc = omniledger.StateChanges{
+				omniledger.NewStateChange(omniledger.Remove,
+					omniledger.NewInstanceID(listing.Instance), listing.ContractID, nil),
+			}
+		case "buy":
+			if listing.Instance == nil {
+				err = errors.New("nothing is for sale")
+				return
+			}
+			if err = checkExpected(inst, listing); err != nil {
+				return
+			}
+			purse := omniledger.NewCoinPurse(c)
+			if err = purse.Spend(CoinName, listing.Price); err != nil {
+				return
+			}
+			var scPayment omniledger.StateChange
+			scPayment, err = transferCoins(cdb, listing.Payment, listing.Price)
+			if err != nil {
+				return
+			}
+			var scMove omniledger.StateChange
+			scMove, err = moveInstance(cdb, listing, darc.ID(inst.Invoke.Args.Search("darc")))
+			if err != nil {
+				return
+			}
+			sc = omniledger.StateChanges{scPayment, scMove}
+			cOut = purse.Coins()
+			listing = &EscrowListing{}
+		case "cancel":
+			if listing.Instance == nil {
+				err = errors.New("nothing is for sale")
+				return
+			}
+			iID := omniledger.NewInstanceID(listing.Instance)
+			if _, cid, err := cdb.GetValues(listing.Instance); err == nil && cid != "" {
+				return nil, nil, errors.New("the instance for sale exists again")
+			}
+			sc = omniledger.StateChanges{
+				omniledger.NewStateChange(omniledger.Create, iID, listing.ContractID, listing.Value),
+			}
+			listing = &EscrowListing{}
+		default:
+			err = errors.New("escrow contract can only list_for_sale, buy and cancel")
+			return
+		}
+		var buf []byte
+		buf, err = protobuf.Encode(listing)
+		if err != nil {
+			return
+		}
+		sc = append(sc, omniledger.NewStateChange(omniledger.Update, inst.InstanceID,
+			ContractEscrowID, buf))
+		return
+	case omniledger.DeleteType:
+		var listing *EscrowListing
+		listing, err = loadListing(cdb, inst.InstanceID)
+		if err != nil {
+			return
+		}
+		if listing.Instance != nil {
+			err = errors.New("cannot delete an escrow while an instance is for sale")
+			return
+		}
+		sc = omniledger.StateChanges{
+			omniledger.NewStateChange(omniledger.Remove, inst.InstanceID, ContractEscrowID, nil),
+		}
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// loadListing returns the listing stored in the escrow instance iID.
+func loadListing(cdb omniledger.CollectionView, iID omniledger.InstanceID) (*EscrowListing, error) {
+	value, cid, err := cdb.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if cid != ContractEscrowID {
+		return nil, errors.New("instance is not an escrow")
+	}
+	listing := &EscrowListing{}
+	if err = protobuf.Decode(value, listing); err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// newListing returns the listing given in the arguments of the list_for_sale
+// instruction inst.
+func newListing(cdb omniledger.CollectionView, inst omniledger.Instruction) (*EscrowListing, error) {
+	instance := inst.Invoke.Args.Search("instance")
+	if len(instance) != 64 {
+		return nil, errors.New("argument \"instance\" must be an instance ID")
+	}
+	iID := omniledger.NewInstanceID(instance)
+	if !iID.DarcID.Equal(inst.InstanceID.DarcID) {
+		return nil, errors.New("instance is not governed by the darc of the escrow")
+	}
+	value, cid, err := cdb.GetValues(instance)
+	if err != nil {
+		return nil, err
+	}
+	switch cid {
+	case "":
+		return nil, errors.New("instance does not exist")
+	case omniledger.ContractDarcID, omniledger.ContractConfigID, ContractEscrowID:
+		return nil, errors.New("cannot sell an instance of contract " + cid)
+	}
+	coinsBuf := inst.Invoke.Args.Search("coins")
+	if len(coinsBuf) != 8 {
+		return nil, errors.New("argument \"coins\" must be a 64-bit uint")
+	}
+	payment := inst.Invoke.Args.Search("payment")
+	if _, cid, err = cdb.GetValues(payment); err != nil {
+		return nil, err
+	}
+	if cid != ContractCoinID {
+		return nil, errors.New("payment is not a coin instance")
+	}
+	return &EscrowListing{
+		Instance:   instance,
+		Price:      binary.LittleEndian.Uint64(coinsBuf),
+		Payment:    payment,
+		Value:      value,
+		ContractID: cid,
+	}, nil
+}
+
+// checkExpected returns an error if the instance and the price the buy
+// instruction inst expects are not the ones of the listing.
+func checkExpected(inst omniledger.Instruction, listing *EscrowListing) error {
+	if !bytes.Equal(inst.Invoke.Args.Search("instance"), listing.Instance) {
+		return errors.New("another instance is for sale")
+	}
+	coinsBuf := inst.Invoke.Args.Search("coins")
+	if len(coinsBuf) != 8 {
+		return errors.New("argument \"coins\" must be a 64-bit uint")
+	}
+	if binary.LittleEndian.Uint64(coinsBuf) != listing.Price {
+		return errors.New("the price of the instance is different")
+	}
+	return nil
+}
+
+// moveInstance returns the state change that gives the instance held by the
+// escrow to the darc buyer, keeping its SubID.
+func moveInstance(cdb omniledger.CollectionView, listing *EscrowListing, buyer darc.ID) (omniledger.StateChange, error) {
+	_, cid, err := cdb.GetValues(omniledger.InstanceID{DarcID: buyer}.Slice())
+	if err != nil {
+		return omniledger.StateChange{}, err
+	}
+	if cid != omniledger.ContractDarcID {
+		return omniledger.StateChange{}, errors.New("argument \"darc\" must be the base ID of a darc")
+	}
+	oldID := omniledger.NewInstanceID(listing.Instance)
+	newID := omniledger.InstanceID{DarcID: buyer, SubID: oldID.SubID}
+	if _, newCid, err := cdb.GetValues(newID.Slice()); err == nil && newCid != "" {
+		return omniledger.StateChange{}, errors.New("the darc of the buyer already has this instance")
+	}
+	return omniledger.NewStateChange(omniledger.Create, newID, listing.ContractID, listing.Value), nil
+}
@@ -0,0 +1,183 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscrow_ListBuy(t *testing.T) {
+	ct, e := newEscrowTest(t)
+
+	// The escrow holds the instance, the seller cannot change it.
+	require.Equal(t, "", ct.contractIDs[string(e.item.Slice())])
+
+	// The buyer doesn't pass on enough coins.
+	_, _, err := ContractEscrow(ct, e.buy(), []omniledger.Coin{{Name: CoinName, Value: 9}})
+	require.Error(t, err)
+
+	// The buyer expects another price or instance.
+	cheaper := e.buy()
+	cheaper.Invoke.Args[2].Value = uint64Buf(5)
+	_, _, err = ContractEscrow(ct, cheaper, []omniledger.Coin{{Name: CoinName, Value: 10}})
+	require.Error(t, err)
+	other := e.buy()
+	other.Invoke.Args[1].Value = e.sellerCoin.Slice()
+	_, _, err = ContractEscrow(ct, other, []omniledger.Coin{{Name: CoinName, Value: 10}})
+	require.Error(t, err)
+
+	// The buyer fetches the coins from its account and buys the instance
+	// in the same transaction.
+	fetch := omniledger.Instruction{
+		InstanceID: e.buyerCoin,
+		Invoke: &omniledger.Invoke{
+			Command: "fetch",
+			Args:    omniledger.Arguments{{Name: "coins", Value: uint64Buf(10)}},
+		},
+	}
+	sc, cOut, err := ContractCoin(ct, fetch, nil)
+	require.Nil(t, err)
+	ct.apply(sc)
+	sc, cOut, err = ContractEscrow(ct, e.buy(), cOut)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), omniledger.NewCoinPurse(cOut).Available(CoinName))
+	ct.apply(sc)
+
+	require.Equal(t, uint64Buf(10), ct.values[string(e.sellerCoin.Slice())])
+	require.Equal(t, uint64Buf(5), ct.values[string(e.buyerCoin.Slice())])
+	require.Equal(t, "", ct.contractIDs[string(e.item.Slice())])
+	bought := omniledger.InstanceID{DarcID: e.buyerDarc, SubID: e.item.SubID}
+	require.Equal(t, []byte("item"), ct.values[string(bought.Slice())])
+	require.Equal(t, ContractValueID, ct.contractIDs[string(bought.Slice())])
+	listing, err := loadListing(ct, e.escrow)
+	require.Nil(t, err)
+	require.Nil(t, listing.Instance)
+
+	// It cannot be bought a second time.
+	_, _, err = ContractEscrow(ct, e.buy(), []omniledger.Coin{{Name: CoinName, Value: 10}})
+	require.Error(t, err)
+}
+
+func TestEscrow_Cancel(t *testing.T) {
+	ct, e := newEscrowTest(t)
+
+	cancel := omniledger.Instruction{
+		InstanceID: e.escrow,
+		Invoke:     &omniledger.Invoke{Command: "cancel"},
+	}
+	sc, _, err := ContractEscrow(ct, cancel, nil)
+	require.Nil(t, err)
+	ct.apply(sc)
+	listing, err := loadListing(ct, e.escrow)
+	require.Nil(t, err)
+	require.Nil(t, listing.Instance)
+
+	// The instance is back with the seller and cannot be bought anymore.
+	_, _, err = ContractEscrow(ct, e.buy(), []omniledger.Coin{{Name: CoinName, Value: 10}})
+	require.Error(t, err)
+	require.Equal(t, []byte("item"), ct.values[string(e.item.Slice())])
+	require.Equal(t, uint64Buf(0), ct.values[string(e.sellerCoin.Slice())])
+	_, _, err = ContractEscrow(ct, cancel, nil)
+	require.Error(t, err)
+
+	// Only an instance of the darc of the escrow can be listed.
+	other := omniledger.InstanceID{DarcID: e.buyerDarc, SubID: omniledger.NewSubID(make([]byte, 32))}
+	ct.Store(other, []byte("other"), ContractValueID)
+	_, _, err = ContractEscrow(ct, e.list(other), nil)
+	require.Error(t, err)
+	sc, _, err = ContractEscrow(ct, e.list(e.item), nil)
+	require.Nil(t, err)
+	ct.apply(sc)
+	listing, err = loadListing(ct, e.escrow)
+	require.Nil(t, err)
+	require.Equal(t, e.item.Slice(), listing.Instance)
+}
+
+type escrowTest struct {
+	escrow     omniledger.InstanceID
+	item       omniledger.InstanceID
+	sellerCoin omniledger.InstanceID
+	buyerCoin  omniledger.InstanceID
+	buyerDarc  darc.ID
+}
+
+// newEscrowTest returns a collection where the seller has listed an instance
+// for 10 coins, and the buyer has 15 coins.
+func newEscrowTest(t *testing.T) (*cvTest, *escrowTest) {
+	ct := newCT()
+	sellerDarc := darc.ID(make([]byte, 32))
+	sellerDarc[0] = 1
+	e := &escrowTest{buyerDarc: darc.ID(make([]byte, 32))}
+	e.buyerDarc[0] = 2
+	ct.Store(omniledger.InstanceID{DarcID: e.buyerDarc}, []byte("buyer darc"), omniledger.ContractDarcID)
+	e.item = omniledger.InstanceID{DarcID: sellerDarc, SubID: iid("item").SubID}
+	ct.Store(e.item, []byte("item"), ContractValueID)
+	e.sellerCoin = omniledger.InstanceID{DarcID: sellerDarc, SubID: iid("seller").SubID}
+	ct.Store(e.sellerCoin, uint64Buf(0), ContractCoinID)
+	e.buyerCoin = omniledger.InstanceID{DarcID: e.buyerDarc, SubID: iid("buyer").SubID}
+	ct.Store(e.buyerCoin, uint64Buf(15), ContractCoinID)
+
+	spawn := omniledger.Instruction{
+		InstanceID: omniledger.InstanceID{DarcID: sellerDarc},
+		Spawn:      &omniledger.Spawn{ContractID: ContractEscrowID},
+	}
+	sc, _, err := ContractEscrow(ct, spawn, nil)
+	require.Nil(t, err)
+	ct.apply(sc)
+	e.escrow = omniledger.NewInstanceID(sc[0].InstanceID)
+	sc, _, err = ContractEscrow(ct, e.list(e.item), nil)
+	require.Nil(t, err)
+	ct.apply(sc)
+	return ct, e
+}
+
+func (e *escrowTest) list(item omniledger.InstanceID) omniledger.Instruction {
+	return omniledger.Instruction{
+		InstanceID: e.escrow,
+		Invoke: &omniledger.Invoke{
+			Command: "list_for_sale",
+			Args: omniledger.Arguments{
+				{Name: "instance", Value: item.Slice()},
+				{Name: "coins", Value: uint64Buf(10)},
+				{Name: "payment", Value: e.sellerCoin.Slice()},
+			},
+		},
+	}
+}
+
+func (e *escrowTest) buy() omniledger.Instruction {
+	return omniledger.Instruction{
+		InstanceID: e.escrow,
+		Invoke: &omniledger.Invoke{
+			Command: "buy",
+			Args: omniledger.Arguments{
+				{Name: "darc", Value: e.buyerDarc},
+				{Name: "instance", Value: e.item.Slice()},
+				{Name: "coins", Value: uint64Buf(10)},
+			},
+		},
+	}
+}
+
+func uint64Buf(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
+
+// apply stores the state changes in the collection.
+func (ct *cvTest) apply(scs []omniledger.StateChange) {
+	for _, sc := range scs {
+		k := string(sc.InstanceID)
+		if sc.StateAction == omniledger.Remove {
+			delete(ct.values, k)
+			delete(ct.contractIDs, k)
+			continue
+		}
+		ct.values[k] = sc.Value
+		ct.contractIDs[k] = string(sc.ContractID)
+	}
+}
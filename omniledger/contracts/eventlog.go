@@ -0,0 +1,199 @@
+package contracts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/dedis/protobuf"
+)
+
+// ContractEventLogID denotes a contract that holds an append-only log of
+// events.
+var ContractEventLogID = "eventlog"
+
+// EventLog is the value of an event log instance. The entries are in the
+// order they have been appended.
+type EventLog struct {
+	Entries []EventLogEntry
+}
+
+// EventLogEntry is one event of the log. Every entry is chained to the
+// previous one by including its hash.
+type EventLogEntry struct {
+	// Timestamp is a unix timestamp in nanoseconds given by the client.
+	Timestamp int64
+	// Data is the content of the event.
+	Data []byte
+	// PrevHash is the hash of the previous entry, or empty for the first
+	// entry.
+	PrevHash []byte
+	// Hash is the sha256 of PrevHash, Timestamp and Data.
+	Hash []byte
+}
+
+// hash computes the hash of the entry.
+func (e EventLogEntry) hash() []byte {
+	h := sha256.New()
+	h.Write(e.PrevHash)
+	binary.Write(h, binary.LittleEndian, e.Timestamp)
+	h.Write(e.Data)
+	return h.Sum(nil)
+}
+
+// DecodeEventLog returns the event log stored in the value of an event log
+// instance.
+func DecodeEventLog(value []byte) (*EventLog, error) {
+	el := &EventLog{}
+	if len(value) == 0 {
+		return el, nil
+	}
+	if err := protobuf.Decode(value, el); err != nil {
+		return nil, err
+	}
+	return el, nil
+}
+
+// Verify checks that every entry of the log is correctly hashed and chained
+// to the previous one, and that the timestamps don't decrease.
+func (el EventLog) Verify() error {
+	var prev *EventLogEntry
+	for i, e := range el.Entries {
+		if prev == nil {
+			if len(e.PrevHash) != 0 {
+				return errors.New("first entry must not have a previous hash")
+			}
+		} else {
+			if !bytes.Equal(e.PrevHash, prev.Hash) {
+				return fmt.Errorf("entry %d is not chained to the previous entry", i)
+			}
+			if e.Timestamp < prev.Timestamp {
+				return fmt.Errorf("entry %d is older than the previous entry", i)
+			}
+		}
+		if !bytes.Equal(e.Hash, e.hash()) {
+			return fmt.Errorf("entry %d has a wrong hash", i)
+		}
+		prev = &el.Entries[i]
+	}
+	return nil
+}
+
+// ContractEventLog is an append-only log of events. Once an entry is in the
+// log, it cannot be changed or removed, and neither can the log itself.
+// The following instructions are available:
+//  - spawn creates a new, empty log
+//  - invoke "append" adds the "event" argument to the log. The "timestamp"
+//    argument holds the time of the event as a 64-bit int in LittleEndian,
+//    in nanoseconds, and must not be older than the last entry of the log.
+//    As the nodes don't agree on a time, the timestamp is given by the
+//    client.
+func ContractEventLog(cdb omniledger.CollectionView, inst omniledger.Instruction, c []omniledger.Coin) (sc []omniledger.StateChange, cOut []omniledger.Coin, err error) {
+	cOut = c
+	switch inst.GetType() {
+	case omniledger.SpawnType:
+		var buf []byte
+		buf, err = protobuf.Encode(&EventLog{})
+		if err != nil {
+			return
+		}
+		sc = []omniledger.StateChange{
+			omniledger.NewStateChange(omniledger.Create, inst.DeriveID(ContractEventLogID),
+				ContractEventLogID, buf),
+		}
+		return
+	case omniledger.InvokeType:
+		if inst.Invoke.Command != "append" {
+			err = errors.New("event log can only append")
+			return
+		}
+		event := inst.Invoke.Args.Search("event")
+		if event == nil {
+			err = errors.New("argument \"event\" is missing")
+			return
+		}
+		tsBuf := inst.Invoke.Args.Search("timestamp")
+		if len(tsBuf) != 8 {
+			err = errors.New("argument \"timestamp\" must be 8 bytes")
+			return
+		}
+
+		var value []byte
+		value, _, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return
+		}
+		var el *EventLog
+		el, err = DecodeEventLog(value)
+		if err != nil {
+			return
+		}
+		entry := EventLogEntry{
+			Timestamp: int64(binary.LittleEndian.Uint64(tsBuf)),
+			Data:      event,
+		}
+		if n := len(el.Entries); n > 0 {
+			last := el.Entries[n-1]
+			if entry.Timestamp < last.Timestamp {
+				err = errors.New("event is older than the last event of the log")
+				return
+			}
+			entry.PrevHash = last.Hash
+		}
+		entry.Hash = entry.hash()
+		el.Entries = append(el.Entries, entry)
+
+		var buf []byte
+		buf, err = protobuf.Encode(el)
+		if err != nil {
+			return
+		}
+		sc = []omniledger.StateChange{
+			omniledger.NewStateChange(omniledger.Update, inst.InstanceID,
+				ContractEventLogID, buf),
+		}
+		return
+	case omniledger.DeleteType:
+		err = errors.New("an event log cannot be deleted")
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// GetEventLog returns all the entries of the event log at id, in the order
+// they have been appended. The proof of the instance is verified against the
+// skipchain of the client, and the hash chain of the entries is verified.
+func GetEventLog(cl *omniledger.Client, id omniledger.InstanceID) ([]EventLogEntry, error) {
+	p, err := cl.GetProof(id.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if err = p.Proof.Verify(cl.ID); err != nil {
+		return nil, err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return nil, errors.New("cannot find the event log")
+	}
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) < 2 {
+		return nil, errors.New("not enough records")
+	}
+	if string(vs[1]) != ContractEventLogID {
+		return nil, errors.New("expected contract to be eventlog but got: " + string(vs[1]))
+	}
+	el, err := DecodeEventLog(vs[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = el.Verify(); err != nil {
+		return nil, err
+	}
+	return el.Entries, nil
+}
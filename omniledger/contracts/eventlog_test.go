@@ -0,0 +1,90 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"testing"
+
+	omniledger "github.com/dedis/cothority/omniledger/service"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog_Spawn(t *testing.T) {
+	ct := newCT()
+	inst := omniledger.Instruction{
+		InstanceID: omniledger.NewInstanceID(nil),
+		Spawn: &omniledger.Spawn{
+			ContractID: ContractEventLogID,
+		},
+	}
+	sc, _, err := ContractEventLog(ct, inst, []omniledger.Coin{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, omniledger.Create, sc[0].StateAction)
+	require.Equal(t, inst.DeriveID(ContractEventLogID).Slice(), sc[0].InstanceID)
+	el, err := DecodeEventLog(sc[0].Value)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(el.Entries))
+}
+
+func TestEventLog_Append(t *testing.T) {
+	ct := newCT()
+	logID := omniledger.NewInstanceID(nil)
+	ct.Store(logID, nil, ContractEventLogID)
+
+	appendInst := func(event string, ts int64) omniledger.Instruction {
+		tsBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(tsBuf, uint64(ts))
+		return omniledger.Instruction{
+			InstanceID: logID,
+			Invoke: &omniledger.Invoke{
+				Command: "append",
+				Args: omniledger.Arguments{
+					{Name: "event", Value: []byte(event)},
+					{Name: "timestamp", Value: tsBuf},
+				},
+			},
+		}
+	}
+
+	events := []string{"first", "second", "third"}
+	for i, e := range events {
+		sc, _, err := ContractEventLog(ct, appendInst(e, int64(i)), []omniledger.Coin{})
+		require.Nil(t, err)
+		require.Equal(t, 1, len(sc))
+		require.Equal(t, omniledger.Update, sc[0].StateAction)
+		ct.Store(logID, sc[0].Value, ContractEventLogID)
+	}
+
+	el, err := DecodeEventLog(ct.values[string(logID.Slice())])
+	require.Nil(t, err)
+	require.Nil(t, el.Verify())
+	require.Equal(t, len(events), len(el.Entries))
+	for i, e := range events {
+		require.Equal(t, []byte(e), el.Entries[i].Data)
+		require.Equal(t, int64(i), el.Entries[i].Timestamp)
+		if i > 0 {
+			require.Equal(t, el.Entries[i-1].Hash, el.Entries[i].PrevHash)
+		}
+	}
+
+	// Events older than the last one are refused.
+	_, _, err = ContractEventLog(ct, appendInst("old", 0), []omniledger.Coin{})
+	require.NotNil(t, err)
+
+	// Changing any entry breaks the hash chain.
+	el.Entries[1].Data = []byte("changed")
+	require.NotNil(t, el.Verify())
+	el.Entries[1].Hash = el.Entries[1].hash()
+	require.NotNil(t, el.Verify())
+
+	// Neither updates nor deletes are allowed.
+	inst := appendInst("update", 3)
+	inst.Invoke.Command = "update"
+	_, _, err = ContractEventLog(ct, inst, []omniledger.Coin{})
+	require.NotNil(t, err)
+	_, _, err = ContractEventLog(ct, omniledger.Instruction{
+		InstanceID: logID,
+		Delete:     &omniledger.Delete{},
+	}, []omniledger.Coin{})
+	require.NotNil(t, err)
+}
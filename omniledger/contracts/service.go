@@ -28,5 +28,20 @@ func newService(c *onet.Context) (onet.Service, error) {
 	}
 	service.RegisterContract(c, ContractValueID, ContractValue)
 	service.RegisterContract(c, ContractCoinID, ContractCoin)
+	service.RegisterContractStateDecoder(c, ContractCoinID, DecodeCoin)
+	service.RegisterContractCapabilities(c, ContractCoinID, service.ContractCapabilities{
+		Spawn: true,
+		Invoke: []string{"mint", "transfer", "fetch", "store", "approve",
+			"transfer_from"},
+		Delete:         true,
+		SelfAuthorized: []string{"transfer_from"},
+	})
+	service.RegisterContract(c, ContractCoinGenesisID, ContractCoinGenesis)
+	service.RegisterContract(c, ContractEventLogID, ContractEventLog)
+	service.RegisterContractState(c, ContractEventLogID, EventLog{})
+	service.RegisterContract(c, ContractCommitmentID, ContractCommitment)
+	service.RegisterContractState(c, ContractCommitmentID, Commitment{})
+	service.RegisterContract(c, ContractEscrowID, ContractEscrow)
+	service.RegisterContractState(c, ContractEscrowID, EscrowListing{})
 	return s, nil
 }
@@ -1,6 +1,7 @@
 package contracts
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/dedis/cothority/omniledger/service"
@@ -18,7 +19,10 @@ var ContractValueID = "value"
 // can put any data inside as wished.
 // It can spawn new value instances and will store the "value" argument in these
 // new instances.
-// Existing value instances can be "update"d and deleted.
+// Existing value instances can be "update"d and deleted. With "update_if",
+// the instance is only updated if it holds the "expected" argument, else
+// service.ErrPreconditionFailed is returned, which makes the whole
+// transaction fail.
 func ContractValue(cdb service.CollectionView, inst service.Instruction, c []service.Coin) ([]service.StateChange, []service.Coin, error) {
 	switch {
 	case inst.Spawn != nil:
@@ -27,8 +31,18 @@ func ContractValue(cdb service.CollectionView, inst service.Instruction, c []ser
 				ContractValueID, inst.Spawn.Args.Search("value")),
 		}, c, nil
 	case inst.Invoke != nil:
-		if inst.Invoke.Command != "update" {
-			return nil, nil, errors.New("Value contract can only update")
+		switch inst.Invoke.Command {
+		case "update":
+		case "update_if":
+			value, _, err := cdb.GetValues(inst.InstanceID.Slice())
+			if err != nil {
+				return nil, nil, err
+			}
+			if !bytes.Equal(value, inst.Invoke.Args.Search("expected")) {
+				return nil, nil, service.ErrPreconditionFailed
+			}
+		default:
+			return nil, nil, errors.New("Value contract can only update and update_if")
 		}
 		return []service.StateChange{
 			service.NewStateChange(service.Update, inst.InstanceID,
@@ -33,6 +33,7 @@ package darc
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
@@ -47,6 +48,8 @@ import (
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/omniledger/darc/expression"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/sign/bls"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/protobuf"
@@ -270,6 +273,41 @@ func (r Rules) updateRule(a Action, expr expression.Expr) error {
 	return nil
 }
 
+// Validate parses the expression of every rule and returns an error naming the
+// first rule whose expression is malformed or refers to an unknown identity
+// type. Empty expressions are accepted, they can never be satisfied.
+func (r Rules) Validate() error {
+	actions := make([]string, 0, len(r))
+	for a := range r {
+		actions = append(actions, string(a))
+	}
+	sort.Strings(actions)
+	for _, a := range actions {
+		expr := r[Action(a)]
+		if len(expr) == 0 {
+			continue
+		}
+		var unknown string
+		Y := expression.InitParser(func(s string) bool {
+			switch strings.SplitN(s, ":", 2)[0] {
+			case "darc", "ed25519", "x509ec", "bls":
+			default:
+				if unknown == "" {
+					unknown = s
+				}
+			}
+			return true
+		})
+		if _, err := expression.Evaluate(Y, expr); err != nil {
+			return fmt.Errorf("rule '%s' has an invalid expression '%s': %v", a, expr, err)
+		}
+		if unknown != "" {
+			return fmt.Errorf("rule '%s' refers to an unknown identity type in '%s'", a, unknown)
+		}
+	}
+	return nil
+}
+
 func isDefault(action Action) bool {
 	if action == evolve || action == sign {
 		return true
@@ -402,12 +440,46 @@ func (r *Request) VerifyWithCB(d *Darc, getDarc GetDarc) error {
 	if !d.Rules.Contains(r.Action) {
 		return fmt.Errorf("VerifyWithCB: action '%v' does not exist", r.Action)
 	}
+	if err := r.VerifySignatures(); err != nil {
+		return err
+	}
+	return r.VerifyIdentitiesWithCB(d, getDarc)
+}
+
+// VerifySignatures checks that every identity of the request signed it. It
+// does not check the request against any darc.
+func (r *Request) VerifySignatures() error {
+	if len(r.Signatures) == 0 {
+		return errors.New("no signatures - nothing to verify")
+	}
+	if len(r.Signatures) != len(r.Identities) {
+		return fmt.Errorf("signatures and identities have unequal length - %d != %d",
+			len(r.Signatures), len(r.Identities))
+	}
 	digest := r.Hash()
 	for i, id := range r.Identities {
 		if err := id.Verify(digest, r.Signatures[i]); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// VerifyIdentitiesWithCB checks that the identities of the request fulfill
+// the rule of the request's action in the given darc, using a callback which
+// looks-up missing darcs. The signatures of the request are NOT verified, so
+// the caller must have verified by other means that the identities signed
+// the request, e.g. with a signature covering several requests.
+func (r *Request) VerifyIdentitiesWithCB(d *Darc, getDarc GetDarc) error {
+	if len(r.Identities) == 0 {
+		return errors.New("no identities - nothing to verify")
+	}
+	if !d.GetBaseID().Equal(r.BaseID) {
+		return fmt.Errorf("base id mismatch")
+	}
+	if !d.Rules.Contains(r.Action) {
+		return fmt.Errorf("VerifyIdentitiesWithCB: action '%v' does not exist", r.Action)
+	}
 	validIDs := r.GetIdentityStrings()
 	err := evalExpr(d.Rules[r.Action], getDarc, validIDs...)
 	if err != nil {
@@ -493,6 +565,32 @@ func (d Darc) SanityCheck(prev *Darc) error {
 	return nil
 }
 
+// VerifyEvolutionChain verifies the evolution history of a darc offline. The
+// darcs must be given in order, each one being the evolution of the previous
+// one, signed by identities allowed by the "_evolve" rule of the previous
+// one. The first darc is trusted as it is, usually it is the genesis darc.
+// Darcs referenced by the evolve rules are looked up in the
+// VerificationDarcs of the evolved darc.
+func VerifyEvolutionChain(darcs []*Darc) error {
+	if len(darcs) == 0 {
+		return errors.New("empty evolution chain")
+	}
+	for i := 1; i < len(darcs); i++ {
+		prev, d := darcs[i-1], darcs[i]
+		if prev == nil || d == nil {
+			return fmt.Errorf("darc %d of the chain is nil", i)
+		}
+		if len(d.Signatures) == 0 {
+			return fmt.Errorf("darc %d of the chain: no signatures", i)
+		}
+		err := verifyOneEvolution(d, prev, DarcsToGetDarcs(d.VerificationDarcs))
+		if err != nil {
+			return fmt.Errorf("darc %d of the chain: %v", i, err)
+		}
+	}
+	return nil
+}
+
 // verifyOneEvolution verifies that one evolution is performed correctly. That
 // is, there exists a signature in the newDarc that is signed by one of the
 // identities with the evolve permission in the oldDarc. The message that
@@ -664,6 +762,8 @@ func (id Identity) Equal(id2 *Identity) bool {
 		return id.Ed25519.Equal(id2.Ed25519)
 	case 2:
 		return id.X509EC.Equal(id2.X509EC)
+	case 3:
+		return id.BLS.Equal(id2.BLS)
 	}
 	return false
 }
@@ -678,6 +778,8 @@ func (id Identity) Type() int {
 		return 1
 	case id.X509EC != nil:
 		return 2
+	case id.BLS != nil:
+		return 3
 	}
 	return -1
 }
@@ -691,6 +793,8 @@ func (id Identity) TypeString() string {
 		return "ed25519"
 	case 2:
 		return "x509ec"
+	case 3:
+		return "bls"
 	default:
 		return "No identity"
 	}
@@ -705,6 +809,8 @@ func (id Identity) String() string {
 		return fmt.Sprintf("%s:%s", id.TypeString(), id.Ed25519.Point.String())
 	case 2:
 		return fmt.Sprintf("%s:%x", id.TypeString(), id.X509EC.Public)
+	case 3:
+		return fmt.Sprintf("%s:%x", id.TypeString(), id.BLS.Public)
 	default:
 		return "No identity"
 	}
@@ -720,6 +826,8 @@ func (id Identity) Verify(msg, sig []byte) error {
 		return id.Ed25519.Verify(msg, sig)
 	case 2:
 		return id.X509EC.Verify(msg, sig)
+	case 3:
+		return id.BLS.Verify(msg, sig)
 	default:
 		return errors.New("unknown identity")
 	}
@@ -797,6 +905,36 @@ func (idkc IdentityX509EC) Verify(msg, s []byte) error {
 	return errors.New("Wrong signature")
 }
 
+// NewIdentityBLS creates a new BLS identity struct given a point of the G2
+// group of bn256.
+func NewIdentityBLS(point kyber.Point) (Identity, error) {
+	public, err := point.MarshalBinary()
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{
+		BLS: &IdentityBLS{
+			Public: public,
+		},
+	}, nil
+}
+
+// Equal returns true if both IdentityBLS point to the same data.
+func (idb IdentityBLS) Equal(idb2 *IdentityBLS) bool {
+	return bytes.Equal(idb.Public, idb2.Public)
+}
+
+// Verify returns nil if the signature is correct, or an error if something
+// fails.
+func (idb IdentityBLS) Verify(msg, sig []byte) error {
+	suite := bn256.NewSuite()
+	public := suite.G2().Point()
+	if err := public.UnmarshalBinary(idb.Public); err != nil {
+		return err
+	}
+	return bls.Verify(suite, public, msg, sig)
+}
+
 // NewSignerEd25519 initializes a new SignerEd25519 signer given public and
 // private keys. If either of the given keys is nil, then a new key pair is
 // generated.
@@ -811,6 +949,40 @@ func NewSignerEd25519(public kyber.Point, private kyber.Scalar) Signer {
 	}}
 }
 
+// DeriveSignerEd25519 derives an ed25519 signer from a seed and a derivation
+// path following SLIP-0010 for ed25519: the seed gives a master key and a
+// chain code, and every index of the path derives a child key from its
+// parent with HMAC-SHA512. Only hardened derivation is possible, so every
+// index is hardened. The resulting key is used as the seed of a standard
+// ed25519 key, so the public key is the same as the one of other SLIP-0010
+// wallets. Its identity is a normal ed25519 identity, so it can be used in
+// darcs like any other.
+func DeriveSignerEd25519(seed []byte, path []uint32) (Signer, error) {
+	if len(seed) < 16 {
+		return Signer{}, errors.New("seed must be at least 16 bytes")
+	}
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	i := mac.Sum(nil)
+	for _, index := range path {
+		data := make([]byte, 1+32+4)
+		copy(data[1:], i[:32])
+		binary.BigEndian.PutUint32(data[33:], index|0x80000000)
+		mac = hmac.New(sha512.New, i[32:])
+		mac.Write(data)
+		i = mac.Sum(nil)
+	}
+	// The secret scalar of an ed25519 key is the clamped first half of the
+	// hash of its seed, in little endian.
+	h := sha512.Sum512(i[:32])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	private := cothority.Suite.Scalar().SetBytes(h[:32])
+	public := cothority.Suite.Point().Mul(private, nil)
+	return NewSignerEd25519(public, private), nil
+}
+
 // Sign creates a schnorr signautre on the message.
 func (eds SignerEd25519) Sign(msg []byte) ([]byte, error) {
 	return schnorr.Sign(cothority.Suite, eds.Secret, msg)
@@ -1,6 +1,7 @@
 package darc
 
 import (
+	"encoding/hex"
 	"testing"
 
 	"github.com/dedis/cothority/omniledger/darc/expression"
@@ -69,6 +70,22 @@ func TestDeleteRule(t *testing.T) {
 	// TODO
 }
 
+func TestRules_Validate(t *testing.T) {
+	owner := createIdentity()
+	rules := InitRules([]Identity{owner}, []Identity{})
+	require.Nil(t, rules.Validate())
+
+	require.Nil(t, rules.AddRule("spawn:dummy", expression.Expr("("+owner.String())))
+	err := rules.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "spawn:dummy")
+
+	require.Nil(t, rules.UpdateRule("spawn:dummy", expression.Expr("unknown:aa | "+owner.String())))
+	err = rules.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown identity type")
+}
+
 // TestDarc_EvolveOne creates two darcs, the first has two owners and the
 // second has one. The first darc is to be evolved into the second one.
 func TestDarc_EvolveOne(t *testing.T) {
@@ -144,6 +161,39 @@ func TestDarc_EvolveMore(t *testing.T) {
 	require.Nil(t, darcs[len(darcs)-2].Verify(true))
 }
 
+func TestDarc_VerifyEvolutionChain(t *testing.T) {
+	d := createDarc(1, "testdarc").darc
+	prevOwner := NewSignerEd25519(nil, nil)
+	require.Nil(t, d.Rules.UpdateEvolution(
+		expression.InitOrExpr(prevOwner.Identity().String())))
+
+	darcs := []*Darc{d}
+	for i := 0; i < 3; i++ {
+		prev := darcs[len(darcs)-1]
+		dNew := prev.Copy()
+		newOwner := NewSignerEd25519(nil, nil)
+		require.Nil(t, dNew.Rules.UpdateEvolution([]byte(newOwner.Identity().String())))
+		require.Nil(t, localEvolution(dNew, prev, prevOwner))
+		darcs = append(darcs, dNew)
+		prevOwner = newOwner
+	}
+	require.Nil(t, VerifyEvolutionChain(darcs))
+	require.NotNil(t, VerifyEvolutionChain(nil))
+
+	// A missing darc breaks the chain.
+	err := VerifyEvolutionChain([]*Darc{darcs[0], darcs[1], darcs[3]})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "darc 2 of the chain")
+
+	// So does a darc that is not signed by the previous owner.
+	forged := darcs[1].Copy()
+	require.Nil(t, forged.Rules.UpdateEvolution([]byte(createIdentity().String())))
+	require.Nil(t, localEvolution(forged, darcs[0], NewSignerEd25519(nil, nil)))
+	err = VerifyEvolutionChain([]*Darc{darcs[0], forged})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "darc 1 of the chain")
+}
+
 func TestDarc_EvolveMoreOnline(t *testing.T) {
 	d := createDarc(1, "testdarc").darc
 	require.Nil(t, d.Verify(true))
@@ -451,3 +501,56 @@ func localEvolution(newDarc *Darc, oldDarc *Darc, signers ...Signer) error {
 	newDarc.VerificationDarcs = append(oldDarc.VerificationDarcs, oldDarc)
 	return nil
 }
+
+func TestDeriveSignerEd25519(t *testing.T) {
+	seed := []byte("a seed of a hierarchical wallet")
+	_, err := DeriveSignerEd25519(seed[:8], nil)
+	require.NotNil(t, err)
+
+	s1, err := DeriveSignerEd25519(seed, []uint32{44, 0, 1})
+	require.Nil(t, err)
+	s1Again, err := DeriveSignerEd25519(seed, []uint32{44, 0, 1})
+	require.Nil(t, err)
+	id1, id1Again := s1.Identity(), s1Again.Identity()
+	require.True(t, id1.Equal(&id1Again))
+	s2, err := DeriveSignerEd25519(seed, []uint32{44, 0, 2})
+	require.Nil(t, err)
+	id2 := s2.Identity()
+	require.False(t, id1.Equal(&id2))
+
+	// The derived key can sign requests for a darc that has its identity.
+	id := []Identity{id1}
+	d := NewDarc(InitRules(id, id), []byte("derived darc"))
+	require.Nil(t, d.Rules.AddRule("spawn:dummy", d.Rules.GetSignExpr()))
+	req, err := InitAndSignRequest(d.GetBaseID(), "spawn:dummy", []byte("msg"), s1)
+	require.Nil(t, err)
+	require.Nil(t, req.Verify(d))
+	req, err = InitAndSignRequest(d.GetBaseID(), "spawn:dummy", []byte("msg"), s2)
+	require.Nil(t, err)
+	require.NotNil(t, req.Verify(d))
+}
+
+func TestDeriveSignerEd25519_SLIP10Vectors(t *testing.T) {
+	// Test vector 1 for ed25519 of SLIP-0010, without the leading zero
+	// byte of the public keys.
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	require.Nil(t, err)
+	vectors := []struct {
+		path   []uint32
+		public string
+	}{
+		{nil, "a4b2856bfec510abab89753fac1ac0e1112364e7d250545963f135f2a33188ed"},
+		{[]uint32{0}, "8c8a13df77a28f3445213a0f432fde644acaa215fc72dcdf300d5efaa85d350c"},
+		{[]uint32{0, 1}, "1932a5270f335bed617d5b935c80aedb1a35bd9fc1e31acafd5372c30f5c1187"},
+		{[]uint32{0, 1, 2}, "ae98736566d30ed0e9d2f4486a64bc95740d89c7db33f52121f8ea8f76ff0fc1"},
+		{[]uint32{0, 1, 2, 2}, "8abae2d66361c879b900d204ad2cc4984fa2aa344dd7ddc46007329ac76c429c"},
+		{[]uint32{0, 1, 2, 2, 1000000000}, "3c24da049451555d51a7014a37337aa4e12d41e485abccfa46b47dfb2af54b7a"},
+	}
+	for _, v := range vectors {
+		s, err := DeriveSignerEd25519(seed, v.path)
+		require.Nil(t, err)
+		public, err := s.Ed25519.Point.MarshalBinary()
+		require.Nil(t, err)
+		require.Equal(t, v.public, hex.EncodeToString(public))
+	}
+}
@@ -52,8 +52,8 @@ type Darc struct {
 	VerificationDarcs []*Darc
 }
 
-// Identity is a generic structure can be either an Ed25519 public key, a Darc
-// or a X509 Identity.
+// Identity is a generic structure can be either an Ed25519 public key, a Darc,
+// a X509 Identity or a BLS public key.
 type Identity struct {
 	// Darc identity
 	Darc *IdentityDarc
@@ -61,6 +61,8 @@ type Identity struct {
 	Ed25519 *IdentityEd25519
 	// Public-key identity
 	X509EC *IdentityX509EC
+	// Public-key identity of a BLS key, possibly shared by a committee
+	BLS *IdentityBLS
 }
 
 // IdentityEd25519 holds a Ed25519 public key (Point)
@@ -73,6 +75,13 @@ type IdentityX509EC struct {
 	Public []byte
 }
 
+// IdentityBLS holds a marshalled BLS public key of the G2 group of bn256.
+// It is typically the public key of a committee sharing the private key, so
+// that a threshold of its members can sign.
+type IdentityBLS struct {
+	Public []byte
+}
+
 // IdentityDarc is a structure that points to a Darc with a given ID on a
 // skipchain. The signer should belong to the Darc.
 type IdentityDarc struct {
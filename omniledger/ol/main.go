@@ -239,9 +239,10 @@ func add(c *cli.Context) error {
 		InstanceID: omniledger.InstanceID{
 			DarcID: d2.GetBaseID(),
 		},
-		Index:  0,
-		Length: 1,
-		Invoke: &invoke,
+		Index:       0,
+		Length:      1,
+		SkipchainID: cl.ID,
+		Invoke:      &invoke,
 		Signatures: []darc.Signature{
 			darc.Signature{Signer: private.Owner.Identity()},
 		},
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// TxAdmissionPolicy decides whether a node accepts a transaction from a
+// client. The policies are only consulted when a transaction is received, so
+// they are local to the node and not part of the consensus: another node
+// might still accept the transaction.
+type TxAdmissionPolicy interface {
+	// Admit returns an error if the transaction must be refused. coll is
+	// the current state of the skipchain the transaction is sent to.
+	Admit(tx ClientTransaction, coll CollectionView) error
+}
+
+// TxAdmissionFunc is a function that can be used as a TxAdmissionPolicy.
+type TxAdmissionFunc func(tx ClientTransaction, coll CollectionView) error
+
+// Admit calls f.
+func (f TxAdmissionFunc) Admit(tx ClientTransaction, coll CollectionView) error {
+	return f(tx, coll)
+}
+
+// RegisterTxAdmissionPolicy adds p to the policies of the service. A
+// transaction is only accepted if all the policies admit it, in the order
+// in which they have been registered.
+func RegisterTxAdmissionPolicy(s skipchain.GetService, p TxAdmissionPolicy) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerTxAdmissionPolicy(p)
+}
+
+func (s *Service) registerTxAdmissionPolicy(p TxAdmissionPolicy) error {
+	if p == nil {
+		return errors.New("nil admission policy")
+	}
+	s.admissionMut.Lock()
+	defer s.admissionMut.Unlock()
+	s.admissionPolicies = append(s.admissionPolicies, p)
+	return nil
+}
+
+// admitTx returns the error of the first policy refusing tx.
+func (s *Service) admitTx(scID skipchain.SkipBlockID, tx ClientTransaction) error {
+	s.admissionMut.Lock()
+	policies := s.admissionPolicies
+	s.admissionMut.Unlock()
+	if len(policies) == 0 {
+		return nil
+	}
+	coll := s.GetCollectionView(scID)
+	for _, p := range policies {
+		if err := p.Admit(tx, coll); err != nil {
+			return errors.New("transaction not admitted: " + err.Error())
+		}
+	}
+	return nil
+}
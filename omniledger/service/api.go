@@ -92,6 +92,59 @@ func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxRe
 	return reply, nil
 }
 
+// AddTransactionBatch adds several transactions at once and returns the batch
+// ID, which is the same as txs.Hash(). The Client's Roster and ID should be
+// initialized before calling this method (see NewClientFromConfig).
+func (c *Client) AddTransactionBatch(txs ClientTransactions) ([]byte, error) {
+	reply := &AddTxBatchResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &AddTxBatchRequest{
+		Version:      CurrentVersion,
+		SkipchainID:  c.ID,
+		Transactions: txs,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.BatchID, nil
+}
+
+// AddPartialSignature sends the partial signature of a committee member on
+// the instruction of index instr of the transaction. The service adds the
+// transaction once enough partial signatures are collected. The Client's
+// Roster and ID should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) AddPartialSignature(tx ClientTransaction, instr int, partial []byte) (*AddPartialSignatureResponse, error) {
+	reply := &AddPartialSignatureResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &AddPartialSignature{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		Transaction: tx,
+		Instruction: instr,
+		Partial:     partial,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetTxStatus returns how many transactions of the batch batchID are in a
+// block. The batch must have been added through the same node, and is
+// forgotten once all its transactions have been reported as included. The
+// Client's Roster should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) GetTxStatus(batchID []byte) (*GetTxStatusResponse, error) {
+	reply := &GetTxStatusResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: batchID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 // GetProof returns a proof for the key stored in the skipchain.  The proof can
 // be verified with the genesis skipblock and can prove the existence or the
 // absence of the key. The Client's Roster and ID should be initialized before
@@ -109,6 +162,264 @@ func (c *Client) GetProof(key []byte) (*GetProofResponse, error) {
 	return reply, nil
 }
 
+// GetNextNonce returns the nonce to use for the next instruction on the
+// instance iID, following the last one recorded for the NonceIncreasing and
+// NonceNext policies. For a spawn, iID is the darc and spawner the identity
+// that will sign the instruction first, else spawner is nil.
+func (c *Client) GetNextNonce(iID InstanceID, spawner *darc.Identity) (Nonce, error) {
+	reply, err := c.GetProof(NonceKey(iID, spawner).Slice())
+	if err != nil {
+		return Nonce{}, err
+	}
+	if err = reply.Proof.Verify(c.ID); err != nil {
+		return Nonce{}, err
+	}
+	if !reply.Proof.InclusionProof.Match() {
+		return Nonce{}.next(), nil
+	}
+	_, values, err := reply.Proof.KeyValue()
+	if err != nil {
+		return Nonce{}, err
+	}
+	if len(values) == 0 {
+		return Nonce{}, errors.New("proof has no nonce")
+	}
+	return NewNonce(values[0]).next(), nil
+}
+
+// GetFreshProof is like GetProof, but the proof is verified and refused
+// with ErrProofStale if its latest block is more than maxAge blocks behind
+// the block with index tip, the latest block known to the caller. The node
+// cannot be trusted to tell how recent its own proof is.
+func (c *Client) GetFreshProof(key []byte, tip, maxAge int) (*GetProofResponse, error) {
+	reply, err := c.GetProof(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = reply.Proof.VerifyFresh(c.ID, tip, maxAge); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetBatchProof returns the proofs of all keys in one bundle, where the parts
+// shared by the proofs are only sent once. BatchProof.Expand returns the
+// individual proofs. The Client's Roster and ID should be initialized before
+// calling this method (see NewClientFromConfig).
+func (c *Client) GetBatchProof(keys [][]byte) (*GetBatchProofResponse, error) {
+	reply := &GetBatchProofResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetBatchProof{
+		Version: CurrentVersion,
+		ID:      c.ID,
+		Keys:    keys,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetConsistentProofs returns the proofs for all the keys. All the proofs
+// refer to the same latest block, so they show the state of the instances at
+// the same time. The Client's Roster and ID should be initialized before
+// calling this method (see NewClientFromConfig).
+func (c *Client) GetConsistentProofs(keys [][]byte) ([]Proof, error) {
+	reply, err := c.GetBatchProof(keys)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Proof.Expand()
+}
+
+// GetInstanceHistory returns every value the instance iID held since the
+// genesis block, oldest change first. The Client's Roster and ID should be
+// initialized before calling this method (see NewClientFromConfig).
+func (c *Client) GetInstanceHistory(iID InstanceID) ([]HistoryEntry, error) {
+	reply := &GetInstanceHistoryResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  iID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
+
+// GetInstanceOrigin returns the index of the block and the hash of the
+// instruction that created the instance iID. The Client's Roster and ID
+// should be initialized before calling this method (see NewClientFromConfig).
+func (c *Client) GetInstanceOrigin(iID InstanceID) (blockIndex int, instrHash []byte, err error) {
+	reply := &GetInstanceOriginResponse{}
+	err = c.SendProtobuf(c.Roster.List[0], &GetInstanceOrigin{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  iID,
+	}, reply)
+	if err != nil {
+		return
+	}
+	return reply.BlockIndex, reply.InstructionHash, nil
+}
+
+// GetLastModifier returns the index and the timestamp of the block and the
+// signers of the last instruction that changed the instance iID. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
+func (c *Client) GetLastModifier(iID InstanceID) (blockIndex int, signers []darc.Identity, timestamp int64, err error) {
+	reply := &GetLastModifierResponse{}
+	err = c.SendProtobuf(c.Roster.List[0], &GetLastModifier{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  iID,
+	}, reply)
+	if err != nil {
+		return
+	}
+	return reply.BlockIndex, reply.Signers, reply.Timestamp, nil
+}
+
+// GetProofSize returns the size in bytes of the encoded proof GetProof
+// returns for key. The Client's Roster and ID should be initialized before
+// calling this method (see NewClientFromConfig).
+func (c *Client) GetProofSize(key []byte) (int, error) {
+	reply := &GetProofSizeResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetProofSize{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		Key:         key,
+	}, reply)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Size, nil
+}
+
+// GetChangesSince returns the state changes of all the blocks after the
+// block at fromIndex, in order, together with the latest block. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
+func (c *Client) GetChangesSince(fromIndex int) (StateChanges, *skipchain.SkipBlock, error) {
+	reply := &GetChangesSinceResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetChangesSince{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		FromIndex:   fromIndex,
+	}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.StateChanges, reply.Latest, nil
+}
+
+// FindByExternalRef returns the hashes of the instructions of the committed
+// transactions tagged with the external reference ref. The Client's Roster
+// and ID should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) FindByExternalRef(ref []byte) ([][]byte, error) {
+	reply := &FindByExternalRefResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &FindByExternalRef{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		ExternalRef: ref,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Hashes, nil
+}
+
+// GetDecodedInstance returns the contract and the value of the instance iID.
+// The value is decoded if its contract registered its state on the node and
+// the type of the state is registered to the network library of this
+// client, else it is returned as []byte. The Client's Roster and ID should be initialized before calling
+// this method (see NewClientFromConfig).
+func (c *Client) GetDecodedInstance(iID InstanceID) (contractID string, decoded interface{}, err error) {
+	reply := &GetDecodedInstanceResponse{}
+	err = c.SendProtobuf(c.Roster.List[0], &GetDecodedInstance{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  iID,
+	}, reply)
+	if err != nil {
+		return
+	}
+	if len(reply.Decoded) > 0 {
+		if _, decoded, err = network.Unmarshal(reply.Decoded, cothority.Suite); err == nil {
+			return reply.ContractID, decoded, nil
+		}
+	}
+	return reply.ContractID, reply.Value, nil
+}
+
+// GetBlock returns the block at the given index of the skipchain. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
+func (c *Client) GetBlock(index int) (*skipchain.SkipBlock, error) {
+	reply := &GetBlockResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetBlock{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		Index:       index,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Skipblock, nil
+}
+
+// StreamBlockBody calls f with every transaction of the block at the given
+// index, in order, getting them from the service a page at a time, so that
+// the whole body is never held in memory. It stops at the first error
+// returned by f. The Client's Roster and ID should be initialized before
+// calling this method (see NewClientFromConfig).
+func (c *Client) StreamBlockBody(index int, f func(ClientTransaction) error) error {
+	start := 0
+	for {
+		reply := &GetBlockTransactionsResponse{}
+		err := c.SendProtobuf(c.Roster.List[0], &GetBlockTransactions{
+			Version:     CurrentVersion,
+			SkipchainID: c.ID,
+			Index:       index,
+			Start:       start,
+			Count:       maxBlockTxsPage,
+		}, reply)
+		if err != nil {
+			return err
+		}
+		for _, ct := range reply.Transactions {
+			if err = f(ct); err != nil {
+				return err
+			}
+		}
+		if !reply.More {
+			return nil
+		}
+		if len(reply.Transactions) == 0 {
+			return errors.New("service returned an empty page")
+		}
+		start += len(reply.Transactions)
+	}
+}
+
+// GetTxReceipt returns the receipt of the transaction with the given hash of
+// instructions. The receipt should be verified with Verify. The Client's
+// Roster and ID should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) GetTxReceipt(txHash []byte) (*TxReceipt, error) {
+	reply := &GetTxReceiptResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetTxReceipt{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		TxHash:      txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Receipt, nil
+}
+
 // GetGenDarc uses the GetProof method to fetch the latest version of the
 // Genesis Darc from OmniLedger and parses it.
 func (c *Client) GetGenDarc() (*darc.Darc, error) {
@@ -158,6 +469,43 @@ func (c *Client) GetGenDarc() (*darc.Darc, error) {
 	return d, nil
 }
 
+// GetInstanceDarc uses the GetProof method to fetch the darc that currently
+// governs the instance iID. The proof of the darc is verified against the
+// Client's skipchain ID before the darc is returned, and the darc is checked
+// to have iID.DarcID as its base ID.
+func (c *Client) GetInstanceDarc(iID InstanceID) (*darc.Darc, error) {
+	p, err := c.GetProof(InstanceID{iID.DarcID, SubID{}}.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if err = p.Proof.Verify(c.ID); err != nil {
+		return nil, err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return nil, errors.New("cannot find the darc of the instance")
+	}
+
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) < 2 {
+		return nil, errors.New("not enough records")
+	}
+	contractBuf := vs[1]
+	if string(contractBuf) != ContractDarcID {
+		return nil, errors.New("expected contract to be darc but got: " + string(contractBuf))
+	}
+	d, err := darc.NewFromProtobuf(vs[0])
+	if err != nil {
+		return nil, err
+	}
+	if !d.GetBaseID().Equal(iID.DarcID) {
+		return nil, errors.New("darc of the instance has a different base ID")
+	}
+	return d, nil
+}
+
 // GetChainConfig uses the GetProof method to fetch the chain config
 // from OmniLedger.
 func (c *Client) GetChainConfig() (*ChainConfig, error) {
@@ -280,6 +628,7 @@ func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...darc.Id
 		rosterPubs[i] = darc.NewIdentityEd25519(sid.Public).String()
 	}
 	d.Rules.AddRule(darc.Action("invoke:view_change"), expression.InitOrExpr(rosterPubs...))
+	d.Rules.AddRule(darc.Action("invoke:"+CmdReportEquivocation), expression.InitOrExpr(rosterPubs...))
 
 	m := CreateGenesisBlock{
 		Version:       v,
@@ -290,6 +639,33 @@ func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...darc.Id
 	return &m, nil
 }
 
+// genesisDarcActions are the actions of the config and darc contracts that
+// NewGenesisDarc gives to the owners, besides invokeEvolve.
+var genesisDarcActions = []darc.Action{
+	darc.Action("spawn:" + ContractDarcID),
+	darc.Action("invoke:update_config"),
+	darc.Action("invoke:view_change"),
+	darc.Action("invoke:" + CmdScheduledViewChange),
+	darc.Action("invoke:" + CmdReportEquivocation),
+	darc.Action("invoke:" + CmdDarcCompact),
+}
+
+// NewGenesisDarc returns a darc with all the rules required by the config and
+// darc contracts. All owners must sign to evolve the darc, and any of them
+// can sign the other actions.
+func NewGenesisDarc(owners []darc.Identity) (*darc.Darc, error) {
+	if len(owners) == 0 {
+		return nil, errors.New("no owners")
+	}
+	d := darc.NewDarc(darc.InitRulesWith(owners, owners, invokeEvolve), []byte("genesis darc"))
+	for _, a := range genesisDarcActions {
+		if err := d.Rules.AddRule(a, d.Rules.GetSignExpr()); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
 // SignInstruction takes an instruction and one or more signers and adds
 // a Signature to the instruction.
 func SignInstruction(inst *Instruction, signers ...darc.Signer) error {
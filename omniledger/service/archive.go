@@ -0,0 +1,186 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// blockArchive is a cold storage for the old blocks of the skipchains. It is
+// kept in a separate bolt database, so that it can be stored on a different
+// disk than the database of the service. The current state of the
+// skipchains, the collections, is not touched by the archival.
+//
+// Once archived, the blocks that are not needed to follow the links of the
+// skipchain are removed from the database of the skipchain service.
+type blockArchive struct {
+	sync.Mutex
+	db *bolt.DB
+	// depth is the number of blocks, counted back from the latest block,
+	// that are not archived.
+	depth int
+}
+
+func newBlockArchive(path string, depth int) (*blockArchive, error) {
+	if depth <= 0 {
+		return nil, errors.New("archive depth must be positive")
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &blockArchive{db: db, depth: depth}, nil
+}
+
+func indexKey(index int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(index))
+	return key
+}
+
+// store adds sb to the archive.
+func (a *blockArchive) store(sb *skipchain.SkipBlock) error {
+	buf, err := network.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(sb.SkipChainID())
+		if err != nil {
+			return err
+		}
+		return b.Put(indexKey(sb.Index), buf)
+	})
+}
+
+// get returns the archived block of skipchain scID at the given index.
+func (a *blockArchive) get(scID skipchain.SkipBlockID, index int) (*skipchain.SkipBlock, error) {
+	a.Lock()
+	defer a.Unlock()
+	var buf []byte
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(scID)
+		if b == nil {
+			return fmt.Errorf("no archived blocks for skipchain %x", scID)
+		}
+		v := b.Get(indexKey(index))
+		if v == nil {
+			return fmt.Errorf("block %d is not archived", index)
+		}
+		buf = dup(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, sbI, err := network.Unmarshal(buf, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	sb, ok := sbI.(*skipchain.SkipBlock)
+	if !ok {
+		return nil, errors.New("archived data is not a skipblock")
+	}
+	return sb, nil
+}
+
+// archived returns true if a block at index must be read from the archive
+// when latest is the index of the latest block.
+func (a *blockArchive) archived(index, latest int) bool {
+	return index <= latest-a.depth
+}
+
+// prunable returns true if the archived block sb can be removed from the
+// skipchain database when latest is the index of the latest block. The
+// proofs follow the highest forward links, which always point to blocks of a
+// height bigger than 1, and only go through blocks of height 1 in the last
+// BaseHeight blocks before their target. So only the blocks of height 1 that
+// are further behind are removed.
+func (a *blockArchive) prunable(sb *skipchain.SkipBlock, latest int) bool {
+	return sb.Height == 1 && sb.MaximumHeight > 1 &&
+		sb.Index <= latest-a.depth-sb.BaseHeight
+}
+
+func (a *blockArchive) close() error {
+	return a.db.Close()
+}
+
+// archivedBlock returns the block of skipchain scID at the given index from
+// the archive.
+func (s *Service) archivedBlock(scID skipchain.SkipBlockID, index int) (*skipchain.SkipBlock, error) {
+	a := s.getArchive()
+	if a == nil {
+		return nil, errors.New("missing block in chain")
+	}
+	return a.get(scID, index)
+}
+
+// prevBlock returns the block before sb. If it has been removed from the
+// skipchain database, it is read from the archive.
+func (s *Service) prevBlock(sb *skipchain.SkipBlock) (*skipchain.SkipBlock, error) {
+	if len(sb.BackLinkIDs) == 0 {
+		return nil, errors.New("block has no previous block")
+	}
+	if prev := s.db().GetByID(sb.BackLinkIDs[0]); prev != nil {
+		return prev, nil
+	}
+	return s.archivedBlock(sb.SkipChainID(), sb.Index-1)
+}
+
+// nextBlock returns the block after sb, or nil if sb has no forward link. If
+// the next block has been removed from the skipchain database, it is read
+// from the archive.
+func (s *Service) nextBlock(sb *skipchain.SkipBlock) (*skipchain.SkipBlock, error) {
+	if len(sb.ForwardLink) == 0 {
+		return nil, nil
+	}
+	if next := s.db().GetByID(sb.ForwardLink[0].To); next != nil {
+		return next, nil
+	}
+	return s.archivedBlock(sb.SkipChainID(), sb.Index+1)
+}
+
+// blockByIndex returns the block of skipchain scID at the given index. Old
+// blocks are read from the archive if archival is enabled, the others are
+// found by following the back links from the latest block.
+func (s *Service) blockByIndex(scID skipchain.SkipBlockID, index int) (*skipchain.SkipBlock, error) {
+	sb, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index > sb.Index {
+		return nil, errors.New("no block with this index")
+	}
+	if a := s.getArchive(); a != nil && a.archived(index, sb.Index) {
+		archived, err := a.get(scID, index)
+		if err == nil {
+			return archived, nil
+		}
+		log.Lvl2(s.ServerIdentity(), "reading block from the skipchain:", err)
+	}
+	for sb.Index > index {
+		// Take the highest back link that doesn't jump over index.
+		var prev *skipchain.SkipBlock
+		for i := len(sb.BackLinkIDs) - 1; i >= 0; i-- {
+			prev = s.db().GetByID(sb.BackLinkIDs[i])
+			if prev != nil && prev.Index >= index {
+				break
+			}
+			prev = nil
+		}
+		if prev == nil {
+			return nil, errors.New("missing block in chain")
+		}
+		sb = prev
+	}
+	return sb, nil
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/omniledger/darc/expression"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// authorizingRulesBucket is the bucket of the database of the service
+// holding the rules that authorized the committed instructions.
+var authorizingRulesBucket = []byte("authorizingrules")
+
+// AuthorizingRule is the rule of a darc that authorized an instruction, as
+// stored in the database.
+type AuthorizingRule struct {
+	Action     string
+	Expression expression.Expr
+	// Identities are the ones the rule has been evaluated with: the
+	// signers of the instruction, of its transaction if it is signed as a
+	// whole, or of its pre-authorization.
+	Identities []darc.Identity
+}
+
+// ruleKey returns the key of the rule of the instruction of index
+// instrIndex in the transaction with the given hash, in the skipchain scID.
+func ruleKey(scID skipchain.SkipBlockID, txHash []byte, instrIndex int) []byte {
+	key := make([]byte, len(scID)+len(txHash)+4)
+	copy(key, scID)
+	copy(key[len(scID):], txHash)
+	binary.BigEndian.PutUint32(key[len(scID)+len(txHash):], uint32(instrIndex))
+	return key
+}
+
+// GetAuthorizingRule returns the rule that authorized the instruction of
+// index instrIndex in the transaction of the skipchain scID whose
+// instructions have the hash txHash. The rule is the one of the darc at the
+// time the instruction was committed: later evolutions of the darc don't
+// change it. The commands a contract authorizes itself have no rule.
+func (s *Service) GetAuthorizingRule(scID skipchain.SkipBlockID, txHash []byte, instrIndex int) (*AuthorizingRule, error) {
+	db, name := s.GetAdditionalBucket(authorizingRulesBucket)
+	var buf []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errors.New("no rule recorded")
+		}
+		v := b.Get(ruleKey(scID, txHash, instrIndex))
+		if v == nil {
+			return errors.New("no rule recorded for this instruction")
+		}
+		buf = dup(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rule := &AuthorizingRule{}
+	if err = protobuf.Decode(buf, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// recordAuthorizingRules stores the rules that authorized the instructions
+// of the transactions of a block. It must be called before the state changes
+// of the block are applied, so that the darcs are the ones that verified the
+// instructions. The instructions added by the leader, the self-authorized
+// ones and the ones whose darc cannot be found are skipped.
+func (s *Service) recordAuthorizingRules(scID skipchain.SkipBlockID, cts ClientTransactions) error {
+	rules := make(map[string][]byte)
+	for _, ct := range cts {
+		txHash := ct.Instructions.Hash()
+		for i, instr := range ct.Instructions {
+			if s.isApplyScheduledViewChange(scID, instr) || s.isExpireInstances(scID, instr) {
+				continue
+			}
+			rule, err := s.authorizingRule(scID, ct, instr)
+			if err != nil {
+				log.Lvl2(s.ServerIdentity(), "no authorizing rule:", err)
+				continue
+			}
+			if rule == nil {
+				continue
+			}
+			buf, err := protobuf.Encode(rule)
+			if err != nil {
+				return err
+			}
+			rules[string(ruleKey(scID, txHash, i))] = buf
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	db, name := s.GetAdditionalBucket(authorizingRulesBucket)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		for k, v := range rules {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// authorizingRule returns the rule of the latest darc of the instruction of
+// the transaction ct, as checked by verifyClientTx, or nil if the contract
+// authorizes the instruction itself.
+func (s *Service) authorizingRule(scID skipchain.SkipBlockID, ct ClientTransaction, instr Instruction) (*AuthorizingRule, error) {
+	var contractID string
+	if instr.Invoke != nil {
+		contractID, _, _ = instr.GetContractState(s.GetCollectionView(scID))
+	}
+	if caps, ok := s.contractCaps[contractID]; ok && caps.selfAuthorized(instr) {
+		return nil, nil
+	}
+	d, err := s.loadLatestDarc(scID, instr.InstanceID.DarcID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := instr.ToDarcRequest()
+	if err != nil {
+		return nil, err
+	}
+	var sigs []darc.Signature
+	switch {
+	case instr.PreAuthorization != nil:
+		sigs = instr.PreAuthorization.Signatures
+	case len(ct.Signatures) > 0:
+		sigs = ct.Signatures
+	default:
+		sigs = instr.Signatures
+	}
+	ids := make([]darc.Identity, len(sigs))
+	for i, sig := range sigs {
+		ids[i] = sig.Signer
+	}
+	action := ruleAction(d, req.Action, contractID)
+	return &AuthorizingRule{
+		Action:     string(action),
+		Expression: d.Rules[action],
+		Identities: ids,
+	}, nil
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+)
+
+// TxStatus is the status of a batch of transactions.
+type TxStatus int
+
+const (
+	// TxPending means that none of the transactions is in a block yet.
+	TxPending TxStatus = iota
+	// TxPartial means that some, but not all, of the transactions are in a
+	// block.
+	TxPartial
+	// TxIncluded means that all the transactions are in a block.
+	TxIncluded
+)
+
+// String returns a readable output of the status.
+func (ts TxStatus) String() string {
+	switch ts {
+	case TxPending:
+		return "pending"
+	case TxPartial:
+		return "partial"
+	case TxIncluded:
+		return "included"
+	default:
+		return "invalid status"
+	}
+}
+
+// batchStatus returns the status of a batch with total transactions, of which
+// included are in a block.
+func batchStatus(included, total int) TxStatus {
+	switch {
+	case included == 0:
+		return TxPending
+	case included < total:
+		return TxPartial
+	default:
+		return TxIncluded
+	}
+}
+
+// batchTTL is the time after which a batch is forgotten, whether its
+// transactions have been included or not.
+const batchTTL = 10 * time.Minute
+
+// txBatch holds the transactions of a batch submitted to this node.
+type txBatch struct {
+	scID skipchain.SkipBlockID
+	// txHashes are the hashes of the instructions of every transaction.
+	txHashes [][]byte
+	// index of the latest block when the batch has been submitted, the
+	// transactions can only be in later blocks.
+	index int
+	// submitted is the time the batch has been submitted.
+	submitted time.Time
+}
+
+// evictBatches removes the batches submitted more than batchTTL before now.
+// The caller must hold batchesMut.
+func (s *Service) evictBatches(now time.Time) {
+	for id, b := range s.batches {
+		if now.Sub(b.submitted) > batchTTL {
+			delete(s.batches, id)
+		}
+	}
+}
+
+// AddTransactionBatch adds all the transactions of the request to the buffer
+// of the leader and returns the batch ID that can be given to GetTxStatus.
+// The batch ID only depends on the transactions, so the client can compute
+// it too.
+func (s *Service) AddTransactionBatch(req *AddTxBatchRequest) (*AddTxBatchResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	gen := s.db().GetByID(req.SkipchainID)
+	if gen == nil || gen.Index != 0 {
+		return nil, errors.New("skipchain ID is does not exist")
+	}
+	err := s.checkSubmitter(req.SkipchainID, req.Transactions.Hash(), req.Submitter)
+	if err != nil {
+		s.rejected(RejectionReason(err))
+		return nil, err
+	}
+	if len(req.Transactions) == 0 {
+		return nil, errors.New("no transactions to add")
+	}
+	if s.isHalted(req.SkipchainID) {
+		s.rejected(RejectionReason(ErrHalted))
+		return nil, ErrHalted
+	}
+	// Refuse the whole batch if any of the transactions is invalid.
+	for _, ct := range req.Transactions {
+		if err := ct.Validate(); err != nil {
+			return nil, errors.New("invalid transaction: " + err.Error())
+		}
+	}
+	// Likewise, a transaction refused by a policy refuses the batch.
+	for _, ct := range req.Transactions {
+		if err := s.admitTx(req.SkipchainID, ct); err != nil {
+			s.rejected(RejectAdmission)
+			return nil, err
+		}
+	}
+	latest, err := s.db().GetLatestByID(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &txBatch{scID: req.SkipchainID, index: latest.Index, submitted: time.Now()}
+	for _, ct := range req.Transactions {
+		s.txBuffer.add(string(req.SkipchainID), ct)
+		b.txHashes = append(b.txHashes, ct.Instructions.Hash())
+	}
+	batchID := req.Transactions.Hash()
+	s.batchesMut.Lock()
+	s.evictBatches(b.submitted)
+	s.batches[string(batchID)] = b
+	s.batchesMut.Unlock()
+	return &AddTxBatchResponse{
+		Version: CurrentVersion,
+		BatchID: batchID,
+	}, nil
+}
+
+// GetTxStatus returns how many transactions of a batch submitted to this node
+// are in a block. Once all the transactions are included and this has been
+// returned, the batch is forgotten. Batches are also forgotten batchTTL after
+// they have been submitted.
+func (s *Service) GetTxStatus(req *GetTxStatus) (*GetTxStatusResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	s.batchesMut.Lock()
+	s.evictBatches(time.Now())
+	b, ok := s.batches[string(req.BatchID)]
+	s.batchesMut.Unlock()
+	if !ok {
+		return nil, errors.New("unknown batch")
+	}
+	included, total, err := s.includedTxs(b)
+	if err != nil {
+		return nil, err
+	}
+	if included == total {
+		s.batchesMut.Lock()
+		delete(s.batches, string(req.BatchID))
+		s.batchesMut.Unlock()
+	}
+	return &GetTxStatusResponse{
+		Version:  CurrentVersion,
+		Status:   batchStatus(included, total),
+		Included: included,
+		Total:    total,
+	}, nil
+}
+
+// includedTxs returns how many of the different transactions of b are in the
+// blocks added since b has been submitted.
+func (s *Service) includedTxs(b *txBatch) (included, total int, err error) {
+	pending := make(map[string]bool)
+	for _, h := range b.txHashes {
+		pending[string(h)] = true
+	}
+	total = len(pending)
+	sb, err := s.db().GetLatestByID(b.scID)
+	if err != nil {
+		return
+	}
+	for sb.Index > b.index && len(pending) > 0 {
+		_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
+		if err != nil {
+			return 0, 0, err
+		}
+		body, ok := bodyI.(*DataBody)
+		if !ok {
+			return 0, 0, errors.New("couldn't unmarshal body")
+		}
+		for _, ct := range body.Transactions {
+			delete(pending, string(ct.Instructions.Hash()))
+		}
+		if len(sb.BackLinkIDs) == 0 {
+			break
+		}
+		sb, err = s.prevBlock(sb)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	included = total - len(pending)
+	return
+}
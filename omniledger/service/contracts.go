@@ -2,11 +2,16 @@ package service
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/omniledger/darc/expression"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
@@ -27,15 +32,75 @@ var zeroDarc = darc.ID(make([]byte, 32))
 // genesis-darc.
 var GenesisReferenceID = InstanceID{zeroDarc, SubID{}}
 
+// ErrInvalidInterval is returned if the block interval given to the config
+// contract is not a single, positive varint.
+var ErrInvalidInterval = errors.New("block interval must be a positive varint without trailing data")
+
 // ContractConfigID denotes a config-contract
 var ContractConfigID = "config"
 
 // ContractDarcID denotes a darc-contract
 var ContractDarcID = "darc"
 
+// CmdScheduledViewChange schedules a change of the roster for a future block.
+var CmdScheduledViewChange = "scheduled_view_change"
+
+// cmdApplyScheduledViewChange is sent by the leader in the block where the
+// scheduled change of the roster takes place.
+var cmdApplyScheduledViewChange = "apply_scheduled_view_change"
+
 // CmdDarcEvolve is needed to evolve a darc.
 var CmdDarcEvolve = "evolve"
 
+// CmdDarcCompact replaces a darc by a new darc with the same rules but
+// without the history of its evolutions.
+var CmdDarcCompact = "compact"
+
+// CmdDarcSpawnImported creates an instance exported from another skipchain
+// using ExportInstance. The instance keeps its SubID, value and contract, but
+// is governed by the darc the command is invoked on. The "source" argument
+// is the ID of the other skipchain, which must be in the ImportSources of the
+// config.
+var CmdDarcSpawnImported = "spawn_imported"
+
+// CmdDarcLockExport locks the instance in the "instance" argument, governed
+// by the darc the command is invoked on, so that it can only be imported
+// into the skipchain in the "destination" argument. The locked instance can
+// neither be changed nor deleted anymore.
+var CmdDarcLockExport = "lock_export"
+
+// instrError decorates err with the contract, the action and the instance of
+// inst, so that it can be related to the instruction in the logs.
+// ErrPreconditionFailed is returned as is, because it is checked by the
+// service.
+func instrError(contractID string, inst Instruction, err error) error {
+	if err == nil || err == ErrPreconditionFailed {
+		return err
+	}
+	return fmt.Errorf("contract=%s action=%s instance=%x: %v", contractID, inst.Action(),
+		inst.InstanceID.Slice(), err)
+}
+
+// checkEvolvable returns an error if the "_evolve" rule of the darc is
+// missing or cannot be satisfied, as the darc could never be evolved again.
+// The expressions have no negation, so a rule can be satisfied if it is true
+// when all the identities sign.
+func checkEvolvable(d *darc.Darc) error {
+	expr := d.Rules.GetEvolutionExpr()
+	if len(expr) == 0 {
+		return errors.New("the darc has no _evolve rule")
+	}
+	Y := expression.InitParser(func(string) bool { return true })
+	ok, err := expression.Evaluate(Y, expr)
+	if err != nil {
+		return errors.New("invalid _evolve rule: " + err.Error())
+	}
+	if !ok {
+		return errors.New("the _evolve rule cannot be satisfied")
+	}
+	return nil
+}
+
 // LoadConfigFromColl loads the configuration data from the collections.
 func LoadConfigFromColl(coll CollectionView) (*ChainConfig, error) {
 	// Find the genesis-darc ID.
@@ -111,9 +176,106 @@ func LoadDarcFromColl(coll CollectionView, key []byte) (*darc.Darc, error) {
 	return d, nil
 }
 
+// LoadInstanceDarc loads the darc that currently governs the instance iID.
+// Instances always point to the base ID of their darc, so the returned darc
+// is the latest evolution stored under that base ID.
+func LoadInstanceDarc(coll CollectionView, iID InstanceID) (*darc.Darc, error) {
+	d, err := LoadDarcFromColl(coll, InstanceID{iID.DarcID, SubID{}}.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if !d.GetBaseID().Equal(iID.DarcID) {
+		return nil, errors.New("darc stored for the instance has a different base ID")
+	}
+	return d, nil
+}
+
+// darcIdentity matches the delegations to other darcs in an expression.
+var darcIdentity = regexp.MustCompile(`darc:[0-9a-f]+`)
+
+// EffectiveRules returns the rules of the darc governing the instance iID,
+// where every delegation to another darc is replaced by the "_sign"
+// expression of that darc, recursively. The returned expressions only refer
+// to the final signers, so they tell who can really perform every action.
+// A delegation to a darc that doesn't exist or has no "_sign" rule can never
+// be satisfied and is kept as is.
+func EffectiveRules(coll CollectionView, iID InstanceID) (darc.Rules, error) {
+	d, err := LoadInstanceDarc(coll, iID)
+	if err != nil {
+		return nil, err
+	}
+	rules := make(darc.Rules, len(d.Rules))
+	for action, expr := range d.Rules {
+		rules[action], err = flattenExpr(coll, expr, map[string]bool{})
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %v", action, err)
+		}
+	}
+	return rules, nil
+}
+
+// flattenExpr replaces the delegations in expr with the "_sign" expressions
+// of the delegated darcs. path holds the delegations being replaced, to
+// detect cycles.
+func flattenExpr(coll CollectionView, expr expression.Expr, path map[string]bool) (expression.Expr, error) {
+	var err error
+	flat := darcIdentity.ReplaceAllStringFunc(string(expr), func(id string) string {
+		if err != nil {
+			return id
+		}
+		if path[id] {
+			err = errors.New("delegation cycle through " + id)
+			return id
+		}
+		darcID, errDec := hex.DecodeString(id[len("darc:"):])
+		if errDec != nil {
+			return id
+		}
+		delegated, errLoad := LoadDarcFromColl(coll, InstanceID{darcID, SubID{}}.Slice())
+		if errLoad != nil || !delegated.Rules.Contains("_sign") {
+			return id
+		}
+		path[id] = true
+		var sub expression.Expr
+		sub, err = flattenExpr(coll, delegated.Rules.GetSignExpr(), path)
+		delete(path, id)
+		return "(" + string(sub) + ")"
+	})
+	return expression.Expr(flat), err
+}
+
+// VerifyConfigGovernance checks that the genesis darc referenced by
+// GenesisReferenceID is stored in coll with the same base ID, and that the
+// config is stored under the key derived from this base ID. Only then is the
+// config governed by the genesis darc.
+func VerifyConfigGovernance(coll CollectionView) error {
+	val, contract, err := getValueContract(coll, GenesisReferenceID.Slice())
+	if err != nil {
+		return errors.New("couldn't load genesis reference: " + err.Error())
+	}
+	if contract != ContractConfigID {
+		return errors.New("genesis reference is not a " + ContractConfigID)
+	}
+	if len(val) != darcIDLen {
+		return errors.New("genesis reference has an invalid length")
+	}
+	configID := InstanceID{
+		DarcID: darc.ID(val),
+		SubID:  oneSubID,
+	}
+	if _, err = LoadInstanceDarc(coll, configID); err != nil {
+		return errors.New("couldn't load genesis darc: " + err.Error())
+	}
+	if _, err = LoadConfigFromColl(coll); err != nil {
+		return errors.New("couldn't load config: " + err.Error())
+	}
+	return nil
+}
+
 // ContractConfig can only be instantiated once per skipchain, and only for
 // the genesis block.
 func (s *Service) ContractConfig(cdb CollectionView, inst Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	defer func() { err = instrError(ContractConfigID, inst, err) }()
 	if inst.GetType() == SpawnType {
 		return s.spawnContractConfig(cdb, inst, coins)
 	} else if inst.GetType() == InvokeType {
@@ -142,6 +304,37 @@ func (s *Service) invokeContractConfig(cdb CollectionView, inst Instruction, coi
 			err = errors.New("block interval is less than or equal to zero")
 			return
 		}
+		if newConfig.MaxStateChanges < 0 {
+			err = errors.New("maximum number of state changes is negative")
+			return
+		}
+		if newConfig.InstructionTimeout < 0 {
+			err = errors.New("instruction timeout is negative")
+			return
+		}
+		if newConfig.NoncePolicy < NonceAny || newConfig.NoncePolicy > NonceNext {
+			err = errors.New("unknown nonce policy")
+			return
+		}
+		if newConfig.LeaderPolicy < LeaderFirst || newConfig.LeaderPolicy > LeaderBeacon {
+			err = errors.New("unknown leader policy")
+			return
+		}
+		for _, q := range newConfig.StorageQuotas {
+			if q.MaxBytes < 0 {
+				err = errors.New("storage quota of " + q.ContractID + " is negative")
+				return
+			}
+		}
+		var config *ChainConfig
+		config, err = LoadConfigFromColl(cdb)
+		if err != nil {
+			return
+		}
+		if newConfig.ConfigVersion != config.ConfigVersion+1 {
+			err = fmt.Errorf("config version must be %d, got %d", config.ConfigVersion+1, newConfig.ConfigVersion)
+			return
+		}
 		sc = []StateChange{
 			NewStateChange(Update, InstanceID{
 				DarcID: inst.InstanceID.DarcID,
@@ -155,6 +348,14 @@ func (s *Service) invokeContractConfig(cdb CollectionView, inst Instruction, coi
 		if err != nil {
 			return
 		}
+		// As for update_config, the version of the new config makes
+		// sure that a view-change cannot be replayed.
+		versionBuf := inst.Invoke.Args.Search("version")
+		version, n := binary.Uvarint(versionBuf)
+		if n <= 0 || n != len(versionBuf) || version != config.ConfigVersion+1 {
+			err = fmt.Errorf("view-change must be for config version %d", config.ConfigVersion+1)
+			return
+		}
 		newRosterBuf := inst.Invoke.Args.Search("roster")
 		newRoster := onet.Roster{}
 		err = protobuf.DecodeWithConstructors(newRosterBuf, &newRoster, network.DefaultConstructors(cothority.Suite))
@@ -164,11 +365,137 @@ func (s *Service) invokeContractConfig(cdb CollectionView, inst Instruction, coi
 		if err = validRotation(config.Roster, newRoster); err != nil {
 			return
 		}
-		if err = s.withinInterval(inst.InstanceID.DarcID, inst.Signatures[0].Signer.Ed25519.Point); err != nil {
+		// The node taking over leads the new roster.
+		if len(inst.Signatures) != 1 || inst.Signatures[0].Signer.Ed25519 == nil {
+			err = errors.New("view-change must be signed by the node changing the view")
+			return
+		}
+		signer := inst.Signatures[0].Signer.Ed25519
+		if !newRoster.List[0].Public.Equal(signer.Point) {
+			err = errors.New("the new roster must start with the node changing the view")
+			return
+		}
+		if err = s.withinInterval(inst.InstanceID.DarcID, signer.Point); err != nil {
 			return
 		}
 		sc, err = updateRosterScs(cdb, inst.InstanceID.DarcID, newRoster)
 		return
+	} else if inst.Invoke.Command == CmdScheduledViewChange {
+		// The rotation is checked now, so that the client knows
+		// early if it is invalid, and again when it is applied.
+		var config *ChainConfig
+		config, err = LoadConfigFromColl(cdb)
+		if err != nil {
+			return
+		}
+		newRosterBuf := inst.Invoke.Args.Search("roster")
+		newRoster := onet.Roster{}
+		err = protobuf.DecodeWithConstructors(newRosterBuf, &newRoster, network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return
+		}
+		if err = validRotation(config.Roster, newRoster); err != nil {
+			return
+		}
+		indexBuf := inst.Invoke.Args.Search("index")
+		index, n := binary.Varint(indexBuf)
+		if n != len(indexBuf) || index <= 0 {
+			err = errors.New("index must be a positive varint without trailing data")
+			return
+		}
+		// That the index is after the block holding this instruction
+		// depends on the tip of the node, so it is checked by
+		// verifyScheduledIndex before the instruction is executed,
+		// not here. A block scheduling a change too early is refused
+		// by verifySkipBlock, as the change is then due.
+		config.ScheduledRosterChange = &ScheduledRosterChange{
+			Index:  int(index),
+			Roster: newRoster,
+		}
+		sc, err = updateConfigScs(inst.InstanceID.DarcID, config)
+		return
+	} else if inst.Invoke.Command == cmdApplyScheduledViewChange {
+		var config *ChainConfig
+		config, err = LoadConfigFromColl(cdb)
+		if err != nil {
+			return
+		}
+		scheduled := config.ScheduledRosterChange
+		if scheduled == nil {
+			err = errors.New("no scheduled view-change")
+			return
+		}
+		// If the rotation is not valid anymore, the scheduled change
+		// is dropped without changing the roster.
+		config.ScheduledRosterChange = nil
+		if err = validRotation(config.Roster, scheduled.Roster); err != nil {
+			log.Lvl2("dropping scheduled view-change:", err)
+		} else {
+			config.Roster = scheduled.Roster
+		}
+		sc, err = updateConfigScs(inst.InstanceID.DarcID, config)
+		return
+	} else if inst.Invoke.Command == cmdExpireInstances {
+		var ts int64
+		ts, err = expireTimestamp(inst)
+		if err != nil {
+			return
+		}
+		sc, err = expireInstancesScs(cdb, ts)
+		return
+	} else if inst.Invoke.Command == CmdReportEquivocation {
+		// The equivocating node is moved to the end of the roster.
+		// As nodes don't hold any stake, it cannot be punished
+		// further.
+		var config *ChainConfig
+		config, err = LoadConfigFromColl(cdb)
+		if err != nil {
+			return
+		}
+		e := Equivocation{}
+		err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("evidence"), &e,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return
+		}
+		if err = e.Verify(); err != nil {
+			return
+		}
+		var scID skipchain.SkipBlockID
+		scID, err = s.scIDFromGenesisDarc(inst.InstanceID.DarcID)
+		if err != nil {
+			return
+		}
+		if !e.First.SkipChainID.Equal(scID) {
+			err = errors.New("evidence is for another skipchain")
+			return
+		}
+		if len(config.Roster.List) < 2 {
+			err = errors.New("cannot replace the leader of a single-node chain")
+			return
+		}
+		// If a view-change already happened, the equivocating node
+		// might not be the leader anymore, but it still must not
+		// become leader again soon.
+		var list []*network.ServerIdentity
+		var leader *network.ServerIdentity
+		for _, si := range config.Roster.List {
+			if si.Public.Equal(e.First.Leader) {
+				leader = si
+			} else {
+				list = append(list, si)
+			}
+		}
+		if leader == nil {
+			err = errors.New("equivocating node is not in the roster")
+			return
+		}
+		config.Roster = *onet.NewRoster(append(list, leader))
+		sc, err = updateConfigScs(inst.InstanceID.DarcID, config)
+		return
+	} else if inst.Invoke.Command == CmdRevokeIdentity || inst.Invoke.Command == CmdUnrevokeIdentity {
+		sc, err = revocationScs(cdb, inst, inst.Invoke.Command == CmdRevokeIdentity)
+		return
 	}
 	err = errors.New("invalid invoke command: " + inst.Invoke.Command)
 	return
@@ -180,7 +507,15 @@ func updateRosterScs(cdb CollectionView, darcID darc.ID, newRoster onet.Roster)
 		return nil, err
 	}
 	config.Roster = newRoster
-	configBuf, err := protobuf.Encode(config)
+	return updateConfigScs(darcID, config)
+}
+
+// updateConfigScs returns the state change storing config as the next version
+// of the config. The given config is not changed.
+func updateConfigScs(darcID darc.ID, config *ChainConfig) (StateChanges, error) {
+	next := *config
+	next.ConfigVersion++
+	configBuf, err := protobuf.Encode(&next)
 	if err != nil {
 		return nil, err
 	}
@@ -192,8 +527,15 @@ func updateRosterScs(cdb CollectionView, darcID darc.ID, newRoster onet.Roster)
 	}, nil
 }
 
+// validRotation checks that newRoster is a rotation of oldRoster. A
+// single-node roster has no other rotation than itself, so for single-node
+// chains only the unchanged roster is accepted.
 func validRotation(oldRoster, newRoster onet.Roster) error {
-	if !oldRoster.IsRotation(&newRoster) {
+	if len(oldRoster.List) == 1 {
+		if len(newRoster.List) != 1 || !oldRoster.List[0].Equal(newRoster.List[0]) {
+			return errors.New("a single-node roster can only be rotated to itself")
+		}
+	} else if !oldRoster.IsRotation(&newRoster) {
 		return errors.New("the new roster is not a valid rotation of the old roster")
 	}
 	newRoster2 := onet.NewRoster(newRoster.List)
@@ -217,6 +559,9 @@ func (s *Service) spawnContractConfig(cdb CollectionView, inst Instruction, coin
 	if len(d.Rules) == 0 {
 		return nil, nil, errors.New("don't accept darc with empty rules")
 	}
+	if err = d.Rules.Validate(); err != nil {
+		return
+	}
 	if err = d.Verify(true); err != nil {
 		log.Error("couldn't verify darc")
 		return
@@ -224,9 +569,9 @@ func (s *Service) spawnContractConfig(cdb CollectionView, inst Instruction, coin
 
 	// sanity check the block interval
 	intervalBuf := inst.Spawn.Args.Search("block_interval")
-	interval, _ := binary.Varint(intervalBuf)
-	if interval <= 0 {
-		err = errors.New("block interval is less or equal to zero")
+	interval, n := binary.Varint(intervalBuf)
+	if n != len(intervalBuf) || interval <= 0 {
+		err = ErrInvalidInterval
 		return
 	}
 
@@ -262,29 +607,36 @@ func (s *Service) spawnContractConfig(cdb CollectionView, inst Instruction, coin
 // ContractDarc accepts the following instructions:
 //   - Spawn - creates a new darc
 //   - Invoke.Evolve - evolves an existing darc
-func (s *Service) ContractDarc(coll CollectionView, inst Instruction, coins []Coin) ([]StateChange, []Coin, error) {
+//   - Invoke.Compact - replaces an existing darc by a new darc with the
+//     same rules, see compactDarcScs
+//   - Invoke.SpawnImported - imports an instance from another skipchain,
+//     see spawnImportedScs
+//   - Invoke.LockExport - locks an instance for its export to another
+//     skipchain, see lockExportScs
+//
+// Spawning other contracts under the authority of a darc doesn't go through
+// this contract: the contract of a spawn instruction is always looked up with
+// Spawn.ContractID, and the darc is only used to verify the signatures. So
+// ContractDarc refuses to spawn anything but a darc, in case it gets called
+// directly, e.g. by another contract.
+func (s *Service) ContractDarc(coll CollectionView, inst Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	defer func() { err = instrError(ContractDarcID, inst, err) }()
 	switch {
 	case inst.Spawn != nil:
-		if inst.Spawn.ContractID == ContractDarcID {
-			darcBuf := inst.Spawn.Args.Search("darc")
-			d, err := darc.NewFromProtobuf(darcBuf)
-			if err != nil {
-				return nil, nil, errors.New("given darc could not be decoded: " + err.Error())
-			}
-			return []StateChange{
-				NewStateChange(Create, InstanceID{d.GetBaseID(), SubID{}}, ContractDarcID, darcBuf),
-			}, coins, nil
+		if inst.Spawn.ContractID != ContractDarcID {
+			return nil, nil, errors.New("darc contract can only spawn darcs, not " + inst.Spawn.ContractID)
+		}
+		darcBuf := inst.Spawn.Args.Search("darc")
+		d, err := darc.NewFromProtobuf(darcBuf)
+		if err != nil {
+			return nil, nil, errors.New("given darc could not be decoded: " + err.Error())
 		}
-		// TODO The code below will never get called because this
-		// contract is used only when tx.Spawn.ContractID is "darc", so
-		// the if statement above gets executed and this contract
-		// returns. Why do we need this part, if we do, how should we
-		// fix it?
-		c, found := s.contracts[inst.Spawn.ContractID]
-		if !found {
-			return nil, nil, errors.New("couldn't find this contract type")
+		if err := d.Rules.Validate(); err != nil {
+			return nil, nil, err
 		}
-		return c(coll, inst, coins)
+		return []StateChange{
+			NewStateChange(Create, InstanceID{d.GetBaseID(), SubID{}}, ContractDarcID, darcBuf),
+		}, coins, nil
 	case inst.Invoke != nil:
 		switch inst.Invoke.Command {
 		case "evolve":
@@ -300,9 +652,33 @@ func (s *Service) ContractDarc(coll CollectionView, inst Instruction, coins []Co
 			if err := newD.SanityCheck(oldD); err != nil {
 				return nil, nil, err
 			}
+			if len(inst.Invoke.Args.Search("allow_freeze")) == 0 {
+				if err := checkEvolvable(newD); err != nil {
+					return nil, nil, errors.New(err.Error() +
+						", the argument allow_freeze is needed to freeze the darc")
+				}
+			}
 			return []StateChange{
 				NewStateChange(Update, inst.InstanceID, ContractDarcID, darcBuf),
 			}, coins, nil
+		case CmdDarcCompact:
+			scs, err := compactDarcScs(coll, inst)
+			if err != nil {
+				return nil, nil, err
+			}
+			return scs, coins, nil
+		case CmdDarcSpawnImported:
+			scs, err := s.spawnImportedScs(coll, inst)
+			if err != nil {
+				return nil, nil, err
+			}
+			return scs, coins, nil
+		case CmdDarcLockExport:
+			scs, err := lockExportScs(coll, inst)
+			if err != nil {
+				return nil, nil, err
+			}
+			return scs, coins, nil
 		default:
 			return nil, nil, errors.New("invalid command: " + inst.Invoke.Command)
 		}
@@ -310,3 +686,69 @@ func (s *Service) ContractDarc(coll CollectionView, inst Instruction, coins []Co
 		return nil, nil, errors.New("Only invoke and spawn are defined yet")
 	}
 }
+
+// compactDarcScs returns the state changes replacing the darc of inst by a
+// new darc of version 0 with the same rules, so it has a new base ID. The
+// instances governed by the darc that are listed in the "instances" argument,
+// as concatenated SubIDs, are moved to the new base ID. Instances that are
+// not listed, and darcs delegating to the old darc, cannot be authorized
+// anymore. As this changes the IDs of instances, the genesis darc must
+// authorize the instruction too, as an additional darc.
+func compactDarcScs(coll CollectionView, inst Instruction) (StateChanges, error) {
+	if inst.InstanceID.SubID != (SubID{}) {
+		return nil, errors.New("can only compact a darc instance")
+	}
+	genesisDarcID, _, err := coll.GetValues(GenesisReferenceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if inst.InstanceID.DarcID.Equal(genesisDarcID) {
+		return nil, errors.New("cannot compact the genesis darc")
+	}
+	var authorized bool
+	for _, id := range inst.AdditionalDarcs {
+		if id.Equal(genesisDarcID) {
+			authorized = true
+		}
+	}
+	if !authorized {
+		return nil, errors.New("compacting a darc must be authorized by the genesis darc")
+	}
+	oldD, err := LoadDarcFromColl(coll, inst.InstanceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	newD := darc.NewDarc(oldD.Copy().Rules, oldD.Description)
+	// The previous ID makes the new base ID unique, even if the rules are
+	// still the ones of the first version of the darc.
+	newD.PrevID = oldD.GetID()
+	newID := newD.GetBaseID()
+	darcBuf, err := newD.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	scs := StateChanges{
+		NewStateChange(Remove, inst.InstanceID, ContractDarcID, nil),
+		NewStateChange(Create, InstanceID{newID, SubID{}}, ContractDarcID, darcBuf),
+	}
+
+	subIDs := inst.Invoke.Args.Search("instances")
+	if len(subIDs)%len(SubID{}) != 0 {
+		return nil, errors.New("instances must be concatenated SubIDs")
+	}
+	for i := 0; i < len(subIDs); i += len(SubID{}) {
+		sub := NewSubID(subIDs[i : i+len(SubID{})])
+		if sub == (SubID{}) {
+			return nil, errors.New("the darc itself cannot be moved")
+		}
+		oldID := InstanceID{inst.InstanceID.DarcID, sub}
+		value, contractID, err := coll.GetValues(oldID.Slice())
+		if err != nil {
+			return nil, errors.New("couldn't move instance: " + err.Error())
+		}
+		scs = append(scs,
+			NewStateChange(Remove, oldID, contractID, nil),
+			NewStateChange(Create, InstanceID{newID, sub}, contractID, value))
+	}
+	return scs, nil
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// CmdReportEquivocation submits an Equivocation to the config instance in
+// the "evidence" argument. The equivocating node is moved to the end of the
+// roster.
+var CmdReportEquivocation = "report_equivocation"
+
+// hash returns the message signed by the leader.
+func (p Proposal) hash() []byte {
+	h := sha256.New()
+	h.Write(p.SkipChainID)
+	binary.Write(h, binary.LittleEndian, int64(p.Index))
+	h.Write(p.Header)
+	return h.Sum(nil)
+}
+
+// Verify checks the signature of the leader on the proposal.
+func (p Proposal) Verify() error {
+	if p.Leader == nil {
+		return errors.New("proposal has no leader")
+	}
+	return schnorr.Verify(cothority.Suite, p.Leader, p.hash(), p.Signature)
+}
+
+// Verify checks that both proposals are correctly signed by the same leader,
+// and that they propose different blocks at the same index of the same
+// skipchain.
+func (e Equivocation) Verify() error {
+	if err := e.First.Verify(); err != nil {
+		return errors.New("first proposal: " + err.Error())
+	}
+	if err := e.Second.Verify(); err != nil {
+		return errors.New("second proposal: " + err.Error())
+	}
+	if !e.First.Leader.Equal(e.Second.Leader) {
+		return errors.New("proposals are from different leaders")
+	}
+	if !e.First.SkipChainID.Equal(e.Second.SkipChainID) ||
+		e.First.Index != e.Second.Index {
+		return errors.New("proposals are for different blocks")
+	}
+	if bytes.Equal(e.First.Header, e.Second.Header) {
+		return errors.New("proposals are the same")
+	}
+	return nil
+}
+
+// signProposal returns the proposal of this node for the block with the
+// given index and header.
+func (s *Service) signProposal(scID skipchain.SkipBlockID, index int, header []byte) (*Proposal, error) {
+	p := &Proposal{
+		SkipChainID: scID,
+		Index:       index,
+		Header:      header,
+		Leader:      s.ServerIdentity().Public,
+	}
+	var err error
+	p.Signature, err = schnorr.Sign(cothority.Suite, s.getPrivateKey(), p.hash())
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// verifyProposal checks that the proposal is signed by a node of the roster
+// and is for newSB. It returns an error if the same leader already proposed
+// another block with the same index, which this node endorsed.
+func (s *Service) verifyProposal(newSB *skipchain.SkipBlock, p *Proposal) error {
+	if p == nil {
+		return errors.New("block has no proposal")
+	}
+	roster := newSB.Roster
+	var scID skipchain.SkipBlockID
+	if newSB.Index > 0 {
+		scID = newSB.SkipChainID()
+		if len(newSB.BackLinkIDs) == 0 {
+			return errors.New("block has no backlink")
+		}
+		prev := s.db().GetByID(newSB.BackLinkIDs[0])
+		if prev == nil {
+			return errors.New("didn't find previous block")
+		}
+		roster = prev.Roster
+	}
+	if !p.SkipChainID.Equal(scID) || p.Index != newSB.Index ||
+		!bytes.Equal(p.Header, newSB.Data) {
+		return errors.New("proposal is for another block")
+	}
+	inRoster := false
+	for _, si := range roster.List {
+		if si.Public.Equal(p.Leader) {
+			inRoster = true
+			break
+		}
+	}
+	if !inRoster {
+		return errors.New("proposal is not from a node of the roster")
+	}
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if scID.IsNull() {
+		return nil
+	}
+	config, err := s.LoadConfig(scID)
+	if err != nil {
+		return err
+	}
+	queue, err := leaderQueue(roster, newSB.Index, newSB.BackLinkIDs[0], config.LeaderPolicy)
+	if err != nil {
+		return err
+	}
+	// A block changing the roster can also come from a node taking over
+	// from a failing leader. It then leads the new roster, and the
+	// view_change contract checks that it is its turn.
+	if !queue[0].Public.Equal(p.Leader) {
+		if newSB.Roster.ID.Equal(roster.ID) || !newSB.Roster.List[0].Public.Equal(p.Leader) {
+			return ErrWrongLeader
+		}
+	}
+
+	s.proposalsMut.Lock()
+	defer s.proposalsMut.Unlock()
+	endorsed, ok := s.proposals[string(scID)]
+	if ok && endorsed.Index == p.Index && endorsed.Leader.Equal(p.Leader) &&
+		!bytes.Equal(endorsed.Header, p.Header) {
+		log.Warnf("%s: leader %s is equivocating at block %d", s.ServerIdentity(),
+			p.Leader, p.Index)
+		s.equivocations[string(scID)] = append(s.equivocations[string(scID)],
+			Equivocation{First: endorsed, Second: *p})
+		return errors.New("leader already proposed another block")
+	}
+	return nil
+}
+
+// endorseProposal stores the proposal of a block this node verified, to
+// detect a leader proposing other blocks with the same index.
+func (s *Service) endorseProposal(p Proposal) {
+	if p.SkipChainID.IsNull() {
+		return
+	}
+	s.proposalsMut.Lock()
+	defer s.proposalsMut.Unlock()
+	s.proposals[string(p.SkipChainID)] = p
+}
+
+// dropOwnReports removes from cts the transactions reporting an
+// equivocation of this node. A block moving its leader to the end of the
+// roster can only be stored by the next leader, so the other nodes have to
+// replace an equivocating leader with a view-change first.
+func (s *Service) dropOwnReports(cts ClientTransactions) ClientTransactions {
+	var ctsOut ClientTransactions
+clientTransactions:
+	for _, ct := range cts {
+		for _, instr := range ct.Instructions {
+			if instr.Invoke == nil || instr.Invoke.Command != CmdReportEquivocation {
+				continue
+			}
+			e := Equivocation{}
+			err := protobuf.DecodeWithConstructors(instr.Invoke.Args.Search("evidence"), &e,
+				network.DefaultConstructors(cothority.Suite))
+			if err == nil && e.First.Leader != nil && e.First.Leader.Equal(s.ServerIdentity().Public) {
+				log.Lvl2(s.ServerIdentity(), "dropping report of its own equivocation")
+				continue clientTransactions
+			}
+		}
+		ctsOut = append(ctsOut, ct)
+	}
+	return ctsOut
+}
+
+// maxProposalRetries is the number of times a block that could not be
+// stored is proposed again, before it is dropped.
+const maxProposalRetries = 3
+
+// proposedBlock is a block proposed by this node as a leader.
+type proposedBlock struct {
+	index int
+	block *skipchain.SkipBlock
+	// retries counts the times the block has been proposed again.
+	retries int
+}
+
+// setProposed records the block this node proposes with the given index on
+// the skipchain scID, or forgets it if sb is nil.
+func (s *Service) setProposed(scID skipchain.SkipBlockID, index int, sb *skipchain.SkipBlock) {
+	s.proposalsMut.Lock()
+	defer s.proposalsMut.Unlock()
+	if sb == nil {
+		delete(s.proposed, string(scID))
+		return
+	}
+	s.proposed[string(scID)] = proposedBlock{index, sb}
+}
+
+// retryProposal returns a copy of the block this node proposed with the
+// given index on the skipchain scID and that wasn't stored, or nil if there
+// is none. A block that has been refused maxProposalRetries times is
+// dropped, as the other nodes will never accept it, and a new block is
+// proposed instead.
+func (s *Service) retryProposal(scID skipchain.SkipBlockID, index int) *skipchain.SkipBlock {
+	s.proposalsMut.Lock()
+	defer s.proposalsMut.Unlock()
+	p, ok := s.proposed[string(scID)]
+	if !ok || p.index != index {
+		return nil
+	}
+	if p.retries >= maxProposalRetries {
+		log.Warnf("%s: dropping block %d that could not be stored", s.ServerIdentity(), index)
+		delete(s.proposed, string(scID))
+		return nil
+	}
+	p.retries++
+	s.proposed[string(scID)] = p
+	return p.block.Copy()
+}
+
+// Equivocations returns the evidence of equivocating leaders this node found
+// on the skipchain scID. It can be submitted to the config instance with
+// the CmdReportEquivocation command.
+func (s *Service) Equivocations(scID skipchain.SkipBlockID) []Equivocation {
+	s.proposalsMut.Lock()
+	defer s.proposalsMut.Unlock()
+	return append([]Equivocation{}, s.equivocations[string(scID)]...)
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/dedis/cothority/omniledger/collection"
+	"github.com/dedis/onet/log"
+)
+
+// execParams are the parameters of the chain used to execute the
+// transactions of a block.
+type execParams struct {
+	maxScs       int
+	recordFailed bool
+	noncePolicy  NoncePolicy
+	timestamp    int64
+	// usage is only read during the execution of a transaction, the
+	// changes are committed in the order of the transactions.
+	usage *storageUsage
+	// effects, if not nil, gets the state changes of every instruction of
+	// every accepted transaction, keyed by the hash of its instructions.
+	effects map[string][]StateChanges
+	// rejections, if not nil, gets the error of every rejected
+	// transaction, keyed by the hash of its instructions.
+	rejections map[string]error
+	// proofRoots are the roots the read proofs of the transactions can
+	// be made against.
+	proofRoots provenRoots
+}
+
+// trackingView is a CollectionView that records the keys that are read.
+type trackingView struct {
+	*roCollection
+	keys    map[string]bool
+	keysMut sync.Mutex
+	// proven holds the values of the read proofs of the transaction, and
+	// provenReads counts the reads they answered.
+	proven      map[string][][]byte
+	provenReads int
+}
+
+func newTrackingView(coll *collection.Collection) *trackingView {
+	return &trackingView{
+		roCollection: &roCollection{coll},
+		keys:         make(map[string]bool),
+		proven:       make(map[string][][]byte),
+	}
+}
+
+// useProofs keeps the values of the proofs made against one of the roots,
+// of keys that are neither written since that root nor in written. Stale or
+// inconsistent proofs are ignored, so the keys they prove are read from the
+// collection.
+func (t *trackingView) useProofs(proofs []collection.Proof, roots provenRoots, written map[string]bool) {
+	for _, p := range proofs {
+		since, ok := roots[string(p.TreeRootHash())]
+		if !ok || since[string(p.Key)] || written[string(p.Key)] {
+			log.Lvl3("stale read proof, reading from the collection")
+			continue
+		}
+		if !p.Consistent() || !p.Match() {
+			continue
+		}
+		values, err := p.RawValues()
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		t.proven[string(p.Key)] = values
+	}
+}
+
+// written tracks a key that is changed by the transaction. A proof of the
+// key no longer holds.
+func (t *trackingView) written(key []byte) {
+	t.track(key)
+	t.keysMut.Lock()
+	delete(t.proven, string(key))
+	t.keysMut.Unlock()
+}
+
+func (t *trackingView) track(key []byte) {
+	t.keysMut.Lock()
+	t.keys[string(key)] = true
+	t.keysMut.Unlock()
+}
+
+// Get records the key and returns its collection.Getter.
+func (t *trackingView) Get(key []byte) collection.Getter {
+	t.track(key)
+	return t.roCollection.Get(key)
+}
+
+// GetValues records the key and returns its value and contractID, taken
+// from the read proofs if one proves the key.
+func (t *trackingView) GetValues(key []byte) (value []byte, contractID string, err error) {
+	t.track(key)
+	t.keysMut.Lock()
+	values, ok := t.proven[string(key)]
+	if ok {
+		t.provenReads++
+	}
+	t.keysMut.Unlock()
+	if ok {
+		return values[0], string(values[1]), nil
+	}
+	return t.roCollection.GetValues(key)
+}
+
+// touched returns true if one of the keys has been read or written.
+func (t *trackingView) touched(keys map[string]bool) bool {
+	t.keysMut.Lock()
+	defer t.keysMut.Unlock()
+	for k := range t.keys {
+		if keys[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// txResult is the outcome of the execution of a transaction.
+type txResult struct {
+	// ct is the transaction, with its failed-precondition marker set.
+	ct ClientTransaction
+	// accepted is true if the transaction goes into the block.
+	accepted bool
+	// states are the state changes of an accepted transaction, and coll
+	// the collection they have been applied to.
+	states StateChanges
+	coll   *collection.Collection
+	// instrStates are the state changes of every instruction, whose
+	// concatenation is states.
+	instrStates []StateChanges
+	// cout are the coins passed on to the next transaction.
+	cout []Coin
+	// usage is the change of the storage of the contracts with a quota.
+	usage map[string]int
+	// view holds the keys the transaction read or wrote.
+	view *trackingView
+	// err is the reason a transaction is not accepted.
+	err error
+}
+
+// executeTx executes the transaction on a clone of coll, with the coins cin
+// left by the previous transactions and written the keys they changed.
+func (s *Service) executeTx(coll *collection.Collection, ct ClientTransaction, cin []Coin, written map[string]bool,
+	p execParams) (r txResult) {
+	// Make a new collection for each transaction. If the transaction is
+	// sucessfully implemented and changes applied, then keep it,
+	// otherwise dump it.
+	cdbI := newTrackingView(coll.Clone())
+	cdbI.useProofs(ct.ReadProofs, p.proofRoots, written)
+	r = txResult{ct: ct, cout: cin, usage: make(map[string]int), view: cdbI}
+	// Only the execution decides whether a precondition failed.
+	r.ct.FailedPrecondition = false
+	var txStates StateChanges
+	for _, instr := range ct.Instructions {
+		if err := checkRevokedSigners(cdbI, ct, instr); err != nil {
+			log.Errorf("%s: %s", s.ServerIdentity(), err)
+			r.err = err
+			return
+		}
+		scs, cout, err := s.executeInstruction(cdbI, r.cout, instr)
+		r.err = err
+		if err == ErrPreconditionFailed && p.recordFailed {
+			log.Lvlf2("%s: recording transaction with failed precondition", s.ServerIdentity())
+			r.ct.FailedPrecondition = true
+			r.accepted = true
+			return
+		}
+		if err != nil {
+			log.Errorf("%s: Call to contract returned error: %s", s.ServerIdentity(), err)
+			return
+		}
+		scs, err = addExpiries(cdbI, instr, scs, p.timestamp)
+		r.err = err
+		if err != nil {
+			log.Errorf("%s: couldn't add expiry: %s", s.ServerIdentity(), err)
+			return
+		}
+		scs, err = removeVersions(cdbI, scs)
+		r.err = err
+		if err != nil {
+			log.Errorf("%s: couldn't remove versions: %s", s.ServerIdentity(), err)
+			return
+		}
+		scs, err = addNonce(cdbI, instr, scs, p.noncePolicy)
+		r.err = err
+		if err != nil {
+			log.Errorf("%s: %s", s.ServerIdentity(), err)
+			return
+		}
+		if len(txStates)+len(scs) > p.maxScs {
+			log.Errorf("%s: %s", s.ServerIdentity(), ErrTooManyStateChanges)
+			r.err = ErrTooManyStateChanges
+			return
+		}
+		for _, sc := range scs {
+			cdbI.written(sc.InstanceID)
+			var before footprint
+			if p.usage != nil {
+				before = instanceFootprint(cdbI, sc.InstanceID)
+			}
+			if err := storeInColl(cdbI.c, &sc); err != nil {
+				log.Error("failed to add to collections with error: " + err.Error())
+				r.err = err
+				return
+			}
+			if p.usage != nil {
+				p.usage.change(r.usage, before, instanceFootprint(cdbI, sc.InstanceID))
+			}
+		}
+		txStates = append(txStates, scs...)
+		r.instrStates = append(r.instrStates, scs)
+		r.cout = cout
+	}
+	r.accepted = true
+	r.states = txStates
+	r.coll = cdbI.c
+	return
+}
+
+// executeTxs executes the transactions in order on a clone of coll and
+// returns the resulting collection, the transactions going into the block
+// and their state changes.
+//
+// If parallel is true, all the transactions are first executed concurrently
+// on the collection as it is before the block. Then their results are taken
+// in order, unless the transaction read or wrote a key written by an earlier
+// transaction of the block, or got coins from it: such a transaction is
+// executed again on the current collection. So the result is the same as
+// with a sequential execution, which is needed for all the nodes to agree.
+func (s *Service) executeTxs(coll *collection.Collection, cts ClientTransactions, p execParams, parallel bool) (
+	cdbTemp *collection.Collection, ctsOK ClientTransactions, states StateChanges) {
+	cdbTemp = coll.Clone()
+	var speculated []txResult
+	if parallel {
+		speculated = make([]txResult, len(cts))
+		var wg sync.WaitGroup
+		workers := make(chan bool, runtime.NumCPU())
+		for i := range cts {
+			wg.Add(1)
+			workers <- true
+			go func(i int) {
+				defer wg.Done()
+				speculated[i] = s.executeTx(cdbTemp, cts[i], nil, nil, p)
+				<-workers
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	var cin []Coin
+	written := make(map[string]bool)
+	for i, ct := range cts {
+		var r txResult
+		fresh := true
+		if parallel && len(cin) == 0 && !speculated[i].view.touched(written) {
+			r = speculated[i]
+			fresh = false
+		} else {
+			r = s.executeTx(cdbTemp, ct, cin, written, p)
+		}
+		cin = r.cout
+		if !r.accepted {
+			if p.rejections != nil {
+				p.rejections[string(ct.Instructions.Hash())] = r.err
+			}
+			continue
+		}
+		if r.ct.FailedPrecondition {
+			ctsOK = append(ctsOK, r.ct)
+			continue
+		}
+		if p.usage != nil {
+			if err := p.usage.commit(r.usage); err != nil {
+				log.Errorf("%s: %s", s.ServerIdentity(), err)
+				if p.rejections != nil {
+					p.rejections[string(ct.Instructions.Hash())] = err
+				}
+				continue
+			}
+		}
+		if fresh {
+			cdbTemp = r.coll
+		} else {
+			// The keys of the transaction are untouched by the
+			// earlier ones, so its state changes have the same
+			// effect on the current collection.
+			for _, sc := range r.states {
+				if err := storeInColl(cdbTemp, &sc); err != nil {
+					log.Error("failed to add to collections with error: " + err.Error())
+				}
+			}
+		}
+		for _, sc := range r.states {
+			written[string(sc.InstanceID)] = true
+		}
+		ctsOK = append(ctsOK, r.ct)
+		states = append(states, r.states...)
+		if p.effects != nil {
+			p.effects[string(r.ct.Instructions.Hash())] = r.instrStates
+		}
+	}
+	return
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// cmdExpireInstances is sent by the leader to remove the instances whose TTL
+// has passed. The "timestamp" argument must be the timestamp of the block.
+var cmdExpireInstances = "expire_instances"
+
+// ttlArgument is the name of the argument of a spawn instruction giving the
+// TTL of the instances it creates. It starts with an underscore, like the
+// actions reserved by darcs, so it doesn't clash with the arguments of the
+// contracts.
+const ttlArgument = "_ttl"
+
+// expiryBucketSeconds is the width of the time buckets holding the expiry
+// times, so that spawning an instance with a TTL only reads and writes the
+// instances expiring around the same time.
+const expiryBucketSeconds = 60
+
+// expirySubID is the subid for storing the range of the buckets of expiry
+// times, next to the OmniLedger config.
+var expirySubID = SubID(func() [32]byte {
+	var two [32]byte
+	two[31] = 2
+	return two
+}())
+
+// expiryRange is the value of the instance holding the range of the buckets
+// of expiry times. The bucket First holds the earliest expiry time, and no
+// bucket after Last holds one. The instance doesn't exist if no expiry time
+// is pending.
+type expiryRange struct {
+	First int64
+	Last  int64
+}
+
+// instanceExpiries is the value of the bucket instance holding the expiry
+// times of the instances expiring in a time bucket.
+type instanceExpiries struct {
+	Expiries []instanceExpiry
+}
+
+// instanceExpiry is the time after which an instance is removed.
+type instanceExpiry struct {
+	InstanceID []byte
+	// Expiry is a unix timestamp in seconds.
+	Expiry int64
+}
+
+// expiryBucket returns the bucket of the expiry time t.
+func expiryBucket(t int64) int64 {
+	return t / expiryBucketSeconds
+}
+
+// expiryBucketID returns the ID of the instance holding the expiry times of
+// the bucket b.
+func expiryBucketID(genesisDarcID darc.ID, b int64) InstanceID {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(b))
+	h := sha256.New()
+	h.Write([]byte("expiries"))
+	h.Write(buf[:])
+	id := InstanceID{DarcID: genesisDarcID}
+	copy(id.SubID[:], h.Sum(nil))
+	return id
+}
+
+// loadExpiryRange returns the range of the buckets stored in coll, the ID of
+// the genesis darc and whether the range exists.
+func loadExpiryRange(coll CollectionView) (*expiryRange, darc.ID, bool, error) {
+	genesisDarcID, _, err := coll.GetValues(GenesisReferenceID.Slice())
+	if err != nil {
+		return nil, nil, false, err
+	}
+	r := &expiryRange{}
+	value, _, err := coll.GetValues(InstanceID{genesisDarcID, expirySubID}.Slice())
+	if err != nil {
+		return r, genesisDarcID, false, nil
+	}
+	if err = protobuf.Decode(value, r); err != nil {
+		return nil, nil, false, err
+	}
+	return r, genesisDarcID, true, nil
+}
+
+// loadExpiryBucket returns the expiry times of the bucket instance id and
+// whether it exists.
+func loadExpiryBucket(coll CollectionView, id InstanceID) (*instanceExpiries, bool, error) {
+	ie := &instanceExpiries{}
+	value, _, err := coll.GetValues(id.Slice())
+	if err != nil {
+		return ie, false, nil
+	}
+	if err = protobuf.Decode(value, ie); err != nil {
+		return nil, false, err
+	}
+	return ie, true, nil
+}
+
+// storeExpirySc returns the state change storing v in the instance id.
+func storeExpirySc(id InstanceID, v interface{}, exists bool) (StateChange, error) {
+	buf, err := protobuf.Encode(v)
+	if err != nil {
+		return StateChange{}, err
+	}
+	action := Update
+	if !exists {
+		action = Create
+	}
+	return NewStateChange(action, id, ContractConfigID, buf), nil
+}
+
+// addExpiries returns scs with additional state changes recording the expiry
+// time of the instances created by instr, if it is a spawn instruction with
+// a "_ttl" argument. The "_ttl" argument is a varint holding the number of
+// seconds the instances live after the block with the given timestamp.
+func addExpiries(coll CollectionView, instr Instruction, scs StateChanges, timestamp int64) (StateChanges, error) {
+	if instr.Spawn == nil {
+		return scs, nil
+	}
+	ttlBuf := instr.Spawn.Args.Search(ttlArgument)
+	if ttlBuf == nil {
+		return scs, nil
+	}
+	ttl, n := binary.Varint(ttlBuf)
+	if n != len(ttlBuf) || ttl <= 0 {
+		return nil, errors.New("ttl must be a positive varint without trailing data")
+	}
+	r, genesisDarcID, exists, err := loadExpiryRange(coll)
+	if err != nil {
+		return nil, err
+	}
+	expiry := timestamp + ttl
+	b := expiryBucket(expiry)
+	bucketID := expiryBucketID(genesisDarcID, b)
+	ie, bucketExists, err := loadExpiryBucket(coll, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range scs {
+		if sc.StateAction == Create {
+			ie.Expiries = append(ie.Expiries, instanceExpiry{
+				InstanceID: sc.InstanceID,
+				Expiry:     expiry,
+			})
+		}
+	}
+	sc, err := storeExpirySc(bucketID, ie, bucketExists)
+	if err != nil {
+		return nil, err
+	}
+	scs = append(scs, sc)
+	if exists && b >= r.First && b <= r.Last {
+		return scs, nil
+	}
+	if !exists {
+		r.First, r.Last = b, b
+	} else if b < r.First {
+		r.First = b
+	} else {
+		r.Last = b
+	}
+	sc, err = storeExpirySc(InstanceID{genesisDarcID, expirySubID}, r, exists)
+	if err != nil {
+		return nil, err
+	}
+	return append(scs, sc), nil
+}
+
+// expireInstancesScs returns the state changes removing all the instances
+// whose expiry time is not after timestamp. Only the buckets up to the one
+// of timestamp, and then up to the next one holding an expiry time, are
+// read. The order of the removals only depends on coll, so all nodes agree
+// on them.
+func expireInstancesScs(coll CollectionView, timestamp int64) (StateChanges, error) {
+	r, genesisDarcID, exists, err := loadExpiryRange(coll)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("no instance with a TTL")
+	}
+	var scs StateChanges
+	now := expiryBucket(timestamp)
+	first := r.Last + 1
+	for b := r.First; b <= r.Last; b++ {
+		bucketID := expiryBucketID(genesisDarcID, b)
+		ie, ok, err := loadExpiryBucket(coll, bucketID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if b > now {
+			first = b
+			break
+		}
+		var remaining []instanceExpiry
+		for _, e := range ie.Expiries {
+			if e.Expiry > timestamp {
+				remaining = append(remaining, e)
+				continue
+			}
+			// The instance might have been deleted already.
+			_, contractID, err := coll.GetValues(e.InstanceID)
+			if err != nil {
+				continue
+			}
+			scs = append(scs, NewStateChange(Remove, NewInstanceID(e.InstanceID), contractID, nil))
+		}
+		if len(remaining) > 0 {
+			ie.Expiries = remaining
+			sc, err := storeExpirySc(bucketID, ie, true)
+			if err != nil {
+				return nil, err
+			}
+			scs = append(scs, sc)
+			first = b
+			break
+		}
+		scs = append(scs, NewStateChange(Remove, bucketID, ContractConfigID, nil))
+	}
+	rangeID := InstanceID{genesisDarcID, expirySubID}
+	if first > r.Last {
+		return append(scs, NewStateChange(Remove, rangeID, ContractConfigID, nil)), nil
+	}
+	r.First = first
+	sc, err := storeExpirySc(rangeID, r, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(scs, sc), nil
+}
+
+// isExpireInstances returns true if instr removes the expired instances of
+// skipchain scID.
+func (s *Service) isExpireInstances(scID skipchain.SkipBlockID, instr Instruction) bool {
+	if instr.Invoke == nil || instr.Invoke.Command != cmdExpireInstances ||
+		instr.InstanceID.SubID != oneSubID {
+		return false
+	}
+	genesisDarcID, _, err := s.GetCollectionView(scID).GetValues(GenesisReferenceID.Slice())
+	return err == nil && bytes.Equal(genesisDarcID, instr.InstanceID.DarcID)
+}
+
+// addExpireInstances removes all the transactions removing expired instances
+// from cts, as only the leader may add them. Then, if some instances expire
+// in the block with the given timestamp, it adds a transaction removing them.
+func (s *Service) addExpireInstances(scID skipchain.SkipBlockID, timestamp int64, cts ClientTransactions) (ClientTransactions, error) {
+	var ctsOut ClientTransactions
+clientTransactions:
+	for _, ct := range cts {
+		for _, instr := range ct.Instructions {
+			if s.isExpireInstances(scID, instr) {
+				log.Warn(s.ServerIdentity(), "dropping transaction removing expired instances")
+				continue clientTransactions
+			}
+		}
+		ctsOut = append(ctsOut, ct)
+	}
+
+	// The first bucket holds the earliest expiry time.
+	cv := s.GetCollectionView(scID)
+	r, genesisDarcID, exists, err := loadExpiryRange(cv)
+	if err != nil {
+		return nil, err
+	}
+	if !exists || r.First > expiryBucket(timestamp) {
+		return ctsOut, nil
+	}
+	ie, _, err := loadExpiryBucket(cv, expiryBucketID(genesisDarcID, r.First))
+	if err != nil {
+		return nil, err
+	}
+	var expired bool
+	for _, e := range ie.Expiries {
+		if e.Expiry <= timestamp {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return ctsOut, nil
+	}
+	tsBuf := make([]byte, binary.MaxVarintLen64)
+	tsBuf = tsBuf[:binary.PutVarint(tsBuf, timestamp)]
+	ct := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: genesisDarcID,
+				SubID:  oneSubID,
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Invoke: &Invoke{
+				Command: cmdExpireInstances,
+				Args:    Arguments{{Name: "timestamp", Value: tsBuf}},
+			},
+		}},
+	}
+	return append(ClientTransactions{ct}, ctsOut...), nil
+}
+
+// expireTimestamp returns the timestamp given to an instruction removing
+// expired instances.
+func expireTimestamp(instr Instruction) (int64, error) {
+	tsBuf := instr.Invoke.Args.Search("timestamp")
+	ts, n := binary.Varint(tsBuf)
+	if n <= 0 || n != len(tsBuf) {
+		return 0, errors.New("timestamp must be a varint without trailing data")
+	}
+	return ts, nil
+}
@@ -0,0 +1,535 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/omniledger/collection"
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// chainArchive is what ExportChain writes: all the blocks of a skipchain,
+// starting with the genesis block, and the instances of the collection at
+// the last block.
+type chainArchive struct {
+	Blocks    []*skipchain.SkipBlock
+	Instances []archivedInstance
+}
+
+// archivedInstance is an entry of the collection.
+type archivedInstance struct {
+	Key        []byte
+	Value      []byte
+	ContractID []byte
+}
+
+// chainCheckpoint is what ExportCheckpoint writes: the genesis block, which
+// identifies the skipchain, and an archive starting at a later block.
+type chainCheckpoint struct {
+	Genesis *skipchain.SkipBlock
+	Archive chainArchive
+}
+
+// ExportChain writes all the blocks of the skipchain scID and a snapshot of
+// its collection to w. The archive can be given to ImportChain of another
+// node to restore the skipchain there.
+func (s *Service) ExportChain(scID skipchain.SkipBlockID, w io.Writer) error {
+	a, err := s.archiveChain(scID, 0)
+	if err != nil {
+		return err
+	}
+	buf, err := protobuf.Encode(a)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ExportCheckpoint writes a checkpoint of the skipchain scID to w: the
+// blocks from the given index up to the latest one and a snapshot of the
+// collection at the latest block. A node can join the skipchain with the
+// checkpoint using ImportCheckpoint, without the blocks before index.
+func (s *Service) ExportCheckpoint(scID skipchain.SkipBlockID, index int, w io.Writer) error {
+	a, err := s.archiveChain(scID, index)
+	if err != nil {
+		return err
+	}
+	genesis := s.db().GetByID(scID).Copy()
+	genesis.ForwardLink = nil
+	buf, err := protobuf.Encode(&chainCheckpoint{Genesis: genesis, Archive: *a})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// archiveChain returns the blocks of the skipchain scID starting at the given
+// index, and the instances of its collection at the last block.
+func (s *Service) archiveChain(scID skipchain.SkipBlockID, index int) (*chainArchive, error) {
+	if !s.isOurChain(scID) {
+		return nil, errors.New("unknown skipchain")
+	}
+	cdb := s.getCollection(scID)
+	// The collection must not change while the blocks are collected, so
+	// that the snapshot corresponds to the last exported block.
+	cdb.mut.RLock()
+	defer cdb.mut.RUnlock()
+
+	var a chainArchive
+	sb := s.db().GetByID(scID)
+	for {
+		if sb.Index >= index {
+			a.Blocks = append(a.Blocks, sb)
+		}
+		if sb.Hash.Equal(cdb.latest) || len(sb.ForwardLink) == 0 {
+			break
+		}
+		var err error
+		sb, err = s.nextBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(a.Blocks) == 0 {
+		return nil, fmt.Errorf("no block with index %d", index)
+	}
+	// The forward links of the last block point to blocks that are not in
+	// the archive.
+	last := a.Blocks[len(a.Blocks)-1].Copy()
+	last.ForwardLink = nil
+	a.Blocks[len(a.Blocks)-1] = last
+	var err error
+	a.Instances, err = cdb.archivedInstances()
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// archivedInstances returns all the instances of the collection, with their
+// logical keys.
+func (c *collectionDB) archivedInstances() (instances []archivedInstance, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		return c.forEachInstance(bucket, func(key, value, cid []byte, _ int) {
+			instances = append(instances, archivedInstance{
+				Key:        key,
+				Value:      value,
+				ContractID: dup(cid),
+			})
+		})
+	})
+	return
+}
+
+// ImportChain reads an archive written by ExportChain and stores its
+// skipchain and collection on this node. The hashes and the forward links of
+// all the blocks are verified, as well as the root of the collection against
+// the header of the last block. A skipchain that is already known is
+// refused.
+func (s *Service) ImportChain(r io.Reader) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var a chainArchive
+	err = protobuf.DecodeWithConstructors(buf, &a, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return errors.New("couldn't decode archive: " + err.Error())
+	}
+	if len(a.Blocks) == 0 {
+		return errors.New("archive has no blocks")
+	}
+	if a.Blocks[0].Index != 0 {
+		return errors.New("archive doesn't start at the genesis block")
+	}
+	scID := a.Blocks[0].SkipChainID()
+	if s.db().GetByID(scID) != nil {
+		return errors.New("skipchain already exists")
+	}
+	if err := verifyArchivedBlocks(a.Blocks); err != nil {
+		return err
+	}
+	return s.restoreChain(scID, &a, func() error {
+		_, err := s.db().StoreBlocks(a.Blocks)
+		return err
+	})
+}
+
+// ImportCheckpoint reads a checkpoint written by ExportCheckpoint and stores
+// its skipchain and collection on this node. The first block of the
+// checkpoint must be the block pinned, which the caller trusts, e.g. because
+// it has been obtained out of band. The forward links from the pinned block
+// to the latest one are verified, as well as the root of the collection. The
+// blocks before the pinned one, except the genesis block, are not stored, so
+// proofs starting at the genesis block cannot be created by this node.
+func (s *Service) ImportCheckpoint(r io.Reader, pinned skipchain.SkipBlockID) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var c chainCheckpoint
+	err = protobuf.DecodeWithConstructors(buf, &c, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return errors.New("couldn't decode checkpoint: " + err.Error())
+	}
+	blocks := c.Archive.Blocks
+	if len(blocks) == 0 {
+		return errors.New("checkpoint has no blocks")
+	}
+	if !blocks[0].Hash.Equal(pinned) {
+		return errors.New("checkpoint doesn't start at the pinned block")
+	}
+	if err := verifyArchivedBlocks(blocks); err != nil {
+		return err
+	}
+	scID := blocks[0].SkipChainID()
+	if c.Genesis == nil || c.Genesis.Index != 0 || !c.Genesis.CalculateHash().Equal(scID) {
+		return errors.New("wrong genesis block")
+	}
+	if s.db().GetByID(scID) != nil {
+		return errors.New("skipchain already exists")
+	}
+	c.Genesis.Hash = scID
+	c.Genesis.ForwardLink = nil
+	return s.restoreChain(scID, &c.Archive, func() error {
+		if blocks[0].Index == 0 {
+			_, err := s.db().StoreBlocks(blocks)
+			return err
+		}
+		if _, err := s.db().StoreBlocks([]*skipchain.SkipBlock{c.Genesis}); err != nil {
+			return err
+		}
+		if err := s.db().StoreTrusted(blocks[0]); err != nil {
+			return err
+		}
+		if len(blocks) == 1 {
+			return nil
+		}
+		_, err := s.db().StoreBlocks(blocks[1:])
+		return err
+	})
+}
+
+// restoreChain checks the instances of the verified archive a against its
+// last block, stores the blocks of the skipchain scID using store and
+// restores its collection.
+func (s *Service) restoreChain(scID skipchain.SkipBlockID, a *chainArchive, store func() error) error {
+	latest := a.Blocks[len(a.Blocks)-1]
+	_, headerI, err := network.Unmarshal(latest.Data, cothority.Suite)
+	if err != nil {
+		return err
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		return errors.New("couldn't unmarshal header")
+	}
+	coll := collection.New(collection.Data{}, collection.Data{})
+	scs := make(StateChanges, len(a.Instances))
+	for i, inst := range a.Instances {
+		if err := coll.Add(inst.Key, inst.Value, inst.ContractID); err != nil {
+			return err
+		}
+		scs[i] = NewStateChange(Create, NewInstanceID(inst.Key), string(inst.ContractID), inst.Value)
+	}
+	if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+		return errors.New("root of the collection doesn't match the last block")
+	}
+
+	if err := store(); err != nil {
+		return err
+	}
+	if !s.isOurChain(scID) {
+		return errors.New("not an omniledger skipchain")
+	}
+	if err := s.getCollection(scID).StoreBlock(latest.Hash, scs); err != nil {
+		return err
+	}
+	s.state.setLast(latest)
+	d, err := s.LoadGenesisDarc(scID)
+	if err != nil {
+		return err
+	}
+	s.darcToScMut.Lock()
+	s.darcToSc[string(d.GetBaseID())] = scID
+	s.darcToScMut.Unlock()
+
+	if s.pollsFor(latest) {
+		interval, err := s.LoadBlockInterval(scID)
+		if err != nil {
+			return err
+		}
+		s.pollChanMut.Lock()
+		s.pollChanWG.Add(1)
+		s.pollChan[string(scID)] = s.startPolling(scID, interval)
+		s.pollChanMut.Unlock()
+	}
+	return nil
+}
+
+// verifyArchivedBlocks checks that blocks are consecutive blocks of a
+// skipchain, where every block is followed by the block its first forward
+// link points to.
+func verifyArchivedBlocks(blocks []*skipchain.SkipBlock) error {
+	scID := blocks[0].SkipChainID()
+	for i, sb := range blocks {
+		if sb.Index != blocks[0].Index+i {
+			return fmt.Errorf("block %d has index %d", i, sb.Index)
+		}
+		if !sb.Hash.Equal(sb.CalculateHash()) {
+			return fmt.Errorf("wrong hash of block %d", i)
+		}
+		if !sb.SkipChainID().Equal(scID) {
+			return fmt.Errorf("block %d is from another skipchain", i)
+		}
+		if err := sb.VerifyForwardSignatures(); err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		if i == len(blocks)-1 {
+			break
+		}
+		if len(sb.ForwardLink) == 0 || !sb.ForwardLink[0].To.Equal(blocks[i+1].Hash) {
+			return fmt.Errorf("block %d doesn't link to block %d", i, i+1)
+		}
+	}
+	return nil
+}
+
+// ContractExportedID is the contract of the instances locked with the
+// lock_export command of a darc. As no contract is registered for it, these
+// instances cannot be changed anymore.
+var ContractExportedID = "exported"
+
+// ContractImportedID is the contract of the instances recording that an
+// instance of another skipchain has been imported, so that it cannot be
+// imported again.
+var ContractImportedID = "imported"
+
+// importedID returns the ID of the instance recording the import of iID from
+// the skipchain scID.
+func importedID(scID skipchain.SkipBlockID, iID InstanceID) InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractImportedID))
+	h.Write(scID)
+	h.Write(iID.Slice())
+	return NewInstanceID(h.Sum(nil))
+}
+
+// ExportInstance returns the instance iID of the skipchain scID together with
+// the proof of its current state. The proof starts at the genesis block, so
+// that another skipchain can verify it knowing only scID, and import the
+// instance with the spawn_imported command of a darc. The instance must have
+// been locked with the lock_export command of its darc before.
+func (s *Service) ExportInstance(scID skipchain.SkipBlockID, iID InstanceID) (*InstanceExport, error) {
+	genesis := s.db().GetByID(scID)
+	if genesis == nil || genesis.Index != 0 {
+		return nil, errors.New("unknown skipchain")
+	}
+	p, err := NewProof(s.getCollection(scID), s.db(), scID, iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if !p.InclusionProof.Match() {
+		return nil, errors.New("instance doesn't exist")
+	}
+	_, values, err := p.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 2 || string(values[1]) != ContractExportedID {
+		return nil, errors.New("instance is not locked for export")
+	}
+	g := genesis.Copy()
+	g.Payload = nil
+	g.ForwardLink = nil
+	return &InstanceExport{Genesis: *g, Proof: *p}, nil
+}
+
+// Verify checks that the proof of the export starts at its genesis block and
+// proves the instance up to the last block it links to. It returns the ID of
+// the skipchain and the exported instance.
+func (e InstanceExport) Verify() (scID skipchain.SkipBlockID, iID InstanceID, value []byte, contractID string, err error) {
+	if e.Genesis.SkipBlockFix == nil || e.Genesis.Index != 0 || e.Genesis.Roster == nil {
+		err = errors.New("missing genesis block")
+		return
+	}
+	scID = e.Genesis.CalculateHash()
+	links := e.Proof.Links
+	if len(links) == 0 || !links[0].To.Equal(scID) || links[0].NewRoster == nil {
+		err = errors.New("proof doesn't start at the genesis block")
+		return
+	}
+	publics, genesisPublics := links[0].NewRoster.Publics(), e.Genesis.Roster.Publics()
+	if len(publics) != len(genesisPublics) {
+		err = errors.New("proof doesn't start with the roster of the genesis block")
+		return
+	}
+	for i := range publics {
+		if !publics[i].Equal(genesisPublics[i]) {
+			err = errors.New("proof doesn't start with the roster of the genesis block")
+			return
+		}
+	}
+	if e.Proof.Latest.SkipBlockFix == nil ||
+		!links[len(links)-1].To.Equal(e.Proof.Latest.CalculateHash()) {
+		err = errors.New("links don't point to the latest block of the proof")
+		return
+	}
+	if err = e.Proof.Verify(scID); err != nil {
+		return
+	}
+	if !e.Proof.InclusionProof.Match() {
+		err = errors.New("instance is not in the proof")
+		return
+	}
+	key, values, err := e.Proof.KeyValue()
+	if err != nil {
+		return
+	}
+	if len(key) != 64 || len(values) < 2 {
+		err = errors.New("proof is not for an instance")
+		return
+	}
+	return scID, NewInstanceID(key), values[0], string(values[1]), nil
+}
+
+// lockExportScs returns the state change locking the instance in the
+// "instance" argument of inst for its export to the skipchain in the
+// "destination" argument. The instance must be governed by the darc of inst,
+// and darcs and configs cannot be exported.
+func lockExportScs(coll CollectionView, inst Instruction) (StateChanges, error) {
+	if inst.InstanceID.SubID != (SubID{}) {
+		return nil, errors.New("can only lock an instance through its darc")
+	}
+	dest := skipchain.SkipBlockID(inst.Invoke.Args.Search("destination"))
+	if dest.IsNull() {
+		return nil, errors.New("missing destination")
+	}
+	iIDBuf := inst.Invoke.Args.Search("instance")
+	if len(iIDBuf) != 64 {
+		return nil, errors.New("invalid instance")
+	}
+	iID := NewInstanceID(iIDBuf)
+	if !bytes.Equal(iID.DarcID, inst.InstanceID.DarcID) || iID.SubID == (SubID{}) {
+		return nil, errors.New("instance is not governed by this darc")
+	}
+	value, contractID, err := coll.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	switch contractID {
+	case "", ContractDarcID, ContractConfigID, ContractExportedID, ContractNonceID,
+		ContractFieldID, ContractVersionID:
+		return nil, errors.New("cannot export an instance of contract " + contractID)
+	}
+	buf, err := protobuf.Encode(&ExportedInstance{
+		Destination: dest,
+		ContractID:  contractID,
+		Value:       value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return StateChanges{NewStateChange(Update, iID, ContractExportedID, buf)}, nil
+}
+
+// spawnImportedScs returns the state change creating the instance exported
+// in the "instance" argument of inst, under the darc of inst. The export must
+// be proven by the skipchain in the "source" argument, which must be one of
+// the ImportSources of the config, and the instance must be locked there for
+// this skipchain. The exported contract must be known to this node. An
+// instance can only be imported once.
+func (s *Service) spawnImportedScs(coll CollectionView, inst Instruction) (StateChanges, error) {
+	if inst.InstanceID.SubID != (SubID{}) {
+		return nil, errors.New("can only import under a darc instance")
+	}
+	source := skipchain.SkipBlockID(inst.Invoke.Args.Search("source"))
+	config, err := LoadConfigFromColl(coll)
+	if err != nil {
+		return nil, err
+	}
+	trusted := false
+	for _, id := range config.ImportSources {
+		if id.Equal(source) {
+			trusted = true
+			break
+		}
+	}
+	if source.IsNull() || !trusted {
+		return nil, errors.New("source skipchain is not in the import sources")
+	}
+	scID, err := s.collectionSkipchain(coll)
+	if err != nil {
+		return nil, err
+	}
+
+	var e InstanceExport
+	err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("instance"), &e,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't decode export: " + err.Error())
+	}
+	srcChain, srcID, value, contractID, err := e.Verify()
+	if err != nil {
+		return nil, errors.New("invalid export: " + err.Error())
+	}
+	if !srcChain.Equal(source) {
+		return nil, errors.New("export is not from the source skipchain")
+	}
+	if contractID != ContractExportedID {
+		return nil, errors.New("instance is not locked for export")
+	}
+	var locked ExportedInstance
+	if err = protobuf.Decode(value, &locked); err != nil {
+		return nil, errors.New("couldn't decode locked instance: " + err.Error())
+	}
+	if !locked.Destination.Equal(scID) {
+		return nil, errors.New("instance is locked for another skipchain")
+	}
+	switch locked.ContractID {
+	case ContractDarcID, ContractConfigID:
+		return nil, errors.New("cannot import an instance of contract " + locked.ContractID)
+	}
+	if _, exists := s.contracts[locked.ContractID]; !exists {
+		return nil, errors.New("unknown contract " + locked.ContractID)
+	}
+	if srcID.SubID == (SubID{}) {
+		return nil, errors.New("cannot import a darc instance")
+	}
+	marker := importedID(source, srcID)
+	if _, cid, err := coll.GetValues(marker.Slice()); err == nil && cid != "" {
+		return nil, errors.New("instance has already been imported")
+	}
+	newID := InstanceID{inst.InstanceID.DarcID, srcID.SubID}
+	if _, cid, err := coll.GetValues(newID.Slice()); err == nil && cid != "" {
+		return nil, errors.New("instance already exists")
+	}
+	return StateChanges{
+		NewStateChange(Create, newID, locked.ContractID, locked.Value),
+		NewStateChange(Create, marker, ContractImportedID, srcID.Slice()),
+	}, nil
+}
+
+// collectionSkipchain returns the ID of the skipchain of coll, found with its
+// genesis darc.
+func (s *Service) collectionSkipchain(coll CollectionView) (skipchain.SkipBlockID, error) {
+	genesisDarcID, _, err := coll.GetValues(GenesisReferenceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	return s.scIDFromGenesisDarc(darc.ID(genesisDarcID))
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/skipchain"
+)
+
+// externalRefsBucket is the bucket of the database of the service indexing
+// the committed transactions by their external reference.
+var externalRefsBucket = []byte("externalrefs")
+
+// externalRefPrefix returns the prefix of the keys of the transactions of
+// the skipchain scID with the external reference ref. The reference is
+// hashed, so that a reference is never the prefix of another one.
+func externalRefPrefix(scID skipchain.SkipBlockID, ref []byte) []byte {
+	h := sha256.Sum256(ref)
+	return append(append([]byte{}, scID...), h[:]...)
+}
+
+// findByExternalRef returns the hashes of the instructions of the committed
+// transactions of the skipchain scID that have been tagged with the external
+// reference ref, in no particular order. The hashes are the ones used by
+// GetTxStatus and GetAuthorizingRule. As the reference is not signed, anybody
+// relaying a transaction can change it: it is a help for the lookup, not a
+// proof.
+func (s *Service) findByExternalRef(scID skipchain.SkipBlockID, ref []byte) ([][]byte, error) {
+	if len(ref) == 0 {
+		return nil, errors.New("empty external reference")
+	}
+	if s.db().GetByID(scID) == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	prefix := externalRefPrefix(scID, ref)
+	db, name := s.GetAdditionalBucket(externalRefsBucket)
+	var hashes [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			hashes = append(hashes, dup(k[len(prefix):]))
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// recordExternalRefs indexes the transactions of a block of the skipchain
+// scID that hold an external reference.
+func (s *Service) recordExternalRefs(scID skipchain.SkipBlockID, cts ClientTransactions) error {
+	var keys [][]byte
+	for _, ct := range cts {
+		if len(ct.ExternalRef) == 0 {
+			continue
+		}
+		keys = append(keys, append(externalRefPrefix(scID, ct.ExternalRef), ct.Instructions.Hash()...))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	db, name := s.GetAdditionalBucket(externalRefsBucket)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		for _, k := range keys {
+			if err := b.Put(k, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
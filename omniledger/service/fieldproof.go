@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// ContractFieldID is the contract of the entries holding the fields of the
+// instances stored with FieldStateChanges. No contract is registered under
+// this ID, so the fields cannot be invoked, and they are not instances of the
+// contract they belong to.
+var ContractFieldID = "field"
+
+// StructField is a named field of the value of an instance.
+type StructField struct {
+	Name  string
+	Value []byte
+}
+
+// FieldInstanceID returns the ID under which the field of the instance iID
+// is stored, if its contract stores the fields with FieldStateChanges.
+func FieldInstanceID(iID InstanceID, field string) InstanceID {
+	h := sha256.New()
+	h.Write(iID.Slice())
+	h.Write([]byte(field))
+	return InstanceID{iID.DarcID, NewSubID(h.Sum(nil))}
+}
+
+// fieldLeaf returns the hash of a field in the tree of the fields.
+func fieldLeaf(f StructField) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	binary.Write(h, binary.LittleEndian, uint32(len(f.Name)))
+	h.Write([]byte(f.Name))
+	h.Write(f.Value)
+	return h.Sum(nil)
+}
+
+// fieldNode returns the hash of an inner node of the tree of the fields.
+func fieldNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// sortFields returns a copy of fields sorted by name.
+func sortFields(fields []StructField) []StructField {
+	sorted := append([]StructField{}, fields...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// fieldTree returns the root of the merkle tree of the leaves, and the hashes
+// needed to go from the leaf at index to the root. The last node of a level
+// with an odd number of nodes is moved up unchanged.
+func fieldTree(leaves [][]byte, index int) (root []byte, path [][]byte) {
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, fieldNode(level[i], level[i+1]))
+			if index == i {
+				path = append(path, level[i+1])
+			} else if index == i+1 {
+				path = append(path, level[i])
+			}
+		}
+		index /= 2
+		level = next
+	}
+	return level[0], path
+}
+
+// FieldsRoot returns the merkle root of the fields, sorted by their names. A
+// contract storing the fields of an instance with FieldStateChanges must
+// start the value of the instance with this root, so that every field can be
+// proven against the value of the instance.
+func FieldsRoot(fields []StructField) []byte {
+	if len(fields) == 0 {
+		return make([]byte, sha256.Size)
+	}
+	sorted := sortFields(fields)
+	leaves := make([][]byte, len(sorted))
+	for i, f := range sorted {
+		leaves[i] = fieldLeaf(f)
+	}
+	root, _ := fieldTree(leaves, 0)
+	return root
+}
+
+// FieldStateChanges returns the state changes that apply sa to every one of
+// the fields of the instance iID, each field being stored under its own key.
+// A contract whose instances hold large structures can return them next to
+// the state change of the instance, whose value starts with FieldsRoot of
+// the same fields, so that GetProof can prove a single field without the
+// others. The fields are not instances: they are only stored for the
+// proofs.
+func FieldStateChanges(sa StateAction, iID InstanceID, fields []StructField) StateChanges {
+	scs := make(StateChanges, len(fields))
+	for i, f := range fields {
+		scs[i] = NewStateChange(sa, FieldInstanceID(iID, f.Name), ContractFieldID, f.Value)
+	}
+	return scs
+}
+
+// RegisterContractFields declares the fields the contract contractID stores
+// with FieldStateChanges, so that GetProof can return proofs of them. The
+// contract itself has to be registered using RegisterContract.
+func RegisterContractFields(s skipchain.GetService, contractID string, fields []string) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractFields(contractID, fields)
+}
+
+// registerContractFields stores the fields of a contract.
+func (s *Service) registerContractFields(contractID string, fields []string) error {
+	if len(fields) == 0 {
+		return errors.New("no fields given")
+	}
+	s.contractFields[contractID] = fields
+	return nil
+}
+
+// fieldProof returns the proof of the field of the instance with the given
+// key against the root of its fields, which is at the start of value. The
+// fields that are not stored are left out of the tree.
+func (s *Service) fieldProof(scID skipchain.SkipBlockID, key, value []byte, field string) (*FieldProof, error) {
+	coll := s.GetCollectionView(scID)
+	_, contractID, err := coll.GetValues(key)
+	if err != nil {
+		return nil, errors.New("couldn't get instance: " + err.Error())
+	}
+	iID := NewInstanceID(key)
+	var fields []StructField
+	declared := false
+	for _, name := range s.contractFields[contractID] {
+		declared = declared || name == field
+		v, cid, err := coll.GetValues(FieldInstanceID(iID, name).Slice())
+		if err != nil || cid != ContractFieldID {
+			continue
+		}
+		fields = append(fields, StructField{name, v})
+	}
+	if !declared {
+		return nil, errors.New("contract " + contractID + " has no field " + field)
+	}
+	fields = sortFields(fields)
+	leaves := make([][]byte, len(fields))
+	index := -1
+	for i, f := range fields {
+		leaves[i] = fieldLeaf(f)
+		if f.Name == field {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("field " + field + " is not stored")
+	}
+	root, path := fieldTree(leaves, index)
+	if len(value) < sha256.Size || !bytes.Equal(root, value[:sha256.Size]) {
+		return nil, errors.New("fields don't match the value of the instance")
+	}
+	return &FieldProof{
+		Name:   field,
+		Value:  fields[index].Value,
+		Index:  index,
+		Count:  len(fields),
+		Hashes: path,
+	}, nil
+}
+
+// VerifyField checks the proof against the skipchain scID and that its field
+// proof proves the field of the instance iID. It returns the value of the
+// field.
+func (p Proof) VerifyField(scID skipchain.SkipBlockID, iID InstanceID, field string) ([]byte, error) {
+	if err := p.Verify(scID); err != nil {
+		return nil, err
+	}
+	key, values, err := p.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(key, iID.Slice()) {
+		return nil, errors.New("proof is not for this instance")
+	}
+	if !p.InclusionProof.Match() || len(values) == 0 {
+		return nil, errors.New("instance is not in the proof")
+	}
+	fp := p.Field
+	if fp == nil || fp.Name != field {
+		return nil, errors.New("proof has no proof of this field")
+	}
+	if fp.Count <= 0 || fp.Index < 0 || fp.Index >= fp.Count {
+		return nil, errors.New("wrong position of the field")
+	}
+	h := fieldLeaf(StructField{fp.Name, fp.Value})
+	hashes := fp.Hashes
+	for index, n := fp.Index, fp.Count; n > 1; index, n = index/2, (n+1)/2 {
+		if index == n-1 && n%2 == 1 {
+			// The last node of an odd level is moved up unchanged.
+			continue
+		}
+		if len(hashes) == 0 {
+			return nil, errors.New("field proof is too short")
+		}
+		if index%2 == 0 {
+			h = fieldNode(h, hashes[0])
+		} else {
+			h = fieldNode(hashes[0], h)
+		}
+		hashes = hashes[1:]
+	}
+	if len(hashes) > 0 {
+		return nil, errors.New("field proof is too long")
+	}
+	if len(values[0]) < sha256.Size || !bytes.Equal(h, values[0][:sha256.Size]) {
+		return nil, errors.New("field is not in the value of the instance")
+	}
+	return fp.Value, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+)
+
+// ErrHalted is returned for a skipchain that has been halted on this node.
+var ErrHalted = errors.New("skipchain is halted on this node")
+
+// Halt stops this node from accepting transactions and from proposing or
+// accepting blocks for the skipchain scID, until Resume is called. Queries,
+// e.g. GetProof, are still answered. Contrary to freezing the darcs of the
+// skipchain, it doesn't need a transaction, so it can be used when the
+// skipchain is under attack. It is only available to the operator of the
+// node and is not stored: a restarted node is not halted anymore.
+func (s *Service) Halt(scID skipchain.SkipBlockID) error {
+	if s.db().GetByID(scID) == nil {
+		return errors.New("unknown skipchain")
+	}
+	s.haltedMut.Lock()
+	defer s.haltedMut.Unlock()
+	s.halted[string(scID)] = true
+	log.Warnf("%s: halting skipchain %x", s.ServerIdentity(), scID)
+	return nil
+}
+
+// Resume reverts Halt for the skipchain scID.
+func (s *Service) Resume(scID skipchain.SkipBlockID) error {
+	s.haltedMut.Lock()
+	defer s.haltedMut.Unlock()
+	if !s.halted[string(scID)] {
+		return errors.New("skipchain is not halted")
+	}
+	delete(s.halted, string(scID))
+	log.Lvlf1("%s: resuming skipchain %x", s.ServerIdentity(), scID)
+	return nil
+}
+
+func (s *Service) isHalted(scID skipchain.SkipBlockID) bool {
+	s.haltedMut.Lock()
+	defer s.haltedMut.Unlock()
+	return s.halted[string(scID)]
+}
@@ -0,0 +1,492 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/omniledger/collection"
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// blockChangesBucket is the bucket of the database of the service holding
+// the state changes of the instructions of the applied blocks, keyed by the
+// hash of the block.
+var blockChangesBucket = []byte("blockchanges")
+
+// blockChanges are the state changes of the instructions of a block, as
+// stored in the database. They follow the order of the instructions of the
+// transactions of the block, leaving out the transactions recorded with a
+// failed precondition.
+type blockChanges struct {
+	Instructions []instructionChanges
+}
+
+// instructionChanges are the state changes produced by an instruction.
+type instructionChanges struct {
+	StateChanges StateChanges
+}
+
+// recordBlockChanges stores the state changes of the instructions of the
+// block sb, whose transactions have just been executed by
+// createStateChanges.
+func (s *Service) recordBlockChanges(sb *skipchain.SkipBlock, body *DataBody) error {
+	digest := body.Transactions.Hash()
+	var changes blockChanges
+	for _, ct := range body.Transactions {
+		if ct.FailedPrecondition {
+			continue
+		}
+		instrScs := s.stateChangeCache.getInstrEffects(sb.SkipChainID(), digest, ct.Instructions.Hash())
+		if len(instrScs) != len(ct.Instructions) {
+			return fmt.Errorf("state changes of block %d are not known", sb.Index)
+		}
+		for _, scs := range instrScs {
+			changes.Instructions = append(changes.Instructions, instructionChanges{scs})
+		}
+	}
+	return s.storeBlockChanges(sb.Hash, &changes)
+}
+
+// storeBlockChanges stores the state changes of the block with the given ID.
+func (s *Service) storeBlockChanges(id skipchain.SkipBlockID, changes *blockChanges) error {
+	buf, err := protobuf.Encode(changes)
+	if err != nil {
+		return err
+	}
+	db, name := s.GetAdditionalBucket(blockChangesBucket)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		return b.Put(id, buf)
+	})
+}
+
+// loadBlockChanges returns the state changes of the block with the given ID,
+// or nil if they have not been stored.
+func (s *Service) loadBlockChanges(id skipchain.SkipBlockID) (*blockChanges, error) {
+	db, name := s.GetAdditionalBucket(blockChangesBucket)
+	var buf []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(id); v != nil {
+			buf = dup(v)
+		}
+		return nil
+	})
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	changes := &blockChanges{}
+	if err = protobuf.Decode(buf, changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// blockContent returns the header and the body of the block sb.
+func blockContent(sb *skipchain.SkipBlock) (*DataHeader, *DataBody, error) {
+	_, headerI, err := network.Unmarshal(sb.Data, cothority.Suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		return nil, nil, errors.New("couldn't unmarshal header")
+	}
+	_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, ok := bodyI.(*DataBody)
+	if !ok {
+		return nil, nil, errors.New("couldn't unmarshal body")
+	}
+	return header, body, nil
+}
+
+// replayFunc is called by replayChain for every instruction of every
+// ClientTransaction that has been accepted, together with the state changes
+// the instruction produced.
+type replayFunc func(sb *skipchain.SkipBlock, instr Instruction, scs StateChanges) error
+
+// errStopReplay can be returned by a replayFunc to stop replayChain without
+// an error.
+var errStopReplay = errors.New("stop replay")
+
+// replayChain goes through all the blocks of the skipchain scID, starting
+// from the genesis block, and calls f with the state changes of their
+// instructions, as they have been stored when the blocks were applied. The
+// changes of the blocks applied before they were stored are recovered with
+// indexChain.
+func (s *Service) replayChain(scID skipchain.SkipBlockID, f replayFunc) error {
+	sb := s.db().GetByID(scID)
+	if sb == nil {
+		return errors.New("didn't find skipchain")
+	}
+	for {
+		_, body, err := blockContent(sb)
+		if err != nil {
+			return err
+		}
+		changes, err := s.loadBlockChanges(sb.Hash)
+		if err != nil {
+			return err
+		}
+		if changes == nil {
+			// All the missing blocks are indexed at once.
+			latest, err := s.db().GetLatestByID(scID)
+			if err != nil {
+				return err
+			}
+			if err = s.indexChain(scID, latest); err != nil {
+				return err
+			}
+			if changes, err = s.loadBlockChanges(sb.Hash); err != nil {
+				return err
+			}
+		}
+
+		i := 0
+		for _, ct := range body.Transactions {
+			if ct.FailedPrecondition {
+				// Recorded as a no-op, it changed no instance.
+				continue
+			}
+			for _, instr := range ct.Instructions {
+				if i >= len(changes.Instructions) {
+					return fmt.Errorf("stored state changes don't match block %d", sb.Index)
+				}
+				if err := f(sb, instr, changes.Instructions[i].StateChanges); err != nil {
+					if err == errStopReplay {
+						return nil
+					}
+					return err
+				}
+				i++
+			}
+		}
+
+		next, err := s.nextBlock(sb)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		sb = next
+	}
+}
+
+// indexChain stores the state changes of the blocks of the skipchain scID up
+// to the block last, for the blocks whose changes have not been stored. To
+// find them, it applies all the blocks from the genesis block to a
+// throw-away collection, executing again the transactions of the missing
+// ones the same way createStateChanges does, and checks the collection
+// against the root of every block. As contracts that depend on the local
+// state of the node, like the timing checks of a view-change, may not give
+// the same result, it fails if an instruction cannot be executed again or if
+// the collection doesn't match a block.
+func (s *Service) indexChain(scID skipchain.SkipBlockID, last *skipchain.SkipBlock) error {
+	sb := s.db().GetByID(scID)
+	if sb == nil {
+		return errors.New("didn't find skipchain")
+	}
+	coll := collection.New(&collection.Data{}, &collection.Data{})
+	for {
+		header, body, err := blockContent(sb)
+		if err != nil {
+			return err
+		}
+		changes, err := s.loadBlockChanges(sb.Hash)
+		if err != nil {
+			return err
+		}
+		if changes == nil {
+			log.Lvlf2("%s: executing block %d again to find its state changes", s.ServerIdentity(), sb.Index)
+			if changes, err = s.replayBlock(coll, sb, header, body); err != nil {
+				return err
+			}
+			if err = s.storeBlockChanges(sb.Hash, changes); err != nil {
+				return err
+			}
+		}
+		for _, ic := range changes.Instructions {
+			for _, sc := range ic.StateChanges {
+				if err := storeInColl(coll, &sc); err != nil {
+					return fmt.Errorf("couldn't apply the state changes of block %d: %s", sb.Index, err)
+				}
+			}
+		}
+		if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+			return fmt.Errorf("replay of block %d doesn't match its collection root", sb.Index)
+		}
+		if sb.Hash.Equal(last.Hash) {
+			return nil
+		}
+
+		next, err := s.nextBlock(sb)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return errors.New("block is not in the skipchain")
+		}
+		sb = next
+	}
+}
+
+// replayBlock executes the accepted transactions of the block sb on a clone
+// of coll, which holds the state before the block, and returns the state
+// changes of their instructions. A transaction that fails is an error, as it
+// has been accepted in the block.
+func (s *Service) replayBlock(coll *collection.Collection, sb *skipchain.SkipBlock, header *DataHeader, body *DataBody) (*blockChanges, error) {
+	// The config of the previous block applies, as in
+	// createStateChanges.
+	var noncePolicy NoncePolicy
+	if config, err := LoadConfigFromColl(&roCollection{coll}); err == nil {
+		noncePolicy = config.NoncePolicy
+	}
+	cdbI := &roCollection{coll.Clone()}
+	changes := &blockChanges{}
+	var cin []Coin
+	for _, ct := range body.Transactions {
+		if ct.FailedPrecondition {
+			continue
+		}
+		for _, instr := range ct.Instructions {
+			scs, cout, err := s.executeInstruction(cdbI, cin, instr)
+			if err == nil {
+				scs, err = addExpiries(cdbI, instr, scs, header.Timestamp)
+			}
+			if err == nil {
+				scs, err = addNonce(cdbI, instr, scs, noncePolicy)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("couldn't replay instruction in block %d: %s", sb.Index, err)
+			}
+			for _, sc := range scs {
+				if err := storeInColl(cdbI.c, &sc); err != nil {
+					return nil, fmt.Errorf("couldn't replay state change in block %d: %s", sb.Index, err)
+				}
+			}
+			changes.Instructions = append(changes.Instructions, instructionChanges{scs})
+			cin = cout
+		}
+	}
+	return changes, nil
+}
+
+// instanceHistory returns all the changes of the instance iID in the
+// skipchain scID, oldest change first.
+func (s *Service) instanceHistory(scID skipchain.SkipBlockID, iID InstanceID) ([]HistoryEntry, error) {
+	key := iID.Slice()
+	var entries []HistoryEntry
+	err := s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, scs StateChanges) error {
+		for _, sc := range scs {
+			if !bytes.Equal(sc.InstanceID, key) {
+				continue
+			}
+			entries = append(entries, HistoryEntry{
+				BlockIndex:      sb.Index,
+				InstructionHash: instr.Hash(),
+				StateAction:     sc.StateAction,
+				Value:           sc.Value,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// instanceOrigin returns the index of the block and the hash of the
+// instruction that created the instance iID in the skipchain scID. As an
+// instance cannot be changed before it exists, this is its first state
+// change.
+func (s *Service) instanceOrigin(scID skipchain.SkipBlockID, iID InstanceID) (blockIndex int, instrHash []byte, err error) {
+	key := iID.Slice()
+	found := false
+	err = s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, scs StateChanges) error {
+		for _, sc := range scs {
+			if bytes.Equal(sc.InstanceID, key) {
+				blockIndex = sb.Index
+				instrHash = instr.Hash()
+				found = true
+				return errStopReplay
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = errors.New("instance has never been created")
+	}
+	return
+}
+
+// instanceLastModifier returns the block index, the signers and the
+// timestamp of the block of the last instruction that changed the instance
+// iID in the skipchain scID. If the transaction of the instruction is signed
+// as a whole, its signers are returned.
+func (s *Service) instanceLastModifier(scID skipchain.SkipBlockID, iID InstanceID) (blockIndex int, signers []darc.Identity, timestamp int64, err error) {
+	key := iID.Slice()
+	var last *skipchain.SkipBlock
+	var lastInstr Instruction
+	err = s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, scs StateChanges) error {
+		for _, sc := range scs {
+			if bytes.Equal(sc.InstanceID, key) {
+				last = sb
+				lastInstr = instr
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if last == nil {
+		err = errors.New("instance has never been created")
+		return
+	}
+
+	_, headerI, err := network.Unmarshal(last.Data, cothority.Suite)
+	if err != nil {
+		return
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		err = errors.New("couldn't unmarshal header")
+		return
+	}
+	sigs := lastInstr.Signatures
+	if len(sigs) == 0 {
+		_, bodyI, err2 := network.Unmarshal(last.Payload, cothority.Suite)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		body, ok := bodyI.(*DataBody)
+		if !ok {
+			err = errors.New("couldn't unmarshal body")
+			return
+		}
+		instrHash := lastInstr.Hash()
+		for _, ct := range body.Transactions {
+			for _, instr := range ct.Instructions {
+				if bytes.Equal(instr.Hash(), instrHash) {
+					sigs = ct.Signatures
+				}
+			}
+		}
+	}
+	for _, sig := range sigs {
+		signers = append(signers, sig.Signer)
+	}
+	return last.Index, signers, header.Timestamp, nil
+}
+
+// GetBlockChanges returns the state changes of the block at index in the
+// skipchain scID, as stored when the block was applied.
+func (s *Service) GetBlockChanges(scID skipchain.SkipBlockID, index int) (StateChanges, error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index > latest.Index {
+		return nil, errors.New("no block with this index")
+	}
+	var scs StateChanges
+	err = s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, instrScs StateChanges) error {
+		if sb.Index > index {
+			return errStopReplay
+		}
+		if sb.Index == index {
+			scs = append(scs, instrScs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scs, nil
+}
+
+// GetOriginInstruction returns the instruction that produced the state
+// change of index stateChangeIndex in GetBlockChanges(scID, index). Its hash
+// and its Index in the transaction identify it in the block.
+func (s *Service) GetOriginInstruction(scID skipchain.SkipBlockID, index, stateChangeIndex int) (*Instruction, error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index > latest.Index {
+		return nil, errors.New("no block with this index")
+	}
+	if stateChangeIndex < 0 {
+		return nil, errors.New("no state change with this index")
+	}
+	var origin *Instruction
+	err = s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, scs StateChanges) error {
+		if sb.Index > index {
+			return errStopReplay
+		}
+		if sb.Index < index {
+			return nil
+		}
+		if stateChangeIndex < len(scs) {
+			origin = &instr
+			return errStopReplay
+		}
+		stateChangeIndex -= len(scs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if origin == nil {
+		return nil, errors.New("no state change with this index")
+	}
+	return origin, nil
+}
+
+// changesSince returns the state changes of all the blocks of the skipchain
+// scID after the block at fromIndex, in order, together with the latest
+// block. Applied to the collection at fromIndex, the changes give the
+// collection root stored in the header of the latest block.
+func (s *Service) changesSince(scID skipchain.SkipBlockID, fromIndex int) (StateChanges, *skipchain.SkipBlock, error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromIndex < 0 || fromIndex > latest.Index {
+		return nil, nil, errors.New("no block with this index")
+	}
+	var scs StateChanges
+	err = s.replayChain(scID, func(sb *skipchain.SkipBlock, instr Instruction, instrScs StateChanges) error {
+		if sb.Index > latest.Index {
+			return errStopReplay
+		}
+		if sb.Index > fromIndex {
+			scs = append(scs, instrScs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return scs, latest, nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/collection"
+	"github.com/dedis/cothority/skipchain"
+)
+
+// BlockInvariant checks a property spanning several instances, e.g. that the
+// total supply of a coin only changes when coins are minted. It complements
+// the checks of the contracts, which only see one instruction at a time.
+// The invariants are run by the leader before proposing a block, and are
+// local to the node like the TxAdmissionPolicy.
+type BlockInvariant interface {
+	// Check returns an error if the state changes of a block, applied to
+	// the state before, giving the state after, violate the invariant.
+	// The whole block is then refused.
+	Check(scs StateChanges, before, after CollectionView) error
+}
+
+// BlockInvariantFunc is a function that can be used as a BlockInvariant.
+type BlockInvariantFunc func(scs StateChanges, before, after CollectionView) error
+
+// Check calls f.
+func (f BlockInvariantFunc) Check(scs StateChanges, before, after CollectionView) error {
+	return f(scs, before, after)
+}
+
+// RegisterBlockInvariant adds inv to the invariants checked for every block
+// proposed by the service.
+func RegisterBlockInvariant(s skipchain.GetService, inv BlockInvariant) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerBlockInvariant(inv)
+}
+
+func (s *Service) registerBlockInvariant(inv BlockInvariant) error {
+	if inv == nil {
+		return errors.New("nil invariant")
+	}
+	s.invariantsMut.Lock()
+	defer s.invariantsMut.Unlock()
+	s.invariants = append(s.invariants, inv)
+	return nil
+}
+
+// checkInvariants returns the error of the first invariant violated by the
+// state changes scs applied to coll.
+func (s *Service) checkInvariants(coll *collection.Collection, scs StateChanges) error {
+	s.invariantsMut.Lock()
+	invariants := s.invariants
+	s.invariantsMut.Unlock()
+	if len(invariants) == 0 {
+		return nil
+	}
+	after := coll.Clone()
+	for _, sc := range scs {
+		if err := storeInColl(after, &sc); err != nil {
+			return err
+		}
+	}
+	for _, inv := range invariants {
+		if err := inv.Check(scs, &roCollection{coll}, &roCollection{after}); err != nil {
+			return errors.New("block invariant violated: " + err.Error())
+		}
+	}
+	return nil
+}
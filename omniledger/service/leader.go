@@ -0,0 +1,80 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+// LeaderPolicy defines which node of the roster proposes a block.
+type LeaderPolicy int
+
+const (
+	// LeaderFirst lets the first node of the roster propose all blocks,
+	// until a view-change replaces it.
+	LeaderFirst LeaderPolicy = iota
+	// LeaderRoundRobin lets the nodes of the roster propose the blocks in
+	// turn, by the index of the block.
+	LeaderRoundRobin
+	// LeaderBeacon picks the node proposing a block from the hash of the
+	// previous block.
+	LeaderBeacon
+)
+
+// ErrWrongLeader is returned if a block is proposed by another node than the
+// leader for its index.
+var ErrWrongLeader = errors.New("block is not proposed by the leader for its index")
+
+// leaderFor returns the node of the roster proposing the block with the given
+// index, following the one with the hash prev.
+func leaderFor(roster *onet.Roster, index int, prev skipchain.SkipBlockID, policy LeaderPolicy) (*network.ServerIdentity, error) {
+	if roster == nil || len(roster.List) < 1 {
+		return nil, errors.New("roster is empty")
+	}
+	n := len(roster.List)
+	switch policy {
+	case LeaderFirst:
+		return roster.List[0], nil
+	case LeaderRoundRobin:
+		return roster.List[index%n], nil
+	case LeaderBeacon:
+		h := sha256.Sum256(prev)
+		return roster.List[binary.BigEndian.Uint64(h[:8])%uint64(n)], nil
+	}
+	return nil, errors.New("unknown leader policy")
+}
+
+// leaderQueue returns the nodes of the roster in the order they take over
+// the proposal of the block with the given index, following the one with
+// the hash prev: the leader given by the policy, then the nodes after it in
+// the roster. The node at position 1 starts a view-change if the leader
+// fails.
+func leaderQueue(roster *onet.Roster, index int, prev skipchain.SkipBlockID, policy LeaderPolicy) ([]*network.ServerIdentity, error) {
+	leader, err := leaderFor(roster, index, prev, policy)
+	if err != nil {
+		return nil, err
+	}
+	i, _ := roster.Search(leader.ID)
+	queue := append([]*network.ServerIdentity{}, roster.List[i:]...)
+	return append(queue, roster.List[:i]...), nil
+}
+
+// pollsFor returns whether this node has to poll for new blocks after sb: the
+// leader under LeaderFirst, and all the nodes of the roster under the
+// policies rotating the leader, as they check it for every block.
+func (s *Service) pollsFor(sb *skipchain.SkipBlock) bool {
+	config, err := s.LoadConfig(sb.SkipChainID())
+	if err != nil {
+		return false
+	}
+	if config.LeaderPolicy == LeaderFirst {
+		leader, err := leaderFor(sb.Roster, sb.Index+1, sb.Hash, LeaderFirst)
+		return err == nil && leader.Equal(s.ServerIdentity())
+	}
+	i, _ := sb.Roster.Search(s.ServerIdentity().ID)
+	return i >= 0
+}
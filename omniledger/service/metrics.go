@@ -0,0 +1,62 @@
+package service
+
+// The reasons for which this node rejected transactions, as counted in
+// Metrics.Rejections.
+const (
+	// RejectUnauthorized counts transactions with a wrong signature or
+	// not allowed by the darcs of their instructions.
+	RejectUnauthorized = "unauthorized"
+	// RejectAdmission counts transactions refused by a TxAdmissionPolicy.
+	RejectAdmission = "admission"
+	// RejectOther counts the rejections without a more precise reason,
+	// e.g. errors returned by a contract.
+	RejectOther = "other"
+)
+
+// rejectionReasons maps the errors returned when rejecting a transaction to
+// their reason in Metrics.Rejections.
+var rejectionReasons = map[error]string{
+	ErrReplay:              "replay",
+	ErrQuotaExceeded:       "quota",
+	ErrTooManyStateChanges: "too_many_state_changes",
+	ErrExecutionTimeout:    "timeout",
+	ErrPreconditionFailed:  "precondition",
+	ErrFutureBlock:         "future_block",
+	ErrSubmitterNotAllowed: "submitter",
+	ErrHalted:              "halted",
+}
+
+// RejectionReason returns the reason under which a transaction rejected with
+// err is counted in Metrics.Rejections.
+func RejectionReason(err error) string {
+	if reason, ok := rejectionReasons[err]; ok {
+		return reason
+	}
+	return RejectOther
+}
+
+// Metrics holds the counters of this node since it started.
+type Metrics struct {
+	// Rejections is the number of rejected transactions by reason. A
+	// transaction is counted by the node refusing it when it is submitted
+	// or collected, or by the leader rejecting it when it creates a block.
+	Rejections map[string]uint64
+}
+
+// GetMetrics returns a copy of the metrics of this node.
+func (s *Service) GetMetrics() Metrics {
+	s.metricsMut.Lock()
+	defer s.metricsMut.Unlock()
+	m := Metrics{Rejections: make(map[string]uint64)}
+	for reason, n := range s.rejections {
+		m.Rejections[reason] = n
+	}
+	return m
+}
+
+// rejected counts a transaction rejected for the reason.
+func (s *Service) rejected(reason string) {
+	s.metricsMut.Lock()
+	s.rejections[reason]++
+	s.metricsMut.Unlock()
+}
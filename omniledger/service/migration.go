@@ -0,0 +1,179 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// CmdMigrate upgrades the value of an instance to a newer format, using the
+// migrations registered by its contract with RegisterMigration. The optional
+// argument "version" is a varint with the version to migrate to, else the
+// highest version that can be reached is used. It is handled by the
+// service, so the contract doesn't need to know about it, but it still
+// needs to be allowed by the "invoke:migrate" rule of the darc.
+var CmdMigrate = "migrate"
+
+// ContractVersionID is the contract of the entries holding the versions of
+// the migrated instances. No contract is registered under this ID, so the
+// versions cannot be invoked.
+var ContractVersionID = "version"
+
+// Migration converts the value of an instance from one version of the
+// format of its contract to another. It must only depend on value, so that
+// all the nodes get the same result.
+type Migration func(value []byte) ([]byte, error)
+
+// migrationKey identifies a migration of a contract.
+type migrationKey struct {
+	contractID string
+	from, to   int
+}
+
+// RegisterMigration stores the migration of the values of the contract
+// contractID from the version from to the version to. Instances without a
+// version are at version 1.
+func RegisterMigration(s skipchain.GetService, contractID string, from, to int, m Migration) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerMigration(contractID, from, to, m)
+}
+
+func (s *Service) registerMigration(contractID string, from, to int, m Migration) error {
+	if from < 1 || to <= from {
+		return errors.New("a migration must go from a version to a higher one")
+	}
+	s.migrations[migrationKey{contractID, from, to}] = m
+	return nil
+}
+
+// VersionInstanceID returns the ID under which the version of the value of
+// the instance iID is stored once it has been migrated.
+func VersionInstanceID(iID InstanceID) InstanceID {
+	h := sha256.New()
+	h.Write(iID.Slice())
+	h.Write([]byte("version"))
+	return InstanceID{iID.DarcID, NewSubID(h.Sum(nil))}
+}
+
+// InstanceVersion returns the version of the value of the instance iID.
+// Instances that have never been migrated are at version 1.
+func InstanceVersion(coll CollectionView, iID InstanceID) (int, error) {
+	stored, err := versionStored(coll, iID)
+	if err != nil {
+		return 0, err
+	}
+	if !stored {
+		return 1, nil
+	}
+	value, contractID, err := coll.GetValues(VersionInstanceID(iID).Slice())
+	if err != nil {
+		return 0, err
+	}
+	if contractID != ContractVersionID {
+		return 0, errors.New("version is not stored by the service")
+	}
+	version, n := binary.Varint(value)
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("invalid version")
+	}
+	return int(version), nil
+}
+
+// versionStored returns whether a version of the instance iID is stored.
+func versionStored(coll CollectionView, iID InstanceID) (bool, error) {
+	record, err := coll.Get(VersionInstanceID(iID).Slice()).Record()
+	if err != nil {
+		return false, err
+	}
+	return record.Match(), nil
+}
+
+// removeVersions returns scs with additional state changes removing the
+// versions of the instances removed by scs, so that an instance spawned
+// again with the same ID starts at version 1.
+func removeVersions(coll CollectionView, scs StateChanges) (StateChanges, error) {
+	out := scs
+	for _, sc := range scs {
+		if sc.StateAction != Remove || string(sc.ContractID) == ContractVersionID {
+			continue
+		}
+		iID := NewInstanceID(sc.InstanceID)
+		stored, err := versionStored(coll, iID)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			out = append(out, NewStateChange(Remove, VersionInstanceID(iID), ContractVersionID, nil))
+		}
+	}
+	return out, nil
+}
+
+// migrateScs returns the state changes migrating the instance of inst, of
+// the contract contractID, to the version of the "version" argument. The
+// migrations are applied one after the other, always taking the one going
+// to the highest version not above the target, so that the result only
+// depends on the registered migrations.
+func (s *Service) migrateScs(coll CollectionView, inst Instruction, contractID string) (StateChanges, error) {
+	version, err := InstanceVersion(coll, inst.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	target := -1
+	if buf := inst.Invoke.Args.Search("version"); buf != nil {
+		t, n := binary.Varint(buf)
+		if n <= 0 || n != len(buf) {
+			return nil, errors.New("version must be a varint without trailing data")
+		}
+		if int(t) <= version {
+			return nil, fmt.Errorf("instance is already at version %d", version)
+		}
+		target = int(t)
+	}
+	value, _, err := coll.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	current := version
+	for current != target {
+		next := current
+		for k := range s.migrations {
+			if k.contractID == contractID && k.from == current && k.to > next &&
+				(target < 0 || k.to <= target) {
+				next = k.to
+			}
+		}
+		if next == current {
+			if target < 0 && current > version {
+				break
+			}
+			return nil, fmt.Errorf("no migration of %s from version %d", contractID, current)
+		}
+		value, err = s.migrations[migrationKey{contractID, current, next}](value)
+		if err != nil {
+			return nil, fmt.Errorf("migration from version %d to %d failed: %v", current, next, err)
+		}
+		current = next
+	}
+
+	versionBuf := make([]byte, binary.MaxVarintLen64)
+	versionBuf = versionBuf[:binary.PutVarint(versionBuf, int64(current))]
+	stored, err := versionStored(coll, inst.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	action := Update
+	if !stored {
+		action = Create
+	}
+	return StateChanges{
+		NewStateChange(Update, inst.InstanceID, contractID, value),
+		NewStateChange(action, VersionInstanceID(inst.InstanceID), ContractVersionID, versionBuf),
+	}, nil
+}
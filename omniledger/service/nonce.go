@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/darc"
+)
+
+// NoncePolicy defines how the nonce of an instruction is checked against the
+// last nonce used on its instance. The nonces are compared as big-endian
+// numbers.
+type NoncePolicy int
+
+const (
+	// NonceAny doesn't check the nonces, so the same instruction can be
+	// applied more than once.
+	NonceAny NoncePolicy = iota
+	// NonceIncreasing requires the nonce to be greater than the last one.
+	NonceIncreasing
+	// NonceNext requires the nonce to be the last one plus one.
+	NonceNext
+)
+
+// ContractNonceID is the contract of the instances holding the last nonce
+// used on another instance. As no contract is registered for it, these
+// instances can only be changed by the service.
+var ContractNonceID = "nonce"
+
+// ErrReplay is returned if the nonce of an instruction doesn't follow the
+// last nonce used on its instance.
+var ErrReplay = errors.New("nonce has already been used")
+
+// NonceInstanceID returns the ID of the instance holding the last nonce used
+// on the instance iID.
+func NonceInstanceID(iID InstanceID) InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractNonceID))
+	h.Write(iID.Slice())
+	return InstanceID{iID.DarcID, NewSubID(h.Sum(nil))}
+}
+
+// NonceKey returns the ID of the instance holding the last nonce used by the
+// instructions on the instance iID. The spawns are all sent to the darc
+// instance, so their nonces are counted for every spawner, the identity of
+// the first signer, which is nil for other instructions.
+func NonceKey(iID InstanceID, spawner *darc.Identity) InstanceID {
+	if spawner == nil {
+		return NonceInstanceID(iID)
+	}
+	h := sha256.New()
+	h.Write([]byte(ContractNonceID))
+	h.Write(iID.Slice())
+	h.Write([]byte(spawner.String()))
+	return InstanceID{iID.DarcID, NewSubID(h.Sum(nil))}
+}
+
+// nonceKey returns the NonceKey of instr.
+func nonceKey(instr Instruction) InstanceID {
+	if instr.Spawn == nil || len(instr.Signatures) == 0 {
+		return NonceKey(instr.InstanceID, nil)
+	}
+	return NonceKey(instr.InstanceID, &instr.Signatures[0].Signer)
+}
+
+// addedByService returns whether instr is one of the instructions the
+// service adds to the blocks itself. These instructions can't know the last
+// nonce of their instance, so their nonces are not checked. Their contract
+// checks them instead.
+func addedByService(instr Instruction) bool {
+	if instr.Invoke == nil || instr.InstanceID.SubID != oneSubID {
+		return false
+	}
+	switch instr.Invoke.Command {
+	case "view_change", cmdApplyScheduledViewChange, cmdExpireInstances:
+		return true
+	}
+	return false
+}
+
+// next returns the nonce following n.
+func (n Nonce) next() Nonce {
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// addNonce returns scs with an additional state change recording the nonce
+// of instr as the last nonce used on its instance. It returns ErrReplay if
+// the nonce doesn't follow the last one according to policy. The first nonce
+// used on an instance is always accepted. With NonceAny, or for the
+// instructions added by the service, scs is returned unchanged.
+func addNonce(coll CollectionView, instr Instruction, scs StateChanges, policy NoncePolicy) (StateChanges, error) {
+	if policy == NonceAny || addedByService(instr) {
+		return scs, nil
+	}
+	key := nonceKey(instr)
+	last, _, err := coll.GetValues(key.Slice())
+	exists := err == nil
+	if exists {
+		switch policy {
+		case NonceIncreasing:
+			if bytes.Compare(instr.Nonce[:], last) <= 0 {
+				return nil, ErrReplay
+			}
+		case NonceNext:
+			if instr.Nonce != NewNonce(last).next() {
+				return nil, ErrReplay
+			}
+		default:
+			return nil, errors.New("unknown nonce policy")
+		}
+	}
+	action := Update
+	if !exists {
+		action = Create
+	}
+	return append(scs, NewStateChange(action, key, ContractNonceID, instr.Nonce[:])), nil
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/omniledger/collection"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/cosi"
 	"github.com/dedis/onet/network"
 )
 
@@ -15,30 +17,89 @@ import (
 // proof for the forward links.
 func NewProof(c *collectionDB, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
 	key []byte) (p *Proof, err error) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
 	p = &Proof{}
 	p.InclusionProof, err = c.coll.Get(key).Proof()
 	if err != nil {
 		return
 	}
+	p.Latest, p.Links, err = proofLinks(s, id, c.latest)
+	// p.ProofBytes = p.proof.Consistent()
+	return
+}
+
+// NewBatchProof creates a proof for all keys in the skipchain with the given
+// id. The skipblocks and the nodes of the collection are only stored once in
+// the returned proof.
+func NewBatchProof(c *collectionDB, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
+	keys [][]byte) (bp *BatchProof, err error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	proofs := make([]collection.Proof, len(keys))
+	for i, key := range keys {
+		proofs[i], err = c.coll.Get(key).Proof()
+		if err != nil {
+			return
+		}
+	}
+	bp = &BatchProof{InclusionProofs: collection.CompressProofs(proofs)}
+	bp.Latest, bp.Links, err = proofLinks(s, id, c.latest)
+	return
+}
+
+// proofLinks returns the block target, and the links to get there from id.
+// If target is nil, it returns the latest block that can be reached from id
+// by following the forward links. The collection might not hold the state of
+// the latest block yet, so the proofs use the block applied to the
+// collection as target.
+func proofLinks(s *skipchain.SkipBlockDB, id, target skipchain.SkipBlockID) (latest skipchain.SkipBlock,
+	links []skipchain.ForwardLink, err error) {
 	sb := s.GetByID(id)
 	if sb == nil {
-		return nil, errors.New("didn't find skipchain")
+		err = errors.New("didn't find skipchain")
+		return
 	}
-	p.Links = []skipchain.ForwardLink{{
+	targetIndex := -1
+	if target != nil {
+		targetSB := s.GetByID(target)
+		if targetSB == nil {
+			err = errors.New("didn't find target block")
+			return
+		}
+		targetIndex = targetSB.Index
+	}
+	links = []skipchain.ForwardLink{{
 		From:      []byte{},
 		To:        id,
 		NewRoster: sb.Roster,
 	}}
-	for len(sb.ForwardLink) > 0 {
-		link := sb.ForwardLink[len(sb.ForwardLink)-1]
-		p.Links = append(p.Links, *link)
-		sb = s.GetByID(link.To)
-		if sb == nil {
-			return nil, errors.New("missing block in chain")
+	for len(sb.ForwardLink) > 0 && sb.Index != targetIndex {
+		// Take the highest link that doesn't jump over the target.
+		var next *skipchain.SkipBlock
+		var link *skipchain.ForwardLink
+		for i := len(sb.ForwardLink) - 1; i >= 0; i-- {
+			link = sb.ForwardLink[i]
+			next = s.GetByID(link.To)
+			if next == nil {
+				err = errors.New("missing block in chain")
+				return
+			}
+			if targetIndex < 0 || next.Index <= targetIndex {
+				break
+			}
 		}
+		links = append(links, *link)
+		sb = next
 	}
-	p.Latest = *sb
-	// p.ProofBytes = p.proof.Consistent()
+	if targetIndex >= 0 && !sb.Hash.Equal(target) {
+		err = errors.New("didn't reach target block")
+		return
+	}
+	latest = *sb
 	return
 }
 
@@ -54,6 +115,10 @@ var ErrorVerifyCollectionRoot = errors.New("root of collection is not in skipblo
 // have a proper proof that it comes from the genesis block.
 var ErrorVerifySkipchain = errors.New("stored skipblock is not properly evolved from genesis block")
 
+// ErrProofStale is returned if the latest block of the proof is too far
+// behind the tip of the skipchain.
+var ErrProofStale = errors.New("latest block of proof is too old")
+
 // Verify takes a skipchain id and verifies that the proof is valid for this skipchain.
 // It verifies the collection-proof, that the merkle-root is stored in the skipblock
 // of the proof and the fact that the skipblock is indeed part of the skipchain.
@@ -69,17 +134,22 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 	if !bytes.Equal(p.InclusionProof.TreeRootHash(), d.(*DataHeader).CollectionRoot) {
 		return ErrorVerifyCollectionRoot
 	}
-	var sbID skipchain.SkipBlockID
-	var publics []kyber.Point
-	for i, l := range p.Links {
-		if i == 0 {
-			// The first forward link is a pointer from []byte{} to the genesis
-			// block and holds the roster of the genesis block.
-			sbID = scID
-			publics = l.NewRoster.Publics()
-			continue
-		}
-		if err = l.Verify(cothority.Suite, publics); err != nil {
+	return VerifyLinks(scID, p.Links)
+}
+
+// VerifyLinks checks that links is a chain of forward links starting at the
+// genesis block genesisID. The first link is a pointer from []byte{} to the
+// genesis block and holds its roster. Every other link must start where the
+// previous one ended and be signed by the roster active at its source block.
+// It returns ErrorVerifySkipchain if any of the links is wrong.
+func VerifyLinks(genesisID skipchain.SkipBlockID, links []skipchain.ForwardLink) error {
+	if len(links) == 0 || links[0].NewRoster == nil {
+		return ErrorVerifySkipchain
+	}
+	sbID := genesisID
+	publics := links[0].NewRoster.Publics()
+	for _, l := range links[1:] {
+		if err := l.Verify(cothority.Suite, publics); err != nil {
 			return ErrorVerifySkipchain
 		}
 		if !l.From.Equal(sbID) {
@@ -93,6 +163,82 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 	return nil
 }
 
+// VerifyWithKeys checks the proof against a pinned set of public keys instead
+// of the genesis block of a skipchain. Every forward link of the proof must be
+// signed by at least threshold of the keys, given in the order of the roster,
+// and the last one must point to the latest block, whose collection root must
+// match the inclusion proof. As the keys are fixed, a proof going over a
+// change of the roster doesn't verify. The proof must hold at least one
+// forward link, so it must be created starting at an earlier block than the
+// latest one.
+func (p Proof) VerifyWithKeys(keys []kyber.Point, threshold int) error {
+	if threshold <= 0 || threshold > len(keys) {
+		return errors.New("threshold must be between 1 and the number of keys")
+	}
+	if !p.InclusionProof.Consistent() {
+		return ErrorVerifyCollection
+	}
+	_, d, err := network.Unmarshal(p.Latest.Data, cothority.Suite)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p.InclusionProof.TreeRootHash(), d.(*DataHeader).CollectionRoot) {
+		return ErrorVerifyCollectionRoot
+	}
+	if len(p.Links) < 2 {
+		return errors.New("proof has no signed forward link")
+	}
+	policy := cosi.NewThresholdPolicy(threshold)
+	for i, l := range p.Links[1:] {
+		if !l.From.Equal(p.Links[i].To) || !bytes.Equal(l.Signature.Msg, l.Hash()) {
+			return ErrorVerifySkipchain
+		}
+		if err := cosi.Verify(cothority.Suite, keys, l.Signature.Msg, l.Signature.Sig, policy); err != nil {
+			return ErrorVerifySkipchain
+		}
+	}
+	if p.Latest.SkipBlockFix == nil || !p.Links[len(p.Links)-1].To.Equal(p.Latest.CalculateHash()) {
+		return ErrorVerifySkipchain
+	}
+	return nil
+}
+
+// VerifyFresh is like Verify, but additionally checks that the latest block
+// of the proof is at most maxAge blocks behind the block with index tip. It
+// returns ErrProofStale if the proof is older, because even a valid proof
+// might not reflect the current state anymore.
+func (p Proof) VerifyFresh(scID skipchain.SkipBlockID, tip, maxAge int) error {
+	if err := p.Verify(scID); err != nil {
+		return err
+	}
+	return p.checkFresh(tip, maxAge)
+}
+
+func (p Proof) checkFresh(tip, maxAge int) error {
+	if tip-p.Latest.Index > maxAge {
+		return ErrProofStale
+	}
+	return nil
+}
+
+// Expand returns the individual proofs of the batch, in the order of the
+// keys that have been requested. Every proof can be verified on its own.
+func (bp BatchProof) Expand() ([]Proof, error) {
+	inclusions, err := bp.InclusionProofs.Expand()
+	if err != nil {
+		return nil, err
+	}
+	proofs := make([]Proof, len(inclusions))
+	for i, inc := range inclusions {
+		proofs[i] = Proof{
+			InclusionProof: inc,
+			Latest:         bp.Latest,
+			Links:          bp.Links,
+		}
+	}
+	return proofs, nil
+}
+
 // KeyValue returns the key and the values stored in the proof.
 func (p Proof) KeyValue() (key []byte, values [][]byte, err error) {
 	key = p.InclusionProof.Key
@@ -50,6 +50,65 @@ func TestVerify(t *testing.T) {
 	require.Equal(t, ErrorVerifyCollectionRoot, p.Verify(s.genesis.SkipChainID()))
 }
 
+func TestVerifyLinks(t *testing.T) {
+	s := createSC(t)
+	p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
+	require.Nil(t, err)
+	scID := s.genesis.SkipChainID()
+	require.Equal(t, 2, len(p.Links))
+	require.Nil(t, VerifyLinks(scID, p.Links))
+
+	require.Equal(t, ErrorVerifySkipchain, VerifyLinks(scID, nil))
+	require.Equal(t, ErrorVerifySkipchain, VerifyLinks(s.genesis2.SkipChainID(), p.Links))
+
+	// A link that doesn't start at the end of the previous one.
+	broken := append([]skipchain.ForwardLink{}, p.Links...)
+	broken[1].From = getSBID("other")
+	require.Equal(t, ErrorVerifySkipchain, VerifyLinks(scID, broken))
+
+	// A link signed by another roster.
+	broken = append([]skipchain.ForwardLink{}, p.Links...)
+	broken[0].NewRoster = s.genesis2.Roster
+	require.Equal(t, ErrorVerifySkipchain, VerifyLinks(scID, broken))
+}
+
+func TestVerifyFresh(t *testing.T) {
+	s := createSC(t)
+	p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
+	require.Nil(t, err)
+	scID := s.genesis.SkipChainID()
+
+	require.Nil(t, p.VerifyFresh(scID, p.Latest.Index, 0))
+	require.Nil(t, p.VerifyFresh(scID, p.Latest.Index+2, 2))
+	require.Equal(t, ErrProofStale, p.VerifyFresh(scID, p.Latest.Index+3, 2))
+
+	// A stale proof must still be valid.
+	require.Equal(t, ErrorVerifySkipchain, p.VerifyFresh(s.genesis2.SkipChainID(), p.Latest.Index, 2))
+}
+
+func TestVerifyWithKeys(t *testing.T) {
+	s := createSC(t)
+	p, err := NewProof(s.c, s.s, s.genesis.Hash, s.key)
+	require.Nil(t, err)
+	keys := s.genesis.Roster.Publics()
+	require.Nil(t, p.VerifyWithKeys(keys, 1))
+
+	require.Equal(t, ErrorVerifySkipchain, p.VerifyWithKeys(s.genesis2.Roster.Publics(), 1))
+	require.NotNil(t, p.VerifyWithKeys(keys, 0))
+	require.NotNil(t, p.VerifyWithKeys(keys, 2))
+
+	// A proof starting at the latest block has no signature to verify.
+	latest, err := NewProof(s.c, s.s, s.sb2.Hash, s.key)
+	require.Nil(t, err)
+	require.NotNil(t, latest.VerifyWithKeys(keys, 1))
+
+	p.Latest.Data, err = network.Marshal(&DataHeader{
+		CollectionRoot: getSBID("123"),
+	})
+	require.Nil(t, err)
+	require.Equal(t, ErrorVerifyCollectionRoot, p.VerifyWithKeys(keys, 1))
+}
+
 type sc struct {
 	c            *collectionDB          // a usable collectionDB to store key/value pairs
 	s            *skipchain.SkipBlockDB // a usable skipchain DB to store blocks
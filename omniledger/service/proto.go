@@ -6,6 +6,7 @@ import (
 	"github.com/dedis/cothority/omniledger/collection"
 	"github.com/dedis/cothority/omniledger/darc"
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
 )
 
@@ -36,12 +37,42 @@ type DataHeader struct {
 	StateChangesHash []byte
 	// Timestamp is a unix timestamp in nanoseconds.
 	Timestamp int64
+	// Salt is the salt used to order the transactions of the block. It
+	// lets clients check the order with VerifyTxOrder.
+	Salt []byte `protobuf:"opt"`
 }
 
 // DataBody is stored in the body of the skipblock but is not hashed. This reduces
 // the proof needed for a key/value pair.
 type DataBody struct {
 	Transactions ClientTransactions
+	// Proposal is signed by the leader proposing this block.
+	Proposal *Proposal
+}
+
+// Proposal is the signature of a leader on the header of a block it proposes.
+// Two different proposals of the same leader for the same block are the
+// proof that the leader is equivocating.
+type Proposal struct {
+	// SkipChainID is the skipchain of the block, or empty for a genesis
+	// block.
+	SkipChainID skipchain.SkipBlockID
+	// Index of the proposed block
+	Index int
+	// Header is the marshalled DataHeader of the proposed block
+	Header []byte
+	// Leader is the public key of the node proposing the block
+	Leader kyber.Point
+	// Signature is the schnorr signature of the leader on the skipchain-ID,
+	// the index and the header
+	Signature []byte
+}
+
+// Equivocation is the evidence that a leader proposed two different blocks
+// with the same index.
+type Equivocation struct {
+	First  Proposal
+	Second Proposal
 }
 
 // ***
@@ -79,12 +110,104 @@ type AddTxRequest struct {
 	// How many block-intervals to wait for inclusion -
 	// missing value or 0 means return immediately.
 	InclusionWait int `protobuf:"opt"`
+	// Submitter is the signature of the client sending the request, as
+	// created by SignSubmitter. It is required if the skipchain has
+	// Submitters in its config.
+	Submitter *darc.Signature `protobuf:"opt"`
 }
 
 // AddTxResponse is the reply after an AddTxRequest is finished.
 type AddTxResponse struct {
 	// Version of the protocol
 	Version Version
+	// Created are the instances created by the transaction, and Modified
+	// the ones it updated or removed. They are only set if the request
+	// waited for the inclusion of the transaction.
+	Created  []InstanceID `protobuf:"opt"`
+	Modified []InstanceID `protobuf:"opt"`
+}
+
+// AddTxBatchRequest requests to apply several related transactions to the
+// ledger. They can be tracked together with the returned batch ID.
+type AddTxBatchRequest struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Transactions to be applied to the kv-store
+	Transactions ClientTransactions
+	// Submitter is the signature of the client sending the request, as
+	// created by SignSubmitter. It is required if the skipchain has
+	// Submitters in its config.
+	Submitter *darc.Signature `protobuf:"opt"`
+}
+
+// AddTxBatchResponse is the reply after an AddTxBatchRequest is finished.
+type AddTxBatchResponse struct {
+	// Version of the protocol
+	Version Version
+	// BatchID is the sha256 hash of the hashes of all the transactions of
+	// the batch.
+	BatchID []byte
+}
+
+// GetTxStatus asks whether the transactions of a batch are in the skipchain.
+type GetTxStatus struct {
+	// Version of the protocol
+	Version Version
+	// BatchID as returned by AddTxBatchRequest
+	BatchID []byte
+}
+
+// GetTxStatusResponse holds how many transactions of the batch have been
+// included in a block.
+type GetTxStatusResponse struct {
+	// Version of the protocol
+	Version Version
+	// Status of the batch as a whole
+	Status TxStatus
+	// Included is the number of transactions of the batch in a block
+	Included int
+	// Total is the number of transactions of the batch
+	Total int
+}
+
+// AddPartialSignature sends the partial signature of a member of a committee
+// sharing the BLS key of a signer of an instruction. The service aggregates
+// the partial signatures and adds the transaction once it is signed.
+type AddPartialSignature struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Transaction holding the instruction, with an empty signature for
+	// the BLS identity of the committee
+	Transaction ClientTransaction
+	// Instruction is the index of the instruction in the transaction
+	Instruction int
+	// Partial is the threshold BLS signature share of the member on the
+	// digest of the instruction
+	Partial []byte
+	// Committee holds the commitments of the public polynomial of the
+	// committee, with the BLS public key first. Its length is the
+	// threshold of the committee.
+	Committee [][]byte `protobuf:"opt"`
+	// Submitter is the signature of the client sending the request, as
+	// created by SignSubmitter. It is required if the skipchain has
+	// Submitters in its config.
+	Submitter *darc.Signature `protobuf:"opt"`
+}
+
+// AddPartialSignatureResponse is the reply to AddPartialSignature.
+type AddPartialSignatureResponse struct {
+	// Version of the protocol
+	Version Version
+	// Signature is the aggregated signature of the committee, or empty if
+	// there are not enough partial signatures yet.
+	Signature []byte
+	// Submitted is true if all the signatures of the transaction are
+	// complete and the transaction has been added.
+	Submitted bool
 }
 
 // GetProof returns the proof that the given key is in the collection.
@@ -96,6 +219,11 @@ type GetProof struct {
 	// ID is any block that is known to us in the skipchain, can be the genesis
 	// block or any later block. The proof returned will be starting at this block.
 	ID skipchain.SkipBlockID
+	// Field, if set, is the name of a field of the instance Key. The proof
+	// then also proves the field against the value of the instance, the
+	// field must have been declared with RegisterContractFields. Use
+	// Proof.VerifyField to verify it.
+	Field string `protobuf:"opt"`
 }
 
 // GetProofResponse can be used together with the Genesis block to proof that
@@ -108,12 +236,358 @@ type GetProofResponse struct {
 	Proof Proof
 }
 
+// GetBatchProof returns the proofs of several keys in one bundle.
+type GetBatchProof struct {
+	// Version of the protocol
+	Version Version
+	// Keys are the keys we want to look up
+	Keys [][]byte
+	// ID is any block that is known to us in the skipchain, can be the genesis
+	// block or any later block. The proof returned will be starting at this block.
+	ID skipchain.SkipBlockID
+}
+
+// GetBatchProofResponse holds the proofs of all the requested keys.
+type GetBatchProofResponse struct {
+	// Version of the protocol
+	Version Version
+	// Proof holds the proofs of all keys, in the order of the request.
+	Proof BatchProof
+}
+
+// GetInstanceHistory asks for all the values an instance held since the
+// genesis block.
+type GetInstanceHistory struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance we want the history of
+	InstanceID InstanceID
+}
+
+// GetInstanceHistoryResponse holds the history of an instance, oldest change
+// first.
+type GetInstanceHistoryResponse struct {
+	// Version of the protocol
+	Version Version
+	// Entries holds one entry for every state change of the instance
+	Entries []HistoryEntry
+}
+
+// GetInstanceOrigin asks for the block and the instruction that created an
+// instance.
+type GetInstanceOrigin struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance we want the origin of
+	InstanceID InstanceID
+}
+
+// GetInstanceOriginResponse holds where an instance has been created.
+type GetInstanceOriginResponse struct {
+	// Version of the protocol
+	Version Version
+	// BlockIndex is the index of the block that created the instance
+	BlockIndex int
+	// InstructionHash is the hash of the instruction that created the
+	// instance
+	InstructionHash []byte
+}
+
+// GetLastModifier asks for the last instruction that changed an instance.
+type GetLastModifier struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance we want the last modifier of
+	InstanceID InstanceID
+}
+
+// GetLastModifierResponse holds who changed an instance last.
+type GetLastModifierResponse struct {
+	// Version of the protocol
+	Version Version
+	// BlockIndex is the index of the block with the last change
+	BlockIndex int
+	// Signers are the identities that signed the instruction, or its
+	// transaction if it is signed as a whole
+	Signers []darc.Identity
+	// Timestamp is the timestamp of the block, in nanoseconds
+	Timestamp int64
+}
+
+// GetProofSize asks for the size of the proof GetProof returns for a key.
+type GetProofSize struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Key is the key we want the size of the proof of
+	Key []byte
+}
+
+// GetProofSizeResponse holds the size of a proof.
+type GetProofSizeResponse struct {
+	// Version of the protocol
+	Version Version
+	// Size is the size in bytes of the encoded proof
+	Size int
+}
+
+// GetChangesSince asks for the state changes of all the blocks after an
+// index.
+type GetChangesSince struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// FromIndex is the index of the last block known to the client
+	FromIndex int
+}
+
+// GetChangesSinceResponse holds the state changes of the blocks after an
+// index, and the latest block.
+type GetChangesSinceResponse struct {
+	// Version of the protocol
+	Version Version
+	// StateChanges of all the blocks after the index, in order
+	StateChanges []StateChange
+	// Latest is the latest block, whose header holds the root of the
+	// collection after the state changes
+	Latest *skipchain.SkipBlock
+}
+
+// FindByExternalRef asks for the transactions tagged with an external
+// reference.
+type FindByExternalRef struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// ExternalRef is the reference chosen by the client
+	ExternalRef []byte
+}
+
+// FindByExternalRefResponse holds the transactions tagged with an external
+// reference.
+type FindByExternalRefResponse struct {
+	// Version of the protocol
+	Version Version
+	// Hashes are the hashes of the instructions of the transactions
+	Hashes [][]byte
+}
+
+// GetDecodedInstance asks for the contract and the decoded value of an
+// instance.
+type GetDecodedInstance struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance we want the value of
+	InstanceID InstanceID
+}
+
+// GetDecodedInstanceResponse holds the contract and the value of an
+// instance.
+type GetDecodedInstanceResponse struct {
+	// Version of the protocol
+	Version Version
+	// ContractID is the contract of the instance
+	ContractID string
+	// Value is the value of the instance as it is stored
+	Value []byte
+	// Decoded is the decoded value, marshalled with network.Marshal
+	Decoded []byte `protobuf:"opt"`
+}
+
+// HistoryEntry is one change of the value of an instance.
+type HistoryEntry struct {
+	// BlockIndex is the index of the block that holds the change
+	BlockIndex int
+	// InstructionHash is the hash of the instruction that changed the instance
+	InstructionHash []byte
+	// StateAction is the action that was applied to the instance
+	StateAction StateAction
+	// Value is the value of the instance after the change
+	Value []byte
+}
+
+// GetBlock asks for the block at a given index of a skipchain.
+type GetBlock struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Index of the block
+	Index int
+}
+
+// GetBlockResponse holds the requested block.
+type GetBlockResponse struct {
+	// Version of the protocol
+	Version Version
+	// Skipblock at the requested index
+	Skipblock *skipchain.SkipBlock
+}
+
+// GetBlockTransactions asks for a page of the transactions of the block at
+// a given index of a skipchain, so that large blocks don't have to be sent
+// in one message.
+type GetBlockTransactions struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Index of the block
+	Index int
+	// Start is the index of the first transaction returned
+	Start int
+	// Count is the maximum number of transactions returned. The service
+	// returns at most maxBlockTxsPage of them.
+	Count int
+}
+
+// GetBlockTransactionsResponse holds a page of the transactions of a block.
+type GetBlockTransactionsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Transactions of the block, in order, starting at Start
+	Transactions ClientTransactions
+	// More is true if the block holds transactions after these ones
+	More bool
+}
+
+// GetTxReceipt asks for the receipt of a transaction in a skipchain.
+type GetTxReceipt struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// TxHash is the hash of the instructions of the transaction
+	TxHash []byte
+}
+
+// GetTxReceiptResponse holds the receipt of the transaction.
+type GetTxReceiptResponse struct {
+	// Version of the protocol
+	Version Version
+	// Receipt of the transaction
+	Receipt TxReceipt
+}
+
+// TxReceipt proves that a transaction is in a block of a skipchain. It can
+// be verified offline using Verify.
+type TxReceipt struct {
+	// Block is the skipblock holding the transaction, without its payload
+	// and forward links. Its data is the DataHeader of the block.
+	Block skipchain.SkipBlock
+	// Position is the index of the transaction in the block.
+	Position int
+	// TxHashes are the hashes of all the transactions of the block, in
+	// order. As the ClientTransactionHash of the header is the hash over
+	// all of them, they are the path from the transaction to the header.
+	TxHashes [][]byte
+	// Links prove that Block is in the skipchain. The first ForwardLink has
+	// an empty-sliced `From` and the genesis-block in `To`, together with
+	// the roster of the genesis-block in the `NewRoster`. The last one
+	// points to Block.
+	Links []skipchain.ForwardLink
+}
+
+// InstanceExport holds an instance of a skipchain together with the proof of
+// its state, so that it can be imported into another skipchain using the
+// spawn_imported command of a darc.
+type InstanceExport struct {
+	// Genesis is the genesis block of the skipchain of the instance,
+	// without its payload and forward links. It is the starting point of
+	// the links of the proof.
+	Genesis skipchain.SkipBlock
+	// Proof of the instance, with links starting at the genesis block.
+	Proof Proof
+}
+
+// ExportedInstance is the value of an instance locked with the lock_export
+// command of a darc. The instance can then only be imported into the
+// Destination skipchain.
+type ExportedInstance struct {
+	Destination skipchain.SkipBlockID
+	ContractID  string
+	Value       []byte
+}
+
 // ChainConfig stores all the configuration information for one skipchain. It will
 // be stored under the key "GenesisDarcID || OneNonce", in the collections. The
 // GenesisDarcID is the value of GenesisReferenceID.
 type ChainConfig struct {
 	BlockInterval time.Duration
 	Roster        onet.Roster
+	// ScheduledRosterChange, if set, is a change of the roster that will
+	// be applied in the block with the given index.
+	ScheduledRosterChange *ScheduledRosterChange
+	// MaxStateChanges is the maximum number of state changes a single
+	// transaction can produce. If it is zero, defaultMaxStateChanges is
+	// used.
+	MaxStateChanges int `protobuf:"opt"`
+	// RequireSkipchainID, if true, refuses instructions that are not bound
+	// to this skipchain with their SkipchainID field. It should be set once
+	// all clients fill in the SkipchainID of their instructions.
+	RequireSkipchainID bool `protobuf:"opt"`
+	// RecordFailedPreconditions, if true, keeps the transactions failing
+	// with ErrPreconditionFailed in the block, marked with
+	// FailedPrecondition and without any state change. Else they are
+	// dropped.
+	RecordFailedPreconditions bool `protobuf:"opt"`
+	// ConfigVersion is incremented by every update of the config. The new
+	// config of an update_config must have the version following the
+	// current one, so that an older config cannot be applied again.
+	ConfigVersion uint64 `protobuf:"opt"`
+	// InstructionTimeout is the time a contract has to execute an
+	// instruction when the leader fills a block. If it takes longer, the
+	// leader drops the transaction with ErrExecutionTimeout. The blocks are
+	// executed without timeout, so that all nodes agree on them. If it is
+	// zero, there is no timeout.
+	InstructionTimeout time.Duration `protobuf:"opt"`
+	// NoncePolicy defines how the nonce of an instruction must follow the
+	// last nonce used on its instance. Instructions that don't follow it
+	// are refused with ErrReplay. The default NonceAny doesn't check them.
+	NoncePolicy NoncePolicy `protobuf:"opt"`
+	// StorageQuotas limit the number of bytes stored by the instances of
+	// some contracts. Transactions going over a quota are refused with
+	// ErrQuotaExceeded.
+	StorageQuotas []StorageQuota `protobuf:"opt"`
+	// Submitters, if not empty, are the only clients allowed to send
+	// transactions to the skipchain. The requests must be signed by one of
+	// them, whatever the darcs of the instructions allow.
+	Submitters []darc.Identity `protobuf:"opt"`
+	// LeaderPolicy defines which node of the roster proposes every block.
+	// Blocks from another node are refused. The default LeaderFirst lets
+	// the first node propose them.
+	LeaderPolicy LeaderPolicy `protobuf:"opt"`
+	// ImportSources are the skipchains from which instances can be
+	// imported with the spawn_imported command of a darc.
+	ImportSources []skipchain.SkipBlockID `protobuf:"opt"`
+}
+
+// StorageQuota is the maximum number of bytes the instances of a contract
+// can store, as counted by InstanceSize.
+type StorageQuota struct {
+	// ContractID of the instances counted
+	ContractID string
+	// MaxBytes is the total size allowed. Zero means unlimited.
+	MaxBytes int
+}
+
+// ScheduledRosterChange is a change of the roster planned for a future block.
+type ScheduledRosterChange struct {
+	// Index of the block that applies the new roster
+	Index int
+	// Roster to use from this block on
+	Roster onet.Roster
 }
 
 // Proof represents everything necessary to verify a given
@@ -134,6 +608,36 @@ type Proof struct {
 	// empty-sliced `From` and the genesis-block in `To`, together with the
 	// roster of the genesis-block in the `NewRoster`.
 	Links []skipchain.ForwardLink
+	// Field, if the proof has been requested for a field, proves the field
+	// against the value of the instance. Use VerifyField to verify it.
+	Field *FieldProof `protobuf:"opt"`
+}
+
+// FieldProof proves a field of an instance against the root of its fields,
+// which is at the start of the value of the instance.
+type FieldProof struct {
+	// Name and Value of the field.
+	Name  string
+	Value []byte
+	// Index of the field in the fields sorted by name, and Count of the
+	// fields.
+	Index int
+	Count int
+	// Hashes are the hashes of the tree of the fields needed to compute
+	// its root from the field, from the bottom up.
+	Hashes [][]byte
+}
+
+// BatchProof holds the proofs of several keys of the same skipchain. Instead
+// of repeating the skipblocks and the nodes of the collection shared by all
+// proofs, they are only stored once. Use Expand to get the individual proofs.
+type BatchProof struct {
+	// InclusionProofs are the compressed collection proofs of all keys.
+	InclusionProofs collection.CompressedProofs
+	// Providing the latest skipblock to retrieve the Merkle tree root.
+	Latest skipchain.SkipBlock
+	// Proving the path to the latest skipblock, the same as in Proof.
+	Links []skipchain.ForwardLink
 }
 
 // Instruction holds only one of Spawn, Invoke, or Delete
@@ -159,6 +663,43 @@ type Instruction struct {
 	Delete *Delete
 	// Signatures that can be verified using the darc defined by the instanceID.
 	Signatures []darc.Signature
+	// AdditionalDarcs holds the base IDs of darcs that must authorize the
+	// instruction too. The identities of the signatures must fulfill the
+	// rule of the action of the instruction in every one of these darcs.
+	AdditionalDarcs []darc.ID
+	// SkipchainID, if set, binds the instruction to the given skipchain.
+	// It is part of the hash, so the signatures of the instruction are not
+	// valid on any other skipchain.
+	SkipchainID skipchain.SkipBlockID `protobuf:"opt"`
+	// PreAuthorization, if set, authorizes the instruction in lieu of
+	// Signatures. The instruction must conform to the template of the
+	// token and must not be signed itself.
+	PreAuthorization *PreAuthorization `protobuf:"opt"`
+	// BlockIndex, if not zero, is the index of the block whose state the
+	// instruction has been prepared against. It must refer to a block that
+	// is already committed. It is part of the hash.
+	BlockIndex int `protobuf:"opt"`
+}
+
+// PreAuthorization is a token signed by a client that lets a relay submit
+// instructions on its behalf. The relay fills in the arguments, but the
+// action, the instance and the nonce of the instruction must match the
+// template. The nonce window bounds the use of the token, which can be
+// revoked earlier by evolving the darc of the instance.
+type PreAuthorization struct {
+	// Action that the instruction must have, e.g. "spawn:value".
+	Action string
+	// InstanceID the instruction must be sent to.
+	InstanceID InstanceID
+	// NonceMin and NonceMax are the inclusive bounds of the nonce of the
+	// instruction.
+	NonceMin Nonce
+	NonceMax Nonce
+	// SkipchainID, if set, is the only skipchain the token is valid on.
+	SkipchainID skipchain.SkipBlockID `protobuf:"opt"`
+	// Signatures on the hash of the token, verified using the darc of the
+	// instance.
+	Signatures []darc.Signature
 }
 
 // An InstanceID is a unique identifier for one instance of a contract.
@@ -175,6 +716,11 @@ type Spawn struct {
 	ContractID string
 	// args holds all data necessary to spawn the new object.
 	Args Arguments
+	// Idempotent, if true, makes the spawn succeed without any change if
+	// an instance it creates already exists with the same contract. It is
+	// meant for singletons at a well-known ID, so that a client can retry
+	// the spawn and then get the proof of the instance.
+	Idempotent bool `protobuf:"opt"`
 }
 
 // Invoke calls a method of an existing object which will update its internal
@@ -202,11 +748,28 @@ type Argument struct {
 // If any of the instructions fails, none of them will be applied.
 type ClientTransaction struct {
 	Instructions Instructions
+	// Signatures, if present, sign the hash of all the instructions and
+	// authorize every instruction of the transaction. The instructions
+	// must then not hold any signatures themselves.
+	Signatures []darc.Signature
+	// FailedPrecondition is set by the leader if the transaction has been
+	// recorded in the block although a precondition failed. None of its
+	// instructions has been applied.
+	FailedPrecondition bool `protobuf:"opt"`
+	// ExternalRef is a reference chosen by the client, e.g. an order ID,
+	// to find the transaction with FindByExternalRef. It is not signed.
+	ExternalRef []byte `protobuf:"opt"`
+	// ReadProofs are proofs of the instances the transaction reads, taken
+	// from one of the latest blocks. They are used instead of reading the
+	// collection for the instances not written since. They are not
+	// signed, as they are checked against the root of that block.
+	ReadProofs []collection.Proof `protobuf:"opt"`
 }
 
 // StateChange is one new state that will be applied to the collection.
 type StateChange struct {
-	// StateAction can be any of Create, Update, Remove
+	// StateAction can be any of Create, Update, Remove, or a custom action
+	// registered with RegisterStateAction
 	StateAction StateAction
 	// InstanceID of the state to change
 	InstanceID []byte
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/collection"
+)
+
+// ErrQuotaExceeded is returned if a transaction makes the instances of a
+// contract store more bytes than allowed by the StorageQuotas of the
+// ChainConfig.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// storageUsage follows the storage of the contracts having a quota while
+// the transactions of a block are executed.
+type storageUsage struct {
+	quotas map[string]int
+	used   map[string]int
+}
+
+// newStorageUsage returns the storage used in coll by the contracts having a
+// quota in the config, or nil if none has a quota. If coll holds the state
+// of c, the sizes are the counters kept by c, so the instances are not
+// scanned for every block.
+func newStorageUsage(c *collectionDB, coll *collection.Collection, config *ChainConfig) *storageUsage {
+	var u *storageUsage
+	for _, q := range config.StorageQuotas {
+		if q.MaxBytes == 0 {
+			continue
+		}
+		if u == nil {
+			u = &storageUsage{quotas: make(map[string]int), used: make(map[string]int)}
+		}
+		u.quotas[q.ContractID] = q.MaxBytes
+	}
+	if u != nil {
+		u.used = c.contractSizesOf(coll, u.quotas)
+	}
+	return u
+}
+
+// footprint is the contract and the size of an instance.
+type footprint struct {
+	contractID string
+	size       int
+}
+
+// instanceFootprint returns the footprint of the instance with the given
+// key, which is empty if the instance doesn't exist.
+func instanceFootprint(coll CollectionView, key []byte) footprint {
+	value, contractID, err := coll.GetValues(key)
+	if err != nil || contractID == "" {
+		return footprint{}
+	}
+	return footprint{contractID, instanceSize(key, value, []byte(contractID))}
+}
+
+// change adds to delta the change of storage of a state change, given the
+// footprints of its instance before and after it is applied.
+func (u *storageUsage) change(delta map[string]int, before, after footprint) {
+	if _, ok := u.quotas[before.contractID]; ok {
+		delta[before.contractID] -= before.size
+	}
+	if _, ok := u.quotas[after.contractID]; ok {
+		delta[after.contractID] += after.size
+	}
+}
+
+// commit adds the changes of storage of a transaction to the usage, or
+// returns ErrQuotaExceeded if it makes a contract go over its quota. A
+// transaction that doesn't increase the storage of a contract is always
+// accepted, even if the contract is already over a lowered quota.
+func (u *storageUsage) commit(delta map[string]int) error {
+	for cid, d := range delta {
+		if d > 0 && u.used[cid]+d > u.quotas[cid] {
+			return ErrQuotaExceeded
+		}
+	}
+	for cid, d := range delta {
+		u.used[cid] += d
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+)
+
+// GetTxReceipt returns the receipt proving that the transaction with the
+// given hash is in a block of the skipchain. The blocks are searched from the
+// latest one backwards.
+func (s *Service) GetTxReceipt(req *GetTxReceipt) (*GetTxReceiptResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	sb, err := s.db().GetLatestByID(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+	for sb != nil {
+		_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
+		if err != nil {
+			return nil, err
+		}
+		body, ok := bodyI.(*DataBody)
+		if !ok {
+			return nil, errors.New("couldn't unmarshal body")
+		}
+		hashes := make([][]byte, len(body.Transactions))
+		position := -1
+		for i, ct := range body.Transactions {
+			hashes[i] = ct.Instructions.Hash()
+			if bytes.Equal(hashes[i], req.TxHash) {
+				position = i
+			}
+		}
+		if position >= 0 {
+			_, links, err := proofLinks(s.db(), req.SkipchainID, sb.Hash)
+			if err != nil {
+				return nil, err
+			}
+			block := sb.Copy()
+			block.Payload = nil
+			block.ForwardLink = nil
+			return &GetTxReceiptResponse{
+				Version: CurrentVersion,
+				Receipt: TxReceipt{
+					Block:    *block,
+					Position: position,
+					TxHashes: hashes,
+					Links:    links,
+				},
+			}, nil
+		}
+		if len(sb.BackLinkIDs) == 0 {
+			break
+		}
+		sb, err = s.prevBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("transaction not found")
+}
+
+// Verify checks that the receipt proves that the transaction with the hash
+// txHash is in a block of the skipchain scID. It only needs the ID of the
+// skipchain, the rosters being given by the links.
+func (r TxReceipt) Verify(scID skipchain.SkipBlockID, txHash []byte) error {
+	if r.Position < 0 || r.Position >= len(r.TxHashes) {
+		return errors.New("position out of range")
+	}
+	if !bytes.Equal(r.TxHashes[r.Position], txHash) {
+		return errors.New("transaction is not at this position")
+	}
+	if r.Block.SkipBlockFix == nil {
+		return errors.New("missing block")
+	}
+	_, headerI, err := network.Unmarshal(r.Block.Data, cothority.Suite)
+	if err != nil {
+		return err
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		return errors.New("couldn't unmarshal header")
+	}
+	h := sha256.New()
+	for _, txh := range r.TxHashes {
+		h.Write(txh)
+	}
+	if !bytes.Equal(h.Sum(nil), header.ClientTransactionHash) {
+		return errors.New("transactions are not in the block")
+	}
+	if len(r.Links) == 0 || !r.Links[len(r.Links)-1].To.Equal(r.Block.CalculateHash()) {
+		return errors.New("links don't point to the block")
+	}
+	return VerifyLinks(scID, r.Links)
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/protobuf"
+)
+
+// CmdRevokeIdentity adds the identity given in the "identity" argument, in
+// its string form, to the revocation list of the skipchain. It is invoked on
+// the config instance, so it is managed by the genesis darc.
+var CmdRevokeIdentity = "revoke_identity"
+
+// CmdUnrevokeIdentity removes the identity given in the "identity" argument
+// from the revocation list of the skipchain.
+var CmdUnrevokeIdentity = "unrevoke_identity"
+
+// revocationSubID is the subid for storing the revocation list, next to the
+// OmniLedger config.
+var revocationSubID = SubID(func() [32]byte {
+	var three [32]byte
+	three[31] = 3
+	return three
+}())
+
+// revocationList is the value of the instance holding the identities whose
+// signatures are refused, whatever the rules of the darcs.
+type revocationList struct {
+	Identities []string
+}
+
+// loadRevocations returns the revocation list stored in coll and whether
+// the instance holding it exists.
+func loadRevocations(coll CollectionView) (*revocationList, bool, error) {
+	genesisDarcID, _, err := coll.GetValues(GenesisReferenceID.Slice())
+	if err != nil {
+		return nil, false, err
+	}
+	rl := &revocationList{}
+	value, _, err := coll.GetValues(InstanceID{genesisDarcID, revocationSubID}.Slice())
+	if err != nil {
+		return rl, false, nil
+	}
+	if err = protobuf.Decode(value, rl); err != nil {
+		return nil, false, err
+	}
+	return rl, true, nil
+}
+
+// checkRevoked returns an error if one of the identities has been revoked.
+func checkRevoked(coll CollectionView, ids []darc.Identity) error {
+	rl, _, err := loadRevocations(coll)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		for _, revoked := range rl.Identities {
+			if id.String() == revoked {
+				return errors.New("identity " + revoked + " is revoked")
+			}
+		}
+	}
+	return nil
+}
+
+// checkRevokedSigners returns an error if one of the identities authorizing
+// instr, which is part of ct, has been revoked in coll. It is checked again
+// during the execution, so that a revocation applies to the following
+// transactions of the same block.
+func checkRevokedSigners(coll CollectionView, ct ClientTransaction, instr Instruction) error {
+	if _, _, err := coll.GetValues(GenesisReferenceID.Slice()); err != nil {
+		// The genesis transaction is executed before the config exists.
+		return nil
+	}
+	var ids []darc.Identity
+	for _, sigs := range [][]darc.Signature{ct.Signatures, instr.Signatures} {
+		for _, sig := range sigs {
+			ids = append(ids, sig.Signer)
+		}
+	}
+	if instr.PreAuthorization != nil {
+		for _, sig := range instr.PreAuthorization.Signatures {
+			ids = append(ids, sig.Signer)
+		}
+	}
+	return checkRevoked(coll, ids)
+}
+
+// revocationScs returns the state change adding the identity of the
+// "identity" argument of inst to the revocation list, or removing it from
+// the list if revoke is false. As the signers of inst must not be revoked,
+// the last identities able to sign for the genesis darc should never be
+// revoked.
+func revocationScs(coll CollectionView, inst Instruction, revoke bool) (StateChanges, error) {
+	id := string(inst.Invoke.Args.Search("identity"))
+	if id == "" {
+		return nil, errors.New("argument \"identity\" is missing")
+	}
+	rl, exists, err := loadRevocations(coll)
+	if err != nil {
+		return nil, err
+	}
+	found := -1
+	for i, revoked := range rl.Identities {
+		if revoked == id {
+			found = i
+		}
+	}
+	if revoke {
+		if found >= 0 {
+			return nil, errors.New("identity is already revoked")
+		}
+		rl.Identities = append(rl.Identities, id)
+	} else {
+		if found < 0 {
+			return nil, errors.New("identity is not revoked")
+		}
+		rl.Identities = append(rl.Identities[:found], rl.Identities[found+1:]...)
+	}
+	buf, err := protobuf.Encode(rl)
+	if err != nil {
+		return nil, err
+	}
+	action := Update
+	if !exists {
+		action = Create
+	}
+	return StateChanges{NewStateChange(action, InstanceID{inst.InstanceID.DarcID, revocationSubID},
+		ContractConfigID, buf)}, nil
+}
@@ -3,11 +3,15 @@ package service
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dedis/cothority"
@@ -41,7 +45,8 @@ func init() {
 	var err error
 	OmniledgerID, err = onet.RegisterNewService(ServiceName, newService)
 	log.ErrFatal(err)
-	network.RegisterMessages(&omniStorage{}, &DataHeader{}, &updateCollection{})
+	network.RegisterMessages(&omniStorage{}, &DataHeader{}, &updateCollection{},
+		&ChainConfig{})
 }
 
 // GenNonce returns a random nonce.
@@ -81,6 +86,20 @@ type Service struct {
 
 	// contracts map kinds to kind specific verification functions
 	contracts map[string]OmniLedgerContract
+	// contractSchemas map kinds to the arguments they accept
+	contractSchemas map[string]ContractSchema
+	// contractCaps holds the actions supported by the contracts that
+	// declared them.
+	contractCaps map[string]ContractCapabilities
+	// contractStates map kinds to the type of their state
+	contractStates map[string]reflect.Type
+	// contractDecoders map kinds to the functions decoding their state
+	contractDecoders map[string]ContractStateDecoder
+	// contractFields map kinds to the fields that can be proven separately
+	contractFields map[string][]string
+	// migrations are the conversions between the versions of the values
+	// of the contracts
+	migrations map[migrationKey]Migration
 	// propagate the new transactions
 	propagateTransactions messaging.PropagationFunc
 
@@ -92,6 +111,53 @@ type Service struct {
 	darcToScMut sync.Mutex
 
 	stateChangeCache stateChangeCache
+
+	// archive is the cold storage for old blocks, it is nil if archival
+	// is not enabled.
+	archive    *blockArchive
+	archiveMut sync.Mutex
+
+	// proposals holds the last proposal this node endorsed for every
+	// skipchain, and equivocations the evidence of leaders who proposed
+	// another block with the same index. proposed holds the last block
+	// this node proposed as a leader, until it is stored.
+	proposals     map[string]Proposal
+	equivocations map[string][]Equivocation
+	proposed      map[string]proposedBlock
+	proposalsMut  sync.Mutex
+
+	// batches holds the batches of transactions submitted to this node.
+	batches    map[string]*txBatch
+	batchesMut sync.Mutex
+
+	// admissionPolicies are consulted before a transaction of a client
+	// is buffered.
+	admissionPolicies []TxAdmissionPolicy
+	admissionMut      sync.Mutex
+
+	// partialSigs holds the transactions waiting for the partial
+	// signatures of a committee.
+	partialSigs    map[string]*partialSignatures
+	partialSigsMut sync.Mutex
+
+	// keySalt is the salt of the keys of the new collections, or nil if
+	// their keys are not hashed.
+	keySalt []byte
+
+	// syncPolicy is given to the collections loaded from the database.
+	syncPolicy SyncPolicy
+
+	// invariants are checked on every block before it is proposed.
+	invariants    []BlockInvariant
+	invariantsMut sync.Mutex
+
+	// halted holds the skipchains halted by the operator.
+	halted    map[string]bool
+	haltedMut sync.Mutex
+
+	// rejections counts the rejected transactions by reason.
+	rejections map[string]uint64
+	metricsMut sync.Mutex
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -102,6 +168,39 @@ const storageID = "OmniLedger"
 // transaction is not set.
 var defaultInterval = 5 * time.Second
 
+// defaultMaxStateChanges is the maximum number of state changes a transaction
+// can produce if the MaxStateChanges field of the config is not set.
+const defaultMaxStateChanges = 1000
+
+// ErrTooManyStateChanges is returned if a transaction produces more state
+// changes than allowed by the config.
+var ErrTooManyStateChanges = errors.New("transaction produces too many state changes")
+
+// ErrExecutionTimeout is returned if a contract doesn't execute an
+// instruction within the InstructionTimeout of the config.
+var ErrExecutionTimeout = errors.New("execution of instruction timed out")
+
+// ErrPreconditionFailed is returned by a contract if the instruction is
+// well-formed but a condition on the current state is not met. Depending on
+// the RecordFailedPreconditions field of the config, the transaction is then
+// dropped or recorded in the block as a no-op.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrFutureBlock is returned if an instruction refers to a block that is not
+// committed yet.
+var ErrFutureBlock = errors.New("instruction refers to a block that is not committed")
+
+// maxTxsPerBlock is the maximum number of transactions the leader puts
+// into a single block. Remaining transactions wait for the next block.
+//
+// TODO: blocks are neither compressed nor limited in size yet. Once they
+// are, a size limit should be measured against the compressed DataBody,
+// as this is what is propagated, so the leader has to compress the body
+// incrementally while filling the block. The hashes of the header must stay
+// over the uncompressed transactions, so that they don't depend on the
+// compressor: the nodes then have to decompress a body before verifying it.
+const maxTxsPerBlock = 1000
+
 // omniStorage is used to save our data locally.
 type omniStorage struct {
 	// PropTimeout is used when sending the request to integrate a new block
@@ -131,7 +230,7 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	if req.Version != CurrentVersion {
 		return nil, fmt.Errorf("version mismatch - got %d but need %d", req.Version, CurrentVersion)
 	}
-	if req.Roster.List == nil {
+	if len(req.Roster.List) == 0 {
 		return nil, errors.New("must provide a roster")
 	}
 
@@ -147,8 +246,8 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	if req.BlockInterval == 0 {
 		req.BlockInterval = defaultInterval
 	}
-	intervalBuf := make([]byte, 8)
-	binary.PutVarint(intervalBuf, int64(req.BlockInterval))
+	intervalBuf := make([]byte, binary.MaxVarintLen64)
+	intervalBuf = intervalBuf[:binary.PutVarint(intervalBuf, int64(req.BlockInterval))]
 
 	rosterBuf, err := protobuf.Encode(&req.Roster)
 	if err != nil {
@@ -193,14 +292,36 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 		return nil, errors.New("version mismatch")
 	}
 
-	if len(req.Transaction.Instructions) == 0 {
-		return nil, errors.New("no transactions to add")
-	}
-
 	gen := s.db().GetByID(req.SkipchainID)
 	if gen == nil || gen.Index != 0 {
 		return nil, errors.New("skipchain ID is does not exist")
 	}
+	// Only whitelisted clients get their transactions looked at.
+	err := s.checkSubmitter(req.SkipchainID, req.Transaction.Instructions.Hash(), req.Submitter)
+	if err != nil {
+		s.rejected(RejectionReason(err))
+		return nil, err
+	}
+	return s.addTransaction(req)
+}
+
+// addTransaction adds the transaction of req, whose submitter has been
+// checked before.
+func (s *Service) addTransaction(req *AddTxRequest) (*AddTxResponse, error) {
+	if len(req.Transaction.Instructions) == 0 {
+		return nil, errors.New("no transactions to add")
+	}
+	if err := req.Transaction.Validate(); err != nil {
+		return nil, errors.New("invalid transaction: " + err.Error())
+	}
+	if s.isHalted(req.SkipchainID) {
+		s.rejected(RejectionReason(ErrHalted))
+		return nil, ErrHalted
+	}
+	if err := s.admitTx(req.SkipchainID, req.Transaction); err != nil {
+		s.rejected(RejectAdmission)
+		return nil, err
+	}
 
 	s.txBuffer.add(string(req.SkipchainID), req.Transaction)
 
@@ -214,10 +335,16 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 		ch := s.state.createWaitChannel(ctxHash)
 		defer s.state.deleteWaitChannel(ctxHash)
 		select {
-		case success := <-ch:
-			if !success {
+		case outcome := <-ch:
+			if !outcome.valid {
 				return nil, errors.New("transaction is in block, but got refused")
 			}
+			created, modified := instancesChanged(outcome.effects)
+			return &AddTxResponse{
+				Version:  CurrentVersion,
+				Created:  created,
+				Modified: modified,
+			}, nil
 		case <-time.After(time.Duration(req.InclusionWait) * interval):
 			return nil, errors.New("didn't find transaction in blocks")
 		}
@@ -227,6 +354,25 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 	}, nil
 }
 
+// instancesChanged returns the instances created and the ones updated or
+// removed by the state changes, in the order of the state changes. An
+// instance created and then updated is only reported as created.
+func instancesChanged(scs StateChanges) (created, modified []InstanceID) {
+	seen := make(map[string]bool)
+	for _, sc := range scs {
+		if seen[string(sc.InstanceID)] {
+			continue
+		}
+		seen[string(sc.InstanceID)] = true
+		if sc.StateAction == Create {
+			created = append(created, NewInstanceID(sc.InstanceID))
+		} else {
+			modified = append(modified, NewInstanceID(sc.InstanceID))
+		}
+	}
+	return
+}
+
 // GetProof searches for a key and returns a proof of the
 // presence or the absence of this key.
 func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
@@ -242,6 +388,20 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	if err != nil {
 		return
 	}
+	if req.Field != "" {
+		var values [][]byte
+		if _, values, err = proof.KeyValue(); err != nil {
+			return
+		}
+		if !proof.InclusionProof.Match() || len(values) == 0 {
+			err = errors.New("instance doesn't exist")
+			return
+		}
+		proof.Field, err = s.fieldProof(req.ID, req.Key, values[0], req.Field)
+		if err != nil {
+			return
+		}
+	}
 	resp = &GetProofResponse{
 		Version: CurrentVersion,
 		Proof:   *proof,
@@ -249,6 +409,427 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	return
 }
 
+// proofSize returns the size in bytes of the encoded proof GetProof returns
+// for key in the skipchain scID. The proof is created but not sent, and the
+// size only holds as long as no new block is added to the skipchain.
+func (s *Service) proofSize(scID skipchain.SkipBlockID, key []byte) (int, error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return 0, err
+	}
+	proof, err := NewProof(s.getCollection(scID), s.db(), latest.Hash, key)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := protobuf.Encode(proof)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// GetChainFingerprint returns the hash of the genesis ID, the hash of the
+// latest block and the root of the collection of this node for the
+// skipchain scID. Two nodes agreeing on the state of the skipchain return
+// the same fingerprint, so operators can compare it to detect a divergence.
+func (s *Service) GetChainFingerprint(scID skipchain.SkipBlockID) ([]byte, error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(latest.SkipChainID())
+	h.Write(latest.Hash)
+	h.Write(s.getCollection(scID).RootHash())
+	return h.Sum(nil), nil
+}
+
+// GetBatchProof returns the proofs of all the requested keys in one bundle.
+func (s *Service) GetBatchProof(req *GetBatchProof) (resp *GetBatchProofResponse, err error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	log.Lvlf2("%s: Getting batch proof for %d keys on sc %x", s.ServerIdentity(), len(req.Keys), req.ID)
+	latest, err := s.db().GetLatestByID(req.ID)
+	if err != nil && latest == nil {
+		return
+	}
+	proof, err := NewBatchProof(s.getCollection(req.ID), s.db(), latest.Hash, req.Keys)
+	if err != nil {
+		return
+	}
+	resp = &GetBatchProofResponse{
+		Version: CurrentVersion,
+		Proof:   *proof,
+	}
+	return
+}
+
+// GetInstanceHistory returns all the values an instance held since the
+// genesis block, together with the index of the block and the hash of the
+// instruction that changed it.
+func (s *Service) GetInstanceHistory(req *GetInstanceHistory) (*GetInstanceHistoryResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	entries, err := s.instanceHistory(req.SkipchainID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &GetInstanceHistoryResponse{
+		Version: CurrentVersion,
+		Entries: entries,
+	}, nil
+}
+
+// GetConsistentProofs returns the proofs for all the keys in the skipchain
+// scID. All the proofs refer to the same latest block, so they show the
+// state of the instances at the same time.
+func (s *Service) GetConsistentProofs(scID skipchain.SkipBlockID, keys [][]byte) ([]Proof, error) {
+	resp, err := s.GetBatchProof(&GetBatchProof{
+		Version: CurrentVersion,
+		Keys:    keys,
+		ID:      scID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Proof.Expand()
+}
+
+// EstimateInclusionDelay returns an estimate of how many blocks it takes
+// before a transaction sent now to this node gets included in the skipchain
+// scID. It only takes into account the transactions buffered on this node
+// and the maximum number of transactions per block.
+func (s *Service) EstimateInclusionDelay(scID skipchain.SkipBlockID) (blocks int, err error) {
+	if s.db().GetByID(scID) == nil {
+		return 0, errors.New("unknown skipchain")
+	}
+	buffered := s.txBuffer.len(string(scID))
+	return buffered/maxTxsPerBlock + 1, nil
+}
+
+// ContractInstances returns the IDs and the values of all the instances of
+// the contract contractID in the latest state of the skipchain scID.
+func (s *Service) ContractInstances(scID skipchain.SkipBlockID, contractID string) ([]InstanceID, [][]byte, error) {
+	if s.db().GetByID(scID) == nil {
+		return nil, nil, errors.New("unknown skipchain")
+	}
+	return s.getCollection(scID).ContractInstances(contractID)
+}
+
+// SimulateTx returns the state changes the transaction ct would produce if it
+// was applied to the latest state of the skipchain scID. Nothing is stored.
+// It also returns the state the transaction has been simulated on.
+func (s *Service) SimulateTx(scID skipchain.SkipBlockID, ct ClientTransaction) (CollectionView, StateChanges, error) {
+	if s.db().GetByID(scID) == nil {
+		return nil, nil, errors.New("unknown skipchain")
+	}
+	if err := s.verifyClientTx(scID, ct); err != nil {
+		return nil, nil, err
+	}
+	cdb := s.getCollection(scID)
+	cdb.mut.RLock()
+	coll := cdb.coll.Clone()
+	cdb.mut.RUnlock()
+
+	cdbI := &roCollection{coll.Clone()}
+	var scs StateChanges
+	var cin []Coin
+	for _, instr := range ct.Instructions {
+		instrScs, cout, err := s.executeInstruction(cdbI, cin, instr)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, sc := range instrScs {
+			if err := storeInColl(cdbI.c, &sc); err != nil {
+				return nil, nil, err
+			}
+		}
+		scs = append(scs, instrScs...)
+		cin = cout
+	}
+	return &roCollection{coll}, scs, nil
+}
+
+// GetInstanceOrigin returns the index of the block and the hash of the
+// instruction that created an instance.
+func (s *Service) GetInstanceOrigin(req *GetInstanceOrigin) (*GetInstanceOriginResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	index, instrHash, err := s.instanceOrigin(req.SkipchainID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &GetInstanceOriginResponse{
+		Version:         CurrentVersion,
+		BlockIndex:      index,
+		InstructionHash: instrHash,
+	}, nil
+}
+
+// GetLastModifier returns the index and the timestamp of the block and the
+// signers of the last instruction that changed an instance.
+func (s *Service) GetLastModifier(req *GetLastModifier) (*GetLastModifierResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	index, signers, timestamp, err := s.instanceLastModifier(req.SkipchainID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &GetLastModifierResponse{
+		Version:    CurrentVersion,
+		BlockIndex: index,
+		Signers:    signers,
+		Timestamp:  timestamp,
+	}, nil
+}
+
+// GetProofSize returns the size in bytes of the encoded proof GetProof
+// returns for a key, so that clients on metered connections can decide
+// whether to fetch it or a proof of a single field.
+func (s *Service) GetProofSize(req *GetProofSize) (*GetProofSizeResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	size, err := s.proofSize(req.SkipchainID, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &GetProofSizeResponse{
+		Version: CurrentVersion,
+		Size:    size,
+	}, nil
+}
+
+// GetChangesSince returns the state changes of all the blocks after an index,
+// in order, together with the latest block.
+func (s *Service) GetChangesSince(req *GetChangesSince) (*GetChangesSinceResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	scs, latest, err := s.changesSince(req.SkipchainID, req.FromIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &GetChangesSinceResponse{
+		Version:      CurrentVersion,
+		StateChanges: scs,
+		Latest:       latest,
+	}, nil
+}
+
+// FindByExternalRef returns the hashes of the instructions of the committed
+// transactions tagged with an external reference.
+func (s *Service) FindByExternalRef(req *FindByExternalRef) (*FindByExternalRefResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	hashes, err := s.findByExternalRef(req.SkipchainID, req.ExternalRef)
+	if err != nil {
+		return nil, err
+	}
+	return &FindByExternalRefResponse{
+		Version: CurrentVersion,
+		Hashes:  hashes,
+	}, nil
+}
+
+// GetDecodedInstance returns the contract and the value of an instance. If
+// the contract registered its state, the decoded value is marshalled with
+// network.Marshal, so that the client gets it with network.Unmarshal.
+func (s *Service) GetDecodedInstance(req *GetDecodedInstance) (*GetDecodedInstanceResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	contractID, value, decoded, err := s.decodedInstance(req.SkipchainID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	resp := &GetDecodedInstanceResponse{
+		Version:    CurrentVersion,
+		ContractID: contractID,
+		Value:      value,
+	}
+	if _, raw := decoded.([]byte); !raw {
+		// States that are not registered to the network library are
+		// only sent as they are stored.
+		if buf, err := network.Marshal(decoded); err == nil {
+			resp.Decoded = buf
+		}
+	}
+	return resp, nil
+}
+
+// GetBlock returns the block at the given index of a skipchain. If archival
+// is enabled, old blocks are read from the archive.
+func (s *Service) GetBlock(req *GetBlock) (*GetBlockResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	sb, err := s.blockByIndex(req.SkipchainID, req.Index)
+	if err != nil {
+		return nil, err
+	}
+	return &GetBlockResponse{
+		Version:   CurrentVersion,
+		Skipblock: sb,
+	}, nil
+}
+
+// GetBlockRoster returns the roster in effect at the block with the given
+// index. It is the roster of the configuration once the block has been
+// applied, so a block holding a view-change already has the new roster,
+// while the forward link to it is signed by the roster of the previous
+// block.
+func (s *Service) GetBlockRoster(scID skipchain.SkipBlockID, index int) (onet.Roster, error) {
+	sb, err := s.blockByIndex(scID, index)
+	if err != nil {
+		return onet.Roster{}, err
+	}
+	if sb.Roster == nil {
+		return onet.Roster{}, errors.New("block has no roster")
+	}
+	return *sb.Roster, nil
+}
+
+// GetRoot returns the root of the collection stored in the header of the
+// latest block of the skipchain scID, together with the index and the hash
+// of this block. No proof is created, so it is a cheap way to check whether
+// the skipchain changed.
+func (s *Service) GetRoot(scID skipchain.SkipBlockID) (root []byte, blockIndex int, blockHash skipchain.SkipBlockID, err error) {
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return
+	}
+	_, headerI, err := network.Unmarshal(latest.Data, cothority.Suite)
+	if err != nil {
+		return
+	}
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		err = errors.New("couldn't unmarshal header")
+		return
+	}
+	return header.CollectionRoot, latest.Index, latest.Hash, nil
+}
+
+// ChainInfo describes a skipchain served by the service.
+type ChainInfo struct {
+	SkipchainID skipchain.SkipBlockID
+	// TipIndex is the index of the latest block.
+	TipIndex int
+	// RosterSize is the number of nodes in the roster of the config.
+	RosterSize    int
+	BlockInterval time.Duration
+}
+
+// GetChains returns all the OmniLedger skipchains this node serves.
+func (s *Service) GetChains() ([]ChainInfo, error) {
+	gasr, err := s.skService().GetAllSkipChainIDs(&skipchain.GetAllSkipChainIDs{})
+	if err != nil {
+		return nil, err
+	}
+	var chains []ChainInfo
+	for _, gen := range gasr.IDs {
+		if !s.isOurChain(gen) {
+			continue
+		}
+		latest, err := s.db().GetLatestByID(gen)
+		if err != nil {
+			return nil, err
+		}
+		config, err := s.LoadConfig(gen)
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, ChainInfo{
+			SkipchainID:   gen,
+			TipIndex:      latest.Index,
+			RosterSize:    len(config.Roster.List),
+			BlockInterval: config.BlockInterval,
+		})
+	}
+	return chains, nil
+}
+
+// IntervalStats compares the configured block interval of a skipchain with
+// the actual time between its latest blocks.
+type IntervalStats struct {
+	// Configured is the block interval of the config.
+	Configured time.Duration
+	// Blocks is the number of intervals the statistics are computed over.
+	Blocks int
+	Mean   time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+// GetIntervalStats returns the statistics of the time between the last n
+// blocks of the skipchain scID, computed from the timestamps of their
+// headers. The timestamps are in seconds, so the statistics are only
+// accurate to the second. A mean much higher than the configured interval
+// hints at a struggling leader.
+func (s *Service) GetIntervalStats(scID skipchain.SkipBlockID, n int) (*IntervalStats, error) {
+	if n <= 0 {
+		return nil, errors.New("number of blocks must be positive")
+	}
+	interval, err := s.LoadBlockInterval(scID)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return nil, err
+	}
+	// The timestamps, from the latest block backwards.
+	var timestamps []int64
+	for {
+		_, headerI, err := network.Unmarshal(sb.Data, cothority.Suite)
+		if err != nil {
+			return nil, err
+		}
+		header, ok := headerI.(*DataHeader)
+		if !ok {
+			return nil, errors.New("couldn't unmarshal header")
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		if len(timestamps) > n || sb.Index == 0 {
+			break
+		}
+		sb, err = s.prevBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stats := intervalStats(timestamps)
+	stats.Configured = interval
+	return &stats, nil
+}
+
+// intervalStats returns the statistics of the differences between the
+// timestamps, given from the latest one backwards.
+func intervalStats(timestamps []int64) (stats IntervalStats) {
+	var total time.Duration
+	for i := 1; i < len(timestamps); i++ {
+		d := time.Duration(timestamps[i-1]-timestamps[i]) * time.Second
+		if stats.Blocks == 0 || d < stats.Min {
+			stats.Min = d
+		}
+		if d > stats.Max {
+			stats.Max = d
+		}
+		total += d
+		stats.Blocks++
+	}
+	if stats.Blocks > 0 {
+		stats.Mean = total / time.Duration(stats.Blocks)
+	}
+	return
+}
+
 // SetPropagationTimeout overrides the default propagation timeout that is used
 // when a new block is announced to the nodes as well as the skipchain
 // propagation timeout.
@@ -272,6 +853,13 @@ func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTran
 	for _, t := range ts {
 		if err := s.verifyClientTx(scID, t); err != nil {
 			log.Error(s.ServerIdentity(), err)
+			reason := RejectionReason(err)
+			if reason == RejectOther {
+				// The other errors come from the signatures
+				// and the darcs.
+				reason = RejectUnauthorized
+			}
+			s.rejected(reason)
 			continue
 		}
 		validTxs = append(validTxs, t)
@@ -280,15 +868,68 @@ func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTran
 }
 
 func (s *Service) verifyClientTx(scID skipchain.SkipBlockID, tx ClientTransaction) error {
+	if err := tx.Validate(); err != nil {
+		return err
+	}
+	var txIDs []darc.Identity
+	if len(tx.Signatures) > 0 {
+		// The transaction is signed as a whole, so we verify the
+		// signatures only once and then check the identities against
+		// the darc of every instruction.
+		digest := tx.Instructions.Hash()
+		for _, sig := range tx.Signatures {
+			if err := sig.Signer.Verify(digest, sig.Signature); err != nil {
+				return errors.New("transaction signature verification failed: " + err.Error())
+			}
+			txIDs = append(txIDs, sig.Signer)
+		}
+	}
 	for _, instr := range tx.Instructions {
-		if err := s.verifyInstruction(scID, instr); err != nil {
+		if s.isApplyScheduledViewChange(scID, instr) {
+			// It has been authorized by the scheduled_view_change
+			// instruction, and verifySkipBlock checks that it is
+			// in the right block.
+			continue
+		}
+		if s.isExpireInstances(scID, instr) {
+			// verifySkipBlock checks that it uses the timestamp
+			// of the block.
+			continue
+		}
+		if txIDs != nil && len(instr.Signatures) > 0 {
+			return errors.New("instructions of a signed transaction must not be signed")
+		}
+		if err := s.verifyInstruction(scID, instr, txIDs); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instruction) error {
+// verifyInstruction checks that the instruction is authorized by its darc. If
+// txIDs is nil, the signatures of the instruction are verified. Else txIDs
+// holds the identities that already signed the whole transaction, and only
+// those are checked against the darc. A pre-authorized instruction is
+// authorized by the signers of its token instead. The darc is not checked
+// for the commands a contract authorizes itself.
+func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instruction, txIDs []darc.Identity) error {
+	if instr.SkipchainID.IsNull() {
+		config, err := s.LoadConfig(scID)
+		if err != nil {
+			return errors.New("couldn't load config: " + err.Error())
+		}
+		if config.RequireSkipchainID {
+			return errors.New("instruction is not bound to a skipchain")
+		}
+	} else if !instr.SkipchainID.Equal(scID) {
+		return errors.New("instruction is bound to another skipchain")
+	}
+	if err := s.verifyBlockIndex(scID, instr); err != nil {
+		return err
+	}
+	if err := s.verifyScheduledIndex(scID, instr); err != nil {
+		return err
+	}
 	d, err := s.loadLatestDarc(scID, instr.InstanceID.DarcID)
 	if err != nil {
 		return errors.New("darc not found: " + err.Error())
@@ -300,7 +941,60 @@ func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instructio
 	// Verify the request is signed by appropriate identities.
 	// A callback is required to get any delegated DARC(s) during
 	// expression evaluation.
-	err = req.VerifyWithCB(d, func(str string, latest bool) *darc.Darc {
+	getDarc := s.darcGetter(scID)
+	// The signatures cover the action of the instruction, so they must be
+	// verified before a wildcard rule is chosen.
+	if instr.PreAuthorization != nil {
+		// The token replaces the signatures, so the instruction must
+		// not be authorized in any other way.
+		if txIDs != nil || len(instr.Signatures) > 0 {
+			return errors.New("pre-authorized instructions must not be signed")
+		}
+		req.Identities, err = instr.PreAuthorization.Verify(instr)
+		if err != nil {
+			return errors.New("request verification failed: " + err.Error())
+		}
+	} else if txIDs != nil {
+		req.Identities = txIDs
+	} else if err = instr.VerifySignatures(); err != nil {
+		return errors.New("request verification failed: " + err.Error())
+	}
+	if err = checkRevoked(s.GetCollectionView(scID), req.Identities); err != nil {
+		return errors.New("request verification failed: " + err.Error())
+	}
+	action := req.Action
+	var contractID string
+	if instr.Invoke != nil {
+		contractID, _, _ = instr.GetContractState(s.GetCollectionView(scID))
+	}
+	if caps, ok := s.contractCaps[contractID]; !ok || !caps.selfAuthorized(instr) {
+		req.Action = ruleAction(d, action, contractID)
+		if err = req.VerifyIdentitiesWithCB(d, getDarc); err != nil {
+			return errors.New("request verification failed: " + err.Error())
+		}
+	}
+	// The signatures have been verified above and cover the additional
+	// darcs, as they are part of the hash of the instruction. So only the
+	// identities need to be checked against the additional darcs.
+	for _, id := range instr.AdditionalDarcs {
+		ad, err := s.loadLatestDarc(scID, id)
+		if err != nil {
+			return errors.New("additional darc not found: " + err.Error())
+		}
+		adReq := *req
+		adReq.BaseID = id
+		adReq.Action = ruleAction(ad, action, contractID)
+		if err = adReq.VerifyIdentitiesWithCB(ad, getDarc); err != nil {
+			return errors.New("request verification of additional darc failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// darcGetter returns the callback that looks up the darcs delegated to during
+// the evaluation of an expression in the skipchain scID.
+func (s *Service) darcGetter(scID skipchain.SkipBlockID) darc.GetDarc {
+	return func(str string, latest bool) *darc.Darc {
 		darcID, err := hex.DecodeString(str[5:])
 		if err != nil {
 			return nil
@@ -310,21 +1004,107 @@ func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instructio
 			return nil
 		}
 		return d
-	})
+	}
+}
+
+// CheckAuthorization returns whether the identity id alone is allowed to
+// perform action, e.g. "invoke:transfer", on the instance iID in the
+// skipchain scID, following the delegations to other darcs. A revoked
+// identity is never authorized. It doesn't check anything else, so a
+// transaction might still fail, e.g. because of additional darcs or the
+// contract itself.
+func (s *Service) CheckAuthorization(scID skipchain.SkipBlockID, iID InstanceID, action string, id darc.Identity) (bool, error) {
+	if s.db().GetByID(scID) == nil {
+		return false, errors.New("skipchain doesn't exist")
+	}
+	d, err := s.loadLatestDarc(scID, iID.DarcID)
 	if err != nil {
-		return errors.New("request verification failed: " + err.Error())
+		return false, errors.New("darc not found: " + err.Error())
+	}
+	if checkRevoked(s.GetCollectionView(scID), []darc.Identity{id}) != nil {
+		return false, nil
+	}
+	_, contractID, _ := s.GetCollectionView(scID).GetValues(iID.Slice())
+	req := &darc.Request{
+		BaseID:     iID.DarcID,
+		Action:     ruleAction(d, darc.Action(action), contractID),
+		Identities: []darc.Identity{id},
+	}
+	return req.VerifyIdentitiesWithCB(d, s.darcGetter(scID)) == nil, nil
+}
+
+// verifyBlockIndex checks that the block referenced by the instruction, if
+// any, is already in the skipchain scID. The block being created or verified
+// is not committed yet, so it cannot be referenced either.
+func (s *Service) verifyBlockIndex(scID skipchain.SkipBlockID, instr Instruction) error {
+	if instr.BlockIndex == 0 {
+		return nil
+	}
+	if instr.BlockIndex < 0 {
+		return errors.New("negative block index")
+	}
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return errors.New("couldn't get latest block: " + err.Error())
+	}
+	if instr.BlockIndex > latest.Index {
+		return ErrFutureBlock
+	}
+	return nil
+}
+
+// verifyScheduledIndex checks that a scheduled view-change is for a block
+// after the next one of the skipchain scID, which can hold the instruction.
+// It depends on the tip of the node, so it is checked when the instruction is
+// submitted and when the leader fills a block, but not by the contract.
+func (s *Service) verifyScheduledIndex(scID skipchain.SkipBlockID, instr Instruction) error {
+	if instr.Invoke == nil || instr.Invoke.Command != CmdScheduledViewChange {
+		return nil
+	}
+	index, n := binary.Varint(instr.Invoke.Args.Search("index"))
+	if n <= 0 {
+		// The contract refuses it.
+		return nil
+	}
+	latest, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return errors.New("couldn't get latest block: " + err.Error())
+	}
+	if next := latest.Index + 1; int(index) <= next {
+		return fmt.Errorf("index %d is not after the current block %d", index, next)
 	}
 	return nil
 }
 
+// ruleAction returns the action of the rule in d that applies to an
+// instruction with the given action on an instance of contractID. If d has
+// no rule for an invoke action, the wildcard rule "invoke:contractID.*" is
+// used, which covers all the commands of the contract.
+func ruleAction(d *darc.Darc, action darc.Action, contractID string) darc.Action {
+	if d.Rules.Contains(action) || contractID == "" ||
+		!strings.HasPrefix(string(action), "invoke:") {
+		return action
+	}
+	wildcard := darc.Action("invoke:" + contractID + ".*")
+	if d.Rules.Contains(wildcard) {
+		return wildcard
+	}
+	return action
+}
+
 // createNewBlock creates a new block and proposes it to the
 // skipchain-service. Once the block has been created, we
 // inform all nodes to update their internal collections
 // to include the new transactions.
 func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts ClientTransactions) (*skipchain.SkipBlock, error) {
+	if !scID.IsNull() && s.isHalted(scID) {
+		return nil, ErrHalted
+	}
 	var sb *skipchain.SkipBlock
 	var mr []byte
 	var coll *collection.Collection
+	var index int
+	timestamp := time.Now().Unix()
 
 	if scID.IsNull() {
 		// For a genesis block, we create a throwaway collection.
@@ -353,8 +1133,28 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 		if r != nil {
 			sb.Roster = r
 		}
+		index = sbLatest.Index + 1
+		if retry := s.retryProposal(scID, index); retry != nil {
+			// The new transactions go into the next block.
+			log.Lvlf2("%s: proposing block %d again", s.ServerIdentity(), index)
+			for _, ct := range cts {
+				s.txBuffer.add(string(scID), ct)
+			}
+			return s.storeProposedBlock(scID, index, retry)
+		}
 
 		cts = s.verifyAndFilterTxs(sb.SkipChainID(), cts)
+		cts, _, err = s.addScheduledViewChange(scID, sbLatest.Index+1, cts)
+		if err != nil {
+			return nil, err
+		}
+		cts, err = s.addExpireInstances(scID, timestamp, cts)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			cts = s.dropOwnReports(cts)
+		}
 		if len(cts) == 0 {
 			return nil, errors.New("no valid transaction")
 		}
@@ -362,51 +1162,105 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 	}
 
 	// Note that the transactions are sorted in-place.
-	if err := sortTransactions(cts); err != nil {
+	salt, err := sortTransactions(cts)
+	if err != nil {
 		return nil, err
 	}
 
 	// Create header of skipblock containing only hashes
 	var scs StateChanges
-	var err error
 	var ctsOK ClientTransactions
 
 	log.Lvl3("Creating state changes")
-	mr, ctsOK, scs, err = s.createStateChanges(coll, scID, cts)
+	_, _, _, uncached := s.stateChangeCache.get(scID, cts.Hash())
+	mr, ctsOK, scs, err = s.createStateChanges(coll, scID, cts, timestamp)
 
 	if err != nil {
 		return nil, err
 	}
+	if uncached != nil {
+		// The transactions rejected by the execution are only counted
+		// by the leader, the first time it executes them, as the
+		// state changes are created again to verify and store the
+		// block.
+		for _, err := range s.stateChangeCache.getRejections(scID, cts.Hash()) {
+			s.rejected(RejectionReason(err))
+		}
+	}
 	if len(scs) == 0 {
 		return nil, errors.New("no state changes")
 	}
+	if err = s.checkInvariants(coll, scs); err != nil {
+		return nil, err
+	}
+	if index > 0 {
+		// The block must hold the roster of the configuration after
+		// the block, which is changed by view-changes and by
+		// reports of equivocations.
+		collClone := coll.Clone()
+		for _, sc := range scs {
+			if err = storeInColl(collClone, &sc); err != nil {
+				return nil, err
+			}
+		}
+		config, err := LoadConfigFromColl(&roCollection{collClone})
+		if err != nil {
+			return nil, err
+		}
+		if !config.Roster.ID.Equal(sb.Roster.ID) {
+			sb.Roster = &config.Roster
+		}
+	}
+	scsHash, err := scs.HashErr()
+	if err != nil {
+		return nil, err
+	}
 	header := &DataHeader{
 		CollectionRoot:        mr,
 		ClientTransactionHash: ctsOK.Hash(),
-		StateChangesHash:      scs.Hash(),
-		Timestamp:             time.Now().Unix(),
+		StateChangesHash:      scsHash,
+		Timestamp:             timestamp,
+		Salt:                  salt,
 	}
 	sb.Data, err = network.Marshal(header)
 	if err != nil {
 		return nil, errors.New("Couldn't marshal data: " + err.Error())
 	}
 
+	proposal, err := s.signProposal(scID, index, sb.Data)
+	if err != nil {
+		return nil, err
+	}
+
 	// Store transactions in the body
-	body := &DataBody{Transactions: ctsOK}
+	body := &DataBody{Transactions: ctsOK, Proposal: proposal}
 	sb.Payload, err = network.Marshal(body)
 	if err != nil {
 		return nil, errors.New("Couldn't marshal data: " + err.Error())
 	}
+	log.Lvlf3("Storing skipblock with %d transactions.", len(ctsOK))
+	return s.storeProposedBlock(scID, index, sb)
+}
 
+// storeProposedBlock stores the block with the given index proposed by this
+// node and propagates it. If it fails, the block is kept so that the next
+// proposal for this index is the same block: followers take a different
+// block at the same index for an equivocation.
+func (s *Service) storeProposedBlock(scID skipchain.SkipBlockID, index int, sb *skipchain.SkipBlock) (*skipchain.SkipBlock, error) {
+	if !scID.IsNull() {
+		s.setProposed(scID, index, sb.Copy())
+	}
 	var ssb = skipchain.StoreSkipBlock{
 		NewBlock:          sb,
 		TargetSkipChainID: scID,
 	}
-	log.Lvlf3("Storing skipblock with %d transactions.", len(ctsOK))
 	ssbReply, err := s.skService().StoreSkipBlock(&ssb)
 	if err != nil {
 		return nil, err
 	}
+	if !scID.IsNull() {
+		s.setProposed(scID, index, nil)
+	}
 
 	s.storage.Lock()
 	pto := s.storage.PropTimeout
@@ -454,25 +1308,42 @@ func (s *Service) updateCollection(msg network.Message) {
 
 	log.Lvlf2("%s: Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
 	cdb := s.getCollection(sb.SkipChainID())
-	_, _, scs, err := s.createStateChanges(cdb.coll, sb.SkipChainID(), body.Transactions)
+	if err = s.catchUpCollection(cdb, sb); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't apply the missing blocks:", err)
+		return
+	}
+	_, _, scs, err := s.createStateChanges(cdb.coll, sb.SkipChainID(), body.Transactions, data.Timestamp)
 	if err != nil {
 		log.Error("Couldn't recreate state changes:", err.Error())
 		return
 	}
 
+	s.recordBlock(sb, body)
+
 	log.Lvlf3("%s: Storing %d state changes %v", s.ServerIdentity(), len(scs), scs.ShortStrings())
-	if err = cdb.StoreAll(scs); err != nil {
+	if err = cdb.StoreBlock(sb.Hash, scs); err != nil {
 		log.Error("error while storing in collection: " + err.Error())
 		return
 	}
 	if !bytes.Equal(cdb.RootHash(), data.CollectionRoot) {
 		log.Error("hash of collection doesn't correspond to root hash")
+	} else if err = s.recordBlockChanges(sb, body); err != nil {
+		// They are found again when the history is asked for.
+		log.Lvl2(s.ServerIdentity(), "couldn't record the state changes:", err)
 	}
 	s.state.setLast(sb)
+	if err := s.archiveBlocks(sb); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't archive blocks:", err)
+	}
 
 	// Send OK to all waiting channels
+	digest := body.Transactions.Hash()
 	for _, ct := range body.Transactions {
-		s.state.informWaitChannel(ct.Instructions.Hash(), true)
+		txHash := ct.Instructions.Hash()
+		s.state.informWaitChannel(txHash, txOutcome{
+			valid:   !ct.FailedPrecondition,
+			effects: s.stateChangeCache.getEffects(sb.SkipChainID(), digest, txHash),
+		})
 	}
 
 	// check whether the heartbeat monitor exists, if it doesn't we start a
@@ -492,7 +1363,7 @@ func (s *Service) updateCollection(msg network.Message) {
 	}
 
 	// if we are the new leader, then start polling
-	if sb.Roster.List[0].Equal(s.ServerIdentity()) {
+	if s.pollsFor(sb) {
 		s.pollChanMut.Lock()
 		if _, ok := s.pollChan[string(sb.SkipChainID())]; !ok {
 			log.Lvlf2("%s: new leader started polling for %x", s.ServerIdentity(), sb.SkipChainID())
@@ -500,6 +1371,16 @@ func (s *Service) updateCollection(msg network.Message) {
 			s.pollChan[string(sb.SkipChainID())] = s.startPolling(sb.SkipChainID(), interval)
 		}
 		s.pollChanMut.Unlock()
+	} else {
+		// a scheduled view-change can replace a leader that is still
+		// running, so it has to stop polling
+		s.pollChanMut.Lock()
+		if c, ok := s.pollChan[string(sb.SkipChainID())]; ok {
+			log.Lvlf2("%s: not leader anymore, stopped polling for %x", s.ServerIdentity(), sb.SkipChainID())
+			close(c)
+			delete(s.pollChan, string(sb.SkipChainID()))
+		}
+		s.pollChanMut.Unlock()
 	}
 
 	// If we are adding a genesis block, then look into it for the darc ID
@@ -529,12 +1410,46 @@ func (s *Service) getCollection(id skipchain.SkipBlockID) *collectionDB {
 	col := s.collectionDB[idStr]
 	if col == nil {
 		db, name := s.GetAdditionalBucket([]byte(idStr))
-		s.collectionDB[idStr] = newCollectionDB(db, name)
-		return s.collectionDB[idStr]
+		if s.keySalt != nil {
+			var err error
+			col, err = newHashedCollectionDB(db, name, s.keySalt)
+			if err != nil {
+				log.Error(s.ServerIdentity(), "keeping the keys as they are:", err)
+			}
+		}
+		if col == nil {
+			col = newCollectionDB(db, name)
+		}
+		if err := col.setSyncPolicy(s.syncPolicy); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't set the sync policy:", err)
+		}
+		s.collectionDB[idStr] = col
 	}
 	return col
 }
 
+// EnableKeyHashing stores the keys of the collections loaded from now on
+// under their hash salted with salt, so that the IDs of the instances cannot
+// be enumerated by browsing the database. The same salt must be given every
+// time the service starts. The collections are still indexed by the
+// InstanceIDs, so GetValues and the proofs are not changed. Only the
+// skipchains without a collection in the database yet are hashed; see
+// newHashedCollectionDB for the trade-offs.
+func (s *Service) EnableKeyHashing(salt []byte) error {
+	if len(salt) == 0 {
+		return errors.New("empty salt")
+	}
+	s.keySalt = salt
+	return nil
+}
+
+// SetSyncPolicy defines when the collections are synced to disk. It applies
+// to the collections loaded from now on, so it should be called when the
+// service starts. See SyncPolicy for the durability of every policy.
+func (s *Service) SetSyncPolicy(p SyncPolicy) {
+	s.syncPolicy = p
+}
+
 // interface to skipchain.Service
 func (s *Service) skService() *skipchain.Service {
 	return s.Service(skipchain.ServiceName).(*skipchain.Service)
@@ -615,8 +1530,19 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 					panic("getLeader should not return an error if roster is initialised.")
 				}
 				if !leader.Equal(s.ServerIdentity()) {
-					panic("startPolling should always be called by the leader," +
-						" if it isn't, then it did not start or shutdown properly.")
+					if s.pollsFor(sb) {
+						// The leader rotates, our turn
+						// comes with a later block.
+						continue
+					}
+					// The roster changed while we were waiting,
+					// updateCollection closes the channel.
+					log.Lvl2(s.ServerIdentity(), "not the leader anymore, stopping polling")
+					return
+				}
+				if s.isHalted(scID) {
+					log.Lvl2(s.ServerIdentity(), "skipchain is halted, not creating new block")
+					continue
 				}
 				tree := sb.Roster.GenerateNaryTree(len(sb.Roster.List))
 
@@ -671,12 +1597,27 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 				log.Lvl3("Counting how many transactions fit in", interval/2)
 				var txsCollect ClientTransactions
 				cdbI := s.GetCollectionView(scID)
+				var timeout time.Duration
+				if config, err := s.LoadConfig(scID); err == nil {
+					timeout = config.InstructionTimeout
+				}
 				now := time.Now()
+			fillBlock:
 				for len(txs) > 0 {
+					if len(txsCollect) >= maxTxsPerBlock {
+						log.Lvlf3("Block is full, %d transactions left", len(txs))
+						break
+					}
 					if s.verifyClientTx(scID, txs[0]) == nil {
 						var cin []Coin
 						for _, instr := range txs[0].Instructions {
-							_, cin, err = s.executeInstruction(cdbI, cin, instr)
+							_, cin, err = s.executeInstructionTimeout(cdbI, cin, instr, timeout)
+							if err == ErrExecutionTimeout {
+								log.Lvl2(s.ServerIdentity(), "dropping transaction:", err)
+								s.rejected(RejectionReason(err))
+								txs = txs[1:]
+								continue fillBlock
+							}
 							if err != nil {
 								continue
 							}
@@ -710,6 +1651,10 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 // We use the OmniLedger as a receiver (as is done in the identity service),
 // so we can access e.g. the collectionDBs of the service.
 func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool {
+	if s.isHalted(newSB.SkipChainID()) {
+		log.Lvl2(s.ServerIdentity(), "skipchain is halted, refusing block")
+		return false
+	}
 	_, headerI, err := network.Unmarshal(newSB.Data, cothority.Suite)
 	header, ok := headerI.(*DataHeader)
 	if err != nil || !ok {
@@ -723,22 +1668,49 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 		return false
 	}
 
+	if err := s.verifyProposal(newSB, body.Proposal); err != nil {
+		log.Error(s.ServerIdentity(), "refusing proposal:", err)
+		return false
+	}
+
 	if bytes.Compare(header.ClientTransactionHash, body.Transactions.Hash()) != 0 {
 		log.Lvl2(s.ServerIdentity(), "Client Transaction Hash doesn't verify")
 		return false
 	}
 	ctx := body.Transactions
+	for _, ct := range ctx {
+		for _, instr := range ct.Instructions {
+			if !s.isExpireInstances(newSB.SkipChainID(), instr) {
+				continue
+			}
+			// Else the leader could remove instances before they
+			// expire.
+			if ts, err := expireTimestamp(instr); err != nil || ts != header.Timestamp {
+				log.Error("expired instances removed with a wrong timestamp")
+				return false
+			}
+		}
+	}
 	cdb := s.getCollection(newSB.SkipChainID())
-	mtr, _, scs, err := s.createStateChanges(cdb.coll, newSB.SkipChainID(), ctx)
+	mtr, ctsOK, scs, err := s.createStateChanges(cdb.coll, newSB.SkipChainID(), ctx, header.Timestamp)
 	if err != nil {
 		log.Error("Couldn't create state changes:", err)
 		return false
 	}
+	if err := checkFailedPreconditions(ctx, ctsOK); err != nil {
+		log.Error(s.ServerIdentity(), err)
+		return false
+	}
 	if bytes.Compare(header.CollectionRoot, mtr) != 0 {
 		log.Lvl2(s.ServerIdentity(), "Collection root doesn't verify")
 		return false
 	}
-	if bytes.Compare(header.StateChangesHash, scs.Hash()) != 0 {
+	scsHash, err := scs.HashErr()
+	if err != nil {
+		log.Error(s.ServerIdentity(), err)
+		return false
+	}
+	if bytes.Compare(header.StateChangesHash, scsHash) != 0 {
 		log.Lvl2(s.ServerIdentity(), "State Changes hash doesn't verify")
 		return false
 	}
@@ -767,13 +1739,37 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 			return false
 		}
 	}
+
+	// A scheduled view-change must be applied exactly in the block with
+	// its index, so after this block no change can be due anymore.
+	if sched := config.ScheduledRosterChange; sched != nil && sched.Index <= newSB.Index {
+		log.Error("scheduled view-change is due but has not been applied")
+		return false
+	}
+	prevConfig, err := LoadConfigFromColl(&roCollection{cdb.coll})
+	if err == nil {
+		for _, ct := range ctx {
+			for _, instr := range ct.Instructions {
+				if !s.isApplyScheduledViewChange(newSB.SkipChainID(), instr) {
+					continue
+				}
+				sched := prevConfig.ScheduledRosterChange
+				if sched == nil || sched.Index != newSB.Index {
+					log.Error("scheduled view-change applied in the wrong block")
+					return false
+				}
+			}
+		}
+	}
+	s.endorseProposal(*body.Proposal)
 	return true
 }
 
 // createStateChanges goes through all ClientTransactions and creates
 // the appropriate StateChanges. If any of the transactions are invalid,
-// it returns an error.
-func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain.SkipBlockID, cts ClientTransactions) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, err error) {
+// it returns an error. The timestamp is the one of the block holding the
+// transactions.
+func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain.SkipBlockID, cts ClientTransactions, timestamp int64) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, err error) {
 	// If what we want is in the cache, then take it from there. Otherwise
 	// ignore the error and compute the state changes.
 	merkleRoot, ctsOK, states, err = s.stateChangeCache.get(scID, cts.Hash())
@@ -787,39 +1783,112 @@ func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain
 	// we need to find out if this is as expensive as it looks, and if so if
 	// we could use some kind of copy-on-write technique.
 
-	cdbTemp := coll.Clone()
-	var cin []Coin
-clientTransactions:
-	for _, ct := range cts {
-		// Make a new collection for each instruction. If the instruction is sucessfully
-		// implemented and changes applied, then keep it (via cdbTemp = cdbI.c),
-		// otherwise dump it.
-		cdbI := &roCollection{cdbTemp.Clone()}
-		for _, instr := range ct.Instructions {
-			scs, cout, err := s.executeInstruction(cdbI, cin, instr)
-			if err != nil {
-				log.Errorf("%s: Call to contract returned error: %s", s.ServerIdentity(), err)
-				continue clientTransactions
-			}
-			for _, sc := range scs {
-				if err := storeInColl(cdbI.c, &sc); err != nil {
-					log.Error("failed to add to collections with error: " + err.Error())
-					continue clientTransactions
-				}
-			}
-			states = append(states, scs...)
-			cin = cout
+	p := execParams{
+		maxScs:     defaultMaxStateChanges,
+		timestamp:  timestamp,
+		effects:    make(map[string][]StateChanges),
+		rejections: make(map[string]error),
+		proofRoots: s.getCollection(scID).provenRoots(coll.GetRoot()),
+	}
+	if config, err := LoadConfigFromColl(&roCollection{coll}); err == nil {
+		if config.MaxStateChanges > 0 {
+			p.maxScs = config.MaxStateChanges
 		}
-		cdbTemp = cdbI.c
-		ctsOK = append(ctsOK, ct)
+		p.recordFailed = config.RecordFailedPreconditions
+		p.noncePolicy = config.NoncePolicy
+		p.usage = newStorageUsage(s.getCollection(scID), coll, config)
 	}
 
+	// Independent transactions are executed in parallel, which only pays
+	// off if there are several of them.
+	cdbTemp, ctsOK, states := s.executeTxs(coll, cts, p, len(cts) > 1)
+
 	// Store the result in the cache before returning.
 	merkleRoot = cdbTemp.GetRoot()
 	s.stateChangeCache.update(scID, cts.Hash(), merkleRoot, ctsOK, states)
+	s.stateChangeCache.setEffects(scID, cts.Hash(), p.effects)
+	s.stateChangeCache.setRejections(scID, cts.Hash(), p.rejections)
 	return
 }
 
+// checkFailedPreconditions returns an error if the failed-precondition
+// markers of the transactions of a block differ from the ones set when
+// executing them.
+func checkFailedPreconditions(block, executed ClientTransactions) error {
+	failed := make(map[string]bool)
+	for _, ct := range executed {
+		if ct.FailedPrecondition {
+			failed[string(ct.Instructions.Hash())] = true
+		}
+	}
+	for _, ct := range block {
+		if ct.FailedPrecondition != failed[string(ct.Instructions.Hash())] {
+			return errors.New("wrong failed-precondition marker in block")
+		}
+	}
+	return nil
+}
+
+// executeInstructionTimeout is like executeInstruction, but returns
+// ErrExecutionTimeout if the contract doesn't return within timeout. A
+// timeout of zero means no timeout. It depends on the speed of the node, so
+// it is only used by the leader to choose the transactions of a block, never
+// to execute a block.
+//
+// A contract cannot be interrupted, so it keeps running in the background and
+// its result is dropped. Its reads of cdbI fail once it timed out, which
+// stops the contracts that read the state.
+func (s *Service) executeInstructionTimeout(cdbI CollectionView, cin []Coin, instr Instruction,
+	timeout time.Duration) (StateChanges, []Coin, error) {
+	if timeout <= 0 {
+		return s.executeInstruction(cdbI, cin, instr)
+	}
+	type result struct {
+		scs  StateChanges
+		cout []Coin
+		err  error
+	}
+	view := &cancelView{CollectionView: cdbI}
+	done := make(chan result, 1)
+	go func() {
+		scs, cout, err := s.executeInstruction(view, cin, instr)
+		done <- result{scs, cout, err}
+	}()
+	select {
+	case r := <-done:
+		return r.scs, r.cout, r.err
+	case <-time.After(timeout):
+		view.cancel()
+		return nil, nil, ErrExecutionTimeout
+	}
+}
+
+// cancelView is a CollectionView whose reads fail once it is cancelled.
+type cancelView struct {
+	CollectionView
+	cancelled int32
+}
+
+func (v *cancelView) cancel() {
+	atomic.StoreInt32(&v.cancelled, 1)
+}
+
+// Get returns a getter for a key that doesn't exist once v is cancelled.
+func (v *cancelView) Get(key []byte) collection.Getter {
+	if atomic.LoadInt32(&v.cancelled) == 1 {
+		return collection.New(&collection.Data{}, &collection.Data{}).Get(key)
+	}
+	return v.CollectionView.Get(key)
+}
+
+// GetValues returns ErrExecutionTimeout once v is cancelled.
+func (v *cancelView) GetValues(key []byte) ([]byte, string, error) {
+	if atomic.LoadInt32(&v.cancelled) == 1 {
+		return nil, "", ErrExecutionTimeout
+	}
+	return v.CollectionView.GetValues(key)
+}
+
 func (s *Service) executeInstruction(cdbI CollectionView, cin []Coin, instr Instruction) (scs StateChanges, cout []Coin, err error) {
 	defer func() {
 		if re := recover(); re != nil {
@@ -840,9 +1909,48 @@ func (s *Service) executeInstruction(cdbI CollectionView, cin []Coin, instr Inst
 		err = errors.New("Leader is dropping instruction of unknown contract: " + contractID)
 		return
 	}
+	if caps, ok := s.contractCaps[contractID]; ok {
+		if err = caps.checkAction(contractID, instr); err != nil {
+			return
+		}
+	}
+	if instr.GetType() == InvokeType && instr.Invoke.Command == CmdMigrate {
+		scs, err = s.migrateScs(cdbI, instr, contractID)
+		return scs, cin, err
+	}
+	if schema, ok := s.contractSchemas[contractID]; ok {
+		if err = schema.checkArguments(instr.arguments()); err != nil {
+			return
+		}
+	}
 	// Now we call the contract function with the data of the key.
+	// TODO: contracts cannot call other contracts yet. If they can one day,
+	// the depth of the calls must be passed on to the contracts and be
+	// limited by the service, else a contract calling itself takes down
+	// the node.
 	log.Lvlf3("%s: Calling contract %s", s.ServerIdentity(), contractID)
-	return contract(cdbI, instr, cin)
+	scs, cout, err = contract(cdbI, instr, cin)
+	if err == nil && instr.GetType() == SpawnType && instr.Spawn.Idempotent &&
+		spawnedBefore(cdbI, scs) {
+		log.Lvlf2("%s: idempotent spawn of existing instance", s.ServerIdentity())
+		return nil, cin, nil
+	}
+	return
+}
+
+// spawnedBefore returns true if one of the instances created by scs already
+// exists with the same contract.
+func spawnedBefore(coll CollectionView, scs StateChanges) bool {
+	for _, sc := range scs {
+		if sc.StateAction != Create {
+			continue
+		}
+		_, contractID, err := coll.GetValues(sc.InstanceID)
+		if err == nil && contractID == string(sc.ContractID) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Service) getLeader(scID skipchain.SkipBlockID) (*network.ServerIdentity, error) {
@@ -850,10 +1958,11 @@ func (s *Service) getLeader(scID skipchain.SkipBlockID) (*network.ServerIdentity
 	if err != nil {
 		return nil, err
 	}
-	if sb.Roster == nil || len(sb.Roster.List) < 1 {
-		return nil, errors.New("roster is empty")
+	config, err := s.LoadConfig(scID)
+	if err != nil {
+		return nil, err
 	}
-	return sb.Roster.List[0], nil
+	return leaderFor(sb.Roster, sb.Index+1, sb.Hash, config.LeaderPolicy)
 }
 
 func (s *Service) getTxs(leader *network.ServerIdentity, scID skipchain.SkipBlockID) ClientTransactions {
@@ -927,14 +2036,27 @@ func (s *Service) startViewChange(scID skipchain.SkipBlockID) error {
 		return err
 	}
 	if len(sb.Roster.List) < 2 {
-		return errors.New("roster size is too small")
+		// A single-node chain has nobody to hand the leadership over
+		// to, so there is nothing to do.
+		log.Lvlf2("%s: not starting view-change on single-node chain %x", s.ServerIdentity(), scID)
+		return nil
+	}
+	config, err := s.LoadConfig(scID)
+	if err != nil {
+		return err
+	}
+	queue, err := leaderQueue(sb.Roster, sb.Index+1, sb.Hash, config.LeaderPolicy)
+	if err != nil {
+		return err
 	}
-	if !sb.Roster.List[1].Equal(s.ServerIdentity()) {
+	if !queue[1].Equal(s.ServerIdentity()) {
 		// i'm not the next leader, do nothing
 		return nil
 	}
 
-	newRoster := onet.NewRoster(append(sb.Roster.List[1:], sb.Roster.List[0]))
+	// The new roster starts with this node, followed by the other nodes
+	// in the order of the roster.
+	newRoster := onet.NewRoster(append(queue[1:], queue[0]))
 	genesisDarcID, _, err := s.GetCollectionView(scID).GetValues(GenesisReferenceID.Slice())
 	if err != nil {
 		return err
@@ -943,6 +2065,8 @@ func (s *Service) startViewChange(scID skipchain.SkipBlockID) error {
 	if err != nil {
 		return err
 	}
+	versionBuf := make([]byte, binary.MaxVarintLen64)
+	versionBuf = versionBuf[:binary.PutUvarint(versionBuf, config.ConfigVersion+1)]
 
 	ctx := ClientTransaction{
 		Instructions: []Instruction{{
@@ -950,14 +2074,18 @@ func (s *Service) startViewChange(scID skipchain.SkipBlockID) error {
 				DarcID: genesisDarcID,
 				SubID:  oneSubID,
 			},
-			Nonce:  GenNonce(),
-			Index:  0,
-			Length: 1,
+			Nonce:       GenNonce(),
+			Index:       0,
+			Length:      1,
+			SkipchainID: scID,
 			Invoke: &Invoke{
 				Command: "view_change",
 				Args: []Argument{{
 					Name:  "roster",
 					Value: newRosterBuf,
+				}, {
+					Name:  "version",
+					Value: versionBuf,
 				}},
 			},
 		}},
@@ -972,6 +2100,63 @@ func (s *Service) startViewChange(scID skipchain.SkipBlockID) error {
 	return err
 }
 
+// isApplyScheduledViewChange returns true if instr applies the scheduled
+// view-change of the config of skipchain scID.
+func (s *Service) isApplyScheduledViewChange(scID skipchain.SkipBlockID, instr Instruction) bool {
+	if instr.Invoke == nil || instr.Invoke.Command != cmdApplyScheduledViewChange ||
+		instr.InstanceID.SubID != oneSubID {
+		return false
+	}
+	genesisDarcID, _, err := s.GetCollectionView(scID).GetValues(GenesisReferenceID.Slice())
+	return err == nil && bytes.Equal(genesisDarcID, instr.InstanceID.DarcID)
+}
+
+// addScheduledViewChange removes all the transactions applying a scheduled
+// view-change from cts, as only the leader may add them. Then, if a
+// view-change is scheduled for the block with the given index, it adds a
+// transaction applying it and returns true.
+func (s *Service) addScheduledViewChange(scID skipchain.SkipBlockID, index int, cts ClientTransactions) (ClientTransactions, bool, error) {
+	var ctsOut ClientTransactions
+clientTransactions:
+	for _, ct := range cts {
+		for _, instr := range ct.Instructions {
+			if s.isApplyScheduledViewChange(scID, instr) {
+				log.Warn(s.ServerIdentity(), "dropping transaction applying a scheduled view-change")
+				continue clientTransactions
+			}
+		}
+		ctsOut = append(ctsOut, ct)
+	}
+
+	config, err := s.LoadConfig(scID)
+	if err != nil {
+		return nil, false, err
+	}
+	if config.ScheduledRosterChange == nil || config.ScheduledRosterChange.Index > index {
+		return ctsOut, false, nil
+	}
+	genesisDarcID, _, err := s.GetCollectionView(scID).GetValues(GenesisReferenceID.Slice())
+	if err != nil {
+		return nil, false, err
+	}
+	log.Lvlf2("%s: applying scheduled view-change in block %d", s.ServerIdentity(), index)
+	ct := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: genesisDarcID,
+				SubID:  oneSubID,
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Invoke: &Invoke{
+				Command: cmdApplyScheduledViewChange,
+			},
+		}},
+	}
+	return append(ClientTransactions{ct}, ctsOut...), true, nil
+}
+
 // getPrivateKey is a hack that creates a temporary TreeNodeInstance and gets
 // the private key out of it. We have to do this because we cannot access the
 // private key from the service.
@@ -1019,21 +2204,27 @@ func (s *Service) withinInterval(genesisDarcID darc.ID, targetPk kyber.Point) er
 		return errors.New("not ready to accept new leader yet")
 	}
 
-	// find the position in the proposer queue
+	// find the position in the proposer queue, which starts with the
+	// leader of the next block
 	latestConfig, err := s.LoadConfig(scID)
 	if err != nil {
 		return err
 	}
-	pos := func() int {
-		var ctr int
-		for _, pk := range latestConfig.Roster.Publics() {
-			if pk.Equal(targetPk) {
-				return ctr
-			}
-			ctr++
+	sb, err := s.db().GetLatestByID(scID)
+	if err != nil {
+		return err
+	}
+	queue, err := leaderQueue(sb.Roster, sb.Index+1, sb.Hash, latestConfig.LeaderPolicy)
+	if err != nil {
+		return err
+	}
+	pos := -1
+	for i, si := range queue {
+		if si.Public.Equal(targetPk) {
+			pos = i
+			break
 		}
-		return -1
-	}()
+	}
 	if pos == -1 || pos == 0 {
 		return errors.New("invalid targetPk " + targetPk.String() + ", or position " + string(pos))
 	}
@@ -1056,6 +2247,86 @@ func (s *Service) registerContract(contractID string, c OmniLedgerContract) erro
 	return nil
 }
 
+// registerContractSchema stores the argument schema of a contract.
+func (s *Service) registerContractSchema(contractID string, schema ContractSchema) error {
+	s.contractSchemas[contractID] = schema
+	return nil
+}
+
+// registerContractCapabilities stores the actions supported by a contract.
+func (s *Service) registerContractCapabilities(contractID string, caps ContractCapabilities) error {
+	s.contractCaps[contractID] = caps
+	return nil
+}
+
+// registerContractState stores the type of the state of a contract.
+func (s *Service) registerContractState(contractID string, prototype interface{}) error {
+	t := reflect.TypeOf(prototype)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return errors.New("the state of a contract must be a struct")
+	}
+	s.contractStates[contractID] = t
+	// So that GetDecodedInstance can send the decoded states.
+	network.RegisterMessage(reflect.New(t).Interface())
+	return nil
+}
+
+// registerContractStateDecoder stores the decoder of the state of a contract.
+func (s *Service) registerContractStateDecoder(contractID string, d ContractStateDecoder) error {
+	if d == nil {
+		return errors.New("nil decoder")
+	}
+	s.contractDecoders[contractID] = d
+	return nil
+}
+
+// DecodeState returns the value of an instance of the contract contractID,
+// decoded by the function registered with RegisterContractStateDecoder, or
+// else into a pointer to the type registered with RegisterContractState.
+func (s *Service) DecodeState(contractID string, value []byte) (interface{}, error) {
+	if d, ok := s.contractDecoders[contractID]; ok {
+		return d(value)
+	}
+	t, ok := s.contractStates[contractID]
+	if !ok {
+		return nil, errors.New("no state registered for contract " + contractID)
+	}
+	state := reflect.New(t).Interface()
+	err := protobuf.DecodeWithConstructors(value, state, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// decodedInstance returns the contract and the value of the instance iID in
+// the latest state of the skipchain scID, as it is stored and decoded. The
+// value is decoded with DecodeState if the contract registered its state:
+// the config is returned as a *ChainConfig and a darc as a *darc.Darc. The
+// values of other contracts, and of the other instances of the config
+// contract, are returned as []byte.
+func (s *Service) decodedInstance(scID skipchain.SkipBlockID, iID InstanceID) (contractID string, value []byte, decoded interface{}, err error) {
+	if s.db().GetByID(scID) == nil {
+		return "", nil, nil, errors.New("unknown skipchain")
+	}
+	value, contractID, err = s.GetCollectionView(scID).GetValues(iID.Slice())
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if contractID == ContractConfigID && iID.SubID != oneSubID {
+		return contractID, value, value, nil
+	}
+	_, registered := s.contractStates[contractID]
+	if _, ok := s.contractDecoders[contractID]; !ok && !registered {
+		return contractID, value, value, nil
+	}
+	decoded, err = s.DecodeState(contractID, value)
+	return contractID, value, decoded, err
+}
+
 // Tries to load the configuration and updates the data in the service
 // if it finds a valid config-file.
 func (s *Service) tryLoad() error {
@@ -1075,7 +2346,7 @@ func (s *Service) tryLoad() error {
 	s.collectionDB = map[string]*collectionDB{}
 	s.state = olState{
 		lastBlock:    make(map[string]skipchain.SkipBlockID),
-		waitChannels: make(map[string]chan bool),
+		waitChannels: make(map[string]chan txOutcome),
 	}
 
 	// NOTE: Usually tryLoad is only called when services start up. but for
@@ -1096,6 +2367,9 @@ func (s *Service) tryLoad() error {
 		if !s.isOurChain(gen) {
 			continue
 		}
+		if err := s.checkCollection(gen); err != nil {
+			return fmt.Errorf("collection of %x: %s", gen, err)
+		}
 		interval, err := s.LoadBlockInterval(gen)
 		if err != nil {
 			return err
@@ -1121,6 +2395,97 @@ func (s *Service) tryLoad() error {
 	return nil
 }
 
+// checkCollection returns an error if the collection of the skipchain scID
+// doesn't match the header of the latest block applied to it, or if that
+// block is not in the skipchain. The collection must then be rebuilt from the
+// skipchain.
+func (s *Service) checkCollection(scID skipchain.SkipBlockID) error {
+	latest := s.getCollection(scID).latestBlock()
+	if latest == nil {
+		// Nothing has been applied yet, or the collection has been
+		// stored before its latest block was recorded.
+		return nil
+	}
+	sb := s.db().GetByID(latest)
+	if sb == nil || !sb.SkipChainID().Equal(scID) {
+		return fmt.Errorf("applied block %x is not in the skipchain", latest)
+	}
+	_, dataI, err := network.Unmarshal(sb.Data, cothority.Suite)
+	header, ok := dataI.(*DataHeader)
+	if err != nil || !ok {
+		return errors.New("couldn't unmarshal header")
+	}
+	if !bytes.Equal(s.getCollection(scID).RootHash(), header.CollectionRoot) {
+		return fmt.Errorf("collection doesn't match the header of block %d", sb.Index)
+	}
+	return nil
+}
+
+// catchUpCollection applies to the collection the blocks between the latest
+// block applied to it and sb. They are missing if the system crashed after
+// storing them in the skipchain, but before syncing the collection.
+func (s *Service) catchUpCollection(cdb *collectionDB, sb *skipchain.SkipBlock) error {
+	latest := cdb.latestBlock()
+	if latest == nil || sb.Index == 0 || latest.Equal(sb.Hash) || latest.Equal(sb.BackLinkIDs[0]) {
+		return nil
+	}
+	applied := s.db().GetByID(latest)
+	if applied == nil || applied.Index >= sb.Index {
+		return fmt.Errorf("applied block %x is not before block %d", latest, sb.Index)
+	}
+	for {
+		next, err := s.nextBlock(applied)
+		if err != nil {
+			return err
+		}
+		if next == nil || next.Index >= sb.Index {
+			return nil
+		}
+		_, dataI, err := network.Unmarshal(next.Data, cothority.Suite)
+		header, ok := dataI.(*DataHeader)
+		if err != nil || !ok {
+			return errors.New("couldn't unmarshal header")
+		}
+		_, bodyI, err := network.Unmarshal(next.Payload, cothority.Suite)
+		body, ok := bodyI.(*DataBody)
+		if err != nil || !ok {
+			return errors.New("couldn't unmarshal body")
+		}
+		log.Lvlf2("%s: applying missing block %d to the collection", s.ServerIdentity(), next.Index)
+		_, _, scs, err := s.createStateChanges(cdb.coll, next.SkipChainID(), body.Transactions, header.Timestamp)
+		if err != nil {
+			return err
+		}
+		s.recordBlock(next, body)
+		if err = cdb.StoreBlock(next.Hash, scs); err != nil {
+			return err
+		}
+		if !bytes.Equal(cdb.RootHash(), header.CollectionRoot) {
+			return fmt.Errorf("collection doesn't match the header of block %d", next.Index)
+		}
+		if err = s.recordBlockChanges(next, body); err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't record the state changes:", err)
+		}
+		applied = next
+	}
+}
+
+// recordBlock updates the indexes of the service with the transactions of
+// the block sb. It must be called before the state changes of the block are
+// applied, as the authorizing rules are the ones of the darcs before the
+// block. The errors are only logged, as the block is committed anyway.
+func (s *Service) recordBlock(sb *skipchain.SkipBlock, body *DataBody) {
+	if err := s.recordAuthorizingRules(sb.SkipChainID(), body.Transactions); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't record authorizing rules:", err)
+	}
+	if err := s.recordExternalRefs(sb.SkipChainID(), body.Transactions); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't index external references:", err)
+	}
+	if err := s.countTxs(sb, len(body.Transactions)); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't count transactions:", err)
+	}
+}
+
 // checks that a given chain has a verifier we recognize
 func (s *Service) isOurChain(gen skipchain.SkipBlockID) bool {
 	sb := s.db().GetByID(gen)
@@ -1147,6 +2512,98 @@ func (s *Service) EnableViewChange() {
 	s.monitorLeaderFailure()
 }
 
+// EnableArchive enables the archival of old blocks. All blocks that are
+// more than depth blocks behind the latest block of a skipchain are copied
+// to a cold storage, the bolt database at path, and GetBlock reads them from
+// there. The collections are not changed by the archival.
+//
+// The archived blocks are removed from the database of the skipchain
+// service, except for the genesis block and the blocks holding the links to
+// the latest block, so the proofs of the current state can still be
+// created. Receipts of transactions in removed blocks are not available
+// anymore, and nodes far behind cannot sync the removed blocks from this
+// node. CloseArchive must be called when the node shuts down.
+func (s *Service) EnableArchive(path string, depth int) error {
+	a, err := newBlockArchive(path, depth)
+	if err != nil {
+		return err
+	}
+	s.archiveMut.Lock()
+	defer s.archiveMut.Unlock()
+	if s.archive != nil {
+		s.archive.close()
+	}
+	s.archive = a
+	return nil
+}
+
+// CloseArchive disables the archival of old blocks and closes the archive
+// database. It does nothing if archival is not enabled.
+func (s *Service) CloseArchive() error {
+	s.archiveMut.Lock()
+	defer s.archiveMut.Unlock()
+	if s.archive == nil {
+		return nil
+	}
+	err := s.archive.close()
+	s.archive = nil
+	return err
+}
+
+func (s *Service) getArchive() *blockArchive {
+	s.archiveMut.Lock()
+	defer s.archiveMut.Unlock()
+	return s.archive
+}
+
+// archiveBlocks stores all the blocks that are at least depth blocks behind
+// latest in the archive, if archival is enabled, and removes the ones that
+// are not needed anymore from the skipchain database. It goes backwards
+// through the skipchain until it finds a block that has been removed before.
+func (s *Service) archiveBlocks(latest *skipchain.SkipBlock) error {
+	a := s.getArchive()
+	if a == nil || latest.Index < a.depth {
+		return nil
+	}
+	sb := latest
+	inDB := true
+	for {
+		if sb.Index <= latest.Index-a.depth {
+			_, err := a.get(sb.SkipChainID(), sb.Index)
+			archived := err == nil
+			if !archived {
+				if err := a.store(sb); err != nil {
+					return err
+				}
+			}
+			switch {
+			case !inDB:
+				// The older blocks have been handled before.
+				return nil
+			case a.prunable(sb, latest.Index):
+				if err := s.db().Remove(sb.Hash); err != nil {
+					return err
+				}
+			case archived && sb.MaximumHeight <= 1:
+				// Without skip links, no block can be removed.
+				return nil
+			}
+		}
+		if sb.Index == 0 {
+			return nil
+		}
+		prev := s.db().GetByID(sb.BackLinkIDs[0])
+		if prev == nil {
+			var err error
+			if prev, err = a.get(sb.SkipChainID(), sb.Index-1); err != nil {
+				return err
+			}
+			inDB = false
+		}
+		sb = prev
+	}
+}
+
 // saves this service's config information
 func (s *Service) save() {
 	s.storage.Lock()
@@ -1165,15 +2622,32 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor:  onet.NewServiceProcessor(c),
 		contracts:         make(map[string]OmniLedgerContract),
+		contractSchemas:   make(map[string]ContractSchema),
+		contractCaps:      make(map[string]ContractCapabilities),
+		contractStates:    make(map[string]reflect.Type),
+		contractDecoders:  make(map[string]ContractStateDecoder),
+		contractFields:    make(map[string][]string),
+		migrations:        make(map[migrationKey]Migration),
 		txBuffer:          newTxBuffer(),
 		heartbeatsTimeout: make(chan string, 1),
 		heartbeatsClose:   make(chan bool, 1),
 		storage:           &omniStorage{},
 		darcToSc:          make(map[string]skipchain.SkipBlockID),
+		proposals:         make(map[string]Proposal),
+		equivocations:     make(map[string][]Equivocation),
+		proposed:          make(map[string]proposedBlock),
+		batches:           make(map[string]*txBatch),
+		partialSigs:       make(map[string]*partialSignatures),
+		halted:            make(map[string]bool),
+		rejections:        make(map[string]uint64),
 		stateChangeCache:  newStateChangeCache(),
 	}
 	if err := s.RegisterHandlers(s.CreateGenesisBlock, s.AddTransaction,
-		s.GetProof); err != nil {
+		s.GetProof, s.GetBatchProof, s.GetInstanceHistory, s.GetInstanceOrigin,
+		s.GetLastModifier, s.GetProofSize, s.GetChangesSince, s.FindByExternalRef,
+		s.GetDecodedInstance,
+		s.GetBlock, s.GetBlockTransactions, s.AddTransactionBatch, s.GetTxStatus, s.GetTxReceipt,
+		s.AddPartialSignature); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
@@ -1189,6 +2663,12 @@ func newService(c *onet.Context) (onet.Service, error) {
 
 	s.registerContract(ContractConfigID, s.ContractConfig)
 	s.registerContract(ContractDarcID, s.ContractDarc)
+	s.registerContractState(ContractDarcID, darc.Darc{})
+	s.registerContractCapabilities(ContractDarcID, ContractCapabilities{
+		Spawn:  true,
+		Invoke: []string{"evolve", CmdDarcCompact, CmdDarcSpawnImported, CmdDarcLockExport},
+	})
+	s.registerContractState(ContractConfigID, ChainConfig{})
 	skipchain.RegisterVerification(c, verifyOmniLedger, s.verifySkipBlock)
 	if _, err := s.ProtocolRegister(collectTxProtocol, NewCollectTxProtocol(s.getTxs)); err != nil {
 		return nil, err
@@ -2,18 +2,30 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/omniledger/collection"
 	"github.com/dedis/cothority/omniledger/darc"
 	"github.com/dedis/cothority/omniledger/darc/expression"
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/tbls"
 	"github.com/dedis/kyber/suites"
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,6 +33,7 @@ import (
 
 var tSuite = suites.MustFind("Ed25519")
 var dummyKind = "dummy"
+var structKind = "struct"
 var slowKind = "slow"
 var invalidKind = "invalid"
 var testInterval = 200 * time.Millisecond
@@ -176,6 +189,379 @@ func testAddTransaction(t *testing.T, sendToIdx int, failure bool) {
 	}
 }
 
+func TestService_AdmissionPolicy(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	errDummy := errors.New("no dummies today")
+	require.Nil(t, RegisterTxAdmissionPolicy(s.hosts[0], TxAdmissionFunc(
+		func(tx ClientTransaction, coll CollectionView) error {
+			for _, instr := range tx.Instructions {
+				if instr.Spawn != nil && instr.Spawn.ContractID == dummyKind {
+					return errDummy
+				}
+			}
+			return nil
+		})))
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: tx,
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), errDummy.Error())
+
+	// Other transactions are still accepted.
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+}
+
+func TestService_BlockInvariant(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// The supply of dummy coins can only change through a mint, which
+	// this chain doesn't have.
+	minted := []byte("minted")
+	errSupply := errors.New("supply changed without a mint")
+	require.Nil(t, RegisterBlockInvariant(s.hosts[0], BlockInvariantFunc(
+		func(scs StateChanges, before, after CollectionView) error {
+			for _, sc := range scs {
+				if string(sc.ContractID) != dummyKind {
+					continue
+				}
+				_, _, err := before.GetValues(sc.InstanceID)
+				existed := err == nil
+				value, _, err := after.GetValues(sc.InstanceID)
+				if !existed && err == nil && bytes.Equal(value, minted) {
+					return errSupply
+				}
+			}
+			return nil
+		})))
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, minted, s.signer)
+	require.Nil(t, err)
+	_, err = s.service().createNewBlock(scID, s.sb.Roster, ClientTransactions{tx})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), errSupply.Error())
+	_, _, err = s.service().getCollection(scID).GetValues(tx.Instructions[0].InstanceID.Slice())
+	require.NotNil(t, err)
+
+	// Blocks respecting the invariant are still accepted.
+	tx, err = createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+}
+
+func TestService_GetIntervalStats(t *testing.T) {
+	stats := intervalStats([]int64{107, 103, 102, 100})
+	require.Equal(t, 3, stats.Blocks)
+	require.Equal(t, 7*time.Second/3, stats.Mean)
+	require.Equal(t, time.Second, stats.Min)
+	require.Equal(t, 4*time.Second, stats.Max)
+	require.Equal(t, 0, intervalStats([]int64{100}).Blocks)
+
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	_, err := s.service().GetIntervalStats(scID, 0)
+	require.NotNil(t, err)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	rep, err := s.service().GetIntervalStats(scID, 10)
+	require.Nil(t, err)
+	require.Equal(t, testInterval, rep.Configured)
+	require.Equal(t, latest.Index, rep.Blocks)
+	require.True(t, rep.Min <= rep.Mean && rep.Mean <= rep.Max)
+	require.True(t, rep.Min >= 0)
+}
+
+func TestService_Halt(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	require.NotNil(t, s.service().Resume(scID))
+	require.Nil(t, s.service().Halt(scID))
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Transaction: tx,
+	})
+	require.Equal(t, ErrHalted, err)
+	_, err = s.service().AddTransactionBatch(&AddTxBatchRequest{
+		Version:      CurrentVersion,
+		SkipchainID:  scID,
+		Transactions: ClientTransactions{tx},
+	})
+	require.Equal(t, ErrHalted, err)
+	_, err = s.service().createNewBlock(scID, s.sb.Roster, ClientTransactions{tx})
+	require.Equal(t, ErrHalted, err)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.False(t, s.service().verifySkipBlock(latest.Hash, latest))
+
+	// The other nodes still accept the transaction, but the halted leader
+	// doesn't propose a block.
+	s.sendTxTo(t, tx, 1)
+	time.Sleep(4 * s.interval)
+	latest2, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.Equal(t, latest.Index, latest2.Index)
+
+	// Queries are still answered.
+	rep, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      scID,
+		Key:     s.tx.Instructions[0].InstanceID.Slice(),
+	})
+	require.Nil(t, err)
+	require.True(t, rep.Proof.InclusionProof.Match())
+
+	require.Nil(t, s.service().Resume(scID))
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+}
+
+func TestService_GetTxCount(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// bodyTxs returns the number of transactions in all the blocks.
+	bodyTxs := func() uint64 {
+		latest, err := s.service().db().GetLatestByID(scID)
+		require.Nil(t, err)
+		var n uint64
+		for i := 0; i <= latest.Index; i++ {
+			rep, err := s.service().GetBlock(&GetBlock{
+				Version:     CurrentVersion,
+				SkipchainID: scID,
+				Index:       i,
+			})
+			require.Nil(t, err)
+			_, bodyI, err := network.Unmarshal(rep.Skipblock.Payload, cothority.Suite)
+			require.Nil(t, err)
+			n += uint64(len(bodyI.(*DataBody).Transactions))
+		}
+		return n
+	}
+
+	count, err := s.service().GetTxCount(scID)
+	require.Nil(t, err)
+	require.Equal(t, bodyTxs(), count)
+	before := count
+
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		s.sendTx(t, tx)
+		require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	}
+	count, err = s.service().GetTxCount(scID)
+	require.Nil(t, err)
+	require.Equal(t, before+3, count)
+	require.Equal(t, bodyTxs(), count)
+
+	// Counting a block again doesn't change the counter.
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.Nil(t, s.service().countTxs(latest, 1))
+
+	// The counter is kept when the service is loaded again.
+	require.Nil(t, s.service().tryLoad())
+	count, err = s.service().GetTxCount(scID)
+	require.Nil(t, err)
+	require.Equal(t, before+3, count)
+	_, err = s.service().GetTxCount(skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+}
+
+func TestService_CollectionCatchUp(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	cdb := s.service().getCollection(scID)
+
+	// snapshotBucket returns the entries of a bucket, and restoreBucket
+	// writes them back, as a crash of the system would after blocks that
+	// have not been synced.
+	snapshotBucket := func(db *bolt.DB, name []byte) (keys, values [][]byte) {
+		require.Nil(t, db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(name)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				keys = append(keys, dup(k))
+				values = append(values, dup(v))
+				return nil
+			})
+		}))
+		return
+	}
+	restoreBucket := func(db *bolt.DB, name []byte, keys, values [][]byte) {
+		require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+			if tx.Bucket(name) != nil {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+			b, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+			for i := range keys {
+				if err := b.Put(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	snapshot := func() (keys, values [][]byte) {
+		return snapshotBucket(cdb.db, cdb.bucketName)
+	}
+	restore := func(keys, values [][]byte) {
+		restoreBucket(cdb.db, cdb.bucketName, keys, values)
+	}
+
+	// The indexes of the service are lost with the collection.
+	type bucketSnapshot struct{ keys, values [][]byte }
+	indexes := [][]byte{txCountBucket, externalRefsBucket, authorizingRulesBucket}
+	indexSnapshots := make([]bucketSnapshot, len(indexes))
+	for i, name := range indexes {
+		db, n := s.service().GetAdditionalBucket(name)
+		indexSnapshots[i].keys, indexSnapshots[i].values = snapshotBucket(db, n)
+	}
+	count, err := s.service().GetTxCount(scID)
+	require.Nil(t, err)
+
+	keys, values := snapshot()
+	var txs ClientTransactions
+	for i := 0; i < 2; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		tx.ExternalRef = []byte("lost")
+		s.sendTx(t, tx)
+		require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+		txs = append(txs, tx)
+	}
+
+	// The collection lost the blocks of the transactions, but it still
+	// matches the block it has recorded, so it can be loaded.
+	restore(keys, values)
+	for i, name := range indexes {
+		db, n := s.service().GetAdditionalBucket(name)
+		restoreBucket(db, n, indexSnapshots[i].keys, indexSnapshots[i].values)
+	}
+	require.Nil(t, s.service().tryLoad())
+	cdb = s.service().getCollection(scID)
+	_, _, err = cdb.GetValues(txs[0].Instructions[0].InstanceID.Slice())
+	require.NotNil(t, err)
+
+	// The lost blocks are applied before the next one.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	for _, tx := range txs {
+		_, _, err = cdb.GetValues(tx.Instructions[0].InstanceID.Slice())
+		require.Nil(t, err)
+	}
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.True(t, latest.Hash.Equal(cdb.latestBlock()))
+
+	// The indexes of the service hold the blocks applied late.
+	count2, err := s.service().GetTxCount(scID)
+	require.Nil(t, err)
+	require.Equal(t, count+3, count2)
+	hashes, err := s.service().findByExternalRef(scID, []byte("lost"))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(hashes))
+	for _, tx := range txs {
+		_, err = s.service().GetAuthorizingRule(scID, tx.Instructions.Hash(), 0)
+		require.Nil(t, err)
+	}
+
+	// A collection that doesn't match its block is not loaded.
+	keys, values = snapshot()
+	for i := range keys {
+		if bytes.Equal(keys[i], tx.Instructions[0].InstanceID.Slice()) {
+			values[i] = []byte("corrupted")
+		}
+	}
+	restore(keys, values)
+	require.NotNil(t, s.service().tryLoad())
+}
+
+func TestService_GetProofSize(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = scID
+
+	for _, key := range [][]byte{s.tx.Instructions[0].InstanceID.Slice(), make([]byte, 64)} {
+		size, err := c.GetProofSize(key)
+		require.Nil(t, err)
+		rep, err := s.service().GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      scID,
+			Key:     key,
+		})
+		require.Nil(t, err)
+		buf, err := protobuf.Encode(&rep.Proof)
+		require.Nil(t, err)
+		require.Equal(t, len(buf), size)
+	}
+	_, err := s.service().proofSize(skipchain.SkipBlockID("unknown"), make([]byte, 64))
+	require.NotNil(t, err)
+}
+
+func TestService_GetChainFingerprint(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// Wait for the second node to have the same tip.
+	var fp0, fp1 []byte
+	for i := 0; i < 10; i++ {
+		var err error
+		fp0, err = s.services[0].GetChainFingerprint(scID)
+		require.Nil(t, err)
+		fp1, err = s.services[1].GetChainFingerprint(scID)
+		require.Nil(t, err)
+		if bytes.Equal(fp0, fp1) {
+			break
+		}
+		time.Sleep(s.interval)
+	}
+	require.Equal(t, fp0, fp1)
+
+	// A change to the collection of one node shows in its fingerprint.
+	sc := NewStateChange(Create, InstanceID{s.darc.GetBaseID(), genSubID()}, dummyKind, s.value)
+	require.Nil(t, s.services[1].getCollection(scID).Store(&sc))
+	fp1, err := s.services[1].GetChainFingerprint(scID)
+	require.Nil(t, err)
+	require.NotEqual(t, fp0, fp1)
+
+	_, err = s.services[0].GetChainFingerprint(skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+}
+
 func TestService_GetProof(t *testing.T) {
 	s := newSer(t, 2, testInterval)
 	defer s.local.CloseAll()
@@ -204,6 +590,16 @@ func TestService_GetProof(t *testing.T) {
 	require.Equal(t, serKey, key)
 	require.Equal(t, s.value, values[0])
 
+	// The freshness is checked by the client, against the tip it knows.
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = s.sb.SkipChainID()
+	tip := rep.Proof.Latest.Index
+	_, err = c.GetFreshProof(serKey, tip, 1)
+	require.Nil(t, err)
+	_, err = c.GetFreshProof(serKey, tip+2, 1)
+	require.Equal(t, ErrProofStale, err)
+
 	// Modify the key and we should not be able to get the proof.
 	rep, err = s.service().GetProof(&GetProof{
 		Version: CurrentVersion,
@@ -216,6 +612,55 @@ func TestService_GetProof(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestService_GetBatchProof(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	serKey := s.tx.Instructions[0].InstanceID
+	require.True(t, s.waitProof(t, serKey).InclusionProof.Match())
+
+	keys := [][]byte{
+		serKey.Slice(),
+		InstanceID{s.darc.GetBaseID(), SubID{}}.Slice(),
+		InstanceID{s.darc.GetBaseID(), oneSubID}.Slice(),
+		append(serKey.Slice(), byte(0)),
+	}
+	rep, err := s.service().GetBatchProof(&GetBatchProof{
+		Version: CurrentVersion,
+		ID:      s.sb.SkipChainID(),
+		Keys:    keys,
+	})
+	require.Nil(t, err)
+
+	proofs, err := rep.Proof.Expand()
+	require.Nil(t, err)
+	require.Equal(t, len(keys), len(proofs))
+	size := 0
+	for i, p := range proofs {
+		require.Nil(t, p.Verify(s.sb.SkipChainID()))
+		require.Equal(t, keys[i], p.InclusionProof.Key)
+		require.Equal(t, i < 3, p.InclusionProof.Match())
+
+		// Compare with the proof of the key alone.
+		single, err := s.service().GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      s.sb.SkipChainID(),
+			Key:     keys[i],
+		})
+		require.Nil(t, err)
+		buf, err := protobuf.Encode(&single.Proof)
+		require.Nil(t, err)
+		size += len(buf)
+	}
+	_, values, err := proofs[0].KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, s.value, values[0])
+
+	buf, err := protobuf.Encode(&rep.Proof)
+	require.Nil(t, err)
+	require.True(t, len(buf) < size)
+}
+
 func TestService_WaitInclusion(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		log.Lvl1("Testing inclusion when sending to service", i)
@@ -394,6 +839,49 @@ func TestService_LoadBlockInterval(t *testing.T) {
 	require.Equal(t, dur, interval)
 }
 
+func TestService_BlockIntervalDecoding(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+
+	darcBuf, err := s.darc.ToProto()
+	require.Nil(t, err)
+	rosterBuf, err := protobuf.Encode(s.roster)
+	require.Nil(t, err)
+	valid := make([]byte, binary.MaxVarintLen64)
+	valid = valid[:binary.PutVarint(valid, int64(testInterval))]
+	negative := make([]byte, binary.MaxVarintLen64)
+	negative = negative[:binary.PutVarint(negative, -1)]
+
+	for i, tc := range []struct {
+		buf []byte
+		ok  bool
+	}{
+		{valid, true},
+		{valid[:len(valid)-1], false},
+		{append(append([]byte{}, valid...), 0), false},
+		{negative, false},
+		{nil, false},
+	} {
+		inst := Instruction{
+			InstanceID: InstanceID{s.darc.GetBaseID(), SubID{}},
+			Spawn: &Spawn{
+				ContractID: ContractConfigID,
+				Args: Arguments{
+					{Name: "darc", Value: darcBuf},
+					{Name: "block_interval", Value: tc.buf},
+					{Name: "roster", Value: rosterBuf},
+				},
+			},
+		}
+		_, _, err := s.service().spawnContractConfig(nil, inst, nil)
+		if tc.ok {
+			require.Nil(t, err, "case %d", i)
+		} else {
+			require.Equal(t, ErrInvalidInterval, err, "case %d", i)
+		}
+	}
+}
+
 func TestService_StateChange(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -488,7 +976,7 @@ func TestService_StateChange(t *testing.T) {
 		},
 	}
 
-	_, ctsOK, scs, err := s.service().createStateChanges(cdb.coll, s.sb.SkipChainID(), cts)
+	_, ctsOK, scs, err := s.service().createStateChanges(cdb.coll, s.sb.SkipChainID(), cts, time.Now().Unix())
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ctsOK))
 	require.Equal(t, n, len(scs))
@@ -533,151 +1021,2701 @@ func TestService_DarcEvolution(t *testing.T) {
 	require.True(t, d22.Equal(d2))
 }
 
-func TestService_DarcSpawn(t *testing.T) {
-	s := newSer(t, 1, testInterval)
+func TestService_InstanceDarc(t *testing.T) {
+	s := newSer(t, 2, testInterval)
 	defer s.local.CloseAll()
 
-	id := []darc.Identity{s.signer.Identity()}
-	darc2 := darc.NewDarc(darc.InitRulesWith(id, id, invokeEvolve),
-		[]byte("next darc"))
-	darc2.Rules.AddRule("spawn:rain", darc2.Rules.GetSignExpr())
-	darc2Buf, err := darc2.ToProto()
+	iID := s.tx.Instructions[0].InstanceID
+	d, err := LoadInstanceDarc(s.service().GetCollectionView(s.sb.SkipChainID()), iID)
 	require.Nil(t, err)
-	darc2Copy, err := darc.NewFromProtobuf(darc2Buf)
+	require.True(t, d.Equal(s.darc))
+	require.False(t, d.Rules.Contains("spawn:rain"))
+
+	// Evolve the darc with a new rule, the instance keeps pointing to the
+	// same base ID but must now be governed by the new rules.
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.AddRule("spawn:rain", d2.Rules.GetSignExpr()))
+	pr := s.testDarcEvolution(t, *d2, false)
+	require.True(t, pr.InclusionProof.Match())
+
+	d, err = LoadInstanceDarc(s.service().GetCollectionView(s.sb.SkipChainID()), iID)
 	require.Nil(t, err)
-	require.True(t, darc2.Equal(darc2Copy))
+	require.True(t, d.Equal(d2))
+	require.Equal(t, uint64(1), d.Version)
+	require.True(t, d.Rules.Contains("spawn:rain"))
 
-	ctx := ClientTransaction{
-		Instructions: []Instruction{{
-			InstanceID: InstanceID{
-				DarcID: s.darc.GetBaseID(),
-				SubID:  SubID{},
-			},
-			Nonce:  GenNonce(),
-			Index:  0,
-			Length: 1,
-			Spawn: &Spawn{
-				ContractID: ContractDarcID,
-				Args: []Argument{{
-					Name:  "darc",
-					Value: darc2Buf,
-				}},
-			},
-		}},
-	}
-	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	// An instance of an unknown darc has no governing darc.
+	_, err = LoadInstanceDarc(s.service().GetCollectionView(s.sb.SkipChainID()),
+		InstanceID{darcidStr("unknown"), iID.SubID})
+	require.NotNil(t, err)
+}
 
-	s.sendTx(t, ctx)
-	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
-	require.True(t, pr.InclusionProof.Match())
+func TestService_ConfigGovernance(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	coll := s.service().getCollection(s.sb.SkipChainID()).coll
+	require.Nil(t, VerifyConfigGovernance(&roCollection{coll}))
+
+	// The genesis reference points to a darc that doesn't exist.
+	c := coll.Clone()
+	require.Nil(t, storeInColl(c, &StateChange{
+		StateAction: Update,
+		InstanceID:  GenesisReferenceID.Slice(),
+		ContractID:  []byte(ContractConfigID),
+		Value:       darcidStr("unknown"),
+	}))
+	require.NotNil(t, VerifyConfigGovernance(&roCollection{c}))
+
+	// The genesis darc is stored under another base ID.
+	c = coll.Clone()
+	d2 := darc.NewDarc(darc.InitRules([]darc.Identity{s.signer.Identity()},
+		[]darc.Identity{s.signer.Identity()}), []byte("other darc"))
+	d2Buf, err := d2.ToProto()
+	require.Nil(t, err)
+	require.Nil(t, storeInColl(c, &StateChange{
+		StateAction: Update,
+		InstanceID:  InstanceID{s.darc.GetBaseID(), SubID{}}.Slice(),
+		ContractID:  []byte(ContractDarcID),
+		Value:       d2Buf,
+	}))
+	require.NotNil(t, VerifyConfigGovernance(&roCollection{c}))
+
+	// The config is missing.
+	c = coll.Clone()
+	require.Nil(t, storeInColl(c, &StateChange{
+		StateAction: Remove,
+		InstanceID:  InstanceID{s.darc.GetBaseID(), oneSubID}.Slice(),
+	}))
+	require.NotNil(t, VerifyConfigGovernance(&roCollection{c}))
 }
 
-func TestService_DarcDelegation(t *testing.T) {
+func TestService_GetRoot(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
 
-	// Spawn second darc with a new owner/signer, but delegate its spawn
-	// rule to the first darc
-	signer2 := darc.NewSignerEd25519(nil, nil)
-	id2 := []darc.Identity{signer2.Identity()}
-	darc2 := darc.NewDarc(darc.InitRules(id2, id2),
-		[]byte("second darc"))
-	darc2.Rules.AddRule("spawn:darc", expression.InitOrExpr(s.darc.GetIdentityString()))
-	darc2Buf, err := darc2.ToProto()
+	root, index, hash, err := s.service().GetRoot(scID)
 	require.Nil(t, err)
-	darc2Copy, err := darc.NewFromProtobuf(darc2Buf)
+	latest, err := s.service().db().GetLatestByID(scID)
 	require.Nil(t, err)
-	require.True(t, darc2.Equal(darc2Copy))
-	ctx := ClientTransaction{
-		Instructions: []Instruction{{
-			InstanceID: InstanceID{
-				DarcID: s.darc.GetBaseID(),
+	require.Equal(t, latest.Index, index)
+	require.True(t, latest.Hash.Equal(hash))
+	_, headerI, err := network.Unmarshal(latest.Data, cothority.Suite)
+	require.Nil(t, err)
+	require.Equal(t, headerI.(*DataHeader).CollectionRoot, root)
+	require.Equal(t, s.service().getCollection(scID).RootHash(), root)
+
+	_, _, _, err = s.service().GetRoot(skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+}
+
+func TestService_TxReceipt(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	txHash := tx.Instructions.Hash()
+
+	resp, err := s.service().GetTxReceipt(&GetTxReceipt{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		TxHash:      txHash,
+	})
+	require.Nil(t, err)
+	receipt := resp.Receipt
+	require.Nil(t, receipt.Verify(scID, txHash))
+	require.True(t, receipt.Block.Index > 0)
+	// The receipt is bound to the skipchain.
+	require.NotNil(t, receipt.Verify(skipchain.SkipBlockID("unknown"), txHash))
+
+	// A transaction that wasn't included cannot be proven, even when
+	// replacing the included one in the receipt.
+	other, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, []byte("other"), s.signer)
+	require.Nil(t, err)
+	otherHash := other.Instructions.Hash()
+	require.NotNil(t, receipt.Verify(scID, otherHash))
+	receipt.TxHashes[receipt.Position] = otherHash
+	require.NotNil(t, receipt.Verify(scID, otherHash))
+	_, err = s.service().GetTxReceipt(&GetTxReceipt{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		TxHash:      otherHash,
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetChains(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scA := s.sb.SkipChainID()
+
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"spawn:dummy"},
+		s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = 2 * s.interval
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scB := resp.Skipblock.SkipChainID()
+
+	chains, err := s.service().GetChains()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(chains))
+	for _, c := range chains {
+		latest, err := s.service().db().GetLatestByID(c.SkipchainID)
+		require.Nil(t, err)
+		require.Equal(t, latest.Index, c.TipIndex)
+		require.Equal(t, len(s.roster.List), c.RosterSize)
+		switch {
+		case c.SkipchainID.Equal(scA):
+			require.Equal(t, s.interval, c.BlockInterval)
+		case c.SkipchainID.Equal(scB):
+			require.Equal(t, 2*s.interval, c.BlockInterval)
+		default:
+			t.Fatal("unknown skipchain")
+		}
+	}
+}
+
+func TestService_InstanceHistory(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// The genesis darc is created in the genesis block and then evolved
+	// twice, so it changes three times.
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	d3 := d2.Copy()
+	require.Nil(t, d3.EvolveFrom(d2))
+	s.testDarcEvolution(t, *d3, false)
+
+	resp, err := s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  InstanceID{s.darc.GetBaseID(), SubID{}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(resp.Entries))
+
+	require.Equal(t, 0, resp.Entries[0].BlockIndex)
+	require.Equal(t, Create, resp.Entries[0].StateAction)
+	require.Equal(t, Update, resp.Entries[1].StateAction)
+	require.Equal(t, Update, resp.Entries[2].StateAction)
+	require.True(t, resp.Entries[0].BlockIndex < resp.Entries[1].BlockIndex)
+	require.True(t, resp.Entries[1].BlockIndex < resp.Entries[2].BlockIndex)
+	for i, d := range []*darc.Darc{s.darc, d2, d3} {
+		dStored, err := darc.NewFromProtobuf(resp.Entries[i].Value)
+		require.Nil(t, err)
+		require.True(t, d.Equal(dStored))
+		require.NotNil(t, resp.Entries[i].InstructionHash)
+	}
+
+	// An unknown instance has no history.
+	resp, err = s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  InstanceID{darcidStr("unknown"), SubID{}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(resp.Entries))
+}
+
+func TestService_GetBlockChanges(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	darcID := InstanceID{s.darc.GetBaseID(), SubID{}}
+
+	// The genesis block creates the genesis darc and the config.
+	scs, err := s.service().GetBlockChanges(scID, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(scs))
+	for _, sc := range scs {
+		require.Equal(t, Create, sc.StateAction)
+	}
+
+	// The evolution of the darc is the only change of all the later blocks.
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	var changes StateChanges
+	for i := 1; i <= latest.Index; i++ {
+		scs, err = s.service().GetBlockChanges(scID, i)
+		require.Nil(t, err)
+		changes = append(changes, scs...)
+	}
+	require.Equal(t, 1, len(changes))
+	require.Equal(t, Update, changes[0].StateAction)
+	require.Equal(t, darcID.Slice(), changes[0].InstanceID)
+	dStored, err := darc.NewFromProtobuf(changes[0].Value)
+	require.Nil(t, err)
+	require.True(t, d2.Equal(dStored))
+
+	_, err = s.service().GetBlockChanges(scID, latest.Index+1)
+	require.NotNil(t, err)
+}
+
+func TestService_BlockChangesIndex(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	s.waitProof(t, tx.Instructions[0].InstanceID)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+
+	// The state changes are stored when the blocks are applied.
+	var stored []*blockChanges
+	for sb := s.sb; sb != nil; sb, err = s.service().nextBlock(sb) {
+		require.Nil(t, err)
+		changes, err := s.service().loadBlockChanges(sb.Hash)
+		require.Nil(t, err)
+		require.NotNil(t, changes)
+		stored = append(stored, changes)
+	}
+	require.Equal(t, latest.Index+1, len(stored))
+	history, err := s.service().instanceHistory(scID, tx.Instructions[0].InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(history))
+
+	// Missing changes are found again by executing the blocks.
+	clearIndex := func() {
+		db, name := s.service().GetAdditionalBucket(blockChangesBucket)
+		require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+			require.Nil(t, tx.DeleteBucket(name))
+			_, err := tx.CreateBucket(name)
+			return err
+		}))
+	}
+	clearIndex()
+	history2, err := s.service().instanceHistory(scID, tx.Instructions[0].InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, history, history2)
+	i := 0
+	for sb := s.sb; sb != nil; sb, err = s.service().nextBlock(sb) {
+		require.Nil(t, err)
+		changes, err := s.service().loadBlockChanges(sb.Hash)
+		require.Nil(t, err)
+		require.Equal(t, stored[i], changes)
+		i++
+	}
+
+	// Changes that don't give the root of their block are an error.
+	clearIndex()
+	wrong := stored[0].Instructions[0].StateChanges[0]
+	wrong.Value = []byte("wrong")
+	require.Nil(t, s.service().storeBlockChanges(s.sb.Hash, &blockChanges{
+		Instructions: []instructionChanges{{StateChanges{wrong}}},
+	}))
+	_, err = s.service().instanceHistory(scID, tx.Instructions[0].InstanceID)
+	require.NotNil(t, err)
+}
+
+func TestService_StreamBlockBody(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	var cts ClientTransactions
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		cts = append(cts, tx)
+		s.sendTx(t, tx)
+	}
+	for _, tx := range cts {
+		require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	}
+
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = scID
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	streamed := 0
+	withTxs := -1
+	for i := 0; i <= latest.Index; i++ {
+		resp, err := s.service().GetBlock(&GetBlock{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			Index:       i,
+		})
+		require.Nil(t, err)
+		_, bodyI, err := network.Unmarshal(resp.Skipblock.Payload, cothority.Suite)
+		require.Nil(t, err)
+		body := bodyI.(*DataBody)
+
+		txs, errs := s.service().StreamBlockBody(context.Background(), scID, i)
+		var got ClientTransactions
+		for tx := range txs {
+			got = append(got, tx)
+		}
+		require.Nil(t, <-errs)
+		require.Equal(t, len(body.Transactions), len(got))
+		require.Equal(t, body.Transactions.Hash(), got.Hash())
+		streamed += len(got)
+
+		// The client gets the same transactions a page at a time.
+		got = nil
+		require.Nil(t, c.StreamBlockBody(i, func(ct ClientTransaction) error {
+			got = append(got, ct)
+			return nil
+		}))
+		require.Equal(t, body.Transactions.Hash(), got.Hash())
+		if len(got) > 0 {
+			withTxs = i
+		}
+	}
+	require.True(t, streamed >= len(cts))
+	require.True(t, withTxs > 0)
+
+	// Pages hold at most Count transactions.
+	req := &GetBlockTransactions{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Index:       withTxs,
+		Count:       1,
+	}
+	var paged ClientTransactions
+	for {
+		resp, err := s.service().GetBlockTransactions(req)
+		require.Nil(t, err)
+		require.True(t, len(resp.Transactions) <= 1)
+		paged = append(paged, resp.Transactions...)
+		if !resp.More {
+			break
+		}
+		req.Start += len(resp.Transactions)
+	}
+	txs, errs := s.service().StreamBlockBody(context.Background(), scID, withTxs)
+	var all ClientTransactions
+	for tx := range txs {
+		all = append(all, tx)
+	}
+	require.Nil(t, <-errs)
+	require.Equal(t, all.Hash(), paged.Hash())
+
+	// Cancelling the stream stops it, even if the transactions are not read.
+	ctx, cancel := context.WithCancel(context.Background())
+	txs, errs = s.service().StreamBlockBody(ctx, scID, withTxs)
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+	for range txs {
+	}
+
+	txs, errs = s.service().StreamBlockBody(context.Background(), scID, latest.Index+1)
+	_, ok := <-txs
+	require.False(t, ok)
+	require.NotNil(t, <-errs)
+	_, err = s.service().GetBlockTransactions(&GetBlockTransactions{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Index:       latest.Index + 1,
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetOriginInstruction(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	found := false
+	for i := 1; i <= latest.Index; i++ {
+		scs, err := s.service().GetBlockChanges(scID, i)
+		require.Nil(t, err)
+		for j, sc := range scs {
+			if !bytes.Equal(sc.InstanceID, tx.Instructions[0].InstanceID.Slice()) {
+				continue
+			}
+			instr, err := s.service().GetOriginInstruction(scID, i, j)
+			require.Nil(t, err)
+			require.Equal(t, tx.Instructions[0].Hash(), instr.Hash())
+			require.Equal(t, 0, instr.Index)
+			found = true
+		}
+		_, err = s.service().GetOriginInstruction(scID, i, len(scs))
+		require.NotNil(t, err)
+	}
+	require.True(t, found)
+	_, err = s.service().GetOriginInstruction(scID, latest.Index+1, 0)
+	require.NotNil(t, err)
+}
+
+func TestService_DarcEvolveFreeze(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	coll := s.service().GetCollectionView(s.sb.SkipChainID())
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	delete(d2.Rules, "_evolve")
+	d2Buf, err := d2.ToProto()
+	require.Nil(t, err)
+	inst := Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), SubID{}},
+		Invoke: &Invoke{
+			Command: "evolve",
+			Args:    Arguments{{Name: "darc", Value: d2Buf}},
+		},
+	}
+	_, _, err = s.service().ContractDarc(coll, inst, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "allow_freeze")
+
+	inst.Invoke.Args = append(inst.Invoke.Args, Argument{Name: "allow_freeze", Value: []byte{1}})
+	_, _, err = s.service().ContractDarc(coll, inst, nil)
+	require.Nil(t, err)
+
+	d2.Rules["_evolve"] = expression.Expr("(")
+	require.NotNil(t, checkEvolvable(d2))
+	d2.Rules["_evolve"] = s.darc.Rules.GetEvolutionExpr()
+	require.Nil(t, checkEvolvable(d2))
+}
+
+func TestService_GetChangesSince(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	from, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	d3 := d2.Copy()
+	require.Nil(t, d3.EvolveFrom(d2))
+	s.testDarcEvolution(t, *d3, false)
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+
+	// The collection as seen by a client that synced up to from.
+	coll := collection.New(collection.Data{}, collection.Data{})
+	for i := 0; i <= from.Index; i++ {
+		scs, err := s.service().GetBlockChanges(scID, i)
+		require.Nil(t, err)
+		for _, sc := range scs {
+			require.Nil(t, storeInColl(coll, &sc))
+		}
+	}
+
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = scID
+	scs, tip, err := c.GetChangesSince(from.Index)
+	require.Nil(t, err)
+	require.True(t, tip.Index > from.Index)
+	for _, sc := range scs {
+		require.Nil(t, storeInColl(coll, &sc))
+	}
+	_, headerI, err := network.Unmarshal(tip.Data, cothority.Suite)
+	require.Nil(t, err)
+	require.Equal(t, headerI.(*DataHeader).CollectionRoot, coll.GetRoot())
+
+	// Nothing changed since the tip.
+	scs, _, err = s.service().changesSince(scID, tip.Index)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(scs))
+	_, _, err = s.service().changesSince(scID, tip.Index+1)
+	require.NotNil(t, err)
+}
+
+func TestService_Archive(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	dir, err := ioutil.TempDir("", "archive")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.NotNil(t, s.service().EnableArchive(dir+"/archive.db", 0))
+	require.Nil(t, s.service().EnableArchive(dir+"/archive.db", 1))
+	defer s.service().CloseArchive()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	d3 := d2.Copy()
+	require.Nil(t, d3.EvolveFrom(d2))
+	s.testDarcEvolution(t, *d3, false)
+
+	latest, err := s.service().db().GetLatestByID(s.sb.SkipChainID())
+	require.Nil(t, err)
+	require.True(t, latest.Index >= 2)
+
+	// The genesis block must be served from the archive.
+	a := s.service().getArchive()
+	require.True(t, a.archived(0, latest.Index))
+	sb, err := a.get(s.sb.SkipChainID(), 0)
+	require.Nil(t, err)
+	require.True(t, sb.Hash.Equal(s.sb.Hash))
+
+	resp, err := s.service().GetBlock(&GetBlock{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Index:       0,
+	})
+	require.Nil(t, err)
+	require.True(t, resp.Skipblock.Hash.Equal(s.sb.Hash))
+
+	// The latest block is not archived.
+	resp, err = s.service().GetBlock(&GetBlock{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Index:       latest.Index,
+	})
+	require.Nil(t, err)
+	require.True(t, resp.Skipblock.Hash.Equal(latest.Hash))
+	_, err = a.get(s.sb.SkipChainID(), latest.Index)
+	require.NotNil(t, err)
+
+	_, err = s.service().GetBlock(&GetBlock{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Index:       latest.Index + 1,
+	})
+	require.NotNil(t, err)
+
+	// The archival doesn't change the state.
+	_, headerI, err := network.Unmarshal(latest.Data, cothority.Suite)
+	require.Nil(t, err)
+	require.Equal(t, headerI.(*DataHeader).CollectionRoot,
+		s.service().getCollection(s.sb.SkipChainID()).RootHash())
+
+	// Once the chain is longer than the depth and the base height, the
+	// blocks of height 1 are removed from the skipchain database.
+	var tx ClientTransaction
+	for latest.Index < 1+s.sb.BaseHeight+2 {
+		tx, err = createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		s.sendTx(t, tx)
+		s.waitProof(t, tx.Instructions[0].InstanceID)
+		latest, err = s.service().db().GetLatestByID(s.sb.SkipChainID())
+		require.Nil(t, err)
+	}
+	var removed int
+	for i := 1; i < latest.Index; i++ {
+		resp, err = s.service().GetBlock(&GetBlock{
+			Version:     CurrentVersion,
+			SkipchainID: s.sb.SkipChainID(),
+			Index:       i,
+		})
+		require.Nil(t, err)
+		require.Equal(t, i, resp.Skipblock.Index)
+		if s.service().db().GetByID(resp.Skipblock.Hash) == nil {
+			require.Equal(t, 1, resp.Skipblock.Height)
+			removed++
+		}
+	}
+	require.True(t, removed > 0)
+	require.NotNil(t, s.service().db().GetByID(s.sb.Hash))
+
+	// The proofs and the replay of the chain still work.
+	pr, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      s.sb.SkipChainID(),
+		Key:     tx.Instructions[0].InstanceID.Slice(),
+	})
+	require.Nil(t, err)
+	require.Nil(t, pr.Proof.Verify(s.sb.SkipChainID()))
+	_, err = s.service().instanceHistory(s.sb.SkipChainID(), tx.Instructions[0].InstanceID)
+	require.Nil(t, err)
+}
+
+func TestService_ExportImportChain(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, s.service().ExportChain(scID, buf))
+	archive := buf.Bytes()
+
+	// A fresh node without any skipchain.
+	s2 := newSer(t, 0, testInterval)
+	defer s2.local.CloseAll()
+	require.Nil(t, s2.service().ImportChain(bytes.NewReader(archive)))
+
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	latest2, err := s2.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.True(t, latest.Equal(latest2))
+	require.Equal(t, s.service().getCollection(scID).RootHash(),
+		s2.service().getCollection(scID).RootHash())
+	d, err := s2.service().LoadGenesisDarc(scID)
+	require.Nil(t, err)
+	require.True(t, d.Equal(d2))
+
+	// The skipchain is known now.
+	require.NotNil(t, s2.service().ImportChain(bytes.NewReader(archive)))
+}
+
+func TestService_ImportCheckpoint(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	d3 := d2.Copy()
+	require.Nil(t, d3.EvolveFrom(d2))
+	s.testDarcEvolution(t, *d3, false)
+
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	pinned := s.service().db().GetByID(latest.BackLinkIDs[0])
+	require.NotEqual(t, 0, pinned.Index)
+	buf := &bytes.Buffer{}
+	require.Nil(t, s.service().ExportCheckpoint(scID, pinned.Index, buf))
+	checkpoint := buf.Bytes()
+
+	// A fresh node that only trusts the pinned block.
+	s2 := newSer(t, 0, testInterval)
+	defer s2.local.CloseAll()
+	require.NotNil(t, s2.service().ImportCheckpoint(bytes.NewReader(checkpoint), latest.Hash))
+	require.Nil(t, s2.service().ImportCheckpoint(bytes.NewReader(checkpoint), pinned.Hash))
+	require.Nil(t, s2.service().db().GetByID(pinned.BackLinkIDs[0]))
+	latest2, err := s2.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.True(t, latest.Hash.Equal(latest2.Hash))
+	require.Equal(t, s.service().getCollection(scID).RootHash(),
+		s2.service().getCollection(scID).RootHash())
+	d, err := s2.service().LoadGenesisDarc(scID)
+	require.Nil(t, err)
+	require.True(t, d.Equal(d3))
+
+	// The following blocks are processed like on any other node.
+	d4 := d3.Copy()
+	require.Nil(t, d4.EvolveFrom(d3))
+	s.testDarcEvolution(t, *d4, false)
+	next, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	_, err = s2.service().db().StoreBlocks([]*skipchain.SkipBlock{
+		s.service().db().GetByID(latest.Hash), next})
+	require.Nil(t, err)
+	s2.service().updateCollection(&updateCollection{next.Hash})
+	require.Equal(t, s.service().getCollection(scID).RootHash(),
+		s2.service().getCollection(scID).RootHash())
+	d, err = s2.service().LoadGenesisDarc(scID)
+	require.Nil(t, err)
+	require.True(t, d.Equal(d4))
+}
+
+func TestService_TransactionSignature(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	n := 2
+	ct := ClientTransaction{}
+	for i := 0; i < n; i++ {
+		instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		instr.Index = i
+		instr.Length = n
+		instr.Signatures = nil
+		ct.Instructions = append(ct.Instructions, instr)
+	}
+	scID := s.sb.SkipChainID()
+
+	// Unsigned instructions are refused.
+	require.NotNil(t, s.service().verifyClientTx(scID, ct))
+
+	// A signature of an unknown signer is refused.
+	require.Nil(t, ct.SignBy(darc.NewSignerEd25519(nil, nil)))
+	require.NotNil(t, s.service().verifyClientTx(scID, ct))
+
+	// One signature authorizes all instructions.
+	require.Nil(t, ct.SignBy(s.signer))
+	require.Nil(t, s.service().verifyClientTx(scID, ct))
+
+	// Instructions must not be signed twice.
+	signed := ct
+	signed.Instructions = append(Instructions{}, ct.Instructions...)
+	require.Nil(t, signed.Instructions[0].SignBy(s.signer))
+	require.NotNil(t, s.service().verifyClientTx(scID, signed))
+
+	// Tampering with any instruction invalidates the signature.
+	tampered := ct
+	tampered.Instructions = append(Instructions{}, ct.Instructions...)
+	tampered.Instructions[1].Spawn = &Spawn{
+		ContractID: dummyKind,
+		Args:       Arguments{{Name: "data", Value: []byte("tampered")}},
+	}
+	require.NotNil(t, s.service().verifyClientTx(scID, tampered))
+
+	s.sendTx(t, ct)
+	for _, instr := range ct.Instructions {
+		pr := s.waitProof(t, instr.InstanceID)
+		require.True(t, pr.InclusionProof.Match())
+	}
+}
+
+func TestService_StrictArguments(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	strictKind := "strict"
+	RegisterContract(s.hosts[0], strictKind, dummyContractFunc)
+	cv := s.service().GetCollectionView(s.sb.SkipChainID())
+
+	instr, err := createInstr(s.darc.GetBaseID(), strictKind, s.value, s.signer)
+	require.Nil(t, err)
+	instr.Spawn.Args = append(instr.Spawn.Args, Argument{Name: "typo", Value: []byte{}})
+
+	// Without a schema, or with a non-strict one, the unknown argument is
+	// ignored.
+	_, _, err = s.service().executeInstruction(cv, nil, instr)
+	require.Nil(t, err)
+	require.Nil(t, RegisterContractSchema(s.hosts[0], strictKind,
+		ContractSchema{Arguments: []string{"data"}}))
+	_, _, err = s.service().executeInstruction(cv, nil, instr)
+	require.Nil(t, err)
+
+	// In strict mode it is rejected.
+	require.Nil(t, RegisterContractSchema(s.hosts[0], strictKind,
+		ContractSchema{Arguments: []string{"data"}, Strict: true}))
+	_, _, err = s.service().executeInstruction(cv, nil, instr)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "typo")
+
+	// But declared arguments are still accepted.
+	instr.Spawn.Args = instr.Spawn.Args[:1]
+	_, _, err = s.service().executeInstruction(cv, nil, instr)
+	require.Nil(t, err)
+}
+
+func TestService_FieldProof(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContract(h, structKind, structContractFunc))
+		require.Nil(t, RegisterContractFields(h, structKind, []string{"name", "data", "owner"}))
+	}
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.AddRule("spawn:"+structKind, d2.Rules.GetSignExpr()))
+	s.testDarcEvolution(t, *d2, false)
+
+	data := make([]byte, 10000)
+	instr, err := createInstr(s.darc.GetBaseID(), structKind, nil, s.signer)
+	require.Nil(t, err)
+	instr.Spawn.Args = Arguments{{Name: "name", Value: []byte("big")}, {Name: "data", Value: data},
+		{Name: "owner", Value: []byte("me")}}
+	require.Nil(t, instr.SignBy(s.signer))
+	s.sendTx(t, ClientTransaction{Instructions: []Instruction{instr}})
+	full := s.waitProof(t, instr.InstanceID)
+	require.True(t, full.InclusionProof.Match())
+
+	// The fields are not instances of the contract.
+	ids, _, err := s.service().ContractInstances(scID, structKind)
+	require.Nil(t, err)
+	require.Equal(t, []InstanceID{instr.InstanceID}, ids)
+	size, err := s.service().getCollection(scID).StorageByContract(structKind)
+	require.Nil(t, err)
+	require.True(t, size < len(data))
+
+	resp, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		Key:     instr.InstanceID.Slice(),
+		ID:      scID,
+		Field:   "name",
+	})
+	require.Nil(t, err)
+	value, err := resp.Proof.VerifyField(scID, instr.InstanceID, "name")
+	require.Nil(t, err)
+	require.Equal(t, []byte("big"), value)
+	_, err = resp.Proof.VerifyField(scID, instr.InstanceID, "data")
+	require.NotNil(t, err)
+	fieldBuf, err := protobuf.Encode(&resp.Proof)
+	require.Nil(t, err)
+	require.True(t, len(fieldBuf) < len(data))
+
+	// A changed field doesn't match the root in the value of the instance.
+	resp.Proof.Field.Value = []byte("small")
+	_, err = resp.Proof.VerifyField(scID, instr.InstanceID, "name")
+	require.NotNil(t, err)
+	for _, field := range []string{"data", "owner"} {
+		resp, err = s.service().GetProof(&GetProof{
+			Version: CurrentVersion,
+			Key:     instr.InstanceID.Slice(),
+			ID:      scID,
+			Field:   field,
+		})
+		require.Nil(t, err)
+		_, err = resp.Proof.VerifyField(scID, instr.InstanceID, field)
+		require.Nil(t, err)
+	}
+
+	// Undeclared fields cannot be proven.
+	_, err = s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		Key:     instr.InstanceID.Slice(),
+		ID:      scID,
+		Field:   "other",
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_DarcSpawn(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	id := []darc.Identity{s.signer.Identity()}
+	darc2 := darc.NewDarc(darc.InitRulesWith(id, id, invokeEvolve),
+		[]byte("next darc"))
+	darc2.Rules.AddRule("spawn:rain", darc2.Rules.GetSignExpr())
+	darc2Buf, err := darc2.ToProto()
+	require.Nil(t, err)
+	darc2Copy, err := darc.NewFromProtobuf(darc2Buf)
+	require.Nil(t, err)
+	require.True(t, darc2.Equal(darc2Copy))
+
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  SubID{},
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args: []Argument{{
+					Name:  "darc",
+					Value: darc2Buf,
+				}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+
+	s.sendTx(t, ctx)
+	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
+	require.True(t, pr.InclusionProof.Match())
+}
+
+func TestService_InstanceOrigin(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	id := []darc.Identity{s.signer.Identity()}
+	darc2 := darc.NewDarc(darc.InitRulesWith(id, id, invokeEvolve),
+		[]byte("origin darc"))
+	darc2Buf, err := darc2.ToProto()
+	require.Nil(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  SubID{},
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args:       []Argument{{Name: "darc", Value: darc2Buf}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
+	require.True(t, pr.InclusionProof.Match())
+
+	// The genesis darc comes from the genesis block, the new darc from
+	// the block with the spawn instruction.
+	resp, err := s.service().GetInstanceOrigin(&GetInstanceOrigin{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  InstanceID{s.darc.GetBaseID(), SubID{}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, resp.BlockIndex)
+	require.NotNil(t, resp.InstructionHash)
+
+	resp, err = s.service().GetInstanceOrigin(&GetInstanceOrigin{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  InstanceID{darc2.GetBaseID(), SubID{}},
+	})
+	require.Nil(t, err)
+	require.True(t, resp.BlockIndex > 0)
+	require.True(t, resp.BlockIndex <= pr.Latest.Index)
+	require.Equal(t, ctx.Instructions[0].Hash(), resp.InstructionHash)
+
+	_, err = s.service().GetInstanceOrigin(&GetInstanceOrigin{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  InstanceID{darcidStr("unknown"), SubID{}},
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetLastModifier(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	iID := InstanceID{s.darc.GetBaseID(), SubID{}}
+	lastModifier := func() *GetLastModifierResponse {
+		resp, err := s.service().GetLastModifier(&GetLastModifier{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			InstanceID:  iID,
+		})
+		require.Nil(t, err)
+		return resp
+	}
+	resp := lastModifier()
+	require.Equal(t, 0, resp.BlockIndex)
+
+	// The genesis darc is evolved by its owner, who hands it over to
+	// signer2, who then evolves it again.
+	signer2 := darc.NewSignerEd25519(nil, nil)
+	expr := expression.InitOrExpr(signer2.Identity().String())
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.UpdateRule("invoke:evolve", expr))
+	require.Nil(t, d2.Rules.UpdateEvolution(expr))
+	s.testDarcEvolution(t, *d2, false)
+	first := lastModifier()
+	require.True(t, first.BlockIndex > 0)
+	require.Equal(t, []darc.Identity{s.signer.Identity()}, first.Signers)
+	require.True(t, first.Timestamp > resp.Timestamp)
+
+	d3 := d2.Copy()
+	require.Nil(t, d3.EvolveFrom(d2))
+	s.sendTx(t, darcToTx(t, *d3, signer2))
+	for i := 0; i < 10; i++ {
+		resp = lastModifier()
+		if resp.BlockIndex > first.BlockIndex {
+			break
+		}
+		time.Sleep(s.interval)
+	}
+	require.True(t, resp.BlockIndex > first.BlockIndex)
+	require.Equal(t, []darc.Identity{signer2.Identity()}, resp.Signers)
+	require.True(t, resp.Timestamp >= first.Timestamp)
+
+	_, err := s.service().GetLastModifier(&GetLastModifier{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		InstanceID:  InstanceID{darcidStr("unknown"), SubID{}},
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_DecodeState(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// The darc contract registers its state.
+	value, cid, err := s.service().GetCollectionView(s.sb.SkipChainID()).GetValues(
+		InstanceID{s.darc.GetBaseID(), SubID{}}.Slice())
+	require.Nil(t, err)
+	state, err := s.service().DecodeState(cid, value)
+	require.Nil(t, err)
+	d, ok := state.(*darc.Darc)
+	require.True(t, ok)
+	require.True(t, d.Equal(s.darc))
+
+	type dummyState struct {
+		Name  string
+		Count int
+	}
+	require.NotNil(t, RegisterContractState(s.hosts[0], dummyKind, "not a struct"))
+	_, err = s.service().DecodeState(dummyKind, value)
+	require.NotNil(t, err)
+
+	require.Nil(t, RegisterContractState(s.hosts[0], dummyKind, &dummyState{}))
+	buf, err := protobuf.Encode(&dummyState{"dummy", 42})
+	require.Nil(t, err)
+	state, err = s.service().DecodeState(dummyKind, buf)
+	require.Nil(t, err)
+	require.Equal(t, &dummyState{"dummy", 42}, state)
+}
+
+func TestService_EstimateInclusionDelay(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	// Stop polling so that the buffer is not emptied by the leader.
+	s.service().TestClose()
+
+	_, err := s.service().EstimateInclusionDelay(skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+
+	scID := s.sb.SkipChainID()
+	blocks, err := s.service().EstimateInclusionDelay(scID)
+	require.Nil(t, err)
+	require.Equal(t, 1, blocks)
+
+	for i := 0; i < maxTxsPerBlock; i++ {
+		s.service().txBuffer.add(string(scID), s.tx)
+	}
+	larger, err := s.service().EstimateInclusionDelay(scID)
+	require.Nil(t, err)
+	require.True(t, larger > blocks)
+}
+
+func TestService_CheckAuthorization(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	iID := InstanceID{s.darc.GetBaseID(), SubID{}}
+
+	ok, err := s.service().CheckAuthorization(scID, iID, "spawn:dummy", s.signer.Identity())
+	require.Nil(t, err)
+	require.True(t, ok)
+	other := darc.NewSignerEd25519(nil, nil)
+	ok, err = s.service().CheckAuthorization(scID, iID, "spawn:dummy", other.Identity())
+	require.Nil(t, err)
+	require.False(t, ok)
+	// An action without a rule is not authorized.
+	ok, err = s.service().CheckAuthorization(scID, iID, "spawn:unknown", s.signer.Identity())
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	_, err = s.service().CheckAuthorization(scID, InstanceID{darcidStr("unknown"), SubID{}},
+		"spawn:dummy", s.signer.Identity())
+	require.NotNil(t, err)
+}
+
+func TestEffectiveRules(t *testing.T) {
+	coll := collection.New(collection.Data{}, collection.Data{})
+	storeDarc := func(sa StateAction, d *darc.Darc) {
+		buf, err := d.ToProto()
+		require.Nil(t, err)
+		require.Nil(t, storeInColl(coll, &StateChange{
+			StateAction: sa,
+			InstanceID:  InstanceID{d.GetBaseID(), SubID{}}.Slice(),
+			ContractID:  []byte(ContractDarcID),
+			Value:       buf,
+		}))
+	}
+	newDarc := func(sign expression.Expr, desc string) *darc.Darc {
+		owner := darc.NewSignerEd25519(nil, nil).Identity()
+		d := darc.NewDarc(darc.InitRules([]darc.Identity{owner}, nil), []byte(desc))
+		require.Nil(t, d.Rules.UpdateSign(sign))
+		return d
+	}
+	alice := darc.NewSignerEd25519(nil, nil).Identity().String()
+	bob := darc.NewSignerEd25519(nil, nil).Identity().String()
+	carol := darc.NewSignerEd25519(nil, nil).Identity().String()
+
+	// The instance is governed by top, which delegates to middle, which
+	// delegates to leaf.
+	leaf := newDarc(expression.Expr(alice), "leaf")
+	middle := newDarc(expression.InitOrExpr(leaf.GetIdentityString(), bob), "middle")
+	top := newDarc(expression.Expr(carol), "top")
+	require.Nil(t, top.Rules.AddRule("spawn:dummy",
+		expression.InitAndExpr(middle.GetIdentityString(), carol)))
+	storeDarc(Create, leaf)
+	storeDarc(Create, middle)
+	storeDarc(Create, top)
+	iID := InstanceID{top.GetBaseID(), NewSubID([]byte("instance"))}
+
+	rules, err := EffectiveRules(&roCollection{coll}, iID)
+	require.Nil(t, err)
+	require.Equal(t, "(("+alice+") | "+bob+") & "+carol, string(rules["spawn:dummy"]))
+	require.Equal(t, carol, string(rules["_sign"]))
+	require.Equal(t, top.Rules.GetEvolutionExpr(), rules["_evolve"])
+	ok, err := expression.DefaultParser(rules["spawn:dummy"], alice, carol)
+	require.Nil(t, err)
+	require.True(t, ok)
+	ok, err = expression.DefaultParser(rules["spawn:dummy"], alice, bob)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// A delegation cycle is an error.
+	require.Nil(t, leaf.Rules.UpdateSign(expression.Expr(middle.GetIdentityString())))
+	storeDarc(Update, leaf)
+	_, err = EffectiveRules(&roCollection{coll}, iID)
+	require.NotNil(t, err)
+
+	_, err = EffectiveRules(&roCollection{coll}, InstanceID{darcidStr("unknown"), SubID{}})
+	require.NotNil(t, err)
+}
+
+func TestService_WildcardRule(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("wildcard darc"))
+	require.Nil(t, d.Rules.AddRule("invoke:coin.*", d.Rules.GetSignExpr()))
+
+	verify := func(command, contractID string) error {
+		instr := Instruction{
+			InstanceID: InstanceID{DarcID: d.GetBaseID()},
+			Invoke:     &Invoke{Command: command},
+			Length:     1,
+		}
+		require.Nil(t, instr.SignBy(signer))
+		req, err := instr.ToDarcRequest()
+		require.Nil(t, err)
+		require.Nil(t, req.VerifySignatures())
+		req.Action = ruleAction(d, req.Action, contractID)
+		return req.VerifyIdentitiesWithCB(d, nil)
+	}
+	// All the commands of the coin contract are authorized.
+	require.Nil(t, verify("transfer", "coin"))
+	require.Nil(t, verify("mint", "coin"))
+	// Commands of other contracts are not.
+	require.NotNil(t, verify("transfer", "othercoin"))
+	require.NotNil(t, verify("transfer", ""))
+}
+
+func TestService_SkipchainBoundInstruction(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// A second skipchain with the same genesis darc.
+	resp, err := s.service().CreateGenesisBlock(&CreateGenesisBlock{
+		Version:       CurrentVersion,
+		Roster:        *s.roster,
+		GenesisDarc:   *s.darc,
+		BlockInterval: s.interval,
+	})
+	require.Nil(t, err)
+	scA := s.sb.SkipChainID()
+	scB := resp.Skipblock.SkipChainID()
+
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	// Instructions that are not bound are accepted on both skipchains.
+	require.Nil(t, s.service().verifyInstruction(scA, instr, nil))
+	require.Nil(t, s.service().verifyInstruction(scB, instr, nil))
+
+	instr.SkipchainID = scA
+	require.Nil(t, instr.SignBy(s.signer))
+	require.Nil(t, s.service().verifyInstruction(scA, instr, nil))
+	require.NotNil(t, s.service().verifyInstruction(scB, instr, nil))
+
+	// The signature for skipchain A doesn't verify once it is bound to B.
+	instr.SkipchainID = scB
+	require.NotNil(t, s.service().verifyInstruction(scB, instr, nil))
+}
+
+func TestService_ExportImportInstance(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scA := s.sb.SkipChainID()
+
+	// Skipchain B only allows to import instances and to update its
+	// config.
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster,
+		[]string{"invoke:" + CmdDarcSpawnImported, "invoke:update_config"}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = s.interval
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	scB := resp.Skipblock.SkipChainID()
+	darcB := genesisMsg.GenesisDarc.GetBaseID()
+	send := func(scID skipchain.SkipBlockID, instr Instruction) {
+		require.Nil(t, instr.SignBy(s.signer))
+		_, err := s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   ClientTransaction{Instructions: []Instruction{instr}},
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+	}
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	srcID := tx.Instructions[0].InstanceID
+	require.True(t, s.waitProof(t, srcID).InclusionProof.Match())
+
+	// The instance has to be locked for B before it can be exported.
+	_, err = s.service().ExportInstance(scA, srcID)
+	require.NotNil(t, err)
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.AddRule(darc.Action("invoke:"+CmdDarcLockExport), s.darc.Rules.GetSignExpr()))
+	s.testDarcEvolution(t, *d2, false)
+	send(scA, Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), SubID{}},
+		Nonce:      GenNonce(),
+		Length:     1,
+		Invoke: &Invoke{
+			Command: CmdDarcLockExport,
+			Args: Arguments{
+				{Name: "instance", Value: srcID.Slice()},
+				{Name: "destination", Value: scB},
+			},
+		},
+	})
+	_, contractID, err := s.service().GetCollectionView(scA).GetValues(srcID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, ContractExportedID, contractID)
+
+	export, err := s.service().ExportInstance(scA, srcID)
+	require.Nil(t, err)
+	scID, iID, _, contractID, err := export.Verify()
+	require.Nil(t, err)
+	require.True(t, scID.Equal(scA))
+	require.True(t, iID.Equal(srcID))
+	require.Equal(t, ContractExportedID, contractID)
+	_, err = s.service().ExportInstance(scA, InstanceID{s.darc.GetBaseID(), genSubID()})
+	require.NotNil(t, err)
+
+	importInstr := func(e *InstanceExport, source skipchain.SkipBlockID) Instruction {
+		buf, err := protobuf.Encode(e)
+		require.Nil(t, err)
+		instr := Instruction{
+			InstanceID: InstanceID{darcB, SubID{}},
+			Nonce:      GenNonce(),
+			Index:      0,
+			Length:     1,
+			Invoke: &Invoke{
+				Command: CmdDarcSpawnImported,
+				Args: Arguments{
+					{Name: "instance", Value: buf},
+					{Name: "source", Value: source},
+				},
+			},
+		}
+		require.Nil(t, instr.SignBy(s.signer))
+		return instr
+	}
+	viewB := func() CollectionView { return s.service().GetCollectionView(scB) }
+
+	// A is not a source of B yet.
+	_, _, err = s.service().ContractDarc(viewB(), importInstr(export, scA), nil)
+	require.NotNil(t, err)
+	config, err := s.service().LoadConfig(scB)
+	require.Nil(t, err)
+	config.ImportSources = []skipchain.SkipBlockID{scA}
+	config.ConfigVersion++
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	send(scB, Instruction{
+		InstanceID: InstanceID{darcB, oneSubID},
+		Nonce:      GenNonce(),
+		Length:     1,
+		Invoke: &Invoke{
+			Command: "update_config",
+			Args:    Arguments{{Name: "config", Value: configBuf}},
+		},
+	})
+
+	// Proofs that don't link the genesis block of A to the instance, or
+	// that are not from the source, are refused.
+	bad := *export
+	bad.Proof.Links = export.Proof.Links[:1]
+	_, _, err = s.service().ContractDarc(viewB(), importInstr(&bad, scA), nil)
+	require.NotNil(t, err)
+	bad = *export
+	bad.Genesis = *resp.Skipblock
+	_, _, err = s.service().ContractDarc(viewB(), importInstr(&bad, scA), nil)
+	require.NotNil(t, err)
+	_, _, err = s.service().ContractDarc(viewB(), importInstr(export, scB), nil)
+	require.NotNil(t, err)
+
+	send(scB, importInstr(export, scA))
+	newID := InstanceID{darcB, srcID.SubID}
+	value, contractID, err := viewB().GetValues(newID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, s.value, value)
+	require.Equal(t, dummyKind, contractID)
+
+	// The instance can only be imported once.
+	_, _, err = s.service().ContractDarc(viewB(), importInstr(export, scA), nil)
+	require.NotNil(t, err)
+}
+
+func TestService_FutureBlockReference(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.True(t, latest.Index > 0)
+
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	instr.BlockIndex = latest.Index
+	require.Nil(t, instr.SignBy(s.signer))
+	require.Nil(t, s.service().verifyInstruction(scID, instr, nil))
+
+	// The next block is not committed yet.
+	instr.BlockIndex = latest.Index + 1
+	require.Nil(t, instr.SignBy(s.signer))
+	require.Equal(t, ErrFutureBlock, s.service().verifyInstruction(scID, instr, nil))
+}
+
+func TestService_PreAuthorization(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	instr.Signatures = nil
+	instr.Nonce = Nonce{5}
+
+	// The client signs the template and hands it to the relay.
+	pa := &PreAuthorization{
+		Action:     "spawn:" + dummyKind,
+		InstanceID: instr.InstanceID,
+		NonceMin:   Nonce{1},
+		NonceMax:   Nonce{10},
+	}
+	require.Nil(t, pa.SignBy(s.signer))
+
+	// The relay fills in the arguments of a conforming instruction.
+	instr.Spawn.Args = Arguments{{Name: "data", Value: []byte("relayed")}}
+	instr.PreAuthorization = pa
+	require.Nil(t, s.service().verifyInstruction(scID, instr, nil))
+
+	// A nonce outside of the range is refused.
+	bad := instr
+	bad.Nonce = Nonce{11}
+	require.NotNil(t, s.service().verifyInstruction(scID, bad, nil))
+
+	// Another action is refused.
+	bad = instr
+	bad.Spawn = nil
+	bad.Delete = &Delete{}
+	require.NotNil(t, s.service().verifyInstruction(scID, bad, nil))
+
+	// A token bound to another skipchain is refused.
+	other := *pa
+	other.SkipchainID = skipchain.SkipBlockID("other")
+	require.Nil(t, other.SignBy(s.signer))
+	bad = instr
+	bad.PreAuthorization = &other
+	require.NotNil(t, s.service().verifyInstruction(scID, bad, nil))
+
+	// A token signed by an unknown signer is refused.
+	unknown := *pa
+	require.Nil(t, unknown.SignBy(darc.NewSignerEd25519(nil, nil)))
+	bad = instr
+	bad.PreAuthorization = &unknown
+	require.NotNil(t, s.service().verifyInstruction(scID, bad, nil))
+
+	s.sendTx(t, ClientTransaction{Instructions: Instructions{instr}})
+	pr := s.waitProof(t, instr.InstanceID)
+	require.True(t, pr.InclusionProof.Match())
+}
+
+func TestService_InstanceTTL(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	ttlBuf := make([]byte, binary.MaxVarintLen64)
+	ttlBuf = ttlBuf[:binary.PutVarint(ttlBuf, 1)]
+	instr := Instruction{
+		InstanceID: InstanceID{
+			DarcID: s.darc.GetBaseID(),
+			SubID:  genSubID(),
+		},
+		Nonce:  GenNonce(),
+		Length: 1,
+		Spawn: &Spawn{
+			ContractID: dummyKind,
+			Args: Arguments{
+				{Name: "data", Value: s.value},
+				{Name: ttlArgument, Value: ttlBuf},
+			},
+		},
+	}
+	require.Nil(t, instr.SignBy(s.signer))
+	s.sendTx(t, ClientTransaction{Instructions: []Instruction{instr}})
+	require.True(t, s.waitProof(t, instr.InstanceID).InclusionProof.Match())
+
+	// The instance is removed in the first block after its TTL.
+	time.Sleep(2 * time.Second)
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	resp, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		Key:     instr.InstanceID.Slice(),
+		ID:      s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.False(t, resp.Proof.InclusionProof.Match())
+}
+
+func TestExpiry_Buckets(t *testing.T) {
+	coll := collection.New(collection.Data{}, collection.Data{})
+	genesisDarcID := darcidStr("genesis")
+	ref := NewStateChange(Create, GenesisReferenceID, ContractConfigID, genesisDarcID)
+	require.Nil(t, storeInColl(coll, &ref))
+	view := &roCollection{coll}
+
+	// spawn stores an instance living for ttl seconds after the block at
+	// timestamp 1000.
+	spawn := func(ttl int64) InstanceID {
+		ttlBuf := make([]byte, binary.MaxVarintLen64)
+		ttlBuf = ttlBuf[:binary.PutVarint(ttlBuf, ttl)]
+		iID := InstanceID{genesisDarcID, genSubID()}
+		instr := Instruction{
+			InstanceID: iID,
+			Spawn:      &Spawn{ContractID: dummyKind, Args: Arguments{{Name: ttlArgument, Value: ttlBuf}}},
+		}
+		scs, err := addExpiries(view, instr, StateChanges{NewStateChange(Create, iID, dummyKind, nil)}, 1000)
+		require.Nil(t, err)
+		for _, sc := range scs {
+			require.Nil(t, storeInColl(coll, &sc))
+		}
+		return iID
+	}
+	late := spawn(10 * expiryBucketSeconds)
+	early := spawn(1)
+	sameBucket := spawn(2)
+	r, _, exists, err := loadExpiryRange(view)
+	require.Nil(t, err)
+	require.True(t, exists)
+	require.Equal(t, expiryBucket(1001), r.First)
+	require.Equal(t, expiryBucket(1000+10*expiryBucketSeconds), r.Last)
+
+	// Every bucket only holds the instances expiring in it.
+	ie, ok, err := loadExpiryBucket(view, expiryBucketID(genesisDarcID, r.First))
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, 2, len(ie.Expiries))
+
+	// expire applies the removals at timestamp and returns the instances
+	// that are still there.
+	expire := func(timestamp int64) (left []InstanceID) {
+		scs, err := expireInstancesScs(view, timestamp)
+		require.Nil(t, err)
+		for _, sc := range scs {
+			require.Nil(t, storeInColl(coll, &sc))
+		}
+		for _, iID := range []InstanceID{early, sameBucket, late} {
+			if _, _, err := view.GetValues(iID.Slice()); err == nil {
+				left = append(left, iID)
+			}
+		}
+		return
+	}
+	require.Equal(t, []InstanceID{sameBucket, late}, expire(1001))
+	require.Equal(t, []InstanceID{late}, expire(1002))
+	r, _, exists, err = loadExpiryRange(view)
+	require.Nil(t, err)
+	require.True(t, exists)
+	require.Equal(t, expiryBucket(1000+10*expiryBucketSeconds), r.First)
+	_, ok, err = loadExpiryBucket(view, expiryBucketID(genesisDarcID, expiryBucket(1001)))
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Once the last instance expired, no expiry time is left.
+	require.Equal(t, 0, len(expire(1000+10*expiryBucketSeconds)))
+	_, _, exists, err = loadExpiryRange(view)
+	require.Nil(t, err)
+	require.False(t, exists)
+	_, err = expireInstancesScs(view, 2000)
+	require.NotNil(t, err)
+}
+
+func TestService_GetConsistentProofs(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	scID := s.sb.SkipChainID()
+	keys := [][]byte{
+		s.tx.Instructions[0].InstanceID.Slice(),
+		InstanceID{s.darc.GetBaseID(), SubID{}}.Slice(),
+		InstanceID{s.darc.GetBaseID(), oneSubID}.Slice(),
+	}
+
+	// Commit new blocks while the proofs are read.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+			if err == nil {
+				_, err = s.service().AddTransaction(&AddTxRequest{
+					Version:     CurrentVersion,
+					SkipchainID: scID,
+					Transaction: tx,
+				})
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(s.interval)
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		proofs, err := s.service().GetConsistentProofs(scID, keys)
+		require.Nil(t, err)
+		require.Equal(t, len(keys), len(proofs))
+		for _, p := range proofs {
+			require.True(t, p.Latest.Hash.Equal(proofs[0].Latest.Hash))
+			require.Nil(t, p.Verify(scID))
+			require.True(t, p.InclusionProof.Match())
+		}
+		time.Sleep(s.interval / 10)
+	}
+}
+
+func TestService_DarcSpawnOther(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	inst := Instruction{
+		InstanceID: InstanceID{
+			DarcID: s.darc.GetBaseID(),
+			SubID:  SubID{},
+		},
+		Spawn: &Spawn{
+			ContractID: dummyKind,
+			Args:       []Argument{{Name: "data", Value: []byte("dummy")}},
+		},
+	}
+
+	// Spawning a dummy instance from a darc is dispatched to the dummy
+	// contract, not to the darc contract.
+	scs, _, err := s.service().executeInstruction(nil, nil, inst)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, []byte(dummyKind), scs[0].ContractID)
+
+	// Calling the darc contract directly for something else than a darc
+	// fails.
+	_, _, err = s.service().ContractDarc(nil, inst, nil)
+	require.NotNil(t, err)
+}
+
+func TestService_DarcSpawnInvalidExpression(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	id := []darc.Identity{s.signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(id, id), []byte("malformed darc"))
+	require.Nil(t, d.Rules.AddRule("spawn:"+dummyKind, []byte("("+s.signer.Identity().String())))
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+	inst := Instruction{
+		InstanceID: InstanceID{
+			DarcID: s.darc.GetBaseID(),
+			SubID:  SubID{},
+		},
+		Spawn: &Spawn{
+			ContractID: ContractDarcID,
+			Args:       []Argument{{Name: "darc", Value: dBuf}},
+		},
+	}
+
+	// The unbalanced parenthesis is caught when spawning, naming the rule.
+	_, _, err = s.service().ContractDarc(nil, inst, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "spawn:"+dummyKind)
+}
+
+func TestService_AdditionalDarcs(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// darc2 is governed by another signer, who also needs to agree on
+	// spawning dummy instances.
+	signer2 := darc.NewSignerEd25519(nil, nil)
+	id2 := []darc.Identity{signer2.Identity()}
+	darc2 := darc.NewDarc(darc.InitRulesWith(id2, id2, invokeEvolve),
+		[]byte("compliance darc"))
+	darc2.Rules.AddRule("spawn:"+dummyKind, darc2.Rules.GetSignExpr())
+	darc2Buf, err := darc2.ToProto()
+	require.Nil(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  SubID{},
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args:       []Argument{{Name: "darc", Value: darc2Buf}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
+	require.True(t, pr.InclusionProof.Match())
+
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	instr.Index = 0
+	instr.Length = 1
+	instr.AdditionalDarcs = []darc.ID{darc2.GetBaseID()}
+	scID := s.sb.SkipChainID()
+	verify := func(signers ...darc.Signer) error {
+		require.Nil(t, instr.SignBy(signers...))
+		return s.service().verifyClientTx(scID, ClientTransaction{
+			Instructions: []Instruction{instr},
+		})
+	}
+
+	// Both darcs must authorize the instruction.
+	require.NotNil(t, verify(s.signer))
+	require.NotNil(t, verify(signer2))
+	require.Nil(t, verify(s.signer, signer2))
+
+	// The additional darcs are covered by the signatures.
+	instr.AdditionalDarcs = nil
+	require.NotNil(t, s.service().verifyClientTx(scID, ClientTransaction{
+		Instructions: []Instruction{instr},
+	}))
+
+	// An unknown additional darc is refused.
+	instr.AdditionalDarcs = []darc.ID{darcidStr("unknown")}
+	require.NotNil(t, verify(s.signer, signer2))
+}
+
+func TestService_DarcCompact(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// The genesis darc must allow compacting darcs.
+	d1 := s.darc.Copy()
+	require.Nil(t, d1.EvolveFrom(s.darc))
+	require.Nil(t, d1.Rules.AddRule("invoke:"+darc.Action(CmdDarcCompact), d1.Rules.GetSignExpr()))
+	pr := s.testDarcEvolution(t, *d1, false)
+	require.True(t, pr.InclusionProof.Match())
+
+	// darc2 governs a dummy instance.
+	id := []darc.Identity{s.signer.Identity()}
+	darc2 := darc.NewDarc(darc.InitRulesWith(id, id, invokeEvolve), []byte("long-lived darc"))
+	darc2.Rules.AddRule("spawn:"+dummyKind, darc2.Rules.GetSignExpr())
+	darc2.Rules.AddRule("invoke:"+darc.Action(CmdDarcCompact), darc2.Rules.GetSignExpr())
+	darc2Buf, err := darc2.ToProto()
+	require.Nil(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  SubID{},
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args:       []Argument{{Name: "darc", Value: darc2Buf}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	require.True(t, s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}}).InclusionProof.Match())
+	dummy, err := createInstr(darc2.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, ClientTransaction{Instructions: []Instruction{dummy}})
+	require.True(t, s.waitProof(t, dummy.InstanceID).InclusionProof.Match())
+
+	compact := Instruction{
+		InstanceID: InstanceID{
+			DarcID: darc2.GetBaseID(),
+			SubID:  SubID{},
+		},
+		Nonce:  GenNonce(),
+		Index:  0,
+		Length: 1,
+		Invoke: &Invoke{
+			Command: CmdDarcCompact,
+			Args:    Arguments{{Name: "instances", Value: dummy.InstanceID.SubID[:]}},
+		},
+	}
+	// The genesis darc must authorize the compaction.
+	coll := s.service().GetCollectionView(scID)
+	_, _, err = s.service().ContractDarc(coll, compact, nil)
+	require.NotNil(t, err)
+
+	compact.AdditionalDarcs = []darc.ID{s.darc.GetBaseID()}
+	require.Nil(t, compact.SignBy(s.signer))
+	s.sendTx(t, ClientTransaction{Instructions: []Instruction{compact}})
+
+	newD := darc.NewDarc(darc2.Rules, darc2.Description)
+	newD.PrevID = darc2.GetID()
+	newID := newD.GetBaseID()
+	require.True(t, s.waitProof(t, InstanceID{newID, SubID{}}).InclusionProof.Match())
+	coll = s.service().GetCollectionView(scID)
+	d, err := LoadDarcFromColl(coll, InstanceID{newID, SubID{}}.Slice())
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), d.Version)
+	require.Equal(t, darc2.Rules, d.Rules)
+
+	// The dummy instance moved to the new darc.
+	movedID := InstanceID{newID, dummy.InstanceID.SubID}
+	value, _, err := coll.GetValues(movedID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, s.value, value)
+	_, _, err = coll.GetValues(dummy.InstanceID.Slice())
+	require.NotNil(t, err)
+
+	// Instructions signed against the old darc aren't valid anymore.
+	old, err := createInstr(darc2.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	require.NotNil(t, s.service().verifyInstruction(scID, old, nil))
+	current, err := createInstr(newID, dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	require.Nil(t, s.service().verifyInstruction(scID, current, nil))
+}
+
+func TestService_DarcDelegation(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// Spawn second darc with a new owner/signer, but delegate its spawn
+	// rule to the first darc
+	signer2 := darc.NewSignerEd25519(nil, nil)
+	id2 := []darc.Identity{signer2.Identity()}
+	darc2 := darc.NewDarc(darc.InitRules(id2, id2),
+		[]byte("second darc"))
+	darc2.Rules.AddRule("spawn:darc", expression.InitOrExpr(s.darc.GetIdentityString()))
+	darc2Buf, err := darc2.ToProto()
+	require.Nil(t, err)
+	darc2Copy, err := darc.NewFromProtobuf(darc2Buf)
+	require.Nil(t, err)
+	require.True(t, darc2.Equal(darc2Copy))
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  SubID{},
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args: []Argument{{
+					Name:  "darc",
+					Value: darc2Buf,
+				}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
+	require.True(t, pr.InclusionProof.Match())
+
+	// Spawn third darc from the second one, but sign the request with
+	// the signer of the first darc to test delegation
+	signer3 := darc.NewSignerEd25519(nil, nil)
+	id3 := []darc.Identity{signer3.Identity()}
+	darc3 := darc.NewDarc(darc.InitRules(id3, id3),
+		[]byte("third darc"))
+	darc3Buf, err := darc3.ToProto()
+	require.Nil(t, err)
+	darc3Copy, err := darc.NewFromProtobuf(darc3Buf)
+	require.Nil(t, err)
+	require.True(t, darc3.Equal(darc3Copy))
+	ctx = ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: darc2.GetBaseID(),
 				SubID:  SubID{},
 			},
 			Nonce:  GenNonce(),
 			Index:  0,
 			Length: 1,
-			Spawn: &Spawn{
-				ContractID: ContractDarcID,
-				Args: []Argument{{
-					Name:  "darc",
-					Value: darc2Buf,
-				}},
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args: []Argument{{
+					Name:  "darc",
+					Value: darc3Buf,
+				}},
+			},
+		}},
+	}
+
+	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	pr = s.waitProof(t, InstanceID{darc3.GetBaseID(), SubID{}})
+	require.True(t, pr.InclusionProof.Match())
+}
+
+func TestService_GetLeader(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	for _, service := range s.services {
+		// everyone should have the same leader after the genesis block is stored
+		leader, err := service.getLeader(s.sb.SkipChainID())
+		require.NoError(t, err)
+		require.NotNil(t, leader)
+		require.True(t, leader.Equal(s.services[0].ServerIdentity()))
+	}
+}
+
+func TestService_NewGenesisDarc(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	_, err := NewGenesisDarc(nil)
+	require.Error(t, err)
+
+	d, err := NewGenesisDarc([]darc.Identity{s.signer.Identity()})
+	require.NoError(t, err)
+	resp, err := s.service().CreateGenesisBlock(&CreateGenesisBlock{
+		Version:       CurrentVersion,
+		Roster:        *s.roster,
+		GenesisDarc:   *d,
+		BlockInterval: s.interval,
+	})
+	require.NoError(t, err)
+	scID := resp.Skipblock.SkipChainID()
+
+	for _, cmd := range []string{"update_config", "view_change"} {
+		instr := Instruction{
+			InstanceID: InstanceID{
+				DarcID: d.GetBaseID(),
+				SubID:  oneSubID,
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Invoke: &Invoke{Command: cmd},
+		}
+		require.NoError(t, instr.SignBy(s.signer))
+		require.NoError(t, s.service().verifyInstruction(scID, instr, nil))
+	}
+}
+
+func TestService_SetConfig(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	ctx, newConfig := createConfigTx(t, s, true)
+	s.sendTx(t, ctx)
+
+	// wait for a change
+	for i := 0; i < 5; i++ {
+		time.Sleep(s.interval)
+		config, err := s.service().LoadConfig(s.sb.SkipChainID())
+		require.NoError(t, err)
+
+		if config.BlockInterval == newConfig.BlockInterval {
+			return
+		}
+	}
+	require.Fail(t, "did not find new config in time")
+}
+
+func TestService_AuthorizingRule(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	rule, err := s.service().GetAuthorizingRule(scID, s.tx.Instructions.Hash(), 0)
+	require.NoError(t, err)
+	require.Equal(t, "spawn:dummy", rule.Action)
+	require.Equal(t, s.darc.Rules["spawn:dummy"], rule.Expression)
+	require.Equal(t, []darc.Identity{s.signer.Identity()}, rule.Identities)
+
+	// The rules are kept per skipchain.
+	_, err = s.service().GetAuthorizingRule(skipchain.SkipBlockID("other"), s.tx.Instructions.Hash(), 0)
+	require.Error(t, err)
+
+	ctx, newConfig := createConfigTx(t, s, true)
+	s.sendTx(t, ctx)
+	for i := 0; i < 5; i++ {
+		time.Sleep(s.interval)
+		config, err := s.service().LoadConfig(scID)
+		require.NoError(t, err)
+		if config.BlockInterval == newConfig.BlockInterval {
+			break
+		}
+	}
+	rule, err = s.service().GetAuthorizingRule(scID, ctx.Instructions.Hash(), 0)
+	require.NoError(t, err)
+	require.Equal(t, "invoke:update_config", rule.Action)
+	require.Equal(t, s.darc.Rules["invoke:update_config"], rule.Expression)
+
+	_, err = s.service().GetAuthorizingRule(scID, ctx.Instructions.Hash(), 1)
+	require.Error(t, err)
+
+	// The identities are the ones that authorized the instruction: the
+	// signers of the transaction or of the pre-authorization.
+	txSigner := darc.NewSignerEd25519(nil, nil)
+	signed, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	signed.Instructions[0].Signatures = nil
+	require.NoError(t, signed.SignBy(txSigner))
+	paSigner := darc.NewSignerEd25519(nil, nil)
+	preAuthorized, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	instr := &preAuthorized.Instructions[0]
+	instr.Signatures = nil
+	instr.PreAuthorization = &PreAuthorization{
+		Action:     "spawn:" + dummyKind,
+		InstanceID: instr.InstanceID,
+		NonceMin:   instr.Nonce,
+		NonceMax:   instr.Nonce,
+	}
+	require.NoError(t, instr.PreAuthorization.SignBy(paSigner))
+
+	// The commands a contract authorizes itself have no rule.
+	require.NoError(t, s.service().registerContractCapabilities(dummyKind, ContractCapabilities{
+		Spawn:          true,
+		Invoke:         []string{"update"},
+		SelfAuthorized: []string{"update"},
+	}))
+	selfAuthorized, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	selfAuthorized.Instructions[0] = Instruction{
+		InstanceID: s.tx.Instructions[0].InstanceID,
+		Nonce:      GenNonce(),
+		Index:      0,
+		Length:     1,
+		Invoke:     &Invoke{Command: "update"},
+	}
+	require.NoError(t, selfAuthorized.Instructions[0].SignBy(s.signer))
+
+	cts := ClientTransactions{signed, preAuthorized, selfAuthorized}
+	require.NoError(t, s.service().recordAuthorizingRules(scID, cts))
+	rule, err = s.service().GetAuthorizingRule(scID, signed.Instructions.Hash(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []darc.Identity{txSigner.Identity()}, rule.Identities)
+	rule, err = s.service().GetAuthorizingRule(scID, preAuthorized.Instructions.Hash(), 0)
+	require.NoError(t, err)
+	require.Equal(t, "spawn:dummy", rule.Action)
+	require.Equal(t, []darc.Identity{paSigner.Identity()}, rule.Identities)
+	_, err = s.service().GetAuthorizingRule(scID, selfAuthorized.Instructions.Hash(), 0)
+	require.Error(t, err)
+}
+
+func TestService_FindByExternalRef(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	ref := []byte("order-42")
+
+	hashes, err := s.service().findByExternalRef(scID, ref)
+	require.NoError(t, err)
+	require.Empty(t, hashes)
+
+	var txs []ClientTransaction
+	for i := 0; i < 2; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.NoError(t, err)
+		tx.ExternalRef = ref
+		s.sendTx(t, tx)
+		txs = append(txs, tx)
+	}
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	tx.ExternalRef = []byte("order-4")
+	s.sendTx(t, tx)
+	for _, tx := range append(txs, tx) {
+		require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	}
+
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = scID
+	hashes, err = c.FindByExternalRef(ref)
+	require.NoError(t, err)
+	require.Len(t, hashes, 2)
+	for _, tx := range txs {
+		require.Contains(t, hashes, tx.Instructions.Hash())
+	}
+	hashes, err = s.service().findByExternalRef(scID, []byte("order-4"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{tx.Instructions.Hash()}, hashes)
+
+	_, err = s.service().findByExternalRef(scID, nil)
+	require.Error(t, err)
+}
+
+func TestService_RevokeIdentity(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	darcID := s.darc.GetBaseID()
+
+	signer2 := darc.NewSignerEd25519(nil, nil)
+	d2 := s.darc.Copy()
+	require.NoError(t, d2.EvolveFrom(s.darc))
+	owner := s.signer.Identity().String()
+	require.NoError(t, d2.Rules.AddRule(darc.Action("invoke:"+CmdRevokeIdentity), expression.InitOrExpr(owner)))
+	require.NoError(t, d2.Rules.AddRule(darc.Action("invoke:"+CmdUnrevokeIdentity), expression.InitOrExpr(owner)))
+	require.NoError(t, d2.Rules.UpdateRule("spawn:dummy", expression.InitOrExpr(owner, signer2.Identity().String())))
+	s.testDarcEvolution(t, *d2, false)
+
+	tx, err := createOneClientTx(darcID, dummyKind, s.value, signer2)
+	require.NoError(t, err)
+	require.NoError(t, s.service().verifyClientTx(scID, tx))
+	authorized := func() bool {
+		ok, err := s.service().CheckAuthorization(scID, InstanceID{darcID, SubID{}},
+			"spawn:"+dummyKind, signer2.Identity())
+		require.NoError(t, err)
+		return ok
+	}
+	require.True(t, authorized())
+
+	revocation := func(cmd string) {
+		instr := Instruction{
+			InstanceID: InstanceID{darcID, oneSubID},
+			Index:      0,
+			Length:     1,
+			Invoke: &Invoke{
+				Command: cmd,
+				Args:    Arguments{{Name: "identity", Value: []byte(signer2.Identity().String())}},
 			},
-		}},
+		}
+		require.NoError(t, instr.SignBy(s.signer))
+		s.sendTx(t, ClientTransaction{Instructions: Instructions{instr}})
+		for i := 0; i < 10; i++ {
+			rl, _, err := loadRevocations(s.service().GetCollectionView(scID))
+			require.NoError(t, err)
+			if (len(rl.Identities) == 1) == (cmd == CmdRevokeIdentity) {
+				return
+			}
+			time.Sleep(s.interval)
+		}
+		require.Fail(t, "revocation list didn't change")
+	}
+
+	// The darc still allows signer2, but its signatures are refused.
+	revocation(CmdRevokeIdentity)
+	err = s.service().verifyClientTx(scID, tx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "revoked")
+	require.False(t, authorized())
+
+	// The revocation is checked again during the execution, so that it
+	// applies to the transactions verified before it.
+	coll := s.service().getCollection(scID).coll.Clone()
+	p := execParams{maxScs: defaultMaxStateChanges, timestamp: time.Now().Unix()}
+	_, ctsOK, _ := s.service().executeTxs(coll, ClientTransactions{tx}, p, false)
+	require.Equal(t, 0, len(ctsOK))
+
+	revocation(CmdUnrevokeIdentity)
+	require.NoError(t, s.service().verifyClientTx(scID, tx))
+	require.True(t, authorized())
+}
+
+func TestService_Migrate(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	iID := s.tx.Instructions[0].InstanceID
+
+	require.Error(t, RegisterMigration(s.hosts[0], dummyKind, 2, 1, nil))
+	require.NoError(t, RegisterMigration(s.hosts[0], dummyKind, 1, 2,
+		func(value []byte) ([]byte, error) {
+			return append([]byte("v2:"), value...), nil
+		}))
+
+	coll := s.service().getCollection(s.sb.SkipChainID()).coll.Clone()
+	version, err := InstanceVersion(&roCollection{coll}, iID)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+
+	versionBuf := make([]byte, binary.MaxVarintLen64)
+	migrate := Instruction{
+		InstanceID: iID,
+		Invoke: &Invoke{
+			Command: CmdMigrate,
+			Args:    Arguments{{Name: "version", Value: versionBuf[:binary.PutVarint(versionBuf, 2)]}},
+		},
+	}
+	scs, _, err := s.service().executeInstruction(&roCollection{coll}, nil, migrate)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(scs))
+	require.Equal(t, Update, scs[0].StateAction)
+	require.Equal(t, append([]byte("v2:"), s.value...), scs[0].Value)
+	for _, sc := range scs {
+		require.NoError(t, storeInColl(coll, &sc))
+	}
+	value, _, err := (&roCollection{coll}).GetValues(iID.Slice())
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("v2:"), s.value...), value)
+	version, err = InstanceVersion(&roCollection{coll}, iID)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	// The version cannot be invoked like the config.
+	_, cid, err := (&roCollection{coll}).GetValues(VersionInstanceID(iID).Slice())
+	require.NoError(t, err)
+	require.Equal(t, ContractVersionID, cid)
+	_, _, err = s.service().executeInstruction(&roCollection{coll}, nil, Instruction{
+		InstanceID: VersionInstanceID(iID),
+		Invoke:     &Invoke{Command: "update_config"},
+	})
+	require.Error(t, err)
+
+	// The instance is up to date now.
+	_, _, err = s.service().executeInstruction(&roCollection{coll}, nil, migrate)
+	require.Error(t, err)
+	migrate.Invoke.Args = nil
+	_, _, err = s.service().executeInstruction(&roCollection{coll}, nil, migrate)
+	require.Error(t, err)
+
+	// A version that cannot be read is an error, not version 1.
+	corrupt := coll.Clone()
+	bad := NewStateChange(Update, VersionInstanceID(iID), ContractVersionID, []byte{0xff})
+	require.NoError(t, storeInColl(corrupt, &bad))
+	_, err = InstanceVersion(&roCollection{corrupt}, iID)
+	require.Error(t, err)
+
+	// Removing the instance removes its version, so that an instance
+	// spawned again with the same ID starts at version 1.
+	remove := StateChanges{NewStateChange(Remove, iID, dummyKind, nil)}
+	scs, err = removeVersions(&roCollection{coll}, remove)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(scs))
+	for _, sc := range scs {
+		require.NoError(t, storeInColl(coll, &sc))
+	}
+	version, err = InstanceVersion(&roCollection{coll}, iID)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	scs, err = removeVersions(&roCollection{coll}, remove)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(scs))
+}
+
+func TestService_GetDecodedInstance(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	darcID := s.darc.GetBaseID()
+	c := NewClient()
+	c.Roster = s.roster
+	c.ID = scID
+
+	contractID, decoded, err := c.GetDecodedInstance(InstanceID{darcID, oneSubID})
+	require.NoError(t, err)
+	require.Equal(t, ContractConfigID, contractID)
+	config, ok := decoded.(*ChainConfig)
+	require.True(t, ok)
+	require.Equal(t, s.interval, config.BlockInterval)
+
+	contractID, decoded, err = c.GetDecodedInstance(InstanceID{darcID, SubID{}})
+	require.NoError(t, err)
+	require.Equal(t, ContractDarcID, contractID)
+	d, ok := decoded.(*darc.Darc)
+	require.True(t, ok)
+	require.True(t, d.Equal(s.darc))
+
+	// Unknown contracts and the other config instances are raw.
+	contractID, decoded, err = c.GetDecodedInstance(s.tx.Instructions[0].InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, dummyKind, contractID)
+	require.Equal(t, s.value, decoded)
+	_, decoded, err = c.GetDecodedInstance(GenesisReferenceID)
+	require.NoError(t, err)
+	require.Equal(t, []byte(darcID), decoded)
+
+	_, _, err = c.GetDecodedInstance(InstanceID{darcID, genSubID()})
+	require.Error(t, err)
+}
+
+func TestService_ConfigVersion(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	coll := s.service().GetCollectionView(s.sb.SkipChainID())
+
+	invoke := func(config ChainConfig) error {
+		configBuf, err := protobuf.Encode(&config)
+		require.NoError(t, err)
+		inst := Instruction{
+			InstanceID: InstanceID{s.darc.GetBaseID(), oneSubID},
+			Invoke: &Invoke{
+				Command: "update_config",
+				Args:    Arguments{{Name: "config", Value: configBuf}},
+			},
+		}
+		_, _, err = s.service().ContractConfig(coll, inst, nil)
+		return err
+	}
+	config, err := s.service().LoadConfig(s.sb.SkipChainID())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), config.ConfigVersion)
+
+	// The replayed genesis config and skipped versions are refused.
+	require.Error(t, invoke(*config))
+	config.ConfigVersion = 2
+	require.Error(t, invoke(*config))
+
+	ctx, newConfig := createConfigTx(t, s, true)
+	require.NoError(t, invoke(newConfig))
+	s.sendTx(t, ctx)
+	for i := 0; i < 5; i++ {
+		config, err = s.service().LoadConfig(s.sb.SkipChainID())
+		require.NoError(t, err)
+		if config.ConfigVersion == 1 {
+			break
+		}
+		time.Sleep(s.interval)
+	}
+	require.Equal(t, uint64(1), config.ConfigVersion)
+
+	// The same update cannot be applied a second time.
+	require.Error(t, invoke(newConfig))
+
+	// The view-changes carry the version of the new config too.
+	viewChange := func(version uint64) error {
+		rosterBuf, err := protobuf.Encode(s.roster)
+		require.NoError(t, err)
+		versionBuf := make([]byte, binary.MaxVarintLen64)
+		versionBuf = versionBuf[:binary.PutUvarint(versionBuf, version)]
+		inst := Instruction{
+			InstanceID: InstanceID{s.darc.GetBaseID(), oneSubID},
+			Invoke: &Invoke{
+				Command: "view_change",
+				Args: Arguments{
+					{Name: "roster", Value: rosterBuf},
+					{Name: "version", Value: versionBuf},
+				},
+			},
+		}
+		require.NoError(t, inst.SignBy(s.signer))
+		_, _, err = s.service().ContractConfig(s.service().GetCollectionView(s.sb.SkipChainID()), inst, nil)
+		return err
+	}
+	for _, version := range []uint64{1, 3} {
+		err = viewChange(version)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "config version 2")
+	}
+	if err = viewChange(2); err != nil {
+		// Without heartbeats, the view-change is refused later on.
+		require.NotContains(t, err.Error(), "config version")
+	}
+
+	// Building the state change doesn't change the given config.
+	_, err = updateConfigScs(s.darc.GetBaseID(), config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), config.ConfigVersion)
+}
+
+func TestService_InstructionTimeout(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// New transactions are created every time, as the state changes of
+	// known transactions are cached.
+	newTxs := func() (slowTx, fastTx ClientTransaction) {
+		slowTx, err := createOneClientTx(s.darc.GetBaseID(), slowKind, s.value, s.signer)
+		require.Nil(t, err)
+		fastTx, err = createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		return
+	}
+
+	// Without a timeout, all transactions are executed.
+	coll := s.service().getCollection(scID).coll.Clone()
+	slowTx, fastTx := newTxs()
+	_, ctsOK, _, err := s.service().createStateChanges(coll, scID,
+		ClientTransactions{slowTx, fastTx}, time.Now().Unix())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ctsOK))
+
+	config, err := s.service().LoadConfig(scID)
+	require.Nil(t, err)
+	config.InstructionTimeout = testInterval / 50
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	require.Nil(t, storeInColl(coll, &StateChange{
+		StateAction: Update,
+		InstanceID:  InstanceID{s.darc.GetBaseID(), oneSubID}.Slice(),
+		ContractID:  []byte(ContractConfigID),
+		Value:       configBuf,
+	}))
+	// The execution of a block doesn't depend on the speed of the node,
+	// so the timeout doesn't apply.
+	slowTx, fastTx = newTxs()
+	_, ctsOK, _, err = s.service().createStateChanges(coll, scID,
+		ClientTransactions{slowTx, fastTx}, time.Now().Unix())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ctsOK))
+
+	// The leader times out the slow contract, whose reads fail afterwards.
+	cv := s.service().GetCollectionView(scID)
+	_, _, err = s.service().executeInstructionTimeout(cv, nil, slowTx.Instructions[0], testInterval/50)
+	require.Equal(t, ErrExecutionTimeout, err)
+	_, _, err = s.service().executeInstructionTimeout(cv, nil, slowTx.Instructions[0], 0)
+	require.Nil(t, err)
+	view := &cancelView{CollectionView: cv}
+	_, _, err = view.GetValues(GenesisReferenceID.Slice())
+	require.Nil(t, err)
+	view.cancel()
+	_, _, err = view.GetValues(GenesisReferenceID.Slice())
+	require.Equal(t, ErrExecutionTimeout, err)
+	record, err := view.Get(GenesisReferenceID.Slice()).Record()
+	require.Nil(t, err)
+	require.False(t, record.Match())
+}
+
+func TestService_ParallelExecution(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	coll := s.service().getCollection(s.sb.SkipChainID()).coll
+
+	var cts ClientTransactions
+	for i := 0; i < 6; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		cts = append(cts, tx)
+	}
+	// The same instance as the first transaction, which only fails if the
+	// first transaction is applied before.
+	dup := ClientTransaction{Instructions: Instructions{cts[0].Instructions[0]}}
+	dup.Instructions[0].Spawn = &Spawn{
+		ContractID: dummyKind,
+		Args:       Arguments{{Name: "data", Value: []byte("other value")}},
+	}
+	invalid, err := createOneClientTx(s.darc.GetBaseID(), invalidKind, s.value, s.signer)
+	require.Nil(t, err)
+	cts = append(cts[:3], append(ClientTransactions{dup, invalid}, cts[3:]...)...)
+
+	p := execParams{maxScs: defaultMaxStateChanges, timestamp: time.Now().Unix()}
+	collSeq, ctsSeq, scsSeq := s.service().executeTxs(coll, cts, p, false)
+	collPar, ctsPar, scsPar := s.service().executeTxs(coll, cts, p, true)
+	require.Equal(t, 6, len(ctsSeq))
+	require.Equal(t, collSeq.GetRoot(), collPar.GetRoot())
+	require.Equal(t, ctsSeq.Hash(), ctsPar.Hash())
+	require.Equal(t, scsSeq.Hash(), scsPar.Hash())
+}
+
+func TestService_StorageQuota(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	used, err := s.service().getCollection(scID).StorageByContract(dummyKind)
+	require.Nil(t, err)
+	require.NotEqual(t, 0, used)
+	size := instanceSize(make([]byte, 64), s.value, []byte(dummyKind))
+
+	config, err := s.service().LoadConfig(scID)
+	require.Nil(t, err)
+	config.StorageQuotas = []StorageQuota{
+		{ContractID: dummyKind, MaxBytes: used + 2*size},
+		{ContractID: slowKind},
+	}
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	coll := s.service().getCollection(scID).coll.Clone()
+	require.Nil(t, storeInColl(coll, &StateChange{
+		StateAction: Update,
+		InstanceID:  InstanceID{s.darc.GetBaseID(), oneSubID}.Slice(),
+		ContractID:  []byte(ContractConfigID),
+		Value:       configBuf,
+	}))
+
+	// Two more instances fit in the quota, the third one is refused.
+	var cts ClientTransactions
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		cts = append(cts, tx)
+	}
+	_, ctsOK, _, err := s.service().createStateChanges(coll, scID, cts, time.Now().Unix())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ctsOK))
+	require.Equal(t, cts[1].Instructions.Hash(), ctsOK[1].Instructions.Hash())
+
+	// A quota of zero is unlimited.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), slowKind, s.value, s.signer)
+	require.Nil(t, err)
+	_, ctsOK, _, err = s.service().createStateChanges(coll, scID, ClientTransactions{tx}, time.Now().Unix())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ctsOK))
+
+	usage := &storageUsage{quotas: map[string]int{dummyKind: 10}, used: map[string]int{dummyKind: 20}}
+	require.Nil(t, usage.commit(map[string]int{dummyKind: -5}))
+	require.Equal(t, ErrQuotaExceeded, usage.commit(map[string]int{dummyKind: 1}))
+}
+
+func TestService_AddPartialSignature(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// A committee of three members, any two of them can sign.
+	suite := bn256.NewSuite()
+	secret := suite.G2().Scalar().Pick(suite.RandomStream())
+	priPoly := share.NewPriPoly(suite.G2(), 2, secret, suite.RandomStream())
+	pubPoly := priPoly.Commit(suite.G2().Point().Base())
+	committee, err := darc.NewIdentityBLS(pubPoly.Commit())
+	require.Nil(t, err)
+	_, commits := pubPoly.Info()
+	var commitsBuf [][]byte
+	for _, c := range commits {
+		buf, err := c.MarshalBinary()
+		require.Nil(t, err)
+		commitsBuf = append(commitsBuf, buf)
+	}
+
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	instr.Signatures = []darc.Signature{{Signer: committee}}
+	darcReq, err := instr.ToDarcRequest()
+	require.Nil(t, err)
+	digest := darcReq.Hash()
+	var partials [][]byte
+	for _, pri := range priPoly.Shares(3) {
+		partial, err := tbls.Sign(suite, pri, digest)
+		require.Nil(t, err)
+		partials = append(partials, partial)
+	}
+
+	req := &AddPartialSignature{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: ClientTransaction{Instructions: Instructions{instr}},
+		Partial:     partials[0],
+		Committee:   commitsBuf,
 	}
-	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
-	s.sendTx(t, ctx)
-	pr := s.waitProof(t, InstanceID{darc2.GetBaseID(), SubID{}})
-	require.True(t, pr.InclusionProof.Match())
 
-	// Spawn third darc from the second one, but sign the request with
-	// the signer of the first darc to test delegation
-	signer3 := darc.NewSignerEd25519(nil, nil)
-	id3 := []darc.Identity{signer3.Identity()}
-	darc3 := darc.NewDarc(darc.InitRules(id3, id3),
-		[]byte("third darc"))
-	darc3Buf, err := darc3.ToProto()
+	// Bogus shares and committees are refused.
+	bogus := *req
+	bogus.Partial = append([]byte{}, partials[1]...)
+	bogus.Partial[len(bogus.Partial)-1] ^= 1
+	_, err = s.service().AddPartialSignature(&bogus)
+	require.NotNil(t, err)
+	bogus = *req
+	bogus.Committee = commitsBuf[1:]
+	_, err = s.service().AddPartialSignature(&bogus)
+	require.NotNil(t, err)
+
+	// The same partial signature twice is still not enough.
+	for i := 0; i < 2; i++ {
+		resp, err := s.service().AddPartialSignature(req)
+		require.Nil(t, err)
+		require.Nil(t, resp.Signature)
+		require.False(t, resp.Submitted)
+	}
+	req.Partial = partials[2]
+	resp, err := s.service().AddPartialSignature(req)
 	require.Nil(t, err)
-	darc3Copy, err := darc.NewFromProtobuf(darc3Buf)
+	require.True(t, resp.Submitted)
+	require.Nil(t, committee.Verify(digest, resp.Signature))
+
+	_, err = recoverBLS(committee, digest, map[int][]byte{0: partials[0]}, 2)
+	require.NotNil(t, err)
+	_, err = recoverBLS(committee, digest, map[int][]byte{1: partials[1], 2: partials[2]}, 2)
 	require.Nil(t, err)
-	require.True(t, darc3.Equal(darc3Copy))
-	ctx = ClientTransaction{
-		Instructions: []Instruction{{
-			InstanceID: InstanceID{
-				DarcID: darc2.GetBaseID(),
-				SubID:  SubID{},
-			},
-			Nonce:  GenNonce(),
-			Index:  0,
-			Length: 1,
-			Spawn: &Spawn{
-				ContractID: ContractDarcID,
-				Args: []Argument{{
-					Name:  "darc",
-					Value: darc3Buf,
-				}},
-			},
-		}},
+
+	// Pending transactions expire.
+	s.service().partialSigsMut.Lock()
+	s.service().partialSigs["stale"] = &partialSignatures{created: time.Now().Add(-partialSigsTTL)}
+	s.service().partialSigsMut.Unlock()
+	instr.Nonce = GenNonce()
+	darcReq, err = instr.ToDarcRequest()
+	require.Nil(t, err)
+	req.Transaction = ClientTransaction{Instructions: Instructions{instr}}
+	req.Partial, err = tbls.Sign(suite, priPoly.Shares(3)[0], darcReq.Hash())
+	require.Nil(t, err)
+	_, err = s.service().AddPartialSignature(req)
+	require.Nil(t, err)
+	s.service().partialSigsMut.Lock()
+	_, ok := s.service().partialSigs["stale"]
+	require.False(t, ok)
+	require.Equal(t, 1, len(s.service().partialSigs))
+	s.service().partialSigsMut.Unlock()
+
+	// Instructions without a BLS signature to complete are refused.
+	req.Transaction = ClientTransaction{Instructions: Instructions{instr}}
+	req.Transaction.Instructions[0].Signatures = nil
+	_, err = s.service().AddPartialSignature(req)
+	require.NotNil(t, err)
+
+	// A submitter sending the same instruction first, signed by another
+	// committee, doesn't keep the shares of the honest committee out.
+	otherPoly := share.NewPriPoly(suite.G2(), 2, nil, suite.RandomStream())
+	otherPub := otherPoly.Commit(suite.G2().Point().Base())
+	otherCommittee, err := darc.NewIdentityBLS(otherPub.Commit())
+	require.Nil(t, err)
+	_, otherCommits := otherPub.Info()
+	var otherCommitsBuf [][]byte
+	for _, c := range otherCommits {
+		buf, err := c.MarshalBinary()
+		require.Nil(t, err)
+		otherCommitsBuf = append(otherCommitsBuf, buf)
+	}
+	instr.Nonce = GenNonce()
+	conflicting := instr
+	conflicting.Signatures = []darc.Signature{{Signer: otherCommittee}}
+	darcReq, err = conflicting.ToDarcRequest()
+	require.Nil(t, err)
+	partial, err := tbls.Sign(suite, otherPoly.Shares(3)[0], darcReq.Hash())
+	require.Nil(t, err)
+	_, err = s.service().AddPartialSignature(&AddPartialSignature{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: ClientTransaction{Instructions: Instructions{conflicting}},
+		Partial:     partial,
+		Committee:   otherCommitsBuf,
+	})
+	require.Nil(t, err)
+
+	instr.Signatures = []darc.Signature{{Signer: committee}}
+	darcReq, err = instr.ToDarcRequest()
+	require.Nil(t, err)
+	req.Transaction = ClientTransaction{Instructions: Instructions{instr}}
+	for i, pri := range priPoly.Shares(3)[:2] {
+		req.Partial, err = tbls.Sign(suite, pri, darcReq.Hash())
+		require.Nil(t, err)
+		resp, err = s.service().AddPartialSignature(req)
+		require.Nil(t, err)
+		require.Equal(t, i == 1, resp.Submitted)
 	}
 
-	require.Nil(t, ctx.Instructions[0].SignBy(s.signer))
-	s.sendTx(t, ctx)
-	pr = s.waitProof(t, InstanceID{darc3.GetBaseID(), SubID{}})
-	require.True(t, pr.InclusionProof.Match())
+	// Signatures that are already set must be valid.
+	instr.Nonce = GenNonce()
+	instr.Signatures = []darc.Signature{
+		{Signer: s.signer.Identity(), Signature: []byte("bogus")},
+		{Signer: committee},
+	}
+	darcReq, err = instr.ToDarcRequest()
+	require.Nil(t, err)
+	req.Transaction = ClientTransaction{Instructions: Instructions{instr}}
+	req.Partial, err = tbls.Sign(suite, priPoly.Shares(3)[0], darcReq.Hash())
+	require.Nil(t, err)
+	_, err = s.service().AddPartialSignature(req)
+	require.NotNil(t, err)
 }
 
-func TestService_GetLeader(t *testing.T) {
-	s := newSer(t, 1, testInterval)
-	defer s.local.CloseAll()
+func TestService_NonceReplay(t *testing.T) {
+	instr, err := createInstr(darcidStr("nonce"), dummyKind, []byte("value"), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+	instr.Nonce = NewNonce(bytes.Repeat([]byte{1}, 32))
 
-	for _, service := range s.services {
-		// everyone should have the same leader after the genesis block is stored
-		leader, err := service.getLeader(s.sb.SkipChainID())
-		require.NoError(t, err)
-		require.NotNil(t, leader)
-		require.True(t, leader.Equal(s.services[0].ServerIdentity()))
+	// apply records the nonce of instr in coll and returns the error.
+	apply := func(coll *collection.Collection, instr Instruction, policy NoncePolicy) error {
+		scs, err := addNonce(&roCollection{coll}, instr, nil, policy)
+		if err != nil {
+			return err
+		}
+		for _, sc := range scs {
+			require.Nil(t, storeInColl(coll, &sc))
+		}
+		return nil
+	}
+
+	for _, policy := range []NoncePolicy{NonceIncreasing, NonceNext} {
+		coll := collection.New(collection.Data{}, collection.Data{})
+		require.Nil(t, apply(coll, instr, policy))
+		value, contractID, err := getValueContract(&roCollection{coll},
+			NonceKey(instr.InstanceID, &instr.Signatures[0].Signer).Slice())
+		require.Nil(t, err)
+		require.Equal(t, ContractNonceID, contractID)
+		require.Equal(t, instr.Nonce[:], value)
+
+		// Resubmitting the same instruction is a replay.
+		require.Equal(t, ErrReplay, apply(coll, instr, policy))
+
+		next := instr
+		next.Nonce = instr.Nonce.next()
+		require.Nil(t, apply(coll, next, policy))
+		require.Equal(t, ErrReplay, apply(coll, instr, policy))
+
+		// Other instances have their own nonces.
+		other := instr
+		other.InstanceID.SubID = genSubID()
+		require.Nil(t, apply(coll, other, policy))
+
+		// Other spawners under the same darc too.
+		spawner := darc.NewSignerEd25519(nil, nil)
+		other = instr
+		require.Nil(t, other.SignBy(spawner))
+		require.Nil(t, apply(coll, other, policy))
+
+		// The instructions added by the service are not checked.
+		view := Instruction{
+			InstanceID: InstanceID{darcidStr("nonce"), oneSubID},
+			Nonce:      instr.Nonce,
+			Invoke:     &Invoke{Command: "view_change"},
+		}
+		require.Nil(t, apply(coll, view, policy))
+		require.Nil(t, apply(coll, view, policy))
 	}
+
+	// Skipping nonces is only allowed if they are increasing.
+	skip := instr
+	skip.Nonce[0]++
+	coll := collection.New(collection.Data{}, collection.Data{})
+	require.Nil(t, apply(coll, instr, NonceIncreasing))
+	require.Nil(t, apply(coll, skip, NonceIncreasing))
+	coll = collection.New(collection.Data{}, collection.Data{})
+	require.Nil(t, apply(coll, instr, NonceNext))
+	require.Equal(t, ErrReplay, apply(coll, skip, NonceNext))
+
+	// Without a policy, nothing is recorded.
+	scs, err := addNonce(&roCollection{coll}, instr, nil, NonceAny)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(scs))
+
+	require.Equal(t, NewNonce(append(make([]byte, 31), 1)), Nonce{}.next())
+	carry := NewNonce(append(make([]byte, 30), 1, 0))
+	require.Equal(t, carry, NewNonce(append(make([]byte, 31), 0xff)).next())
 }
 
-func TestService_SetConfig(t *testing.T) {
+func TestService_ContractErrorContext(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
+	coll := s.service().GetCollectionView(s.sb.SkipChainID())
 
-	ctx, newConfig := createConfigTx(t, s, true)
-	s.sendTx(t, ctx)
-
-	// wait for a change
-	for i := 0; i < 5; i++ {
-		time.Sleep(s.interval)
-		config, err := s.service().LoadConfig(s.sb.SkipChainID())
-		require.NoError(t, err)
-
-		if config.BlockInterval == newConfig.BlockInterval {
-			return
-		}
+	iID := InstanceID{s.darc.GetBaseID(), SubID{}}
+	inst := Instruction{
+		InstanceID: iID,
+		Invoke:     &Invoke{Command: "unknown"},
 	}
-	require.Fail(t, "did not find new config in time")
+	_, _, err := s.service().ContractDarc(coll, inst, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(),
+		fmt.Sprintf("contract=darc action=invoke:unknown instance=%x: invalid command", iID.Slice()))
+
+	inst.InstanceID = InstanceID{s.darc.GetBaseID(), oneSubID}
+	inst.Invoke.Command = "update_config"
+	_, _, err = s.service().ContractConfig(coll, inst, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(),
+		fmt.Sprintf("contract=config action=invoke:update_config instance=%x: ", inst.InstanceID.Slice()))
 }
 
 func TestService_SetBadConfig(t *testing.T) {
@@ -717,45 +3755,447 @@ func TestService_RotateLeader(t *testing.T) {
 	s.service().TestClose()
 	s.hosts[0].Pause()
 
-	// wait for the new block
-	var ok bool
-	for i := 0; i < 5; i++ {
-		time.Sleep(2 * s.interval)
-		config, err := s.services[1].LoadConfig(s.sb.SkipChainID())
+	// wait for the new block
+	var ok bool
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * s.interval)
+		config, err := s.services[1].LoadConfig(s.sb.SkipChainID())
+		require.NoError(t, err)
+
+		if config.Roster.List[0].Equal(s.services[1].ServerIdentity()) {
+			ok = true
+			break
+		}
+	}
+	require.True(t, ok, "leader rotation failed")
+
+	// check that the leader is updated for all nodes
+	for _, service := range s.services[1:] {
+		// everyone should have the same leader after the genesis block is stored
+		leader, err := service.getLeader(s.sb.SkipChainID())
+		require.NoError(t, err)
+		require.NotNil(t, leader)
+		require.True(t, leader.Equal(s.services[1].ServerIdentity()))
+	}
+
+	// try to send a transaction to the node on index 2, which is a
+	// follower (not the new leader)
+	tx1, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	s.sendTxTo(t, tx1, 2)
+
+	// wait for the transaction to be stored on the new leader, because it
+	// polls for new transactions
+	pr := s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 1)
+	require.True(t, pr.InclusionProof.Match())
+
+	// the transaction should also be stored on followers, at index 2 and 3
+	pr = s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 2)
+	require.True(t, pr.InclusionProof.Match())
+	pr = s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 3)
+	require.True(t, pr.InclusionProof.Match())
+
+	// the blocks before the view-change have the old roster, the ones
+	// after it the new roster
+	latest, err := s.services[1].db().GetLatestByID(s.sb.SkipChainID())
+	require.NoError(t, err)
+	roster, err := s.services[1].GetBlockRoster(s.sb.SkipChainID(), 0)
+	require.NoError(t, err)
+	require.True(t, roster.List[0].Equal(s.services[0].ServerIdentity()))
+	roster, err = s.services[1].GetBlockRoster(s.sb.SkipChainID(), latest.Index)
+	require.NoError(t, err)
+	require.True(t, roster.List[0].Equal(s.services[1].ServerIdentity()))
+	_, err = s.services[1].GetBlockRoster(s.sb.SkipChainID(), latest.Index+1)
+	require.Error(t, err)
+}
+
+func TestService_Equivocation(t *testing.T) {
+	s := newSerN(t, 1, testInterval, 4, false)
+	defer s.local.CloseAll()
+
+	scID := s.sb.SkipChainID()
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+
+	// propose returns the next block holding a new dummy instance with
+	// value, as proposed by the leader.
+	propose := func(value []byte) *skipchain.SkipBlock {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, value, s.signer)
+		require.Nil(t, err)
+		coll := s.service().getCollection(scID).coll
+		mr, ctsOK, scs, err := s.service().createStateChanges(coll, scID, ClientTransactions{tx}, time.Now().Unix())
+		require.Nil(t, err)
+
+		sb := latest.Copy()
+		sb.Index = latest.Index + 1
+		sb.GenesisID = scID
+		sb.BackLinkIDs = []skipchain.SkipBlockID{latest.Hash}
+		sb.Data, err = network.Marshal(&DataHeader{
+			CollectionRoot:        mr,
+			ClientTransactionHash: ctsOK.Hash(),
+			StateChangesHash:      scs.Hash(),
+			Timestamp:             time.Now().Unix(),
+		})
+		require.Nil(t, err)
+		p, err := s.service().signProposal(scID, sb.Index, sb.Data)
+		require.Nil(t, err)
+		sb.Payload, err = network.Marshal(&DataBody{Transactions: ctsOK, Proposal: p})
+		require.Nil(t, err)
+		return sb
+	}
+	sb1 := propose([]byte("first"))
+	sb2 := propose([]byte("second"))
+
+	// The same proposal can be verified twice, but not a different one.
+	node := s.services[1]
+	require.True(t, node.verifySkipBlock(nil, sb1))
+	require.True(t, node.verifySkipBlock(nil, sb1))
+	require.Equal(t, 0, len(node.Equivocations(scID)))
+	require.False(t, node.verifySkipBlock(nil, sb2))
+
+	evidence := node.Equivocations(scID)
+	require.Equal(t, 1, len(evidence))
+	require.Nil(t, evidence[0].Verify())
+	require.True(t, evidence[0].First.Leader.Equal(s.services[0].ServerIdentity().Public))
+	bad := evidence[0]
+	bad.Second.Header = bad.First.Header
+	require.NotNil(t, bad.Verify())
+
+	// Reporting the evidence moves the leader to the end of the roster.
+	require.True(t, s.darc.Rules.Contains(darc.Action("invoke:"+CmdReportEquivocation)))
+	evidenceBuf, err := protobuf.Encode(&evidence[0])
+	require.Nil(t, err)
+	inst := Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), oneSubID},
+		Invoke: &Invoke{
+			Command: CmdReportEquivocation,
+			Args:    Arguments{{Name: "evidence", Value: evidenceBuf}},
+		},
+	}
+	scs, _, err := node.executeInstruction(node.GetCollectionView(scID), nil, inst)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	config := ChainConfig{}
+	require.Nil(t, protobuf.DecodeWithConstructors(scs[0].Value, &config,
+		network.DefaultConstructors(cothority.Suite)))
+	require.True(t, config.Roster.List[0].Equal(s.services[1].ServerIdentity()))
+	require.True(t, config.Roster.List[3].Equal(s.services[0].ServerIdentity()))
+
+	inst.Invoke.Args[0].Value = []byte("no evidence")
+	_, _, err = node.executeInstruction(node.GetCollectionView(scID), nil, inst)
+	require.NotNil(t, err)
+}
+
+func TestService_ReportEquivocation(t *testing.T) {
+	s := newSerN(t, 1, testInterval, 4, false)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// The node at index 2 signs two proposals for the same block.
+	node := s.services[2]
+	first, err := node.signProposal(scID, 100, []byte("first"))
+	require.Nil(t, err)
+	second, err := node.signProposal(scID, 100, []byte("second"))
+	require.Nil(t, err)
+	evidenceBuf, err := protobuf.Encode(&Equivocation{First: *first, Second: *second})
+	require.Nil(t, err)
+
+	// Any node of the roster can report it through AddTransaction.
+	reporter := s.services[1]
+	inst := Instruction{
+		InstanceID:  InstanceID{s.darc.GetBaseID(), oneSubID},
+		Nonce:       GenNonce(),
+		Length:      1,
+		SkipchainID: scID,
+		Invoke: &Invoke{
+			Command: CmdReportEquivocation,
+			Args:    Arguments{{Name: "evidence", Value: evidenceBuf}},
+		},
+	}
+	require.Nil(t, inst.SignBy(darc.NewSignerEd25519(reporter.ServerIdentity().Public, reporter.getPrivateKey())))
+	s.sendTx(t, ClientTransaction{Instructions: Instructions{inst}})
+
+	var config *ChainConfig
+	for i := 0; i < 10; i++ {
+		config, err = s.service().LoadConfig(scID)
+		require.Nil(t, err)
+		if config.Roster.List[3].Equal(node.ServerIdentity()) {
+			break
+		}
+		time.Sleep(s.interval)
+	}
+	require.True(t, config.Roster.List[3].Equal(node.ServerIdentity()))
+	require.True(t, config.Roster.List[0].Equal(s.services[0].ServerIdentity()))
+
+	// The block holding the report has the new roster, so the chain goes
+	// on.
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.True(t, latest.Roster.ID.Equal(config.Roster.ID))
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	pr := s.waitProof(t, tx.Instructions[0].InstanceID)
+	require.True(t, pr.InclusionProof.Match())
+
+	// The leader doesn't include the report of its own equivocation.
+	own, err := s.service().signProposal(scID, 100, []byte("first"))
+	require.Nil(t, err)
+	ownBuf, err := protobuf.Encode(&Equivocation{First: *own, Second: *own})
+	require.Nil(t, err)
+	inst.Invoke.Args[0].Value = ownBuf
+	require.Equal(t, 0, len(s.service().dropOwnReports(ClientTransactions{{Instructions: Instructions{inst}}})))
+}
+
+func TestService_RetryProposal(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	// A stored block is forgotten.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	s.waitProof(t, tx.Instructions[0].InstanceID)
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	require.Nil(t, s.service().retryProposal(scID, latest.Index))
+	require.Nil(t, s.service().retryProposal(scID, latest.Index+1))
+
+	// A block that failed is proposed again for the same index only.
+	failed := latest.Copy()
+	failed.Data = []byte("header")
+	s.service().setProposed(scID, latest.Index+1, failed)
+	retry := s.service().retryProposal(scID, latest.Index+1)
+	require.NotNil(t, retry)
+	require.Equal(t, failed.Data, retry.Data)
+	require.Nil(t, s.service().retryProposal(scID, latest.Index+2))
+	s.service().setProposed(scID, latest.Index+1, nil)
+	require.Nil(t, s.service().retryProposal(scID, latest.Index+1))
+
+	// A block that is always refused is dropped after some retries.
+	s.service().setProposed(scID, latest.Index+1, failed)
+	for i := 0; i < maxProposalRetries; i++ {
+		require.NotNil(t, s.service().retryProposal(scID, latest.Index+1))
+	}
+	require.Nil(t, s.service().retryProposal(scID, latest.Index+1))
+}
+
+func TestService_LeaderPolicy(t *testing.T) {
+	s := newSerN(t, 1, testInterval, 4, false)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	config, err := s.service().LoadConfig(scID)
+	require.Nil(t, err)
+	config.LeaderPolicy = LeaderRoundRobin
+	config.ConfigVersion++
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	instr := Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), oneSubID},
+		Nonce:      GenNonce(),
+		Length:     1,
+		Invoke: &Invoke{
+			Command: "update_config",
+			Args:    Arguments{{Name: "config", Value: configBuf}},
+		},
+	}
+	require.Nil(t, instr.SignBy(s.signer))
+	send := func(tx ClientTransaction) {
+		_, err := s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   scID,
+			Transaction:   tx,
+			InclusionWait: 10,
+		})
+		require.Nil(t, err)
+	}
+	send(ClientTransaction{Instructions: []Instruction{instr}})
+	first, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+
+	// Every new block is proposed by the next node of the roster.
+	for i := 0; i < 4; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.Nil(t, err)
+		send(tx)
+	}
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	leaders := make(map[string]bool)
+	for sb := latest; sb.Index > first.Index; sb = s.service().db().GetByID(sb.BackLinkIDs[0]) {
+		_, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
+		require.Nil(t, err)
+		leader := bodyI.(*DataBody).Proposal.Leader
+		require.True(t, sb.Roster.List[sb.Index%4].Public.Equal(leader))
+		leaders[leader.String()] = true
+	}
+	require.Equal(t, 4, len(leaders))
+
+	// Only the leader for its index can propose the next block.
+	sb := latest.Copy()
+	sb.Index = latest.Index + 1
+	sb.BackLinkIDs = []skipchain.SkipBlockID{latest.Hash}
+	expected := sb.Roster.List[sb.Index%4]
+	for _, node := range s.services {
+		p, err := node.signProposal(scID, sb.Index, sb.Data)
+		require.Nil(t, err)
+		err = s.services[0].verifyProposal(sb, p)
+		if node.ServerIdentity().Equal(expected) {
+			require.Nil(t, err)
+		} else {
+			require.Equal(t, ErrWrongLeader, err)
+		}
+	}
+
+	// The view-change is started by the node after the leader for the
+	// index, not by the second node of the roster.
+	queue, err := leaderQueue(latest.Roster, sb.Index, latest.Hash, LeaderRoundRobin)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(queue))
+	require.True(t, queue[0].Equal(expected))
+	require.True(t, queue[1].Equal(sb.Roster.List[(sb.Index+1)%4]))
+
+	// A block changing the roster is still checked: it must come from the
+	// leader, or from a node taking over and leading the new roster.
+	sb.Roster = onet.NewRoster(append(queue[1:], queue[0]))
+	for _, node := range s.services {
+		p, err := node.signProposal(scID, sb.Index, sb.Data)
+		require.Nil(t, err)
+		err = s.services[0].verifyProposal(sb, p)
+		if node.ServerIdentity().Equal(queue[0]) || node.ServerIdentity().Equal(queue[1]) {
+			require.Nil(t, err)
+		} else {
+			require.Equal(t, ErrWrongLeader, err)
+		}
+	}
+}
+
+func TestService_ScheduledViewChange(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.NoError(t, err)
+	// The scheduling goes into the next block, then two more blocks are
+	// needed to reach the target.
+	target := latest.Index + 3
+	newRoster := onet.NewRoster(append(s.roster.List[1:], s.roster.List[0]))
+	rosterBuf, err := protobuf.Encode(newRoster)
+	require.NoError(t, err)
+	indexBuf := make([]byte, binary.MaxVarintLen64)
+	indexBuf = indexBuf[:binary.PutVarint(indexBuf, int64(target))]
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{
+				DarcID: s.darc.GetBaseID(),
+				SubID:  oneSubID,
+			},
+			Nonce:  GenNonce(),
+			Index:  0,
+			Length: 1,
+			Invoke: &Invoke{
+				Command: CmdScheduledViewChange,
+				Args: []Argument{
+					{Name: "roster", Value: rosterBuf},
+					{Name: "index", Value: indexBuf},
+				},
+			},
+		}},
+	}
+	require.NoError(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+
+	var scheduled bool
+	for i := 0; i < 10 && !scheduled; i++ {
+		time.Sleep(s.interval)
+		config, err := s.service().LoadConfig(scID)
 		require.NoError(t, err)
+		scheduled = config.ScheduledRosterChange != nil
+	}
+	require.True(t, scheduled, "view-change has not been scheduled")
 
-		if config.Roster.List[0].Equal(s.services[1].ServerIdentity()) {
-			ok = true
-			break
-		}
+	// A change for the block holding the instruction or an earlier one is
+	// refused when it is submitted. The contract doesn't depend on the
+	// tip of the node, so that the blocks can be executed again.
+	latest, err = s.service().db().GetLatestByID(scID)
+	require.NoError(t, err)
+	coll := s.service().GetCollectionView(scID)
+	for _, index := range []int{latest.Index, latest.Index + 1} {
+		indexBuf = make([]byte, binary.MaxVarintLen64)
+		indexBuf = indexBuf[:binary.PutVarint(indexBuf, int64(index))]
+		ctx.Instructions[0].Invoke.Args[1].Value = indexBuf
+		require.NoError(t, ctx.Instructions[0].SignBy(s.signer))
+		err = s.service().verifyInstruction(scID, ctx.Instructions[0], nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is not after the current block")
+		_, _, err = s.service().ContractConfig(coll, ctx.Instructions[0], nil)
+		require.NoError(t, err)
 	}
-	require.True(t, ok, "leader rotation failed")
 
-	// check that the leader is updated for all nodes
-	for _, service := range s.services[1:] {
-		// everyone should have the same leader after the genesis block is stored
-		leader, err := service.getLeader(s.sb.SkipChainID())
+	// Create one block after the other until the target has been passed.
+	for latest.Index <= target {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.NoError(t, err)
+		s.sendTx(t, tx)
+		pr := s.waitProof(t, tx.Instructions[0].InstanceID)
+		require.True(t, pr.InclusionProof.Match())
+		latest, err = s.service().db().GetLatestByID(scID)
 		require.NoError(t, err)
-		require.NotNil(t, leader)
-		require.True(t, leader.Equal(s.services[1].ServerIdentity()))
 	}
 
-	// try to send a transaction to the node on index 2, which is a
-	// follower (not the new leader)
-	tx1, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	roster, err := s.service().GetBlockRoster(scID, target-1)
 	require.NoError(t, err)
-	s.sendTxTo(t, tx1, 2)
+	require.True(t, roster.List[0].Equal(s.roster.List[0]))
+	roster, err = s.service().GetBlockRoster(scID, target)
+	require.NoError(t, err)
+	require.True(t, roster.List[0].Equal(s.roster.List[1]))
 
-	// wait for the transaction to be stored on the new leader, because it
-	// polls for new transactions
-	pr := s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 1)
-	require.True(t, pr.InclusionProof.Match())
+	config, err := s.service().LoadConfig(scID)
+	require.NoError(t, err)
+	require.Nil(t, config.ScheduledRosterChange)
+	require.True(t, config.Roster.List[0].Equal(s.roster.List[1]))
+}
 
-	// the transaction should also be stored on followers, at index 2 and 3
-	pr = s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 2)
-	require.True(t, pr.InclusionProof.Match())
-	pr = s.waitProofWithIdx(t, tx1.Instructions[0].InstanceID, 3)
+func TestService_SingleNode(t *testing.T) {
+	s := newSerN(t, 1, testInterval, 1, true)
+	defer s.local.CloseAll()
+	require.Equal(t, 1, len(s.sb.Roster.List))
+
+	// spawn a new instance
+	tx1, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx1)
+	pr := s.waitProof(t, tx1.Instructions[0].InstanceID)
 	require.True(t, pr.InclusionProof.Match())
+	require.Nil(t, pr.Verify(s.sb.SkipChainID()))
+
+	// invoke on the genesis darc
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	pr2 := s.testDarcEvolution(t, *d2, false)
+	require.True(t, pr2.InclusionProof.Match())
+	require.Nil(t, pr2.Verify(s.sb.SkipChainID()))
+
+	// a view-change on a single-node chain is a no-op
+	require.Nil(t, s.service().startViewChange(s.sb.SkipChainID()))
+	leader, err := s.service().getLeader(s.sb.SkipChainID())
+	require.Nil(t, err)
+	require.True(t, leader.Equal(s.service().ServerIdentity()))
+}
+
+func TestService_SingleNodeRotation(t *testing.T) {
+	local := onet.NewLocalTestT(tSuite, t)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(2, true)
+	r1 := onet.NewRoster(roster.List[:1])
+	r2 := onet.NewRoster(roster.List[1:])
+
+	require.Nil(t, validRotation(*r1, *r1))
+	require.NotNil(t, validRotation(*r1, *r2))
+	require.NotNil(t, validRotation(*r1, *roster))
 }
 
 func TestService_DarcToSc(t *testing.T) {
@@ -802,14 +4242,14 @@ func TestService_StateChangeCache(t *testing.T) {
 	tx, err := createOneClientTx(s.darc.GetBaseID(), contractID, []byte{}, s.signer)
 	txs := ClientTransactions([]ClientTransaction{tx})
 	require.NoError(t, err)
-	root, ctsOK, states, err := s.service().createStateChanges(coll, scID, txs)
+	root, ctsOK, states, err := s.service().createStateChanges(coll, scID, txs, time.Now().Unix())
 	require.NoError(t, err)
 	require.Equal(t, ctr, 1)
 
 	// If we call createStateChanges again, then it should load it from the
 	// cache, which means that ctr is still one (we do not call the
 	// contract twice).
-	root1, ctsOK1, states1, err := s.service().createStateChanges(coll, scID, txs)
+	root1, ctsOK1, states1, err := s.service().createStateChanges(coll, scID, txs, time.Now().Unix())
 	require.NoError(t, err)
 	require.Equal(t, ctr, 1)
 
@@ -821,7 +4261,7 @@ func TestService_StateChangeCache(t *testing.T) {
 	// again, i.e., ctr == 2.
 	s.service().stateChangeCache = newStateChangeCache()
 	require.NoError(t, err)
-	root2, ctsOK2, states2, err := s.service().createStateChanges(coll, scID, txs)
+	root2, ctsOK2, states2, err := s.service().createStateChanges(coll, scID, txs, time.Now().Unix())
 	require.NoError(t, err)
 	require.Equal(t, root, root2)
 	require.Equal(t, ctsOK, ctsOK2)
@@ -829,12 +4269,180 @@ func TestService_StateChangeCache(t *testing.T) {
 	require.Equal(t, ctr, 2)
 }
 
+func TestService_TooManyStateChanges(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	contractID := "tooManyStateChanges"
+	contract := func(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		scs := make([]StateChange, defaultMaxStateChanges+1)
+		for i := range scs {
+			scs[i] = NewStateChange(Create, inst.DeriveID(strconv.Itoa(i)), contractID, nil)
+		}
+		return scs, c, nil
+	}
+	s.service().registerContract(contractID, contract)
+
+	scID := s.sb.SkipChainID()
+	coll := s.service().getCollection(scID).coll
+	txBad, err := createOneClientTx(s.darc.GetBaseID(), contractID, []byte{}, s.signer)
+	require.NoError(t, err)
+	txGood, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	_, ctsOK, states, err := s.service().createStateChanges(coll, scID, ClientTransactions{txBad, txGood}, time.Now().Unix())
+	require.NoError(t, err)
+	require.Equal(t, ClientTransactions{txGood}, ctsOK)
+	require.Equal(t, 1, len(states))
+}
+
+func TestService_TxBatch(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	var txs ClientTransactions
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+		require.NoError(t, err)
+		txs = append(txs, tx)
+	}
+	txBad, err := createOneClientTx(s.darc.GetBaseID(), invalidKind, s.value, s.signer)
+	require.NoError(t, err)
+
+	// The batch ID only depends on the transactions.
+	batch := ClientTransactions{txs[0], txs[1]}
+	resp, err := s.service().AddTransactionBatch(&AddTxBatchRequest{
+		Version:      CurrentVersion,
+		SkipchainID:  scID,
+		Transactions: batch,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ClientTransactions{txs[0], txs[1]}.Hash(), resp.BatchID)
+	respBad, err := s.service().AddTransactionBatch(&AddTxBatchRequest{
+		Version:      CurrentVersion,
+		SkipchainID:  scID,
+		Transactions: ClientTransactions{txs[2], txBad},
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, resp.BatchID, respBad.BatchID)
+
+	for _, tx := range txs {
+		require.True(t, s.waitProof(t, tx.Instructions[0].InstanceID).InclusionProof.Match())
+	}
+	status, err := s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: resp.BatchID,
+	})
+	require.NoError(t, err)
+	require.Equal(t, TxIncluded, status.Status)
+	require.Equal(t, 2, status.Included)
+	require.Equal(t, 2, status.Total)
+
+	// The included batch has been forgotten.
+	_, err = s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: resp.BatchID,
+	})
+	require.Error(t, err)
+
+	// The invalid transaction is never included.
+	status, err = s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: respBad.BatchID,
+	})
+	require.NoError(t, err)
+	require.Equal(t, TxPartial, status.Status)
+	require.Equal(t, 1, status.Included)
+	require.Equal(t, 2, status.Total)
+
+	// A transaction that is not in a block yet.
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.NoError(t, err)
+	included, total, err := s.service().includedTxs(&txBatch{
+		scID:     scID,
+		txHashes: [][]byte{txs[0].Instructions.Hash()},
+		index:    latest.Index,
+	})
+	require.NoError(t, err)
+	require.Equal(t, TxPending, batchStatus(included, total))
+
+	_, err = s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: []byte("unknown"),
+	})
+	require.Error(t, err)
+
+	// Batches that are never fully included expire.
+	s.service().batchesMut.Lock()
+	s.service().batches[string(respBad.BatchID)].submitted = time.Now().Add(-batchTTL - time.Second)
+	s.service().batchesMut.Unlock()
+	_, err = s.service().GetTxStatus(&GetTxStatus{
+		Version: CurrentVersion,
+		BatchID: respBad.BatchID,
+	})
+	require.Error(t, err)
+}
+
+func TestService_FailedPreconditions(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	contractID := "failedPrecondition"
+	contract := func(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return nil, nil, ErrPreconditionFailed
+	}
+	s.service().registerContract(contractID, contract)
+	scID := s.sb.SkipChainID()
+	coll := s.service().getCollection(scID).coll
+
+	// By default, transactions with a failed precondition are dropped.
+	txFailed, err := createOneClientTx(s.darc.GetBaseID(), contractID, []byte{}, s.signer)
+	require.NoError(t, err)
+	txGood, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	_, ctsOK, states, err := s.service().createStateChanges(coll, scID, ClientTransactions{txFailed, txGood}, time.Now().Unix())
+	require.NoError(t, err)
+	require.Equal(t, ClientTransactions{txGood}, ctsOK)
+	require.Equal(t, 1, len(states))
+
+	// With the policy set, they are recorded without any state change.
+	config, err := s.service().LoadConfig(scID)
+	require.NoError(t, err)
+	config.RecordFailedPreconditions = true
+	scs, err := updateConfigScs(s.darc.GetBaseID(), config)
+	require.NoError(t, err)
+	collRecord := coll.Clone()
+	for _, sc := range scs {
+		require.NoError(t, storeInColl(collRecord, &sc))
+	}
+	txFailed, err = createOneClientTx(s.darc.GetBaseID(), contractID, []byte{}, s.signer)
+	require.NoError(t, err)
+	txGood, err = createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	block := ClientTransactions{txFailed, txGood}
+	_, ctsOK, states, err = s.service().createStateChanges(collRecord, scID, block, time.Now().Unix())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(ctsOK))
+	require.True(t, ctsOK[0].FailedPrecondition)
+	require.False(t, ctsOK[1].FailedPrecondition)
+	require.Equal(t, 1, len(states))
+
+	// The markers in a block must match the execution.
+	require.NoError(t, checkFailedPreconditions(ctsOK, ctsOK))
+	require.Error(t, checkFailedPreconditions(block, ctsOK))
+
+	// The hash in the header covers the markers.
+	flipped := append(ClientTransactions{}, ctsOK...)
+	flipped[0].FailedPrecondition = false
+	require.NotEqual(t, ctsOK.Hash(), flipped.Hash())
+}
+
 func createConfigTx(t *testing.T, s *ser, isgood bool) (ClientTransaction, ChainConfig) {
 	var config ChainConfig
 	if isgood {
-		config = ChainConfig{420 * time.Millisecond, *s.roster}
+		config = ChainConfig{BlockInterval: 420 * time.Millisecond, Roster: *s.roster, ConfigVersion: 1}
 	} else {
-		config = ChainConfig{-1, *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2)}
+		config = ChainConfig{BlockInterval: -1, Roster: *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2)}
 	}
 	configBuf, err := protobuf.Encode(&config)
 	require.NoError(t, err)
@@ -997,7 +4605,8 @@ func newSerN(t *testing.T, step int, interval time.Duration, n int, viewchange b
 	}
 
 	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster,
-		[]string{"spawn:dummy", "spawn:invalid", "spawn:panic", "spawn:darc", "invoke:update_config", "spawn:slow"}, s.signer.Identity())
+		[]string{"spawn:dummy", "spawn:invalid", "spawn:panic", "spawn:darc", "invoke:update_config", "spawn:slow",
+			"invoke:" + CmdScheduledViewChange}, s.signer.Identity())
 	require.Nil(t, err)
 	s.darc = &genesisMsg.GenesisDarc
 
@@ -1047,6 +4656,17 @@ func dummyContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateC
 	}, nil, nil
 }
 
+// structContractFunc stores every argument of the spawn instruction as a
+// field, the value of the instance being the root of the fields.
+func structContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	var fields []StructField
+	for _, arg := range inst.Spawn.Args {
+		fields = append(fields, StructField{arg.Name, arg.Value})
+	}
+	scs := StateChanges{NewStateChange(Create, inst.InstanceID, structKind, FieldsRoot(fields))}
+	return append(scs, FieldStateChanges(Create, inst.InstanceID, fields)...), nil, nil
+}
+
 func slowContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
 	// This has to sleep for less than testInterval / 2 or else it will
 	// block the system from processing txs. See #1359.
@@ -1077,3 +4697,390 @@ func genSubID() (n SubID) {
 	random.Bytes(n[:], random.New())
 	return n
 }
+
+func TestTrackingView_ReadProofs(t *testing.T) {
+	coll := collection.New(collection.Data{}, collection.Data{})
+	iID := InstanceID{darcidStr("instance"), genSubID()}
+	sc := NewStateChange(Create, iID, "dummy", []byte("old"))
+	require.Nil(t, storeInColl(coll, &sc))
+	other := NewStateChange(Create, InstanceID{darcidStr("other"), genSubID()}, "dummy", []byte("value"))
+	require.Nil(t, storeInColl(coll, &other))
+	p, err := coll.Get(sc.InstanceID).Proof()
+	require.Nil(t, err)
+	root := string(coll.GetRoot())
+
+	// The proof is made against the root, so the value is taken from it.
+	view := newTrackingView(coll.Clone())
+	view.useProofs([]collection.Proof{p}, provenRoots{root: {}}, nil)
+	value, contractID, err := view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, []byte("old"), value)
+	require.Equal(t, "dummy", contractID)
+	require.Equal(t, 1, view.provenReads)
+	require.True(t, view.touched(map[string]bool{string(sc.InstanceID): true}))
+
+	// Keys without a proof are read from the collection.
+	_, _, err = view.GetValues(other.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, 1, view.provenReads)
+
+	// Once the transaction writes the key, the proof no longer holds.
+	view.written(sc.InstanceID)
+	_, _, err = view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, 1, view.provenReads)
+
+	// Neither does it once an earlier transaction of the block wrote it.
+	view = newTrackingView(coll.Clone())
+	view.useProofs([]collection.Proof{p}, provenRoots{root: {}}, map[string]bool{string(sc.InstanceID): true})
+	_, _, err = view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, 0, view.provenReads)
+
+	// A proof against an older root still holds if its key has not been
+	// written since.
+	update := NewStateChange(Update, other.InstanceID, "dummy", []byte("new"))
+	require.Nil(t, storeInColl(coll, &update))
+	roots := provenRoots{string(coll.GetRoot()): {}, root: {string(other.InstanceID): true}}
+	view = newTrackingView(coll.Clone())
+	view.useProofs([]collection.Proof{p}, roots, nil)
+	value, _, err = view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, []byte("old"), value)
+	require.Equal(t, 1, view.provenReads)
+
+	// The key has been written since the proof has been made: the stale
+	// proof is ignored and the new value is read from the collection.
+	update = NewStateChange(Update, iID, "dummy", []byte("new"))
+	require.Nil(t, storeInColl(coll, &update))
+	roots[root][string(sc.InstanceID)] = true
+	roots[string(coll.GetRoot())] = map[string]bool{}
+	view = newTrackingView(coll.Clone())
+	view.useProofs([]collection.Proof{p}, roots, nil)
+	value, _, err = view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, []byte("new"), value)
+	require.Equal(t, 0, view.provenReads)
+
+	// So is a proof against a root that is not a recent one.
+	view = newTrackingView(coll.Clone())
+	view.useProofs([]collection.Proof{p}, provenRoots{string(coll.GetRoot()): {}}, nil)
+	_, _, err = view.GetValues(sc.InstanceID)
+	require.Nil(t, err)
+	require.Equal(t, 0, view.provenReads)
+}
+
+func TestService_Submitters(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	submitter := darc.NewSignerEd25519(nil, nil)
+	config, err := s.service().LoadConfig(scID)
+	require.NoError(t, err)
+	config.Submitters = []darc.Identity{submitter.Identity()}
+	config.ConfigVersion++
+	configBuf, err := protobuf.Encode(config)
+	require.NoError(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{s.darc.GetBaseID(), oneSubID},
+			Nonce:      GenNonce(),
+			Index:      0,
+			Length:     1,
+			Invoke: &Invoke{
+				Command: "update_config",
+				Args:    Arguments{{Name: "config", Value: configBuf}},
+			},
+		}},
+	}
+	require.NoError(t, ctx.Instructions[0].SignBy(s.signer))
+	s.sendTx(t, ctx)
+	for i := 0; i < 10; i++ {
+		config, err = s.service().LoadConfig(scID)
+		require.NoError(t, err)
+		if len(config.Submitters) == 1 {
+			break
+		}
+		time.Sleep(s.interval)
+	}
+	require.Equal(t, 1, len(config.Submitters))
+
+	// A valid transaction is refused if not sent by a submitter.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	req := &AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Transaction: tx,
+	}
+	_, err = s.service().AddTransaction(req)
+	require.Equal(t, ErrSubmitterNotAllowed, err)
+	require.NoError(t, req.SignSubmitter(s.signer))
+	_, err = s.service().AddTransaction(req)
+	require.Equal(t, ErrSubmitterNotAllowed, err)
+
+	// The signature must be over the sent transaction.
+	require.NoError(t, req.SignSubmitter(submitter))
+	other, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	req.Transaction = other
+	_, err = s.service().AddTransaction(req)
+	require.Equal(t, ErrSubmitterNotAllowed, err)
+
+	req.Transaction = tx
+	_, err = s.service().AddTransaction(req)
+	require.NoError(t, err)
+	s.waitProof(t, tx.Instructions[0].InstanceID)
+
+	batch := &AddTxBatchRequest{
+		Version:      CurrentVersion,
+		SkipchainID:  scID,
+		Transactions: ClientTransactions{other},
+	}
+	_, err = s.service().AddTransactionBatch(batch)
+	require.Equal(t, ErrSubmitterNotAllowed, err)
+	require.NoError(t, batch.SignSubmitter(submitter))
+	_, err = s.service().AddTransactionBatch(batch)
+	require.NoError(t, err)
+
+	// Partial signatures are refused as well without a submitter.
+	_, err = s.service().AddPartialSignature(&AddPartialSignature{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		Transaction: tx,
+	})
+	require.Equal(t, ErrSubmitterNotAllowed, err)
+}
+
+func TestService_IdempotentSpawn(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+
+	singleton := InstanceID{s.darc.GetBaseID(), genSubID()}
+	spawn := func(value []byte, idempotent bool) ClientTransaction {
+		instr, err := createInstr(s.darc.GetBaseID(), dummyKind, value, s.signer)
+		require.NoError(t, err)
+		instr.InstanceID = singleton
+		instr.Spawn.Idempotent = idempotent
+		require.NoError(t, instr.SignBy(s.signer))
+		return ClientTransaction{Instructions: Instructions{instr}}
+	}
+
+	coll := s.service().getCollection(scID).coll.Clone()
+	first := spawn([]byte("first"), true)
+	_, ctsOK, states, err := s.service().createStateChanges(coll, scID, ClientTransactions{first}, time.Now().Unix())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ctsOK))
+	require.Equal(t, 1, len(states))
+	for _, sc := range states {
+		require.NoError(t, storeInColl(coll, &sc))
+	}
+
+	// The retry is accepted without overwriting the singleton, while a
+	// normal spawn is refused.
+	retry := spawn([]byte("second"), true)
+	again := spawn([]byte("third"), false)
+	_, ctsOK, states, err = s.service().createStateChanges(coll, scID, ClientTransactions{retry, again}, time.Now().Unix())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ctsOK))
+	require.Equal(t, retry.Instructions.Hash(), ctsOK[0].Instructions.Hash())
+	require.Equal(t, 0, len(states))
+	value, _, err := getValueContract(&roCollection{coll}, singleton.Slice())
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), value)
+
+	// The flag is signed.
+	unsigned := spawn([]byte("first"), false)
+	unsigned.Instructions[0].Spawn.Idempotent = true
+	require.NotEqual(t, spawn([]byte("first"), false).Instructions[0].Hash(),
+		unsigned.Instructions[0].Hash())
+}
+
+func TestService_RejectionMetrics(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	scID := s.sb.SkipChainID()
+	require.Equal(t, 0, len(s.service().GetMetrics().Rejections))
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	req := &AddTxRequest{Version: CurrentVersion, SkipchainID: scID, Transaction: tx}
+	require.NoError(t, s.service().Halt(scID))
+	_, err = s.service().AddTransaction(req)
+	require.Equal(t, ErrHalted, err)
+	require.NoError(t, s.service().Resume(scID))
+
+	// Replays, too many state changes and contract errors while executing
+	// the transactions of a block are reported, but not counted.
+	coll := s.service().getCollection(scID).coll
+	instr, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	instr.Nonce = GenNonce()
+	require.NoError(t, instr.SignBy(s.signer))
+	replayed := ClientTransaction{Instructions: Instructions{instr}}
+	unknown, err := createOneClientTx(s.darc.GetBaseID(), "unknown", s.value, s.signer)
+	require.NoError(t, err)
+	p := execParams{maxScs: 10, noncePolicy: NonceIncreasing, rejections: make(map[string]error)}
+	s.service().executeTxs(coll, ClientTransactions{replayed, replayed, unknown}, p, false)
+	require.Equal(t, ErrReplay, p.rejections[string(replayed.Instructions.Hash())])
+	require.Equal(t, RejectOther, RejectionReason(p.rejections[string(unknown.Instructions.Hash())]))
+	p.maxScs = 1
+	s.service().executeTxs(coll, ClientTransactions{replayed}, p, false)
+	require.Equal(t, ErrTooManyStateChanges, p.rejections[string(replayed.Instructions.Hash())])
+	require.Equal(t, 1, len(s.service().GetMetrics().Rejections))
+
+	// Instructions referring to a future block are refused when the
+	// transactions are filtered.
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.NoError(t, err)
+	future, err := createInstr(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	future.BlockIndex = latest.Index + 1
+	require.NoError(t, future.SignBy(s.signer))
+	require.Empty(t, s.service().verifyAndFilterTxs(scID,
+		[]ClientTransaction{{Instructions: Instructions{future}}}))
+
+	// The leader counts the transactions rejected in the block it
+	// creates once, even if the state changes are created again.
+	invalid, err := createOneClientTx(s.darc.GetBaseID(), invalidKind, s.value, s.signer)
+	require.NoError(t, err)
+	valid, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	cts := ClientTransactions{invalid, valid}
+	_, err = s.service().createNewBlock(scID, nil, cts)
+	require.NoError(t, err)
+	_, _, _, err = s.service().createStateChanges(coll, scID, cts, time.Now().UnixNano())
+	require.NoError(t, err)
+
+	metrics := s.service().GetMetrics()
+	require.Equal(t, map[string]uint64{
+		"halted":       1,
+		"future_block": 1,
+		RejectOther:    1,
+	}, metrics.Rejections)
+
+	// The returned metrics are a copy.
+	metrics.Rejections["halted"] = 10
+	require.Equal(t, uint64(1), s.service().GetMetrics().Rejections["halted"])
+}
+
+func TestService_ContractCapabilities(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	coll := s.service().GetCollectionView(s.sb.SkipChainID())
+
+	// An unsupported command on a darc is refused before the contract
+	// is called.
+	instr := Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), SubID{}},
+		Invoke:     &Invoke{Command: "transfer"},
+	}
+	_, _, err := s.service().executeInstruction(coll, nil, instr)
+	require.Error(t, err)
+	require.Equal(t, "contract darc does not support action invoke:transfer", err.Error())
+
+	called := false
+	capsKind := "caps"
+	require.NoError(t, s.service().registerContract(capsKind,
+		func(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+			called = true
+			return nil, c, nil
+		}))
+	require.NoError(t, RegisterContractCapabilities(s.hosts[0], capsKind,
+		ContractCapabilities{Invoke: []string{"supported"}}))
+	iID := InstanceID{s.darc.GetBaseID(), genSubID()}
+	collCaps := s.service().getCollection(s.sb.SkipChainID()).coll.Clone()
+	sc := NewStateChange(Create, iID, capsKind, nil)
+	require.NoError(t, storeInColl(collCaps, &sc))
+	for _, instr := range []Instruction{
+		{InstanceID: iID, Invoke: &Invoke{Command: "unsupported"}},
+		{InstanceID: iID, Delete: &Delete{}},
+		{InstanceID: InstanceID{s.darc.GetBaseID(), genSubID()}, Spawn: &Spawn{ContractID: capsKind}},
+	} {
+		_, _, err = s.service().executeInstruction(&roCollection{collCaps}, nil, instr)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "contract caps does not support action")
+	}
+	require.False(t, called)
+	_, _, err = s.service().executeInstruction(&roCollection{collCaps}, nil, Instruction{
+		InstanceID: iID,
+		Invoke:     &Invoke{Command: "supported"},
+	})
+	require.NoError(t, err)
+	require.True(t, called)
+
+	// Contracts without capabilities are called for every action.
+	instr = Instruction{
+		InstanceID: InstanceID{s.darc.GetBaseID(), genSubID()},
+		Spawn: &Spawn{
+			ContractID: dummyKind,
+			Args:       Arguments{{Name: "data", Value: s.value}},
+		},
+	}
+	_, _, err = s.service().executeInstruction(coll, nil, instr)
+	require.NoError(t, err)
+}
+
+func TestService_AddTxEffects(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// The ID of a spawned darc is derived from its content.
+	id := []darc.Identity{s.signer.Identity()}
+	darc2 := darc.NewDarc(darc.InitRules(id, id), []byte("derived darc"))
+	darc2Buf, err := darc2.ToProto()
+	require.NoError(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: InstanceID{s.darc.GetBaseID(), SubID{}},
+			Nonce:      GenNonce(),
+			Index:      0,
+			Length:     1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args:       []Argument{{Name: "darc", Value: darc2Buf}},
+			},
+		}},
+	}
+	require.NoError(t, ctx.Instructions[0].SignBy(s.signer))
+	resp, err := s.service().AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   ctx,
+		InclusionWait: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []InstanceID{{darc2.GetBaseID(), SubID{}}}, resp.Created)
+	require.Equal(t, 0, len(resp.Modified))
+
+	pr, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		ID:      s.sb.SkipChainID(),
+		Key:     resp.Created[0].Slice(),
+	})
+	require.NoError(t, err)
+	require.True(t, pr.Proof.InclusionProof.Match())
+
+	// Without waiting, the effects are not known.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.NoError(t, err)
+	resp, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: tx,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.Created)
+
+	iID := InstanceID{darcidStr("darc"), genSubID()}
+	removed := InstanceID{darcidStr("darc"), genSubID()}
+	created, modified := instancesChanged(StateChanges{
+		NewStateChange(Create, iID, dummyKind, nil),
+		NewStateChange(Update, iID, dummyKind, nil),
+		NewStateChange(Remove, removed, dummyKind, nil),
+	})
+	require.Equal(t, []InstanceID{iID}, created)
+	require.Equal(t, []InstanceID{removed}, modified)
+}
@@ -24,6 +24,12 @@ type stateChangeValue struct {
 	merkleRoot []byte
 	ctsOK      ClientTransactions
 	states     StateChanges
+	// effects are the state changes of every instruction of every accepted
+	// transaction, keyed by the hash of its instructions.
+	effects map[string][]StateChanges
+	// rejections are the errors of every rejected transaction, keyed by
+	// the hash of its instructions.
+	rejections map[string]error
 }
 
 func newStateChangeCache() stateChangeCache {
@@ -63,3 +69,60 @@ func (c *stateChangeCache) update(scID skipchain.SkipBlockID, digest []byte, mer
 		states:     states,
 	}
 }
+
+// setEffects stores the state changes of every transaction in the cached
+// value with the given digest.
+func (c *stateChangeCache) setEffects(scID skipchain.SkipBlockID, digest []byte, effects map[string][]StateChanges) {
+	c.Lock()
+	defer c.Unlock()
+	out, ok := c.cache[string(scID)]
+	if ok && bytes.Equal(out.digest, digest) {
+		out.effects = effects
+	}
+}
+
+// getEffects returns the state changes of the transaction with the hash
+// txHash in the cached value with the given digest.
+func (c *stateChangeCache) getEffects(scID skipchain.SkipBlockID, digest, txHash []byte) StateChanges {
+	var scs StateChanges
+	for _, instrScs := range c.getInstrEffects(scID, digest, txHash) {
+		scs = append(scs, instrScs...)
+	}
+	return scs
+}
+
+// getInstrEffects returns the state changes of every instruction of the
+// transaction with the hash txHash in the cached value with the given
+// digest, or nil if they are not known.
+func (c *stateChangeCache) getInstrEffects(scID skipchain.SkipBlockID, digest, txHash []byte) []StateChanges {
+	c.Lock()
+	defer c.Unlock()
+	out, ok := c.cache[string(scID)]
+	if !ok || !bytes.Equal(out.digest, digest) {
+		return nil
+	}
+	return out.effects[string(txHash)]
+}
+
+// setRejections stores the errors of the rejected transactions in the cached
+// value with the given digest.
+func (c *stateChangeCache) setRejections(scID skipchain.SkipBlockID, digest []byte, rejections map[string]error) {
+	c.Lock()
+	defer c.Unlock()
+	out, ok := c.cache[string(scID)]
+	if ok && bytes.Equal(out.digest, digest) {
+		out.rejections = rejections
+	}
+}
+
+// getRejections returns the errors of the rejected transactions in the
+// cached value with the given digest.
+func (c *stateChangeCache) getRejections(scID skipchain.SkipBlockID, digest []byte) map[string]error {
+	c.Lock()
+	defer c.Unlock()
+	out, ok := c.cache[string(scID)]
+	if !ok || !bytes.Equal(out.digest, digest) {
+		return nil
+	}
+	return out.rejections
+}
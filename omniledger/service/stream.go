@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// maxBlockTxsPage is the maximum number of transactions returned by
+// GetBlockTransactions.
+const maxBlockTxsPage = 100
+
+// StreamBlockBody sends the transactions of the block at index in the
+// skipchain scID one at a time on the returned channel, in the order of the
+// block, and closes it after the last one. The body is decoded one
+// transaction at a time, so neither the service nor the client need to hold
+// all the decoded transactions. Once the transactions are sent, the error
+// channel gets nil, or the error that stopped the stream. Cancelling ctx
+// stops the stream, else the transactions must be read until the channel is
+// closed.
+func (s *Service) StreamBlockBody(ctx context.Context, scID skipchain.SkipBlockID, index int) (<-chan ClientTransaction, <-chan error) {
+	txs := make(chan ClientTransaction)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(txs)
+		resp, err := s.GetBlock(&GetBlock{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			Index:       index,
+		})
+		if err != nil {
+			errs <- err
+			return
+		}
+		errs <- streamTransactions(ctx, resp.Skipblock.Payload, txs)
+	}()
+	return txs, errs
+}
+
+// GetBlockTransactions returns up to req.Count transactions of a block,
+// starting at req.Start. It is the way for clients to stream the body of a
+// block, see Client.StreamBlockBody.
+func (s *Service) GetBlockTransactions(req *GetBlockTransactions) (*GetBlockTransactionsResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if req.Start < 0 {
+		return nil, errors.New("negative start")
+	}
+	count := req.Count
+	if count <= 0 || count > maxBlockTxsPage {
+		count = maxBlockTxsPage
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	txs, errs := s.StreamBlockBody(ctx, req.SkipchainID, req.Index)
+	resp := &GetBlockTransactionsResponse{Version: CurrentVersion}
+	i := 0
+	for ct := range txs {
+		if i >= req.Start {
+			if len(resp.Transactions) == count {
+				resp.More = true
+				return resp, nil
+			}
+			resp.Transactions = append(resp.Transactions, ct)
+		}
+		i++
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// streamTransactions decodes the DataBody in payload one field at a time and
+// sends the transactions on txs, until ctx is done. The payload is a
+// DataBody marshalled by network.Marshal: its message type followed by the
+// protobuf encoding, in which the transactions are the repeated field 1.
+func streamTransactions(ctx context.Context, payload []byte, txs chan<- ClientTransaction) error {
+	msgType := network.MessageType(&DataBody{})
+	if !bytes.HasPrefix(payload, msgType[:]) {
+		return errors.New("the payload is not a DataBody")
+	}
+	buf := payload[len(msgType):]
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		buf = buf[n:]
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(buf); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			buf = buf[n:]
+		case 1:
+			if len(buf) < 8 {
+				return errors.New("invalid fixed64")
+			}
+			buf = buf[8:]
+		case 2:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < l {
+				return errors.New("invalid length-delimited field")
+			}
+			field := buf[n : n+int(l)]
+			buf = buf[n+int(l):]
+			if key>>3 != 1 {
+				continue
+			}
+			var ct ClientTransaction
+			err := protobuf.DecodeWithConstructors(field, &ct, network.DefaultConstructors(cothority.Suite))
+			if err != nil {
+				return err
+			}
+			select {
+			case txs <- ct:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case 5:
+			if len(buf) < 4 {
+				return errors.New("invalid fixed32")
+			}
+			buf = buf[4:]
+		default:
+			return errors.New("unknown wire type")
+		}
+	}
+	return nil
+}
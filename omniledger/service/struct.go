@@ -1,8 +1,12 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"sync"
 
 	bolt "github.com/coreos/bbolt"
@@ -22,6 +26,79 @@ type collectionDB struct {
 	bucketName []byte
 	coll       *collection.Collection
 	scID       skipchain.SkipBlockID
+	// mut makes sure that proofs are not created while a block is
+	// applied to the collection.
+	mut sync.RWMutex
+	// latest is the ID of the latest block applied to the collection, or
+	// nil if no block has been applied to it. It is stored in the database
+	// with the state changes of the block, under latestBlockKey.
+	latest skipchain.SkipBlockID
+	// keySalt is the salt of the keys in the database, or nil if the keys
+	// are stored as they are. See newHashedCollectionDB.
+	keySalt []byte
+	// syncPolicy defines when the database is synced to disk, unsynced
+	// counts the blocks stored since the last sync.
+	syncPolicy SyncPolicy
+	unsynced   int
+	// contractSizes is the sum of the sizes of the instances of every
+	// contract, as returned by InstanceSize. It is counted when the
+	// collection is loaded and updated with every state change stored.
+	contractSizes map[string]int
+	// recentRoots are the roots of the collection after the latest blocks
+	// stored, oldest first, and recentWrites the keys written by each of
+	// these blocks. See provenRoots.
+	recentRoots  [][]byte
+	recentWrites []map[string]bool
+}
+
+// maxProofAge is the number of blocks a read proof of a transaction can lag
+// behind the latest block.
+const maxProofAge = 10
+
+// SyncPolicy defines after how many blocks the database of the collections
+// is synced to disk. It trades durability for throughput:
+//   - SyncEveryBlock, the default, syncs every block when it is stored. A
+//     crash of the node or of its system loses no stored block.
+//   - SyncEveryNBlocks(n) only syncs every n blocks. A crash of the node
+//     process loses nothing, as the writes are in the cache of the system,
+//     but a crash of the system can lose the last n-1 blocks or leave the
+//     database corrupted. The blocks the collection lost are applied again
+//     before the next block, but if the collection doesn't match the block
+//     it has recorded, the service refuses to start and the collection must
+//     be rebuilt from the skipchain.
+//   - SyncNever leaves it to the system and is only meant for tests.
+//
+// As syncing is a setting of the whole database, it also applies to the
+// other buckets of the database.
+type SyncPolicy int
+
+const (
+	// SyncEveryBlock syncs the database after every block.
+	SyncEveryBlock SyncPolicy = 0
+	// SyncNever never syncs the database.
+	SyncNever SyncPolicy = -1
+)
+
+// SyncEveryNBlocks returns the policy syncing the database every n blocks.
+func SyncEveryNBlocks(n int) SyncPolicy {
+	if n <= 1 {
+		return SyncEveryBlock
+	}
+	return SyncPolicy(n)
+}
+
+// setSyncPolicy changes the sync policy of the collection and of its
+// database. The database only reads NoSync when it commits a writable
+// transaction, so it is changed in one to not race with the other writers.
+func (c *collectionDB) setSyncPolicy(p SyncPolicy) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.syncPolicy = p
+	c.unsynced = 0
+	return c.db.Update(func(tx *bolt.Tx) error {
+		tx.DB().NoSync = p != SyncEveryBlock
+		return nil
+	})
 }
 
 // A CollectionView is an interface that defines the read-only operations
@@ -62,6 +139,67 @@ func (r *roCollection) GetValues(key []byte) (value []byte, contractID string, e
 // which is to be modified, we pass it as a pointer here.
 type OmniLedgerContract func(coll CollectionView, inst Instruction, inCoins []Coin) (sc []StateChange, outCoins []Coin, err error)
 
+// CoinPurse holds the coins passed from one instruction to the next one in a
+// ClientTransaction. A contract can use it to consume the coins it gets, and
+// then return Coins() as its output coins.
+type CoinPurse struct {
+	coins []Coin
+}
+
+// NewCoinPurse returns a purse with a copy of the given coins.
+func NewCoinPurse(coins []Coin) *CoinPurse {
+	return &CoinPurse{coins: append([]Coin{}, coins...)}
+}
+
+// Available returns the number of coins of the given type in the purse.
+func (cp *CoinPurse) Available(name InstanceID) uint64 {
+	var sum uint64
+	for _, c := range cp.coins {
+		if c.Name.Equal(name) {
+			if sum+c.Value < sum {
+				return math.MaxUint64
+			}
+			sum += c.Value
+		}
+	}
+	return sum
+}
+
+// Spend takes amount coins of the given type out of the purse. If there are
+// not enough coins, an error is returned and the purse is not changed.
+func (cp *CoinPurse) Spend(name InstanceID, amount uint64) error {
+	if cp.Available(name) < amount {
+		return errors.New("not enough coins in purse")
+	}
+	for i := range cp.coins {
+		if amount == 0 {
+			break
+		}
+		if !cp.coins[i].Name.Equal(name) {
+			continue
+		}
+		if cp.coins[i].Value >= amount {
+			cp.coins[i].Value -= amount
+			amount = 0
+		} else {
+			amount -= cp.coins[i].Value
+			cp.coins[i].Value = 0
+		}
+	}
+	return nil
+}
+
+// Coins returns the coins left in the purse, leaving out empty ones.
+func (cp *CoinPurse) Coins() []Coin {
+	coins := []Coin{}
+	for _, c := range cp.coins {
+		if c.Value > 0 {
+			coins = append(coins, c)
+		}
+	}
+	return coins
+}
+
 // newCollectionDB initialises a structure and reads all key/value pairs to store
 // it in the collection.
 func newCollectionDB(db *bolt.DB, name []byte) *collectionDB {
@@ -89,36 +227,245 @@ func dup(in []byte) []byte {
 	return append([]byte{}, in...)
 }
 
+// latestBlockKey is the key of the database entry holding the ID of the
+// latest block applied to the collection. Its length differs from the ones
+// of the keys of the instances.
+var latestBlockKey = []byte("latestblock")
+
+// keyHashMarker is the key of the database entry present if the keys are
+// hashed. Its length differs from the ones of the keys of the instances and
+// of the contracts.
+var keyHashMarker = []byte("keyhash")
+
+// newHashedCollectionDB is like newCollectionDB, but the keys of the
+// instances are stored in the database under their hash salted with salt,
+// so that an operator browsing the database cannot enumerate the IDs of the
+// instances. The collection, and so the proofs, still use the logical keys,
+// which are stored masked in front of the values to load the collection.
+//
+// The trade-offs are:
+//   - the same salt must be given every time the database is opened, as it
+//     is not stored. Without it, the collection has to be rebuilt from the
+//     skipchain.
+//   - whoever knows the salt can still check whether a given ID exists, and
+//     unmask all the keys.
+//   - StorageByDarc cannot seek by prefix anymore and has to go through all
+//     the instances.
+//
+// The hashing is chosen when the bucket is created: an error is returned if
+// the bucket already holds keys that are not hashed, or that are hashed with
+// another salt.
+func newHashedCollectionDB(db *bolt.DB, name []byte, salt []byte) (*collectionDB, error) {
+	if len(salt) == 0 {
+		return nil, errors.New("empty salt")
+	}
+	check := sha256.Sum256(salt)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		marker := b.Get(keyHashMarker)
+		switch {
+		case marker == nil:
+			if k, _ := b.Cursor().First(); k != nil {
+				return errors.New("the bucket already holds keys that are not hashed")
+			}
+			return b.Put(keyHashMarker, check[:])
+		case !bytes.Equal(marker, check[:]):
+			return errors.New("the keys of the bucket are hashed with another salt")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &collectionDB{
+		db:         db,
+		bucketName: name,
+		coll:       collection.New(collection.Data{}, collection.Data{}),
+		keySalt:    salt,
+	}
+	if err := c.loadAll(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// storageKey returns the key under which the instance with the given key is
+// stored in the database.
+func (c *collectionDB) storageKey(key []byte) []byte {
+	if c.keySalt == nil {
+		return key
+	}
+	h := sha256.New()
+	h.Write(c.keySalt)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// contractKey returns the key of the contract ID of the instance stored
+// under sk.
+func contractKey(sk []byte) []byte {
+	return append([]byte{'C'}, sk...)
+}
+
+// isInstanceKey returns true if k is the key of an instance in the database,
+// and not the key of a contract ID or of the marker.
+func (c *collectionDB) isInstanceKey(k []byte) bool {
+	if c.keySalt == nil {
+		return len(k) > 0 && k[0] != 'C' && !bytes.Equal(k, latestBlockKey)
+	}
+	return len(k) == sha256.Size
+}
+
+// instanceKeyLen returns the length of the keys of the instances in the
+// database.
+func (c *collectionDB) instanceKeyLen() int {
+	if c.keySalt == nil {
+		return darcIDLen + len(SubID{})
+	}
+	return sha256.Size
+}
+
+// maskKey xors key with a stream derived from the salt and the storage key.
+// As the storage key depends on key, every key has its own stream.
+func (c *collectionDB) maskKey(sk, key []byte) []byte {
+	masked := make([]byte, len(key))
+	var stream []byte
+	for i := range key {
+		if i%sha256.Size == 0 {
+			h := sha256.New()
+			h.Write(c.keySalt)
+			h.Write(sk)
+			h.Write([]byte{byte(i / sha256.Size)})
+			stream = h.Sum(nil)
+		}
+		masked[i] = key[i] ^ stream[i%sha256.Size]
+	}
+	return masked
+}
+
+// storageValue returns what is stored in the database for the instance. If
+// the keys are hashed, the masked key is prepended to the value.
+func (c *collectionDB) storageValue(sk, key, value []byte) []byte {
+	if c.keySalt == nil {
+		return value
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(key)+len(value))
+	buf = buf[:binary.PutUvarint(buf, uint64(len(key)))]
+	buf = append(buf, c.maskKey(sk, key)...)
+	return append(buf, value...)
+}
+
+// loadEntry returns copies of the key and the value of the instance stored
+// under sk with the database value v.
+func (c *collectionDB) loadEntry(sk, v []byte) (key, value []byte, err error) {
+	if c.keySalt == nil {
+		return dup(sk), dup(v), nil
+	}
+	l, n := binary.Uvarint(v)
+	if n <= 0 || uint64(len(v)-n) < l {
+		return nil, nil, fmt.Errorf("corrupted entry %x", sk)
+	}
+	key = c.maskKey(sk, v[n:n+int(l)])
+	return key, dup(v[n+int(l):]), nil
+}
+
+// putInstance stores the instance in the bucket.
+func (c *collectionDB) putInstance(bucket *bolt.Bucket, key, value, contractID []byte) error {
+	sk := c.storageKey(key)
+	if err := bucket.Put(sk, c.storageValue(sk, key, value)); err != nil {
+		return err
+	}
+	return bucket.Put(contractKey(sk), contractID)
+}
+
+// deleteInstance removes the instance from the bucket.
+func (c *collectionDB) deleteInstance(bucket *bolt.Bucket, key []byte) error {
+	sk := c.storageKey(key)
+	if err := bucket.Delete(sk); err != nil {
+		return err
+	}
+	return bucket.Delete(contractKey(sk))
+}
+
 func (c *collectionDB) loadAll() error {
 	return c.db.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
 		b := tx.Bucket([]byte(c.bucketName))
+		if latest := b.Get(latestBlockKey); latest != nil {
+			c.latest = dup(latest)
+		}
+		c.contractSizes = make(map[string]int)
 		cur := b.Cursor()
 
 		for k, v := cur.First(); k != nil; k, v = cur.Next() {
-			// This is a Contract key, skip it.
-			if len(k) > 0 && k[0] == 'C' {
+			// This is a Contract key or the marker, skip it.
+			if !c.isInstanceKey(k) {
 				continue
 			}
-			kc := make([]byte, len(k)+1)
-			kc[0] = 'C'
-			copy(kc[1:], k)
-
-			cv := b.Get(kc)
+			cv := b.Get(contractKey(k))
 			if cv == nil {
 				return fmt.Errorf("contract ype missing for object ID %x", k)
 			}
-			err := c.coll.Add(dup(k), dup(v), dup(cv))
+			key, value, err := c.loadEntry(k, v)
 			if err != nil {
 				return err
 			}
+			err = c.coll.Add(key, value, dup(cv))
+			if err != nil {
+				return err
+			}
+			c.contractSizes[string(cv)] += instanceSize(key, value, cv)
 		}
 
 		return nil
 	})
 }
 
+// resolveStateAction returns the state change with a built-in action that
+// has the same effect on coll as t. Custom state actions are resolved by
+// calling their handler.
+func resolveStateAction(coll *collection.Collection, t StateChange) (StateChange, error) {
+	switch t.StateAction {
+	case Create, Update, Remove:
+		return t, nil
+	}
+	ca, ok := getStateAction(t.StateAction)
+	if !ok {
+		return t, errors.New("invalid state action")
+	}
+	current, _, err := getValueContract(&roCollection{coll}, t.InstanceID)
+	exists := err == nil
+	if !exists {
+		current = nil
+	}
+	value, err := ca.handler(current, t)
+	if err != nil {
+		return t, err
+	}
+	resolved := StateChange{
+		StateAction: Update,
+		InstanceID:  t.InstanceID,
+		ContractID:  t.ContractID,
+		Value:       value,
+	}
+	if !exists {
+		resolved.StateAction = Create
+	}
+	return resolved, nil
+}
+
 func storeInColl(coll *collection.Collection, t *StateChange) error {
+	resolved, err := resolveStateAction(coll, *t)
+	if err != nil {
+		return err
+	}
+	return storeResolvedInColl(coll, &resolved)
+}
+
+func storeResolvedInColl(coll *collection.Collection, t *StateChange) error {
 	switch t.StateAction {
 	case Create:
 		return coll.Add(t.InstanceID, t.Value, t.ContractID)
@@ -141,29 +488,21 @@ func (c *collectionDB) GetValues(key []byte) (value []byte, contractID string, e
 
 // FIXME: if there is a failure in boltdb update, then our state will be
 // inconsistent, an entry in collection may not be in boltdb.
-func (c *collectionDB) Store(t *StateChange) error {
-	if err := storeInColl(c.coll, t); err != nil {
+func (c *collectionDB) Store(sc *StateChange) error {
+	t, err := resolveStateAction(c.coll, *sc)
+	if err != nil {
+		return err
+	}
+	if err := c.storeResolved(&t); err != nil {
 		return err
 	}
 	return c.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(c.bucketName))
-
-		// The contract type is stored in a key starting with C
-		keyC := make([]byte, 1+len(t.InstanceID))
-		keyC[0] = byte('C')
-		copy(keyC[1:], t.InstanceID)
-
 		switch t.StateAction {
 		case Create, Update:
-			if err := bucket.Put(t.InstanceID, t.Value); err != nil {
-				return err
-			}
-			return bucket.Put(keyC, t.ContractID)
+			return c.putInstance(bucket, t.InstanceID, t.Value, t.ContractID)
 		case Remove:
-			if err := bucket.Delete(t.InstanceID); err != nil {
-				return err
-			}
-			return bucket.Delete(keyC)
+			return c.deleteInstance(bucket, t.InstanceID)
 		default:
 			return errors.New("invalid state action")
 		}
@@ -172,11 +511,25 @@ func (c *collectionDB) Store(t *StateChange) error {
 
 // FIXME: if there is an error, the data in collection may not be consistent
 // with boltdb.
-func (c *collectionDB) StoreAll(ts StateChanges) error {
-	for _, t := range ts {
-		if err := storeInColl(c.coll, &t); err != nil {
+func (c *collectionDB) StoreAll(scs StateChanges) error {
+	return c.storeAll(scs, nil)
+}
+
+// storeAll stores the state changes, and id as the latest block applied to
+// the collection if it is not nil, in the same transaction of the database.
+func (c *collectionDB) storeAll(scs StateChanges, id skipchain.SkipBlockID) error {
+	// Custom actions depend on the previous state changes, so they are
+	// resolved while applying them.
+	ts := make(StateChanges, len(scs))
+	for i, sc := range scs {
+		t, err := resolveStateAction(c.coll, sc)
+		if err != nil {
+			return err
+		}
+		if err := c.storeResolved(&t); err != nil {
 			return err
 		}
+		ts[i] = t
 	}
 	return c.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(c.bucketName))
@@ -184,32 +537,244 @@ func (c *collectionDB) StoreAll(ts StateChanges) error {
 			return errors.New("bucket does not exist")
 		}
 		for _, t := range ts {
-			// The contract type is stored in a key starting with C
-			keyC := make([]byte, 1+len(t.InstanceID))
-			keyC[0] = byte('C')
-			copy(keyC[1:], t.InstanceID)
-
 			switch t.StateAction {
 			case Create, Update:
-				if err := bucket.Put(t.InstanceID, t.Value); err != nil {
-					return err
-				}
-				if err := bucket.Put(keyC, t.ContractID); err != nil {
+				if err := c.putInstance(bucket, t.InstanceID, t.Value, t.ContractID); err != nil {
 					return err
 				}
 			case Remove:
-				if err := bucket.Delete(t.InstanceID); err != nil {
-					return err
-				}
-				if err := bucket.Delete(keyC); err != nil {
+				if err := c.deleteInstance(bucket, t.InstanceID); err != nil {
 					return err
 				}
 			default:
 				return errors.New("invalid state action")
 			}
 		}
+		if id != nil {
+			return bucket.Put(latestBlockKey, id)
+		}
+		return nil
+	})
+}
+
+// storeResolved applies the resolved state change t to the collection and
+// updates the sizes of the contracts of the instance before and after it.
+func (c *collectionDB) storeResolved(t *StateChange) error {
+	before := instanceFootprint(&roCollection{c.coll}, t.InstanceID)
+	if err := storeResolvedInColl(c.coll, t); err != nil {
+		return err
+	}
+	after := instanceFootprint(&roCollection{c.coll}, t.InstanceID)
+	if before.size > 0 {
+		c.contractSizes[before.contractID] -= before.size
+	}
+	if after.size > 0 {
+		c.contractSizes[after.contractID] += after.size
+	}
+	return nil
+}
+
+// instanceSize returns the number of bytes an instance uses in the database.
+// The key is stored twice, once for the value and once with a 'C' prefix for
+// the contract ID.
+func instanceSize(key, value, contractID []byte) int {
+	return 2*len(key) + 1 + len(value) + len(contractID)
+}
+
+// InstanceSize returns the size of the instance: its key, value and contract
+// ID. It is the number of bytes stored in the database if the keys are not
+// hashed. With hashed keys, the size is the same, so that all nodes count the
+// same sizes for the storage quotas.
+func (c *collectionDB) InstanceSize(iID InstanceID) (size int, err error) {
+	sk := c.storageKey(iID.Slice())
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		v := bucket.Get(sk)
+		if v == nil {
+			return errors.New("instance does not exist")
+		}
+		key, value, err := c.loadEntry(sk, v)
+		if err != nil {
+			return err
+		}
+		size = instanceSize(key, value, bucket.Get(contractKey(sk)))
+		return nil
+	})
+	return
+}
+
+// forEachInstance calls f with the logical key, the value and the contract ID
+// of every instance of the bucket, and its size as returned by InstanceSize.
+func (c *collectionDB) forEachInstance(bucket *bolt.Bucket, f func(key, value, contractID []byte, size int)) error {
+	cur := bucket.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		// Skip the contract keys and the marker.
+		if len(k) != c.instanceKeyLen() {
+			continue
+		}
+		cid := bucket.Get(contractKey(k))
+		key, value, err := c.loadEntry(k, v)
+		if err != nil {
+			return err
+		}
+		f(key, value, cid, instanceSize(key, value, cid))
+	}
+	return nil
+}
+
+// StorageByDarc returns the sum of the sizes of all the instances governed
+// by the darc with base ID darcID, including the darc itself.
+func (c *collectionDB) StorageByDarc(darcID darc.ID) (size int, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		if c.keySalt != nil {
+			// The hashed keys cannot be sought by prefix.
+			return c.forEachInstance(bucket, func(key, _, _ []byte, s int) {
+				if bytes.HasPrefix(key, darcID) {
+					size += s
+				}
+			})
+		}
+		cur := bucket.Cursor()
+		for k, v := cur.Seek(darcID); k != nil && bytes.HasPrefix(k, darcID); k, v = cur.Next() {
+			// Skip the contract keys, in case the darcID starts with 'C'.
+			if len(k) != len(darcID)+len(SubID{}) {
+				continue
+			}
+			size += instanceSize(k, v, bucket.Get(contractKey(k)))
+		}
 		return nil
 	})
+	return
+}
+
+// contractSizesOf returns the sizes of the instances of the contracts of
+// cids in coll. If coll holds the same state as the collection, they are the
+// counters of the collection, else the instances of coll are counted.
+func (c *collectionDB) contractSizesOf(coll *collection.Collection, cids map[string]int) map[string]int {
+	sizes := make(map[string]int)
+	c.mut.RLock()
+	same := bytes.Equal(coll.GetRoot(), c.coll.GetRoot())
+	if same {
+		for cid := range cids {
+			sizes[cid] = c.contractSizes[cid]
+		}
+	}
+	c.mut.RUnlock()
+	if same {
+		return sizes
+	}
+	coll.ForEach(func(key []byte, values [][]byte) {
+		if len(values) < 2 {
+			return
+		}
+		if _, ok := cids[string(values[1])]; ok {
+			sizes[string(values[1])] += instanceSize(key, values[0], values[1])
+		}
+	})
+	return sizes
+}
+
+// StorageByContract returns the sum of the sizes of all the instances of
+// the contract contractID. It is counted with the state changes stored, so
+// the database is not read.
+func (c *collectionDB) StorageByContract(contractID string) (size int, err error) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return c.contractSizes[contractID], nil
+}
+
+// ContractInstances returns the IDs and the values of all the instances of
+// the contract contractID.
+func (c *collectionDB) ContractInstances(contractID string) (ids []InstanceID, values [][]byte, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		return c.forEachInstance(bucket, func(key, value, cid []byte, _ int) {
+			if string(cid) == contractID {
+				ids = append(ids, NewInstanceID(key))
+				values = append(values, value)
+			}
+		})
+	})
+	return
+}
+
+// StoreBlock applies the state changes of the block with the given ID, and
+// records it as the latest block applied to the collection.
+func (c *collectionDB) StoreBlock(id skipchain.SkipBlockID, scs StateChanges) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if len(c.recentRoots) == 0 {
+		c.recentRoots = [][]byte{c.coll.GetRoot()}
+		c.recentWrites = []map[string]bool{{}}
+	}
+	if err := c.storeAll(scs, id); err != nil {
+		return err
+	}
+	c.latest = id
+	keys := make(map[string]bool)
+	for _, sc := range scs {
+		keys[string(sc.InstanceID)] = true
+	}
+	c.recentRoots = append(c.recentRoots, c.coll.GetRoot())
+	c.recentWrites = append(c.recentWrites, keys)
+	if len(c.recentRoots) > maxProofAge+1 {
+		c.recentRoots = c.recentRoots[1:]
+		c.recentWrites = c.recentWrites[1:]
+	}
+	if c.syncPolicy > SyncEveryBlock {
+		c.unsynced++
+		if c.unsynced >= int(c.syncPolicy) {
+			c.unsynced = 0
+			return c.db.Sync()
+		}
+	}
+	return nil
+}
+
+// provenRoots maps the roots read proofs can be made against to the keys
+// written since them, which the proofs no longer prove.
+type provenRoots map[string]map[string]bool
+
+// provenRoots returns the roots of the latest blocks stored, if root is the
+// current one. Else the collection is being executed on is not the one
+// stored, and only proofs against root itself are good.
+func (c *collectionDB) provenRoots(root []byte) provenRoots {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	roots := provenRoots{string(root): {}}
+	n := len(c.recentRoots)
+	if n == 0 || !bytes.Equal(c.recentRoots[n-1], root) {
+		return roots
+	}
+	since := make(map[string]bool)
+	for i := n - 2; i >= 0; i-- {
+		for k := range c.recentWrites[i+1] {
+			since[k] = true
+		}
+		keys := make(map[string]bool, len(since))
+		for k := range since {
+			keys[k] = true
+		}
+		roots[string(c.recentRoots[i])] = keys
+	}
+	return roots
+}
+
+// latestBlock returns the ID of the latest block applied to the collection.
+func (c *collectionDB) latestBlock() skipchain.SkipBlockID {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return c.latest
 }
 
 // RootHash returns the hash of the root node in the merkle tree.
@@ -278,15 +843,174 @@ func RegisterContract(s skipchain.GetService, kind string, f OmniLedgerContract)
 	return scs.(*Service).registerContract(kind, f)
 }
 
+// ContractSchema declares the names of the arguments a contract
+// understands. If Strict is set, the service rejects every instruction for
+// this contract that holds an argument which is not declared, before the
+// contract is called. Without Strict the schema is informative only.
+type ContractSchema struct {
+	Arguments []string
+	Strict    bool
+}
+
+// checkArguments returns an error if the schema is strict and one of args is
+// not declared in the schema. The TTL of a spawn is always accepted.
+func (cs ContractSchema) checkArguments(args Arguments) error {
+	if !cs.Strict {
+		return nil
+	}
+	for _, arg := range args {
+		found := arg.Name == ttlArgument
+		for _, name := range cs.Arguments {
+			if arg.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("unknown argument: " + arg.Name)
+		}
+	}
+	return nil
+}
+
+// RegisterContractSchema stores the argument schema of a contract. The
+// contract itself has to be registered using RegisterContract.
+func RegisterContractSchema(s skipchain.GetService, contractID string, schema ContractSchema) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractSchema(contractID, schema)
+}
+
+// ContractCapabilities declares the actions a contract supports. If they are
+// registered, the service rejects every instruction with another action
+// before the contract is called, so that the client gets a clear error.
+type ContractCapabilities struct {
+	// Spawn is true if instances of the contract can be spawned.
+	Spawn bool
+	// Invoke are the commands the instances of the contract understand.
+	Invoke []string
+	// Delete is true if the instances of the contract can be deleted.
+	Delete bool
+	// SelfAuthorized are the invoke commands the contract authorizes
+	// itself, e.g. against a state stored in the instance. The signatures
+	// of such instructions are verified, but the darc of the instance is
+	// not checked, so the contract must check the signers.
+	SelfAuthorized []string
+}
+
+// selfAuthorized returns true if the contract authorizes the command of the
+// invoke instruction instr itself.
+func (cc ContractCapabilities) selfAuthorized(instr Instruction) bool {
+	if instr.GetType() != InvokeType {
+		return false
+	}
+	for _, cmd := range cc.SelfAuthorized {
+		if cmd == instr.Invoke.Command {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAction returns an error if the contract contractID doesn't support
+// the action of instr. The migrate command is handled by the service, so it
+// is always supported.
+func (cc ContractCapabilities) checkAction(contractID string, instr Instruction) error {
+	supported := false
+	switch instr.GetType() {
+	case SpawnType:
+		supported = cc.Spawn
+	case InvokeType:
+		if instr.Invoke.Command == CmdMigrate {
+			return nil
+		}
+		for _, cmd := range cc.Invoke {
+			if cmd == instr.Invoke.Command {
+				supported = true
+				break
+			}
+		}
+	case DeleteType:
+		supported = cc.Delete
+	}
+	if !supported {
+		return fmt.Errorf("contract %s does not support action %s", contractID, instr.Action())
+	}
+	return nil
+}
+
+// RegisterContractCapabilities stores the actions a contract supports. The
+// contract itself has to be registered using RegisterContract.
+func RegisterContractCapabilities(s skipchain.GetService, contractID string, caps ContractCapabilities) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractCapabilities(contractID, caps)
+}
+
+// RegisterContractState declares the type of the values a contract stores in
+// its instances, so that they can be decoded with DecodeState. The values
+// must be protobuf-encoded structures, and prototype is such a structure or
+// a pointer to it.
+func RegisterContractState(s skipchain.GetService, contractID string, prototype interface{}) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractState(contractID, prototype)
+}
+
+// ContractStateDecoder decodes the value of an instance of a contract whose
+// values are not protobuf-encoded structures.
+type ContractStateDecoder func(value []byte) (interface{}, error)
+
+// RegisterContractStateDecoder declares the function decoding the values of
+// the instances of a contract, for DecodeState. It takes precedence over a
+// prototype registered with RegisterContractState.
+func RegisterContractStateDecoder(s skipchain.GetService, contractID string, d ContractStateDecoder) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractStateDecoder(contractID, d)
+}
+
+// BlockRandomness returns a pseudo-random value derived from the
+// CollectionRoot and the StateChangesHash of the header and the given seed.
+// Everybody having the header can recompute and verify it, and different
+// seeds give independent values for the same block.
+//
+// The value is not perfectly unbiasable: the leader cannot choose the hashes
+// once the transactions of the block are fixed, but it can choose which
+// transactions to include, and so try out several candidate blocks and only
+// propose the one giving the value it prefers. As the header of a block is
+// only known once the block has been created, contracts can only use the
+// header of a previous block.
+func BlockRandomness(header DataHeader, seed []byte) []byte {
+	h := sha256.New()
+	h.Write(header.CollectionRoot)
+	h.Write(header.StateChangesHash)
+	h.Write(seed)
+	return h.Sum(nil)
+}
+
 type olState struct {
 	sync.Mutex
 	// lastBlock is the last integrated block into the collection
 	lastBlock map[string]skipchain.SkipBlockID
 	// waitChannels will be informed by Service.updateCollection that a
-	// given ClientTransaction has been included. updateCollection will
-	// send true for a valid ClientTransaction and false for an invalid
-	// ClientTransaction.
-	waitChannels map[string]chan bool
+	// given ClientTransaction has been included, with its outcome.
+	waitChannels map[string]chan txOutcome
+}
+
+// txOutcome tells whether a ClientTransaction included in a block is valid,
+// and holds the state changes it produced.
+type txOutcome struct {
+	valid   bool
+	effects StateChanges
 }
 
 func (ol *olState) setLast(sb *skipchain.SkipBlock) {
@@ -301,20 +1025,20 @@ func (ol *olState) getLast(id skipchain.SkipBlockID) skipchain.SkipBlockID {
 	return ol.lastBlock[string(id)]
 }
 
-func (ol *olState) createWaitChannel(ctxHash []byte) chan bool {
+func (ol *olState) createWaitChannel(ctxHash []byte) chan txOutcome {
 	ol.Lock()
 	defer ol.Unlock()
-	ch := make(chan bool, 1)
+	ch := make(chan txOutcome, 1)
 	ol.waitChannels[string(ctxHash)] = ch
 	return ch
 }
 
-func (ol *olState) informWaitChannel(ctxHash []byte, valid bool) {
+func (ol *olState) informWaitChannel(ctxHash []byte, outcome txOutcome) {
 	ol.Lock()
 	defer ol.Unlock()
 	ch := ol.waitChannels[string(ctxHash)]
 	if ch != nil {
-		ch <- valid
+		ch <- outcome
 	}
 }
 
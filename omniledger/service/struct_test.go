@@ -1,12 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/omniledger/collection"
 	"github.com/stretchr/testify/require"
 )
 
@@ -120,6 +122,101 @@ func TestCollectionDB(t *testing.T) {
 	}
 }
 
+func TestCollectionDBHashedKeys(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	salt := []byte("salt")
+	plain := newCollectionDB(db, []byte("plain"))
+	cdb, err := newHashedCollectionDB(db, testName, salt)
+	require.Nil(t, err)
+	var keys [][]byte
+	for i := 0; i < 8; i++ {
+		key := InstanceID{darcidStr("darc"), subidStr(fmt.Sprintf("sub%d", i))}.Slice()
+		keys = append(keys, key)
+		sc := &StateChange{
+			StateAction: Create,
+			InstanceID:  key,
+			Value:       []byte(fmt.Sprintf("value%d", i)),
+			ContractID:  []byte("myContract"),
+		}
+		require.Nil(t, cdb.Store(sc))
+		require.Nil(t, plain.Store(sc))
+	}
+	require.Nil(t, cdb.Store(&StateChange{StateAction: Remove, InstanceID: keys[0]}))
+	require.Nil(t, plain.Store(&StateChange{StateAction: Remove, InstanceID: keys[0]}))
+	require.Equal(t, plain.RootHash(), cdb.RootHash())
+
+	// The logical keys don't appear in the database.
+	require.Nil(t, db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(testName).ForEach(func(k, v []byte) error {
+			for _, key := range keys {
+				require.False(t, bytes.Contains(k, key))
+				require.False(t, bytes.Contains(v, key))
+			}
+			return nil
+		})
+	}))
+
+	// The collection is loaded again with the logical keys.
+	cdb2, err := newHashedCollectionDB(db, testName, salt)
+	require.Nil(t, err)
+	require.Equal(t, cdb.RootHash(), cdb2.RootHash())
+	_, _, err = cdb2.GetValues(keys[0])
+	require.NotNil(t, err)
+	for i, key := range keys[1:] {
+		value, contract, err := cdb2.GetValues(key)
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("value%d", i+1), string(value))
+		require.Equal(t, "myContract", contract)
+
+		proof, err := cdb2.Get(key).Proof()
+		require.Nil(t, err)
+		require.True(t, proof.Match())
+		require.True(t, plain.coll.Verify(proof))
+	}
+	ids, _, err := cdb2.ContractInstances("myContract")
+	require.Nil(t, err)
+	require.Equal(t, len(keys)-1, len(ids))
+	size, err := cdb2.StorageByDarc(darcidStr("darc"))
+	require.Nil(t, err)
+	sizeContract, err := cdb2.StorageByContract("myContract")
+	require.Nil(t, err)
+	require.Equal(t, sizeContract, size)
+
+	// The sizes and the exported instances don't depend on the hashing.
+	sizePlain, err := plain.StorageByContract("myContract")
+	require.Nil(t, err)
+	require.Equal(t, sizePlain, sizeContract)
+	sizePlain, err = plain.InstanceSize(NewInstanceID(keys[1]))
+	require.Nil(t, err)
+	size, err = cdb2.InstanceSize(NewInstanceID(keys[1]))
+	require.Nil(t, err)
+	require.Equal(t, sizePlain, size)
+	instances, err := cdb2.archivedInstances()
+	require.Nil(t, err)
+	instancesPlain, err := plain.archivedInstances()
+	require.Nil(t, err)
+	require.Equal(t, len(keys)-1, len(instances))
+	require.Equal(t, len(instancesPlain), len(instances))
+	for _, inst := range instances {
+		value, contract, err := plain.GetValues(inst.Key)
+		require.Nil(t, err)
+		require.Equal(t, value, inst.Value)
+		require.Equal(t, contract, string(inst.ContractID))
+	}
+
+	_, err = newHashedCollectionDB(db, testName, []byte("other salt"))
+	require.NotNil(t, err)
+	_, err = newHashedCollectionDB(db, []byte("plain"), salt)
+	require.NotNil(t, err)
+}
+
 // TODO: Test good case, bad add case, bad remove case
 func TestCollectionDBtryHash(t *testing.T) {
 	tmpDB, err := ioutil.TempFile("", "tmpDB")
@@ -155,3 +252,317 @@ func TestCollectionDBtryHash(t *testing.T) {
 	mrReal := cdb.RootHash()
 	require.Equal(t, mrTrial, mrReal)
 }
+
+func TestCollectionDBInstanceSize(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	cdb := newCollectionDB(db, testName)
+	contract := []byte("myContract")
+	iID1 := InstanceID{darcidStr("darc1"), subidStr("one")}
+	iID2 := InstanceID{darcidStr("darc1"), subidStr("two")}
+	iID3 := InstanceID{darcidStr("darc2"), subidStr("one")}
+	for _, iID := range []InstanceID{iID1, iID2, iID3} {
+		require.Nil(t, cdb.Store(&StateChange{
+			StateAction: Create,
+			InstanceID:  iID.Slice(),
+			Value:       []byte("value"),
+			ContractID:  contract,
+		}))
+	}
+
+	overhead := 2*len(iID1.Slice()) + 1 + len(contract)
+	size, err := cdb.InstanceSize(iID1)
+	require.Nil(t, err)
+	require.Equal(t, overhead+len("value"), size)
+
+	// A bigger value makes the instance bigger.
+	require.Nil(t, cdb.Store(&StateChange{
+		StateAction: Update,
+		InstanceID:  iID1.Slice(),
+		Value:       []byte("a longer value"),
+		ContractID:  contract,
+	}))
+	size, err = cdb.InstanceSize(iID1)
+	require.Nil(t, err)
+	require.Equal(t, overhead+len("a longer value"), size)
+
+	size, err = cdb.StorageByDarc(darcidStr("darc1"))
+	require.Nil(t, err)
+	require.Equal(t, 2*overhead+len("a longer value")+len("value"), size)
+	size, err = cdb.StorageByDarc(darcidStr("darc3"))
+	require.Nil(t, err)
+	require.Equal(t, 0, size)
+
+	_, err = cdb.InstanceSize(InstanceID{darcidStr("darc3"), SubID{}})
+	require.NotNil(t, err)
+
+	// The size of the contract follows the updates and the removals, and
+	// is counted again when the collection is loaded.
+	size, err = cdb.StorageByContract(string(contract))
+	require.Nil(t, err)
+	require.Equal(t, 3*overhead+len("a longer value")+2*len("value"), size)
+	require.Nil(t, cdb.StoreAll(StateChanges{
+		{StateAction: Remove, InstanceID: iID2.Slice()},
+		{StateAction: Create, InstanceID: iID2.Slice(), Value: []byte("v"), ContractID: []byte("other")},
+	}))
+	size, err = cdb.StorageByContract(string(contract))
+	require.Nil(t, err)
+	require.Equal(t, 2*overhead+len("a longer value")+len("value"), size)
+	size, err = cdb.StorageByContract("other")
+	require.Nil(t, err)
+	require.Equal(t, 2*len(iID2.Slice())+1+len("other")+len("v"), size)
+	cdb2 := newCollectionDB(db, testName)
+	for _, cid := range []string{string(contract), "other"} {
+		size, err = cdb.StorageByContract(cid)
+		require.Nil(t, err)
+		size2, err := cdb2.StorageByContract(cid)
+		require.Nil(t, err)
+		require.Equal(t, size, size2)
+	}
+
+	// The sizes of another state are counted from its instances.
+	cids := map[string]int{string(contract): 0}
+	require.Equal(t, 2*overhead+len("a longer value")+len("value"),
+		cdb.contractSizesOf(cdb.coll, cids)[string(contract)])
+	other := cdb.coll.Clone()
+	require.Nil(t, other.Remove(iID1.Slice()))
+	require.Equal(t, overhead+len("value"), cdb.contractSizesOf(other, cids)[string(contract)])
+}
+
+func TestBlockRandomness(t *testing.T) {
+	h1 := DataHeader{
+		CollectionRoot:   []byte("root1"),
+		StateChangesHash: []byte("scs1"),
+		Timestamp:        1,
+	}
+	h2 := h1
+	h2.Timestamp = 2
+	r := BlockRandomness(h1, []byte("seed"))
+	require.Equal(t, r, BlockRandomness(h1, []byte("seed")))
+	require.Equal(t, r, BlockRandomness(h2, []byte("seed")))
+	require.NotEqual(t, r, BlockRandomness(h1, []byte("other seed")))
+
+	h2.CollectionRoot = []byte("root2")
+	require.NotEqual(t, r, BlockRandomness(h2, []byte("seed")))
+	h2 = h1
+	h2.StateChangesHash = []byte("scs2")
+	require.NotEqual(t, r, BlockRandomness(h2, []byte("seed")))
+}
+
+func TestCoinPurse(t *testing.T) {
+	nameA := InstanceID{DarcID: bytes.Repeat([]byte{1}, 32)}
+	nameB := InstanceID{DarcID: bytes.Repeat([]byte{2}, 32)}
+
+	// The coins returned by a first instruction, split over two entries.
+	out := []Coin{{nameA, 3}, {nameB, 2}, {nameA, 2}}
+
+	// A second instruction spends some of them.
+	purse := NewCoinPurse(out)
+	require.Equal(t, uint64(5), purse.Available(nameA))
+	require.Equal(t, uint64(2), purse.Available(nameB))
+	require.Nil(t, purse.Spend(nameA, 4))
+	require.Equal(t, uint64(1), purse.Available(nameA))
+	out2 := purse.Coins()
+	require.Equal(t, 2, len(out2))
+	// The coins of the first instruction are not changed.
+	require.Equal(t, uint64(3), out[0].Value)
+
+	// A third instruction gets the rest.
+	purse = NewCoinPurse(out2)
+	require.NotNil(t, purse.Spend(nameB, 3))
+	require.Equal(t, uint64(2), purse.Available(nameB))
+	require.Nil(t, purse.Spend(nameB, 2))
+	require.Equal(t, uint64(0), purse.Available(nameB))
+	require.Equal(t, []Coin{{nameA, 1}}, purse.Coins())
+	require.Equal(t, uint64(0), purse.Available(NewInstanceID(nil)))
+}
+
+func TestCollectionDBCustomStateAction(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	appendAction := StateAction(100)
+	require.Nil(t, RegisterStateAction(appendAction, "Append",
+		func(current []byte, sc StateChange) ([]byte, error) {
+			return append(append([]byte{}, current...), sc.Value...), nil
+		}))
+	require.NotNil(t, RegisterStateAction(appendAction, "Append2", nil))
+	require.NotNil(t, RegisterStateAction(Update, "Update2", nil))
+	require.Equal(t, "Append", appendAction.String())
+
+	cdb := newCollectionDB(db, testName)
+	key := []byte("key")
+	contract := []byte("contract")
+	appendSC := func(value string) StateChange {
+		return StateChange{
+			StateAction: appendAction,
+			InstanceID:  key,
+			Value:       []byte(value),
+			ContractID:  contract,
+		}
+	}
+
+	// Appending to a missing instance creates it.
+	require.Nil(t, cdb.Store(&StateChange{
+		StateAction: appendAction,
+		InstanceID:  key,
+		Value:       []byte("one"),
+		ContractID:  contract,
+	}))
+	require.Nil(t, cdb.StoreAll(StateChanges{appendSC(",two"), appendSC(",three")}))
+	value, cid, err := cdb.GetValues(key)
+	require.Nil(t, err)
+	require.Equal(t, "one,two,three", string(value))
+	require.Equal(t, string(contract), cid)
+
+	// The root is the same as if the value had been set directly.
+	coll := collection.New(collection.Data{}, collection.Data{})
+	require.Nil(t, coll.Add(key, []byte("one,two,three"), contract))
+	require.Equal(t, coll.GetRoot(), cdb.RootHash())
+
+	// The resolved value is also stored in the database.
+	cdb2 := newCollectionDB(db, testName)
+	require.Equal(t, cdb.RootHash(), cdb2.RootHash())
+
+	require.NotNil(t, cdb.Store(&StateChange{
+		StateAction: StateAction(101),
+		InstanceID:  key,
+		ContractID:  contract,
+	}))
+}
+
+func TestCollectionDB_SyncPolicy(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	cdb := newCollectionDB(db, testName)
+	sc := StateChange{
+		StateAction: Create,
+		InstanceID:  []byte("key"),
+		Value:       []byte("value"),
+		ContractID:  []byte("contract"),
+	}
+	require.Nil(t, cdb.StoreBlock([]byte("block0"), StateChanges{sc}))
+	sc.StateAction = Update
+
+	// durable returns, for every block stored with the policy, whether it
+	// is on disk once stored: either bolt syncs the commit, or the
+	// collection syncs the database after it.
+	durable := func(p SyncPolicy) (blocks []bool) {
+		require.Nil(t, cdb.setSyncPolicy(p))
+		for i := 1; i <= 4; i++ {
+			var noSync bool
+			require.Nil(t, db.View(func(tx *bolt.Tx) error {
+				noSync = tx.DB().NoSync
+				return nil
+			}))
+			sc.Value = []byte(fmt.Sprintf("value%d", i))
+			require.Nil(t, cdb.StoreBlock([]byte(fmt.Sprintf("block%d", i)), StateChanges{sc}))
+			blocks = append(blocks, !noSync || (p > SyncEveryBlock && cdb.unsynced == 0))
+		}
+		return
+	}
+	require.Equal(t, []bool{true, true, true, true}, durable(SyncEveryBlock))
+	require.Equal(t, []bool{false, false, true, false}, durable(SyncEveryNBlocks(3)))
+	require.Equal(t, []bool{false, false, false, false}, durable(SyncNever))
+	require.Equal(t, SyncEveryBlock, SyncEveryNBlocks(1))
+
+	// The latest block is stored with the collection, but not loaded as
+	// an instance.
+	root := cdb.RootHash()
+	require.Nil(t, db.Close())
+	db, err = bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	defer db.Close()
+	cdb = newCollectionDB(db, testName)
+	require.Equal(t, []byte("block4"), []byte(cdb.latestBlock()))
+	require.Equal(t, root, cdb.RootHash())
+	_, _, err = cdb.GetValues(latestBlockKey)
+	require.NotNil(t, err)
+}
+
+func TestCollectionDB_ProvenRoots(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	defer db.Close()
+	cdb := newCollectionDB(db, testName)
+	sc := StateChange{
+		StateAction: Create,
+		InstanceID:  []byte("key"),
+		Value:       []byte("value"),
+		ContractID:  []byte("contract"),
+	}
+	first := cdb.RootHash()
+	require.Nil(t, cdb.StoreBlock([]byte("block0"), StateChanges{sc}))
+	second := cdb.RootHash()
+	sc.InstanceID = []byte("other")
+	require.Nil(t, cdb.StoreBlock([]byte("block1"), StateChanges{sc}))
+
+	roots := cdb.provenRoots(cdb.RootHash())
+	require.Equal(t, 3, len(roots))
+	require.Equal(t, map[string]bool{}, roots[string(cdb.RootHash())])
+	require.Equal(t, map[string]bool{"other": true}, roots[string(second)])
+	require.Equal(t, map[string]bool{"key": true, "other": true}, roots[string(first)])
+
+	// Only the given root is known for another collection.
+	require.Equal(t, provenRoots{string(second): {}}, cdb.provenRoots(second))
+
+	// Only the latest blocks are kept.
+	sc.StateAction = Update
+	for i := 0; i < maxProofAge; i++ {
+		sc.Value = []byte(fmt.Sprintf("value%d", i))
+		require.Nil(t, cdb.StoreBlock([]byte(fmt.Sprintf("block%d", i+2)), StateChanges{sc}))
+	}
+	roots = cdb.provenRoots(cdb.RootHash())
+	_, ok := roots[string(second)]
+	require.False(t, ok)
+}
+
+// BenchmarkCollectionDB_Sync compares the time to store blocks with the
+// different sync policies.
+func BenchmarkCollectionDB_Sync(b *testing.B) {
+	for _, policy := range []SyncPolicy{SyncEveryBlock, SyncEveryNBlocks(10), SyncNever} {
+		b.Run(fmt.Sprintf("policy%d", policy), func(b *testing.B) {
+			tmpDB, err := ioutil.TempFile("", "tmpDB")
+			require.Nil(b, err)
+			tmpDB.Close()
+			defer os.Remove(tmpDB.Name())
+			db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+			require.Nil(b, err)
+			defer db.Close()
+			cdb := newCollectionDB(db, testName)
+			require.Nil(b, cdb.setSyncPolicy(policy))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sc := StateChange{
+					StateAction: Create,
+					InstanceID:  []byte(fmt.Sprintf("key%d", i)),
+					Value:       []byte("value"),
+					ContractID:  []byte("contract"),
+				}
+				require.Nil(b, cdb.StoreBlock([]byte("block"), StateChanges{sc}))
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/cothority/skipchain"
+)
+
+// ErrSubmitterNotAllowed is returned if a skipchain with Submitters in its
+// config receives a request that is not signed by one of them.
+var ErrSubmitterNotAllowed = errors.New("submitter is not allowed")
+
+// submitterDigest is the message signed by the submitter of the
+// transactions with the hash msg to the skipchain scID.
+func submitterDigest(scID skipchain.SkipBlockID, msg []byte) []byte {
+	h := sha256.New()
+	h.Write(scID)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func signSubmitter(signer darc.Signer, scID skipchain.SkipBlockID, msg []byte) (*darc.Signature, error) {
+	sig, err := signer.Sign(submitterDigest(scID, msg))
+	if err != nil {
+		return nil, err
+	}
+	return &darc.Signature{Signature: sig, Signer: signer.Identity()}, nil
+}
+
+// SignSubmitter signs the request with the identity of the client sending
+// it. The SkipchainID and the Transaction must be set.
+func (req *AddTxRequest) SignSubmitter(signer darc.Signer) (err error) {
+	req.Submitter, err = signSubmitter(signer, req.SkipchainID,
+		req.Transaction.Instructions.Hash())
+	return
+}
+
+// SignSubmitter signs the request with the identity of the client sending
+// it. The SkipchainID and the Transactions must be set.
+func (req *AddTxBatchRequest) SignSubmitter(signer darc.Signer) (err error) {
+	req.Submitter, err = signSubmitter(signer, req.SkipchainID,
+		req.Transactions.Hash())
+	return
+}
+
+// SignSubmitter signs the request with the identity of the client sending
+// it. The SkipchainID and the Transaction must be set. All the members of
+// the committee can send the same signature.
+func (req *AddPartialSignature) SignSubmitter(signer darc.Signer) (err error) {
+	req.Submitter, err = signSubmitter(signer, req.SkipchainID,
+		req.Transaction.Instructions.Hash())
+	return
+}
+
+// checkSubmitter returns ErrSubmitterNotAllowed if the skipchain scID has
+// Submitters in its config and sig is not a signature of msg by one of them.
+func (s *Service) checkSubmitter(scID skipchain.SkipBlockID, msg []byte, sig *darc.Signature) error {
+	config, err := s.LoadConfig(scID)
+	if err != nil {
+		return err
+	}
+	if len(config.Submitters) == 0 {
+		return nil
+	}
+	if sig == nil {
+		return ErrSubmitterNotAllowed
+	}
+	for _, id := range config.Submitters {
+		if id.Equal(&sig.Signer) {
+			if sig.Signer.Verify(submitterDigest(scID, msg), sig.Signature) != nil {
+				return ErrSubmitterNotAllowed
+			}
+			return nil
+		}
+	}
+	return ErrSubmitterNotAllowed
+}
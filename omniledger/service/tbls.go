@@ -0,0 +1,332 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority/omniledger/darc"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/tbls"
+)
+
+// maxPendingPartialSigs is the maximum number of transactions waiting for
+// partial signatures. New transactions are refused once it is reached.
+const maxPendingPartialSigs = 1000
+
+// maxCommittees is the maximum number of committees collecting partial
+// signatures for the same instruction.
+const maxCommittees = 4
+
+// partialSigsTTL is the time after which a transaction that didn't get all
+// its partial signatures is dropped.
+const partialSigsTTL = 10 * time.Minute
+
+// partialSignatures holds a transaction waiting for the partial signatures
+// of the committees signing its instructions.
+type partialSignatures struct {
+	ct      ClientTransaction
+	created time.Time
+	// shares maps the index of an instruction to the committees that sent
+	// signature shares for it, by the hash of their public polynomial.
+	shares map[int]map[string]*committeeShares
+}
+
+// committeeShares are the verified signature shares of the members of a
+// committee, by index of the share.
+type committeeShares struct {
+	poly   *share.PubPoly
+	t      int
+	shares map[int][]byte
+}
+
+// AddPartialSignature collects the partial signature of a member of a
+// committee, for clients that cannot coordinate to aggregate them. The
+// partial signature is verified against the public polynomial of the
+// committee given in the request. When the threshold of the committee is
+// reached, the partial signatures are aggregated to a signature of the BLS
+// identity of the committee, which is stored in the instruction. Once all
+// the signatures of the transaction are set, the transaction is added like
+// with AddTransaction.
+//
+// The transactions waiting for partial signatures are dropped after
+// partialSigsTTL.
+func (s *Service) AddPartialSignature(req *AddPartialSignature) (*AddPartialSignatureResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if req.Instruction < 0 || req.Instruction >= len(req.Transaction.Instructions) {
+		return nil, errors.New("no such instruction")
+	}
+	gen := s.db().GetByID(req.SkipchainID)
+	if gen == nil || gen.Index != 0 {
+		return nil, errors.New("skipchain ID is does not exist")
+	}
+	// The submitter is checked here, as the completed transaction is added
+	// without a submitter signature.
+	err := s.checkSubmitter(req.SkipchainID, req.Transaction.Instructions.Hash(), req.Submitter)
+	if err != nil {
+		s.rejected(RejectionReason(err))
+		return nil, err
+	}
+	slot := blsSlot(req.Transaction.Instructions[req.Instruction])
+	if slot < 0 {
+		return nil, errors.New("instruction has no BLS signature to complete")
+	}
+	poly, err := committeePoly(req.Transaction.Instructions[req.Instruction].Signatures[slot].Signer,
+		req.Committee)
+	if err != nil {
+		return nil, err
+	}
+	darcReq, err := req.Transaction.Instructions[req.Instruction].ToDarcRequest()
+	if err != nil {
+		return nil, err
+	}
+	if err = tbls.Verify(bn256.NewSuite(), poly, darcReq.Hash(), req.Partial); err != nil {
+		return nil, errors.New("invalid partial signature: " + err.Error())
+	}
+	index, err := tbls.SigShare(req.Partial).Index()
+	if err != nil {
+		return nil, err
+	}
+
+	txHash, err := partialTxHash(req.Transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	s.partialSigsMut.Lock()
+	defer s.partialSigsMut.Unlock()
+	for k, p := range s.partialSigs {
+		if time.Since(p.created) > partialSigsTTL {
+			delete(s.partialSigs, k)
+		}
+	}
+	// The key covers the signers, so that a transaction with the same
+	// instructions but other signers doesn't take the place of this one.
+	key := fmt.Sprintf("%x/%x", req.SkipchainID, txHash)
+	p := s.partialSigs[key]
+	if p != nil {
+		if err = sameSigners(p.ct, req.Transaction); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(s.partialSigs) >= maxPendingPartialSigs {
+			return nil, errors.New("too many transactions are waiting for partial signatures")
+		}
+		// The signatures that are already set must be valid, else
+		// the transaction could never be added.
+		if err = verifySetSignatures(req.Transaction); err != nil {
+			return nil, err
+		}
+		p = &partialSignatures{
+			ct:      req.Transaction,
+			created: time.Now(),
+			shares:  make(map[int]map[string]*committeeShares),
+		}
+		s.partialSigs[key] = p
+	}
+	instr := &p.ct.Instructions[req.Instruction]
+	slot = blsSlot(*instr)
+	if slot < 0 {
+		return nil, errors.New("the signature of the instruction is already complete")
+	}
+	if p.shares[req.Instruction] == nil {
+		p.shares[req.Instruction] = make(map[string]*committeeShares)
+	}
+	polyID := string(hashCommittee(req.Committee))
+	cs := p.shares[req.Instruction][polyID]
+	if cs == nil {
+		if len(p.shares[req.Instruction]) >= maxCommittees {
+			return nil, errors.New("too many committees for this instruction")
+		}
+		cs = &committeeShares{
+			poly:   poly,
+			t:      len(req.Committee),
+			shares: make(map[int][]byte),
+		}
+		p.shares[req.Instruction][polyID] = cs
+	}
+	cs.shares[index] = req.Partial
+
+	if len(cs.shares) < cs.t {
+		return &AddPartialSignatureResponse{Version: CurrentVersion}, nil
+	}
+	sig, err := recoverBLS(instr.Signatures[slot].Signer, darcReq.Hash(), cs.shares, cs.t)
+	if err != nil {
+		return nil, err
+	}
+	instr.Signatures[slot].Signature = sig
+	delete(p.shares, req.Instruction)
+	resp := &AddPartialSignatureResponse{
+		Version:   CurrentVersion,
+		Signature: sig,
+	}
+	for _, in := range p.ct.Instructions {
+		for _, sig := range in.Signatures {
+			if len(sig.Signature) == 0 {
+				return resp, nil
+			}
+		}
+	}
+	delete(s.partialSigs, key)
+	if _, err = s.addTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: req.SkipchainID,
+		Transaction: p.ct,
+	}); err != nil {
+		return nil, err
+	}
+	resp.Submitted = true
+	return resp, nil
+}
+
+// partialTxHash returns the hash identifying a transaction waiting for
+// partial signatures: the hashes of the darc requests of its instructions,
+// which include the identities of their signers, and the identities of the
+// signers of the transaction.
+func partialTxHash(ct ClientTransaction) ([]byte, error) {
+	h := sha256.New()
+	for _, instr := range ct.Instructions {
+		darcReq, err := instr.ToDarcRequest()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(darcReq.Hash())
+	}
+	for _, sig := range ct.Signatures {
+		h.Write([]byte(sig.Signer.String()))
+	}
+	return h.Sum(nil), nil
+}
+
+// sameSigners returns an error if ct has other instructions or other
+// signers than the transaction stored waiting for partial signatures.
+func sameSigners(stored, ct ClientTransaction) error {
+	differs := errors.New("another transaction with these instructions is waiting for partial signatures")
+	if !bytes.Equal(stored.Instructions.Hash(), ct.Instructions.Hash()) ||
+		len(stored.Signatures) != len(ct.Signatures) {
+		return differs
+	}
+	for i, sig := range stored.Signatures {
+		if !sig.Signer.Equal(&ct.Signatures[i].Signer) {
+			return differs
+		}
+	}
+	for i, instr := range stored.Instructions {
+		if len(instr.Signatures) != len(ct.Instructions[i].Signatures) {
+			return differs
+		}
+		for j, sig := range instr.Signatures {
+			if !sig.Signer.Equal(&ct.Instructions[i].Signatures[j].Signer) {
+				return differs
+			}
+		}
+	}
+	return nil
+}
+
+// verifySetSignatures verifies the signatures of ct that are not empty.
+func verifySetSignatures(ct ClientTransaction) error {
+	for _, sig := range ct.Signatures {
+		if err := sig.Signer.Verify(ct.Instructions.Hash(), sig.Signature); err != nil {
+			return errors.New("invalid signature of the transaction: " + err.Error())
+		}
+	}
+	for _, instr := range ct.Instructions {
+		darcReq, err := instr.ToDarcRequest()
+		if err != nil {
+			return err
+		}
+		for _, sig := range instr.Signatures {
+			if len(sig.Signature) == 0 {
+				continue
+			}
+			if err := sig.Signer.Verify(darcReq.Hash(), sig.Signature); err != nil {
+				return errors.New("invalid signature of an instruction: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// blsSlot returns the index of the first empty signature of a BLS identity
+// in the instruction, or -1 if there is none.
+func blsSlot(instr Instruction) int {
+	for i, sig := range instr.Signatures {
+		if sig.Signer.BLS != nil && len(sig.Signature) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// committeePoly returns the public polynomial of the committee with the
+// given commitments, which must commit to the public key of the BLS
+// identity id.
+func committeePoly(id darc.Identity, committee [][]byte) (*share.PubPoly, error) {
+	if len(committee) == 0 {
+		return nil, errors.New("missing public polynomial of the committee")
+	}
+	g := bn256.NewSuite().G2()
+	commits := make([]kyber.Point, len(committee))
+	for i, buf := range committee {
+		commits[i] = g.Point()
+		if err := commits[i].UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+	}
+	poly := share.NewPubPoly(g, nil, commits)
+	public, err := poly.Commit().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(public, id.BLS.Public) {
+		return nil, errors.New("public polynomial is not the one of the committee")
+	}
+	return poly, nil
+}
+
+// hashCommittee returns the hash of the commitments of a committee.
+func hashCommittee(committee [][]byte) []byte {
+	h := sha256.New()
+	for _, c := range committee {
+		h.Write(c)
+	}
+	return h.Sum(nil)
+}
+
+// recoverBLS aggregates t verified threshold BLS signature shares and
+// returns the signature if it is a valid signature of msg by the identity.
+func recoverBLS(id darc.Identity, msg []byte, shares map[int][]byte, t int) ([]byte, error) {
+	suite := bn256.NewSuite()
+	pubShares := make([]*share.PubShare, 0, len(shares))
+	for _, s := range shares {
+		sh := tbls.SigShare(s)
+		i, err := sh.Index()
+		if err != nil {
+			return nil, err
+		}
+		v := suite.G1().Point()
+		if err := v.UnmarshalBinary(sh.Value()); err != nil {
+			return nil, err
+		}
+		pubShares = append(pubShares, &share.PubShare{I: i, V: v})
+	}
+	commit, err := share.RecoverCommit(suite.G1(), pubShares, t, len(pubShares))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := commit.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := id.Verify(msg, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
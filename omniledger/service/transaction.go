@@ -6,11 +6,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/dedis/cothority"
-	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
 
 	"github.com/dedis/cothority/omniledger/collection"
@@ -89,9 +90,34 @@ func (args Arguments) Search(name string) []byte {
 	return nil
 }
 
+// SearchPrefix returns the arguments whose name starts with the prefix, in
+// their original order. It is useful for a variable number of arguments
+// like "item.0.name", "item.1.name".
+func (args Arguments) SearchPrefix(prefix string) Arguments {
+	var found Arguments
+	for _, arg := range args {
+		if strings.HasPrefix(arg.Name, prefix) {
+			found = append(found, arg)
+		}
+	}
+	return found
+}
+
 // Hash computes the digest of the hash function
 func (instr Instruction) Hash() []byte {
 	h := sha256.New()
+	// The hash of instructions without a skipchain ID stays the same, so
+	// that their existing signatures remain valid.
+	if !instr.SkipchainID.IsNull() {
+		h.Write([]byte("skipchain"))
+		h.Write(instr.SkipchainID)
+	}
+	if instr.BlockIndex != 0 {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(instr.BlockIndex))
+		h.Write([]byte("block"))
+		h.Write(b)
+	}
 	h.Write(instr.InstanceID.DarcID)
 	h.Write(instr.InstanceID.SubID[:])
 	h.Write(instr.Nonce[:])
@@ -105,6 +131,11 @@ func (instr Instruction) Hash() []byte {
 	case instr.Spawn != nil:
 		h.Write([]byte{0})
 		h.Write([]byte(instr.Spawn.ContractID))
+		// Only hashed if set, to keep the signatures of existing
+		// spawns valid.
+		if instr.Spawn.Idempotent {
+			h.Write([]byte("idempotent"))
+		}
 		args = instr.Spawn.Args
 	case instr.Invoke != nil:
 		h.Write([]byte{1})
@@ -116,11 +147,16 @@ func (instr Instruction) Hash() []byte {
 		h.Write([]byte(a.Name))
 		h.Write(a.Value)
 	}
+	for _, d := range instr.AdditionalDarcs {
+		h.Write(d)
+	}
 	return h.Sum(nil)
 }
 
 // DeriveID derives a new InstanceID from the instruction's
 // InstanceID, the given string, and the hash of the Instruction.
+// The SubID is the sha256 of, in this order, the given string, the hash of
+// the Instruction and the signature bytes of every signature.
 func (instr Instruction) DeriveID(what string) InstanceID {
 	h := sha256.New()
 	h.Write([]byte(what))
@@ -140,6 +176,93 @@ func (instr Instruction) DeriveID(what string) InstanceID {
 	}
 }
 
+// ChildInstance is the contract and the value of an instance spawned
+// together with its parent by DeriveChildren.
+type ChildInstance struct {
+	ContractID string
+	Value      []byte
+}
+
+// DeriveChildren returns the IDs of the children of an instance spawned by
+// the instruction, and the state changes creating them. The ID of the
+// child i is derived from the string what and i, so a spawn handler can
+// embed the IDs in the value of the parent before returning all the state
+// changes, and the parent and its children are created atomically.
+func (instr Instruction) DeriveChildren(what string, children []ChildInstance) ([]InstanceID, StateChanges) {
+	ids := make([]InstanceID, len(children))
+	scs := make(StateChanges, len(children))
+	for i, child := range children {
+		ids[i] = instr.DeriveID(fmt.Sprintf("%s/child/%d", what, i))
+		scs[i] = NewStateChange(Create, ids[i], child.ContractID, child.Value)
+	}
+	return ids, scs
+}
+
+// DeriveIDDebug returns the same InstanceID as DeriveID together with a
+// human readable description of every component that has been hashed, in
+// the order it has been hashed. The components of the instruction hash are
+// prefixed with "instr.". It is meant to find out why an InstanceID
+// predicted by a client differs from the one of the service.
+func (instr Instruction) DeriveIDDebug(what string) (InstanceID, []string) {
+	var steps []string
+	step := func(h hash.Hash, name string, b []byte) {
+		h.Write(b)
+		steps = append(steps, fmt.Sprintf("%s: %x", name, b))
+	}
+
+	hi := sha256.New()
+	step(hi, "instr.darcID", instr.InstanceID.DarcID)
+	step(hi, "instr.subID", instr.InstanceID.SubID[:])
+	step(hi, "instr.nonce", instr.Nonce[:])
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(instr.Index))
+	step(hi, "instr.index", b)
+	b = make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(instr.Length))
+	step(hi, "instr.length", b)
+	var args []Argument
+	switch {
+	case instr.Spawn != nil:
+		step(hi, "instr.type(spawn)", []byte{0})
+		step(hi, "instr.contractID", []byte(instr.Spawn.ContractID))
+		if instr.Spawn.Idempotent {
+			step(hi, "instr.idempotent", []byte("idempotent"))
+		}
+		args = instr.Spawn.Args
+	case instr.Invoke != nil:
+		step(hi, "instr.type(invoke)", []byte{1})
+		args = instr.Invoke.Args
+	case instr.Delete != nil:
+		step(hi, "instr.type(delete)", []byte{2})
+	}
+	for _, a := range args {
+		step(hi, "instr.arg.name", []byte(a.Name))
+		step(hi, "instr.arg.value("+a.Name+")", a.Value)
+	}
+	for i, d := range instr.AdditionalDarcs {
+		step(hi, fmt.Sprintf("instr.additionalDarc[%d]", i), d)
+	}
+	instrHash := hi.Sum(nil)
+	steps = append(steps, fmt.Sprintf("instr.hash: %x", instrHash))
+
+	h := sha256.New()
+	step(h, "what", []byte(what))
+	step(h, "instruction hash", instrHash)
+	for i, s := range instr.Signatures {
+		step(h, fmt.Sprintf("signature[%d]", i), s.Signature)
+	}
+	sum := h.Sum(nil)
+
+	var sub SubID
+	copy(sub[:], sum)
+	steps = append(steps, fmt.Sprintf("subID: %x", sub[:]))
+
+	return InstanceID{
+		DarcID: instr.InstanceID.DarcID,
+		SubID:  sub,
+	}, steps
+}
+
 // GetContractState searches for the contract kind of this instruction and the
 // attached state to it. It needs the collection to do so.
 func (instr Instruction) GetContractState(coll CollectionView) (contractID string, state []byte, err error) {
@@ -179,6 +302,18 @@ func (instr Instruction) GetContractState(coll CollectionView) (contractID strin
 	return
 }
 
+// arguments returns the arguments of the instruction, delete instructions
+// have none.
+func (instr Instruction) arguments() Arguments {
+	switch {
+	case instr.Spawn != nil:
+		return instr.Spawn.Args
+	case instr.Invoke != nil:
+		return instr.Invoke.Args
+	}
+	return nil
+}
+
 // Action returns the action that the user wants to do with this
 // instruction.
 func (instr Instruction) Action() string {
@@ -242,6 +377,64 @@ func (instr *Instruction) SignBy(signers ...darc.Signer) error {
 	return nil
 }
 
+// SigningDigest returns the digest every signer of the instruction has to
+// sign. It covers the content of the instruction and the identities of all
+// the signers, so the signers have to be listed in Signatures, possibly with
+// an empty signature, before it is computed. Every signer can then sign the
+// digest on its own and the signatures are added with AddSignature.
+func (instr Instruction) SigningDigest() ([]byte, error) {
+	if len(instr.Signatures) == 0 {
+		return nil, errors.New("no signers listed")
+	}
+	req, err := instr.ToDarcRequest()
+	if err != nil {
+		return nil, err
+	}
+	return req.Hash(), nil
+}
+
+// AddSignature sets the signature of the listed signer id. The signature must
+// be over the digest returned by SigningDigest.
+func (instr *Instruction) AddSignature(id darc.Identity, sig []byte) error {
+	digest, err := instr.SigningDigest()
+	if err != nil {
+		return err
+	}
+	for i := range instr.Signatures {
+		if instr.Signatures[i].Signer.Equal(&id) {
+			if err := id.Verify(digest, sig); err != nil {
+				return errors.New("signature is not over the content of the instruction: " + err.Error())
+			}
+			instr.Signatures[i].Signature = sig
+			return nil
+		}
+	}
+	return errors.New("signer " + id.String() + " is not listed")
+}
+
+// VerifySignatures checks that all the signatures of the instruction are
+// over the same digest, recomputed from the instruction, and that no signer
+// is listed twice. It returns which signature disagrees, so that a mistake
+// in a detached signing workflow can be found.
+func (instr Instruction) VerifySignatures() error {
+	digest, err := instr.SigningDigest()
+	if err != nil {
+		return err
+	}
+	for i, sig := range instr.Signatures {
+		for _, other := range instr.Signatures[:i] {
+			if other.Signer.Equal(&sig.Signer) {
+				return fmt.Errorf("signer %s is listed twice", sig.Signer.String())
+			}
+		}
+		if err := sig.Signer.Verify(digest, sig.Signature); err != nil {
+			return fmt.Errorf("signature %d of %s is not over the content of the instruction: %v",
+				i, sig.Signer.String(), err)
+		}
+	}
+	return nil
+}
+
 // ToDarcRequest converts the Instruction content into a darc.Request.
 func (instr Instruction) ToDarcRequest() (*darc.Request, error) {
 	baseID := instr.InstanceID.DarcID
@@ -269,6 +462,77 @@ func (instr Instruction) ToDarcRequest() (*darc.Request, error) {
 	return &req, nil
 }
 
+// Hash returns the digest of the template that is signed by the authorizers
+// of the token.
+func (pa PreAuthorization) Hash() []byte {
+	h := sha256.New()
+	h.Write([]byte("preauthorization"))
+	h.Write([]byte(pa.Action))
+	h.Write(pa.InstanceID.DarcID)
+	h.Write(pa.InstanceID.SubID[:])
+	h.Write(pa.NonceMin[:])
+	h.Write(pa.NonceMax[:])
+	h.Write(pa.SkipchainID)
+	return h.Sum(nil)
+}
+
+// SignBy gets signers to sign the (receiver) token.
+func (pa *PreAuthorization) SignBy(signers ...darc.Signer) error {
+	digest := pa.Hash()
+	pa.Signatures = make([]darc.Signature, len(signers))
+	for i := range signers {
+		sig, err := signers[i].Sign(digest)
+		if err != nil {
+			return err
+		}
+		pa.Signatures[i] = darc.Signature{
+			Signature: sig,
+			Signer:    signers[i].Identity(),
+		}
+	}
+	return nil
+}
+
+// Conforms returns an error if instr doesn't match the template of the
+// token. It only depends on the instruction, so all the nodes agree on it.
+func (pa PreAuthorization) Conforms(instr Instruction) error {
+	if instr.Action() != pa.Action {
+		return fmt.Errorf("action %s is not pre-authorized", instr.Action())
+	}
+	if !instr.InstanceID.Equal(pa.InstanceID) {
+		return errors.New("instance is not pre-authorized")
+	}
+	if bytes.Compare(instr.Nonce[:], pa.NonceMin[:]) < 0 ||
+		bytes.Compare(instr.Nonce[:], pa.NonceMax[:]) > 0 {
+		return errors.New("nonce is outside of the pre-authorized range")
+	}
+	if !pa.SkipchainID.IsNull() && !pa.SkipchainID.Equal(instr.SkipchainID) {
+		return errors.New("pre-authorization is bound to another skipchain")
+	}
+	return nil
+}
+
+// Verify checks that instr conforms to the token and that the signatures of
+// the token are valid. It returns the identities of the signers, which still
+// need to be checked against the darc.
+func (pa PreAuthorization) Verify(instr Instruction) ([]darc.Identity, error) {
+	if err := pa.Conforms(instr); err != nil {
+		return nil, err
+	}
+	if len(pa.Signatures) == 0 {
+		return nil, errors.New("pre-authorization is not signed")
+	}
+	digest := pa.Hash()
+	ids := make([]darc.Identity, len(pa.Signatures))
+	for i, sig := range pa.Signatures {
+		if err := sig.Signer.Verify(digest, sig.Signature); err != nil {
+			return nil, errors.New("pre-authorization signature verification failed: " + err.Error())
+		}
+		ids[i] = sig.Signer
+	}
+	return ids, nil
+}
+
 // Instructions is a slice of Instruction
 type Instructions []Instruction
 
@@ -281,13 +545,66 @@ func (instrs Instructions) Hash() []byte {
 	return h.Sum(nil)
 }
 
+// SignBy signs the hash of all instructions of the (receiver) transaction
+// with every signer. The signatures authorize all the instructions at once,
+// so the instructions themselves don't need to be signed.
+func (ct *ClientTransaction) SignBy(signers ...darc.Signer) error {
+	digest := ct.Instructions.Hash()
+	ct.Signatures = make([]darc.Signature, len(signers))
+	for i := range signers {
+		sig, err := signers[i].Sign(digest)
+		if err != nil {
+			return err
+		}
+		ct.Signatures[i] = darc.Signature{
+			Signature: sig,
+			Signer:    signers[i].Identity(),
+		}
+	}
+	return nil
+}
+
+// Validate checks that the transaction is well-formed: it must have at least
+// one instruction, every instruction must have exactly one of Spawn, Invoke
+// or Delete, and the Index and Length of every instruction must match its
+// position in the transaction. The nonces don't need to be checked, as their
+// type only allows 32 bytes.
+func (ct ClientTransaction) Validate() error {
+	if len(ct.Instructions) == 0 {
+		return errors.New("transaction has no instructions")
+	}
+	for i, instr := range ct.Instructions {
+		if instr.GetType() == InvalidInstrType {
+			return fmt.Errorf("instruction %d must have exactly one of spawn, invoke or delete", i)
+		}
+		if instr.Index != i {
+			return fmt.Errorf("instruction %d has index %d", i, instr.Index)
+		}
+		if instr.Length != len(ct.Instructions) {
+			return fmt.Errorf("instruction %d has length %d instead of %d", i,
+				instr.Length, len(ct.Instructions))
+		}
+	}
+	return nil
+}
+
 // ClientTransactions is a slice of ClientTransaction
 type ClientTransactions []ClientTransaction
 
-// Hash returns the sha256 hash of all client transactions.
+// Hash returns the sha256 hash of all client transactions. It covers the
+// FailedPrecondition markers, so that they cannot be changed in a block.
 func (cts ClientTransactions) Hash() []byte {
 	h := sha256.New()
 	for _, ct := range cts {
+		if ct.FailedPrecondition {
+			// The unmarked transactions keep their hash, so that
+			// the blocks without markers don't change.
+			hm := sha256.New()
+			hm.Write(ct.Instructions.Hash())
+			hm.Write([]byte("failed precondition"))
+			h.Write(hm.Sum(nil))
+			continue
+		}
 		h.Write(ct.Instructions.Hash())
 	}
 	return h.Sum(nil)
@@ -339,17 +656,33 @@ func (sc StateChange) ShortString() string {
 // StateChanges hold a slice of StateChange
 type StateChanges []StateChange
 
-// Hash returns the sha256 of all stateChanges
+// encodeStateChange is used to encode the state changes when hashing them.
+// It is a variable so that the tests can replace it.
+var encodeStateChange = protobuf.Encode
+
+// Hash returns the sha256 of all stateChanges. A state change that cannot be
+// encoded would give a wrong hash and break the consensus, so Hash panics in
+// that case. Use HashErr to handle the error instead.
 func (scs StateChanges) Hash() []byte {
+	h, err := scs.HashErr()
+	if err != nil {
+		panic("couldn't hash state changes: " + err.Error())
+	}
+	return h
+}
+
+// HashErr returns the sha256 of all stateChanges, or an error if one of them
+// cannot be encoded.
+func (scs StateChanges) HashErr() ([]byte, error) {
 	h := sha256.New()
 	for _, sc := range scs {
-		scBuf, err := protobuf.Encode(&sc)
+		scBuf, err := encodeStateChange(&sc)
 		if err != nil {
-			log.Lvl2("Couldn't marshal transaction")
+			return nil, errors.New("couldn't marshal state change: " + err.Error())
 		}
 		h.Write(scBuf)
 	}
-	return h.Sum(nil)
+	return h.Sum(nil), nil
 }
 
 // ShortStrings outputs the ShortString of every state change.
@@ -383,10 +716,53 @@ func (sc StateAction) String() string {
 	case Remove:
 		return "Remove"
 	default:
+		if ca, ok := getStateAction(sc); ok {
+			return ca.name
+		}
 		return "Invalid stateChange"
 	}
 }
 
+// StateActionHandler returns the new value of an instance for a custom
+// StateAction. current is the value of the instance before the state change,
+// or nil if it doesn't exist yet. The handler must be deterministic, as all
+// nodes call it when they apply the state change.
+type StateActionHandler func(current []byte, sc StateChange) ([]byte, error)
+
+type customStateAction struct {
+	name    string
+	handler StateActionHandler
+}
+
+var customStateActions = struct {
+	sync.Mutex
+	actions map[StateAction]customStateAction
+}{actions: make(map[StateAction]customStateAction)}
+
+// RegisterStateAction adds a custom StateAction. When a state change with
+// this action is applied, the instance is created or updated with the value
+// returned by the handler. The built-in actions Create, Update and Remove
+// cannot be replaced.
+func RegisterStateAction(sa StateAction, name string, h StateActionHandler) error {
+	if sa <= Remove {
+		return errors.New("cannot register a built-in state action")
+	}
+	customStateActions.Lock()
+	defer customStateActions.Unlock()
+	if _, exists := customStateActions.actions[sa]; exists {
+		return fmt.Errorf("state action %d is already registered", sa)
+	}
+	customStateActions.actions[sa] = customStateAction{name, h}
+	return nil
+}
+
+func getStateAction(sa StateAction) (customStateAction, bool) {
+	customStateActions.Lock()
+	defer customStateActions.Unlock()
+	ca, ok := customStateActions.actions[sa]
+	return ca, ok
+}
+
 // InstrType is the instruction type, which can be spawn, invoke or delete.
 type InstrType int
 
@@ -450,6 +826,13 @@ func (r *txBuffer) add(key string, newTx ClientTransaction) {
 	}
 }
 
+func (r *txBuffer) len(key string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	return len(r.txsMap[key])
+}
+
 // sortWithSalt sorts transactions according to their salted hash:
 // The salt is prepended to the transactions []byte representation
 // and this concatenation is hashed then.
@@ -465,11 +848,12 @@ func sortWithSalt(ts [][]byte, salt []byte) {
 }
 
 // sortTransactions needs to marshal transactions, if it fails to do so,
-// it returns an error and leaves the slice unchanged.
+// it returns an error and leaves the slice unchanged. It returns the salt
+// used to sort them.
 // The helper functions (sortWithSalt, xorTransactions) operate on []byte
 // representations directly. This allows for some more compact error handling
 // when (un)marshalling.
-func sortTransactions(ts []ClientTransaction) error {
+func sortTransactions(ts []ClientTransaction) ([]byte, error) {
 	bs := make([][]byte, len(ts))
 	sortedTs := make([]*ClientTransaction, len(ts))
 	var err error
@@ -477,7 +861,7 @@ func sortTransactions(ts []ClientTransaction) error {
 	for i := range ts {
 		bs[i], err = network.Marshal(&ts[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -492,17 +876,17 @@ func sortTransactions(ts []ClientTransaction) error {
 	for i := range bs {
 		_, tmp, err := network.Unmarshal(bs[i], cothority.Suite)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		sortedTs[i], ok = tmp.(*ClientTransaction)
 		if !ok {
-			return errors.New("Data of wrong type")
+			return nil, errors.New("Data of wrong type")
 		}
 	}
 	for i := range sortedTs {
 		ts[i] = *sortedTs[i]
 	}
-	return nil
+	return salt, nil
 }
 
 // xorTransactions returns the XOR of the hash values of all the transactions.
@@ -516,3 +900,31 @@ func xorTransactions(ts [][]byte) []byte {
 	}
 	return result
 }
+
+// VerifyTxOrder checks that the transactions of the block body are in the
+// order given by their hashes salted with salt, which is stored in the
+// header of the block. It detects a leader reordering the transactions to
+// its advantage. The transactions dropped by the leader don't change the
+// order of the remaining ones, so only the order is checked and not the
+// salt itself.
+func VerifyTxOrder(blockBody DataBody, salt []byte) error {
+	var previous []byte
+	for i, ct := range blockBody.Transactions {
+		// The leader sorts the transactions before marking the ones with
+		// a failed precondition.
+		ct.FailedPrecondition = false
+		buf, err := network.Marshal(&ct)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(buf)
+		hash := h.Sum(nil)
+		if bytes.Compare(previous, hash) > 0 {
+			return fmt.Errorf("transaction %d is out of order", i)
+		}
+		previous = hash
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/dedis/cothority/omniledger/collection"
 	"github.com/dedis/cothority/omniledger/darc"
 	"github.com/stretchr/testify/require"
 )
@@ -82,15 +86,42 @@ func TestSortTransactions(t *testing.T) {
 				},
 			}}},
 	}
-	err := sortTransactions(ts1)
+	_, err := sortTransactions(ts1)
 	require.Nil(t, err)
-	err = sortTransactions(ts2)
+	_, err = sortTransactions(ts2)
 	require.Nil(t, err)
 	for i := range ts1 {
 		require.Equal(t, ts1[i], ts2[i])
 	}
 }
 
+func TestVerifyTxOrder(t *testing.T) {
+	var ts ClientTransactions
+	for _, name := range []string{"key1", "key2", "key3", "key4"} {
+		ts = append(ts, ClientTransaction{
+			Instructions: []Instruction{{
+				InstanceID: InstanceID{
+					DarcID: darcidStr(name),
+					SubID:  subidStr("nonce"),
+				},
+				Spawn: &Spawn{
+					ContractID: "kind",
+				},
+			}}})
+	}
+	salt, err := sortTransactions(ts)
+	require.Nil(t, err)
+	require.Nil(t, VerifyTxOrder(DataBody{Transactions: ts}, salt))
+
+	// Dropping a transaction or marking a failed precondition keeps the
+	// order.
+	ts[1].FailedPrecondition = true
+	require.Nil(t, VerifyTxOrder(DataBody{Transactions: ts[1:]}, salt))
+
+	ts[0], ts[2] = ts[2], ts[0]
+	require.NotNil(t, VerifyTxOrder(DataBody{Transactions: ts}, salt))
+}
+
 func TestTransaction_Signing(t *testing.T) {
 	signer := darc.NewSignerEd25519(nil, nil)
 	ids := []darc.Identity{signer.Identity()}
@@ -108,6 +139,166 @@ func TestTransaction_Signing(t *testing.T) {
 	require.Nil(t, req.Verify(d))
 }
 
+func TestTransaction_DetachedSigning(t *testing.T) {
+	signer1 := darc.NewSignerEd25519(nil, nil)
+	signer2 := darc.NewSignerEd25519(nil, nil)
+	instr, err := createInstr(darc.ID(make([]byte, 32)), "dummy_kind", []byte("dummy_value"), signer1)
+	require.Nil(t, err)
+	require.Nil(t, instr.SignBy(signer1, signer2))
+	require.Nil(t, instr.VerifySignatures())
+
+	// Every signer signs the digest on its own.
+	instr.Signatures = []darc.Signature{{Signer: signer1.Identity()}, {Signer: signer2.Identity()}}
+	digest, err := instr.SigningDigest()
+	require.Nil(t, err)
+	require.NotNil(t, instr.VerifySignatures())
+	for _, signer := range []darc.Signer{signer1, signer2} {
+		sig, err := signer.Sign(digest)
+		require.Nil(t, err)
+		require.Nil(t, instr.AddSignature(signer.Identity(), sig))
+	}
+	require.Nil(t, instr.VerifySignatures())
+
+	// The second signer signed other content.
+	other := instr
+	other.Spawn = &Spawn{ContractID: "dummy_kind", Args: Arguments{{Name: "data", Value: []byte("other")}}}
+	otherDigest, err := other.SigningDigest()
+	require.Nil(t, err)
+	sig, err := signer2.Sign(otherDigest)
+	require.Nil(t, err)
+	require.NotNil(t, instr.AddSignature(signer2.Identity(), sig))
+	instr.Signatures[1].Signature = sig
+	err = instr.VerifySignatures()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "signature 1")
+
+	signer3 := darc.NewSignerEd25519(nil, nil)
+	require.NotNil(t, instr.AddSignature(signer3.Identity(), sig))
+	instr.Signatures[1] = instr.Signatures[0]
+	require.Contains(t, instr.VerifySignatures().Error(), "listed twice")
+}
+
+func TestTransaction_SigningDerived(t *testing.T) {
+	signer, err := darc.DeriveSignerEd25519([]byte("seed of the wallet"), []uint32{0, 7})
+	require.Nil(t, err)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("derived darc"))
+	d.Rules.AddRule("spawn:dummy_kind", d.Rules.GetSignExpr())
+
+	instr, err := createInstr(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.Nil(t, err)
+	req, err := instr.ToDarcRequest()
+	require.Nil(t, err)
+	require.Nil(t, req.Verify(d))
+}
+
+func TestTransaction_Validate(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ct, err := createOneClientTx(darcidStr("darc"), "dummy_kind", []byte("value"), signer)
+	require.Nil(t, err)
+	require.Nil(t, ct.Validate())
+
+	// An instruction with both spawn and invoke is refused.
+	ct.Instructions[0].Invoke = &Invoke{Command: "update"}
+	require.NotNil(t, ct.Validate())
+	ct.Instructions[0].Invoke = nil
+
+	// Index and length must match the instructions.
+	ct.Instructions = append(ct.Instructions, ct.Instructions[0])
+	require.NotNil(t, ct.Validate())
+	for i := range ct.Instructions {
+		ct.Instructions[i].Index = i
+		ct.Instructions[i].Length = 2
+	}
+	require.Nil(t, ct.Validate())
+	ct.Instructions[1].Index = 0
+	require.NotNil(t, ct.Validate())
+
+	require.NotNil(t, ClientTransaction{}.Validate())
+}
+
+func TestStateChanges_HashErr(t *testing.T) {
+	scs := StateChanges{
+		NewStateChange(Create, NewInstanceID(nil), "dummy", []byte("value")),
+	}
+	h, err := scs.HashErr()
+	require.Nil(t, err)
+	require.Equal(t, h, scs.Hash())
+
+	// A state change that cannot be encoded is reported.
+	defer func(f func(interface{}) ([]byte, error)) {
+		encodeStateChange = f
+	}(encodeStateChange)
+	encodeStateChange = func(interface{}) ([]byte, error) {
+		return nil, errors.New("cannot encode")
+	}
+	_, err = scs.HashErr()
+	require.NotNil(t, err)
+	require.Panics(t, func() { scs.Hash() })
+}
+
+func TestTransaction_DeriveChildren(t *testing.T) {
+	instr, err := createInstr(darcidStr("parent"), "tree", []byte("root"), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+
+	// The parent stores the concatenation of the IDs of its children.
+	children := []ChildInstance{
+		{ContractID: "leaf", Value: []byte("left")},
+		{ContractID: "leaf", Value: []byte("right")},
+	}
+	ids, scs := instr.DeriveChildren("tree", children)
+	var value []byte
+	for _, id := range ids {
+		value = append(value, id.Slice()...)
+	}
+	scs = append(StateChanges{NewStateChange(Create, instr.DeriveID("tree"), "tree", value)}, scs...)
+
+	coll := collection.New(collection.Data{}, collection.Data{})
+	for _, sc := range scs {
+		require.Nil(t, storeInColl(coll, &sc))
+	}
+	cv := &roCollection{coll}
+	stored, _, err := cv.GetValues(instr.DeriveID("tree").Slice())
+	require.Nil(t, err)
+	for i, child := range children {
+		id := stored[i*64 : (i+1)*64]
+		v, cid, err := cv.GetValues(id)
+		require.Nil(t, err)
+		require.Equal(t, child.ContractID, cid)
+		require.Equal(t, child.Value, v)
+	}
+	require.NotEqual(t, ids[0], ids[1])
+}
+
+func TestTransaction_DeriveIDDebug(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	instr, err := createInstr(darcidStr("darc"), "dummy_kind", []byte("dummy_value"), signer)
+	require.Nil(t, err)
+
+	id, steps := instr.DeriveIDDebug("what")
+	require.True(t, id.Equal(instr.DeriveID("what")))
+
+	// The components of the instruction hash come first, in the order
+	// they are hashed by Instruction.Hash.
+	prefixes := []string{"instr.darcID", "instr.subID", "instr.nonce",
+		"instr.index", "instr.length", "instr.type(spawn)", "instr.contractID",
+		"instr.arg.name", "instr.arg.value(data)", "instr.hash",
+		"what", "instruction hash", "signature[0]", "subID"}
+	require.Equal(t, len(prefixes), len(steps))
+	for i, p := range prefixes {
+		require.True(t, strings.HasPrefix(steps[i], p+": "), steps[i])
+	}
+	require.Equal(t, fmt.Sprintf("instr.hash: %x", instr.Hash()), steps[9])
+	require.Equal(t, fmt.Sprintf("what: %x", []byte("what")), steps[10])
+	require.Equal(t, fmt.Sprintf("signature[0]: %x", instr.Signatures[0].Signature), steps[12])
+	require.Equal(t, fmt.Sprintf("subID: %x", id.SubID[:]), steps[13])
+
+	// A different string only changes the derivation steps.
+	_, steps2 := instr.DeriveIDDebug("other")
+	require.Equal(t, steps[:10], steps2[:10])
+	require.NotEqual(t, steps[10], steps2[10])
+}
+
 func createOneClientTx(dID darc.ID, kind string, value []byte, signer darc.Signer) (ClientTransaction, error) {
 	instr, err := createInstr(dID, kind, value, signer)
 	t := ClientTransaction{
@@ -122,6 +313,8 @@ func createInstr(dID darc.ID, contractID string, value []byte, signer darc.Signe
 			DarcID: dID,
 			SubID:  genSubID(),
 		},
+		Index:  0,
+		Length: 1,
 		Spawn: &Spawn{
 			ContractID: contractID,
 			Args:       Arguments{{Name: "data", Value: value}},
@@ -130,3 +323,21 @@ func createInstr(dID darc.ID, contractID string, value []byte, signer darc.Signe
 	err := instr.SignBy(signer)
 	return instr, err
 }
+
+func TestArguments_SearchPrefix(t *testing.T) {
+	args := Arguments{
+		{Name: "item.1.name", Value: []byte("b")},
+		{Name: "total", Value: []byte("2")},
+		{Name: "item.0.name", Value: []byte("a")},
+		{Name: "items", Value: []byte("x")},
+	}
+	items := args.SearchPrefix("item.")
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "item.1.name", items[0].Name)
+	require.Equal(t, "item.0.name", items[1].Name)
+	require.Equal(t, []byte("a"), items.Search("item.0.name"))
+
+	require.Equal(t, 3, len(args.SearchPrefix("item")))
+	require.Equal(t, args, args.SearchPrefix(""))
+	require.Equal(t, 0, len(args.SearchPrefix("unknown")))
+}
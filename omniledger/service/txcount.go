@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/skipchain"
+)
+
+// txCountBucket is the bucket of the database of the service holding, for
+// every skipchain, the number of committed transactions, and a marker for
+// every block that has been counted.
+var txCountBucket = []byte("txcount")
+
+// countedKey returns the key of the marker of the block sb.
+func countedKey(sb *skipchain.SkipBlock) []byte {
+	return append(append([]byte{}, sb.SkipChainID()...), sb.Hash...)
+}
+
+// GetTxCount returns the number of transactions committed to the skipchain
+// scID, including the ones recorded with a failed precondition. It is a
+// counter updated with every block this node stores, so blocks restored
+// with ImportChain or ImportCheckpoint are not counted.
+func (s *Service) GetTxCount(scID skipchain.SkipBlockID) (uint64, error) {
+	if s.db().GetByID(scID) == nil {
+		return 0, errors.New("unknown skipchain")
+	}
+	db, name := s.GetAdditionalBucket(txCountBucket)
+	var count uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(scID); len(v) >= 8 {
+			count = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// countTxs adds n transactions of the block sb to the counter of its
+// skipchain. A block that has already been counted is ignored, whatever its
+// index, so that the blocks applied late by catchUpCollection are counted.
+func (s *Service) countTxs(sb *skipchain.SkipBlock, n int) error {
+	db, name := s.GetAdditionalBucket(txCountBucket)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		if b.Get(countedKey(sb)) != nil {
+			return nil
+		}
+		key := sb.SkipChainID()
+		var count uint64
+		if v := b.Get(key); len(v) >= 8 {
+			count = binary.BigEndian.Uint64(v)
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, count+uint64(n))
+		if err := b.Put(key, v); err != nil {
+			return err
+		}
+		return b.Put(countedKey(sb), []byte{})
+	})
+}
@@ -713,6 +713,34 @@ func (db *SkipBlockDB) Store(sb *SkipBlock) SkipBlockID {
 	return nil
 }
 
+// StoreTrusted stores sb even if no block of the database links to it. It is
+// meant for blocks that have been verified by other means, e.g. against a
+// hash pinned by the user, so that the following blocks can be stored with
+// StoreBlocks.
+func (db *SkipBlockDB) StoreTrusted(sb *SkipBlock) error {
+	if !sb.Hash.Equal(sb.CalculateHash()) {
+		return errors.New("wrong hash of the trusted block")
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return db.storeToTx(tx, sb)
+	})
+	if err != nil {
+		return err
+	}
+	db.latestUpdate(sb)
+	return nil
+}
+
+// Remove deletes the block with the given ID from the database. It is meant
+// for blocks that are kept somewhere else, e.g. in an archive. The caller
+// must make sure that the blocks needed to follow the links of the skipchain
+// are not removed.
+func (db *SkipBlockDB) Remove(sbID SkipBlockID) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(db.bucketName)).Delete(sbID)
+	})
+}
+
 // HasForwardLink verififes if sb can be accepted in the database by searching
 // for a forwardlink of any level.
 func (db *SkipBlockDB) HasForwardLink(sb *SkipBlock) bool {